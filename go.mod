@@ -1,18 +1,25 @@
 module github.com/dunglas/mercure
 
-go 1.12
+go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gofrs/uuid v3.2.0+incompatible
+	github.com/gomodule/redigo v1.8.9
 	github.com/gorilla/handlers v1.4.0
 	github.com/gorilla/mux v1.7.0
+	github.com/gorilla/websocket v1.4.0
 	github.com/joho/godotenv v1.3.0
 	github.com/joonix/log v0.0.0-20190213172830-51a6cca1fed3
+	github.com/prometheus/client_golang v0.9.2
 	github.com/sirupsen/logrus v1.4.0
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.7.0
 	github.com/unrolled/secure v1.0.0
 	github.com/yosida95/uritemplate v0.0.0-20170413134207-5c22f358020b
 	go.etcd.io/bbolt v1.3.2
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
 )
@@ -1,15 +1,21 @@
 package hub
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/yosida95/uritemplate"
 )
 
 // Claims contains Mercure's JWT claims
+// The Mercure claim is read from another key of the payload when a custom namespace is configured
 type claims struct {
 	Mercure mercureClaim `json:"mercure"`
 	jwt.StandardClaims
@@ -18,29 +24,242 @@ type claims struct {
 type mercureClaim struct {
 	Publish   []string `json:"publish"`
 	Subscribe []string `json:"subscribe"`
+	// PublishDeny contains the topics and targets the publisher isn't allowed to publish to, even if "publish" contains "*"
+	PublishDeny []string `json:"publish_deny,omitempty"`
 }
 
-// Authorize validates the JWT that may be provided through an "Authorization" HTTP header or a "mercureAuthorization" cookie.
+// jwtConfig contains the key material and the signing method used to validate a JWT
+type jwtConfig struct {
+	// keys are the HMAC secrets, or the PEM-encoded public keys for asymmetric algorithms
+	// Several keys can be provided to allow keys rotation
+	keys [][]byte
+	// keyIDs contains the "kid" associated with the key at the same index, if any
+	keyIDs        []string
+	signingMethod jwt.SigningMethod
+	// issuer and audience are checked against the "iss" and "aud" claims when not empty
+	issuer   string
+	audience string
+	// leeway is the clock skew tolerated when checking the "exp", "iat" and "nbf" claims
+	leeway time.Duration
+	// revokedTokens contains the IDs of tokens to reject, tokens without a "jti" claim are never rejected
+	revokedTokens *revokedTokens
+	// claimsNamespace is the key of the payload containing the Mercure claim, "mercure" if empty
+	claimsNamespace string
+	// maxClaimTargets is the maximum number of targets of each list of the Mercure claim, 0 for no limit
+	maxClaimTargets int
+	// jwks contains the keys fetched from a remote JWKS, they are tried after the configured keys
+	jwks *jwks
+}
+
+const (
+	defaultClaimsNamespace             = "mercure"
+	defaultCookieName                  = "mercureAuthorization"
+	defaultQueryAuthorizationParameter = "authorization"
+	defaultTokenHeader                 = "Authorization"
+)
+
+// Errors returned when the JWT can't be validated, they can be matched using errors.Is
+var (
+	// ErrTokenExpired is returned when the "exp" claim of the token is in the past, the client should get a new token
+	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenInvalidSignature is returned when the token hasn't been signed with one of the configured keys
+	ErrTokenInvalidSignature = errors.New("invalid token signature")
+	// ErrTokenMalformed is returned when the token isn't a well-formed JWT
+	ErrTokenMalformed = errors.New("malformed token")
+	// ErrTokenNotYetValid is returned when the "nbf" claim of the token is in the future, the client should retry later
+	ErrTokenNotYetValid = errors.New("token not yet valid")
+)
+
+// authorizationErrorCodes maps the sentinel errors to the code of the corresponding authorization errors
+var authorizationErrorCodes = map[error]string{
+	ErrTokenExpired:          "token_expired",
+	ErrTokenInvalidSignature: "invalid_signature",
+	ErrTokenMalformed:        "malformed_token",
+	ErrTokenNotYetValid:      "token_not_yet_valid",
+}
+
+// authorizationError explains why a request can't be authorized
+// The code is sent to the client in the WWW-Authenticate header (RFC 6750)
+type authorizationError struct {
+	code string
+	err  error
+}
+
+func (e *authorizationError) Error() string {
+	return e.err.Error()
+}
+
+// Is allows to match the error with ErrTokenExpired, ErrTokenInvalidSignature, ErrTokenMalformed or ErrTokenNotYetValid using errors.Is
+func (e *authorizationError) Is(target error) bool {
+	code, ok := authorizationErrorCodes[target]
+
+	return ok && code == e.code
+}
+
+// newAuthorizationErrorFromJWT converts the errors returned by the JWT library
+func newAuthorizationErrorFromJWT(err error) *authorizationError {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return &authorizationError{"invalid_token", err}
+	}
+
+	if ae, ok := ve.Inner.(*authorizationError); ok {
+		return ae
+	}
+
+	if ve.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+		return &authorizationError{"invalid_signature", err}
+	}
+
+	if ve.Errors&jwt.ValidationErrorMalformed != 0 {
+		return &authorizationError{"malformed_token", err}
+	}
+
+	return &authorizationError{"invalid_token", err}
+}
+
+// sendUnauthorized replies with a 401 status code and a WWW-Authenticate header describing the error, if any
+func sendUnauthorized(w http.ResponseWriter, err error) {
+	sendAuthenticateError(w, err, http.StatusUnauthorized)
+}
+
+// sendAuthenticateError sends the given status code along with a "WWW-Authenticate" header describing the error
+func sendAuthenticateError(w http.ResponseWriter, err error, statusCode int) {
+	header := "Bearer"
+	if err != nil {
+		code := "invalid_token"
+		if ae, ok := err.(*authorizationError); ok {
+			code = ae.code
+		}
+
+		// Double quotes and backslashes aren't allowed in the error description
+		r := strings.NewReplacer("\"", "'", "\\", "")
+		header = fmt.Sprintf("Bearer error=\"%s\", error_description=\"%s\"", code, r.Replace(err.Error()))
+	}
+
+	w.Header().Set("WWW-Authenticate", header)
+	http.Error(w, http.StatusText(statusCode), statusCode)
+}
+
+// authorizationFailureReason returns the RFC 6750 error code corresponding to the error, or "missing_token" if no JWT has been provided
+func authorizationFailureReason(err error) string {
+	if err == nil {
+		return "missing_token"
+	}
+
+	if ae, ok := err.(*authorizationError); ok {
+		return ae.code
+	}
+
+	return "invalid_token"
+}
+
+// unauthorized logs and counts the authorization failure, then replies with a 401 status code
+// The keys of the JWKS being unavailable isn't the fault of the client, a 503 status code is sent instead
+func (h *Hub) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*jwksUnavailableError); ok {
+		h.metrics.authorizationFailed("jwks_unavailable")
+		h.logger.Error("Authorization failed", "remote_addr", r.RemoteAddr, "reason", "jwks_unavailable", "error", err)
+		sendServiceUnavailable(w)
+		return
+	}
+
+	reason := authorizationFailureReason(err)
+	h.metrics.authorizationFailed(reason)
+	h.logger.Info("Authorization failed", "remote_addr", r.RemoteAddr, "reason", reason, "error", err)
+
+	sendUnauthorized(w, err)
+}
+
+// forbidden rejects a request authenticated with a valid JWT that doesn't grant the required access (RFC 6750 "insufficient_scope")
+func (h *Hub) forbidden(w http.ResponseWriter, r *http.Request, err error) {
+	h.metrics.authorizationFailed("insufficient_scope")
+	h.logger.Info("Authorization failed", "remote_addr", r.RemoteAddr, "reason", "insufficient_scope", "error", err)
+
+	sendAuthenticateError(w, &authorizationError{"insufficient_scope", err}, http.StatusForbidden)
+}
+
+// subject returns the "sub" claim of the JWT, if any
+func subject(claims *claims) string {
+	if claims == nil {
+		return ""
+	}
+
+	return claims.Subject
+}
+
+// authorizationConfig contains the settings used to extract the JWT from a request and to validate it
+type authorizationConfig struct {
+	jwt                   *jwtConfig
+	publishAllowedOrigins *originPatterns
+	// publishAllowedFetchSites contains the values of the "Sec-Fetch-Site" HTTP header accepted when the request has neither an "Origin" nor a "Referer" HTTP header
+	publishAllowedFetchSites []string
+	// trustForwardedHeaders uses the scheme set by the reverse proxy when the origin is derived from the Referer
+	trustForwardedHeaders bool
+	cookieName            string
+	// cookieSecure rejects the cookie-based authorization mechanism when the request hasn't been sent using TLS
+	cookieSecure bool
+	// queryParameter is the name of the query parameter that may contain the JWT of GET requests, empty to disable
+	queryParameter string
+	// tokenHeader is the name of the HTTP header containing the JWT, "Authorization" if empty
+	tokenHeader string
+	// tokenHeaderBare is true if the header contains the JWT without the "Bearer" scheme, it only applies to custom headers
+	tokenHeaderBare bool
+	// anonymousPublish grants all targets to the publishers providing no JWT, it must only be used in debug mode
+	anonymousPublish bool
+}
+
+// Authorize validates the JWT that may be provided through an "Authorization" HTTP header (or the configured header), a cookie (named "mercureAuthorization" by default)
+// or, if enabled, a query parameter of GET requests.
 // It returns the claims contained in the token if it exists and is valid, nil if no token is provided (anonymous mode), and an error if the token is not valid.
-func authorize(r *http.Request, jwtKey []byte, publishAllowedOrigins []string) (*claims, error) {
-	authorizationHeaders, headerExists := r.Header["Authorization"]
+func authorize(r *http.Request, config *authorizationConfig) (*claims, error) {
+	headerName := config.tokenHeader
+	if headerName == "" {
+		headerName = defaultTokenHeader
+	}
+
+	authorizationHeaders, headerExists := r.Header[http.CanonicalHeaderKey(headerName)]
 	if headerExists {
-		if len(authorizationHeaders) != 1 || len(authorizationHeaders[0]) < 48 || authorizationHeaders[0][:7] != "Bearer " {
-			return nil, errors.New("Invalid \"Authorization\" HTTP header")
+		if len(authorizationHeaders) != 1 {
+			return nil, &authorizationError{"invalid_request", fmt.Errorf("Invalid \"%s\" HTTP header", headerName)}
 		}
 
-		return validateJWT(authorizationHeaders[0][7:], jwtKey)
+		token, ok := extractBearerToken(authorizationHeaders[0])
+		if config.tokenHeaderBare && !strings.EqualFold(headerName, defaultTokenHeader) {
+			token = strings.TrimSpace(authorizationHeaders[0])
+			ok = token != ""
+		}
+		if !ok {
+			return nil, &authorizationError{"invalid_request", fmt.Errorf("Invalid \"%s\" HTTP header", headerName)}
+		}
+
+		return validateJWT(token, config.jwt)
 	}
 
-	cookie, err := r.Cookie("mercureAuthorization")
+	cookie, err := r.Cookie(config.cookieName)
 	if err != nil {
+		// Browsers' EventSource can neither set headers nor always send cookies across origins
+		if config.queryParameter != "" && r.Method == "GET" {
+			if token := r.URL.Query().Get(config.queryParameter); token != "" {
+				return validateJWT(token, config.jwt)
+			}
+		}
+
 		// Anonymous
+		if config.anonymousPublish {
+			return anonymousPublisherClaims(), nil
+		}
+
 		return nil, nil
 	}
 
+	if config.cookieSecure && !isSecure(r, config.trustForwardedHeaders) {
+		return nil, &authorizationError{"invalid_request", fmt.Errorf("The cookie-based authorization mechanism requires HTTPS, use a TLS connection or send the JWT in the \"%s\" HTTP header", headerName)}
+	}
+
 	// CSRF attacks cannot occurs when using safe methods
 	if r.Method != "POST" {
-		return validateJWT(cookie.Value, jwtKey)
+		return validateJWT(cookie.Value, config.jwt)
 	}
 
 	origin := r.Header.Get("Origin")
@@ -48,49 +267,337 @@ func authorize(r *http.Request, jwtKey []byte, publishAllowedOrigins []string) (
 		// Try to extract the origin from the Referer, or return an error
 		referer := r.Header.Get("Referer")
 		if referer == "" {
-			return nil, errors.New("An \"Origin\" or a \"Referer\" HTTP header must be present to use the cookie-based authorization mechanism")
+			if fetchSiteAllowed(r, config.publishAllowedFetchSites) {
+				return validateJWT(cookie.Value, config.jwt)
+			}
+
+			return nil, &authorizationError{"invalid_request", errors.New("An \"Origin\" or a \"Referer\" HTTP header must be present to use the cookie-based authorization mechanism")}
 		}
 
 		u, err := url.Parse(referer)
 		if err != nil {
-			return nil, err
+			return nil, &authorizationError{"invalid_request", err}
 		}
 
-		origin = fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+		scheme := u.Scheme
+		if config.trustForwardedHeaders {
+			if proto := forwardedProto(r); proto != "" {
+				scheme = proto
+			}
+		}
+
+		origin = fmt.Sprintf("%s://%s", scheme, u.Host)
 	}
 
-	for _, allowedOrigin := range publishAllowedOrigins {
-		if origin == allowedOrigin {
-			return validateJWT(cookie.Value, jwtKey)
+	if config.publishAllowedOrigins.match(origin) {
+		return validateJWT(cookie.Value, config.jwt)
+	}
+
+	return nil, &authorizationError{"origin_not_allowed", fmt.Errorf("The origin \"%s\" is not allowed to post updates", origin)}
+}
+
+const (
+	fetchSiteSameOrigin = "same-origin"
+	fetchSiteSameSite   = "same-site"
+)
+
+// fetchSiteAllowed checks if the "Sec-Fetch-Site" HTTP header, set by the browser and that scripts can't change, contains one of the allowed values
+// It is only used when the origin of the request is unknown, unlike the origin, it can't tell which site of the same domain sent the request
+func fetchSiteAllowed(r *http.Request, allowedFetchSites []string) bool {
+	site := r.Header.Get("Sec-Fetch-Site")
+	for _, allowed := range allowedFetchSites {
+		if site == allowed {
+			return true
 		}
 	}
 
-	return nil, fmt.Errorf("The origin \"%s\" is not allowed to post updates", origin)
+	return false
+}
+
+// anonymousPublisherClaims returns the claims granted to anonymous publishers in debug mode
+func anonymousPublisherClaims() *claims {
+	return &claims{Mercure: mercureClaim{Publish: []string{"*"}}}
+}
+
+// isSecure checks if the request has been sent using TLS, to the hub or, if forwarded headers are trusted, to the reverse proxy
+func isSecure(r *http.Request, trustForwardedHeaders bool) bool {
+	return r.TLS != nil || (trustForwardedHeaders && forwardedProto(r) == "https")
+}
+
+// forwardedProto returns the scheme of the request sent by the client to the reverse proxy,
+// as set in the "Forwarded" (RFC 7239) or in the "X-Forwarded-Proto" HTTP header, or an empty string
+// Only the value set by the proxy closest to the client is used, these headers must only be trusted behind a proxy overwriting them
+func forwardedProto(r *http.Request) string {
+	var proto string
+	if forwarded := r.Header.Get("Forwarded"); forwarded != "" {
+		element := strings.SplitN(forwarded, ",", 2)[0]
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "proto") {
+				proto = strings.Trim(kv[1], `"`)
+				break
+			}
+		}
+	} else {
+		proto = strings.TrimSpace(strings.SplitN(r.Header.Get("X-Forwarded-Proto"), ",", 2)[0])
+	}
+
+	proto = strings.ToLower(proto)
+	if proto != "http" && proto != "https" {
+		return ""
+	}
+
+	return proto
+}
+
+// extractBearerToken extracts the token from the value of an "Authorization" HTTP header using the Bearer scheme
+// The scheme is case-insensitive (RFC 7235), the actual validation of the token is done by validateJWT
+func extractBearerToken(header string) (string, bool) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+
+	return parts[1], true
 }
 
 // validateJWT validates that the provided JWT token is a valid Mercure token
-func validateJWT(encodedToken string, key []byte) (*claims, error) {
-	token, err := jwt.ParseWithClaims(encodedToken, &claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+// Every candidate key is tried in turn, a key which verified the signature of a token whose claims are invalid has its error returned rather than the signature errors of the other keys
+func validateJWT(encodedToken string, config *jwtConfig) (*claims, error) {
+	if config.jwks != nil {
+		var err error
+		if config, err = withJWKSKeys(config); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := candidateKeys(encodedToken, config)
+	if len(keys) == 0 {
+		return nil, errors.New("No JWT key configured")
+	}
+
+	var err, claimsErr error
+	for _, key := range keys {
+		var claims *claims
+		if claims, err = validateJWTWithKey(encodedToken, key, config); err == nil {
+			return claims, nil
+		}
+
+		if claimsErr == nil && authorizationFailureReason(err) != "invalid_signature" {
+			claimsErr = err
+		}
+	}
+
+	if claimsErr != nil {
+		return nil, claimsErr
+	}
+
+	return nil, err
+}
+
+// withJWKSKeys returns a copy of the configuration containing the keys of the JWKS too
+// If the JWKS is unavailable, the configured keys are used alone, ErrJWKSUnavailable is only returned if there are none
+func withJWKSKeys(config *jwtConfig) (*jwtConfig, error) {
+	jwksKeys, jwksKeyIDs, err := config.jwks.get()
+	if err != nil {
+		if len(config.keys) == 0 {
+			return nil, err
+		}
+
+		return config, nil
+	}
+
+	c := *config
+	c.keys = append(append([][]byte{}, config.keys...), jwksKeys...)
+	c.keyIDs = make([]string, len(config.keys), len(c.keys))
+	copy(c.keyIDs, config.keyIDs)
+	c.keyIDs = append(c.keyIDs, jwksKeyIDs...)
+
+	return &c, nil
+}
+
+// candidateKeys returns the key matching the "kid" header of the token if any, or all the configured keys
+func candidateKeys(encodedToken string, config *jwtConfig) [][]byte {
+	token, _, err := new(jwt.Parser).ParseUnverified(encodedToken, &claims{})
+	if err != nil {
+		return config.keys
+	}
+
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return config.keys
+	}
+
+	for i, keyID := range config.keyIDs {
+		if keyID == kid && i < len(config.keys) {
+			return [][]byte{config.keys[i]}
+		}
+	}
+
+	return config.keys
+}
+
+// validateJWTWithKey validates the JWT using the given key
+func validateJWTWithKey(encodedToken string, key []byte, config *jwtConfig) (*claims, error) {
+	// Time-based claims are validated below, to take the leeway into account
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(encodedToken, &claims{}, func(token *jwt.Token) (interface{}, error) {
+		// The algorithm chosen by the issuer of the token must be the configured one, even another variant of the same family is rejected
+		if token.Method.Alg() != config.signingMethod.Alg() {
+			return nil, &authorizationError{"unexpected_algorithm", fmt.Errorf("Unexpected signing method: %v, expected: %s", token.Header["alg"], config.signingMethod.Alg())}
+		}
+
+		switch config.signingMethod.(type) {
+		case *jwt.SigningMethodHMAC:
+			return key, nil
+
+		case *jwt.SigningMethodRSA:
+			return jwt.ParseRSAPublicKeyFromPEM(key)
+
+		case *jwt.SigningMethodECDSA:
+			return jwt.ParseECPublicKeyFromPEM(key)
+
+		default:
+			return nil, fmt.Errorf("Unsupported signing method: %s", config.signingMethod.Alg())
 		}
-		return key, nil
 	})
 
 	if err != nil {
+		return nil, newAuthorizationErrorFromJWT(err)
+	}
+
+	claims, ok := token.Claims.(*claims)
+	if !ok || !token.Valid {
+		return nil, errors.New("Invalid JWT")
+	}
+
+	if config.claimsNamespace != "" && config.claimsNamespace != defaultClaimsNamespace {
+		if claims.Mercure, err = namespacedClaim(token, config.claimsNamespace); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateTimeClaims(claims, config.leeway); err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*claims); ok && token.Valid {
-		return claims, nil
+	if err := validateClaimTargets(claims, config.maxClaimTargets); err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("Invalid JWT")
+	if claims.Id != "" && config.revokedTokens != nil && config.revokedTokens.contains(claims.Id) {
+		return nil, &authorizationError{"invalid_token", errors.New("Token has been revoked")}
+	}
+
+	if config.issuer != "" && !claims.VerifyIssuer(config.issuer, true) {
+		return nil, &authorizationError{"invalid_token", fmt.Errorf("Unexpected JWT issuer \"%s\", expected: \"%s\"", claims.Issuer, config.issuer)}
+	}
+
+	if config.audience != "" && !claims.VerifyAudience(config.audience, true) {
+		return nil, &authorizationError{"invalid_token", fmt.Errorf("Unexpected JWT audience \"%s\", expected: \"%s\"", claims.Audience, config.audience)}
+	}
+
+	return claims, nil
 }
 
-func authorizedTargets(claims *claims, publisher bool) (all bool, targets map[string]struct{}) {
+// namespacedClaim decodes the Mercure claim stored under the given key of the payload, the claim is empty if the key doesn't exist
+func namespacedClaim(token *jwt.Token, namespace string) (mercureClaim, error) {
+	var claim mercureClaim
+
+	parts := strings.Split(token.Raw, ".")
+	if len(parts) != 3 {
+		return claim, &authorizationError{"invalid_token", errors.New("Invalid JWT")}
+	}
+
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return claim, &authorizationError{"invalid_token", err}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return claim, &authorizationError{"invalid_token", err}
+	}
+
+	raw, ok := fields[namespace]
+	if !ok {
+		return claim, nil
+	}
+
+	if err := json.Unmarshal(raw, &claim); err != nil {
+		return claim, &authorizationError{"invalid_token", fmt.Errorf("Invalid \"%s\" claim: %s", namespace, err)}
+	}
+
+	return claim, nil
+}
+
+// validateTimeClaims checks the "exp", "iat" and "nbf" claims, tolerating the given clock skew
+func validateTimeClaims(claims *claims, leeway time.Duration) error {
+	now := time.Now()
+
+	if !claims.VerifyExpiresAt(now.Add(-leeway).Unix(), false) {
+		return &authorizationError{"token_expired", errors.New("Token is expired")}
+	}
+
+	if !claims.VerifyIssuedAt(now.Add(leeway).Unix(), false) {
+		return &authorizationError{"invalid_token", errors.New("Token used before issued")}
+	}
+
+	if !claims.VerifyNotBefore(now.Add(leeway).Unix(), false) {
+		// The date is given to the client, to let it know when to retry
+		return &authorizationError{"token_not_yet_valid", fmt.Errorf("Token is not valid yet, it will be valid from %s", time.Unix(claims.NotBefore, 0).UTC().Format(time.RFC3339))}
+	}
+
+	return nil
+}
+
+// validateClaimTargets rejects the tokens listing too many targets, they would make checking every update against the targets of the connection slow
+func validateClaimTargets(claims *claims, max int) error {
+	if max == 0 {
+		return nil
+	}
+
+	names := [...]string{"publish", "subscribe", "publish_deny"}
+	for i, targets := range [...][]string{claims.Mercure.Publish, claims.Mercure.Subscribe, claims.Mercure.PublishDeny} {
+		if len(targets) > max {
+			return &authorizationError{"invalid_token", fmt.Errorf("The \"%s\" claim contains %d targets, the maximum is %d", names[i], len(targets), max)}
+		}
+	}
+
+	return nil
+}
+
+type contextKey string
+
+// TargetsContextKey is the key of the request's context value containing the AuthorizedTargets of the connection
+const TargetsContextKey = contextKey("targets")
+
+// AuthorizedTargets contains the targets granted to a connection by its JWT
+type AuthorizedTargets struct {
+	// All is true if the connection is authorized to access all targets
+	All     bool
+	Targets map[string]struct{}
+	// Publisher is true for publishers, false for subscribers
+	Publisher bool
+}
+
+// withAuthorizedTargets stores the targets granted to the connection in the request's context
+func withAuthorizedTargets(r *http.Request, all bool, targets map[string]struct{}, publisher bool) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), TargetsContextKey, &AuthorizedTargets{all, targets, publisher}))
+}
+
+// TargetsFromContext retrieves the targets granted to the connection, it returns nil if the connection hasn't been authorized yet
+func TargetsFromContext(ctx context.Context) *AuthorizedTargets {
+	targets, _ := ctx.Value(TargetsContextKey).(*AuthorizedTargets)
+
+	return targets
+}
+
+// authorizedTargets returns the targets listed in the publish or subscribe claim
+// Targets containing URI template (RFC6570) expressions are also returned as uritemplate.Template instances
+func authorizedTargets(claims *claims, publisher bool) (all bool, targets map[string]struct{}, templateTargets []*uritemplate.Template) {
 	if claims == nil {
-		return false, map[string]struct{}{}
+		return false, map[string]struct{}{}, nil
 	}
 
 	var providedTargets []string
@@ -100,14 +607,57 @@ func authorizedTargets(claims *claims, publisher bool) (all bool, targets map[st
 		providedTargets = claims.Mercure.Subscribe
 	}
 
-	authorizedTargets := make(map[string]struct{}, len(providedTargets))
+	return parseTargets(providedTargets)
+}
+
+// parseTargets converts a list of targets to a set of raw targets and to URI templates
+// All is true if the list contains the reserved "*" value
+func parseTargets(providedTargets []string) (all bool, targets map[string]struct{}, templateTargets []*uritemplate.Template) {
+	targets = make(map[string]struct{}, len(providedTargets))
 	for _, target := range providedTargets {
 		if target == "*" {
-			return true, nil
+			return true, nil, nil
+		}
+
+		// Template targets also match exactly, as raw strings
+		targets[target] = struct{}{}
+		if !strings.Contains(target, "{") {
+			continue
 		}
 
-		authorizedTargets[target] = struct{}{}
+		if tpl, err := uritemplate.New(target); err == nil {
+			templateTargets = append(templateTargets, tpl)
+		}
+	}
+
+	return false, targets, templateTargets
+}
+
+// publishDenied returns a function checking if a topic or a target is listed in the "publish_deny" claim
+// Tokens without this claim are never denied anything
+func publishDenied(claims *claims) func(string) bool {
+	if claims == nil || len(claims.Mercure.PublishDeny) == 0 {
+		return func(string) bool { return false }
+	}
+
+	all, targets, templateTargets := parseTargets(claims.Mercure.PublishDeny)
+
+	return func(s string) bool {
+		return all || matchTarget(s, targets, templateTargets)
+	}
+}
+
+// matchTarget checks if the target is one of the raw targets or matches one of the template targets
+func matchTarget(target string, rawTargets map[string]struct{}, templateTargets []*uritemplate.Template) bool {
+	if _, ok := rawTargets[target]; ok {
+		return true
+	}
+
+	for _, tpl := range templateTargets {
+		if tpl.Match(target) != nil {
+			return true
+		}
 	}
 
-	return false, authorizedTargets
+	return false
 }
@@ -1,9 +1,21 @@
 package hub
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,25 +27,43 @@ func TestAuthorizeMultipleAuthorizationHeader(t *testing.T) {
 	r.Header.Add("Authorization", validEmptyHeader)
 	r.Header.Add("Authorization", validEmptyHeader)
 
-	claims, err := authorize(r, []byte{}, []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
 	assert.EqualError(t, err, "Invalid \"Authorization\" HTTP header")
 	assert.Nil(t, claims)
 }
 
-func TestAuthorizeAuthorizationHeaderTooShort(t *testing.T) {
+func TestAuthorizeAuthorizationHeaderShortToken(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.Header.Add("Authorization", "Bearer x")
 
-	claims, err := authorize(r, []byte{}, []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
+	assert.EqualError(t, err, "token contains an invalid number of segments")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeAuthorizationHeaderNoToken(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer ")
+
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
 	assert.EqualError(t, err, "Invalid \"Authorization\" HTTP header")
 	assert.Nil(t, claims)
 }
 
+func TestAuthorizeAuthorizationHeaderLowercaseScheme(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "  bearer   "+validFullHeader+" ")
+
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil))
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+}
+
 func TestAuthorizeAuthorizationHeaderNoBearer(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.Header.Add("Authorization", "Greater "+validEmptyHeader)
 
-	claims, err := authorize(r, []byte{}, []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
 	assert.EqualError(t, err, "Invalid \"Authorization\" HTTP header")
 	assert.Nil(t, claims)
 }
@@ -42,8 +72,8 @@ func TestAuthorizeAuthorizationHeaderInvalidAlg(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.Header.Add("Authorization", "Bearer "+createDummyNoneSignedJWT())
 
-	claims, err := authorize(r, []byte{}, []string{})
-	assert.EqualError(t, err, "Unexpected signing method: none")
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
+	assert.EqualError(t, err, "Unexpected signing method: none, expected: HS256")
 	assert.Nil(t, claims)
 }
 
@@ -51,7 +81,7 @@ func TestAuthorizeAuthorizationHeaderInvalidKey(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.Header.Add("Authorization", "Bearer "+validEmptyHeader)
 
-	claims, err := authorize(r, []byte{}, []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
 	assert.EqualError(t, err, "signature is invalid")
 	assert.Nil(t, claims)
 }
@@ -60,7 +90,7 @@ func TestAuthorizeAuthorizationHeaderNoContent(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.Header.Add("Authorization", "Bearer "+validEmptyHeader)
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil))
 	assert.Nil(t, claims.Mercure.Publish)
 	assert.Nil(t, claims.Mercure.Subscribe)
 	assert.Nil(t, err)
@@ -70,18 +100,329 @@ func TestAuthorizeAuthorizationHeader(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.Header.Add("Authorization", "Bearer "+validFullHeader)
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil))
 	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
 	assert.Equal(t, []string{"foo", "baz"}, claims.Mercure.Subscribe)
 	assert.Nil(t, err)
 }
 
+func TestAuthorizeAuthorizationHeaderRSA(t *testing.T) {
+	privateKey, publicKey := createDummyRSAKeys()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims{Mercure: mercureClaim{Publish: []string{"foo"}}})
+	tokenString, _ := token.SignedString(privateKey)
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{publicKey}, signingMethod: jwt.SigningMethodRS256}, cookieName: defaultCookieName})
+	assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeAuthorizationHeaderHMACWhenRSAExpected(t *testing.T) {
+	_, publicKey := createDummyRSAKeys()
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+validFullHeader)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{publicKey}, signingMethod: jwt.SigningMethodRS256}, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "Unexpected signing method: HS256, expected: RS256")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeAuthorizationHeaderOtherVariantOfTheAlgorithm(t *testing.T) {
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS512, &claims{Mercure: mercureClaim{Publish: []string{"foo"}}}).SignedString([]byte("!UnsecureChangeMe!"))
+	privateKey, publicKey := createDummyRSAKeys()
+	rsaToken, _ := jwt.NewWithClaims(jwt.SigningMethodRS512, &claims{Mercure: mercureClaim{Publish: []string{"foo"}}}).SignedString(privateKey)
+
+	testCases := []struct {
+		token         string
+		key           []byte
+		tokenMethod   jwt.SigningMethod
+		signingMethod jwt.SigningMethod
+		message       string
+	}{
+		{hmacToken, []byte("!UnsecureChangeMe!"), jwt.SigningMethodHS512, jwt.SigningMethodHS256, "Unexpected signing method: HS512, expected: HS256"},
+		{rsaToken, publicKey, jwt.SigningMethodRS512, jwt.SigningMethodRS256, "Unexpected signing method: RS512, expected: RS256"},
+	}
+
+	for _, tc := range testCases {
+		r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+		r.Header.Add("Authorization", "Bearer "+tc.token)
+
+		claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{tc.key}, signingMethod: tc.signingMethod}, cookieName: defaultCookieName})
+		assert.EqualError(t, err, tc.message)
+		assert.Equal(t, "unexpected_algorithm", err.(*authorizationError).code)
+		assert.Nil(t, claims)
+
+		// The token is valid when its algorithm is the configured one
+		claims, err = authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{tc.key}, signingMethod: tc.tokenMethod}, cookieName: defaultCookieName})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+	}
+}
+
+func TestAuthorizeAuthorizationHeaderECDSA(t *testing.T) {
+	privateKey, publicKey := createDummyECDSAKeys()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, &claims{Mercure: mercureClaim{Publish: []string{"foo"}}})
+	tokenString, _ := token.SignedString(privateKey)
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{publicKey}, signingMethod: jwt.SigningMethodES256}, cookieName: defaultCookieName})
+	assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeAuthorizationHeaderRSAWhenECDSAExpected(t *testing.T) {
+	privateKey, publicKey := createDummyRSAKeys()
+	_, ecdsaPublicKey := createDummyECDSAKeys()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims{})
+	tokenString, _ := token.SignedString(privateKey)
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{ecdsaPublicKey, publicKey}, signingMethod: jwt.SigningMethodES256}, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "Unexpected signing method: RS256, expected: ES256")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeAuthorizationHeaderInvalidRSAKey(t *testing.T) {
+	privateKey, _ := createDummyRSAKeys()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims{})
+	tokenString, _ := token.SignedString(privateKey)
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("not a PEM")}, signingMethod: jwt.SigningMethodRS256}, cookieName: defaultCookieName})
+	assert.EqualError(t, err, jwt.ErrKeyMustBePEMEncoded.Error())
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeAuthorizationHeaderIssuerAndAudience(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{
+		mercureClaim{Publish: []string{"foo"}},
+		jwt.StandardClaims{Issuer: "https://auth.example.com", Audience: "https://hub.example.com"},
+	})
+	tokenString, _ := token.SignedString([]byte("!UnsecureChangeMe!"))
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	config := &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256, issuer: "https://auth.example.com", audience: "https://hub.example.com"}
+	claims, err := authorize(r, &authorizationConfig{jwt: config, cookieName: defaultCookieName})
+	assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+
+	config.issuer = "https://other.example.com"
+	claims, err = authorize(r, &authorizationConfig{jwt: config, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "Unexpected JWT issuer \"https://auth.example.com\", expected: \"https://other.example.com\"")
+	assert.Nil(t, claims)
+
+	config.issuer = ""
+	config.audience = "https://other.example.com"
+	claims, err = authorize(r, &authorizationConfig{jwt: config, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "Unexpected JWT audience \"https://hub.example.com\", expected: \"https://other.example.com\"")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeAuthorizationHeaderMissingIssuer(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+validFullHeader)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256, issuer: "https://auth.example.com"}, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "Unexpected JWT issuer \"\", expected: \"https://auth.example.com\"")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeClaimsNamespace(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"https://example.com/mercure": map[string][]string{"publish": {"foo"}, "subscribe": {"bar"}},
+		"mercure":                     map[string][]string{"publish": {"*"}},
+	})
+	tokenString, _ := token.SignedString([]byte("!UnsecureChangeMe!"))
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	config := &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256, claimsNamespace: "https://example.com/mercure"}
+	claims, err := authorize(r, &authorizationConfig{jwt: config, cookieName: defaultCookieName})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+	assert.Equal(t, []string{"bar"}, claims.Mercure.Subscribe)
+
+	// The "mercure" key is ignored when another namespace is configured
+	config.claimsNamespace = "https://example.com/other"
+	claims, err = authorize(r, &authorizationConfig{jwt: config, cookieName: defaultCookieName})
+	assert.Nil(t, err)
+	assert.Empty(t, claims.Mercure.Publish)
+	assert.Empty(t, claims.Mercure.Subscribe)
+
+	config.claimsNamespace = defaultClaimsNamespace
+	claims, err = authorize(r, &authorizationConfig{jwt: config, cookieName: defaultCookieName})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"*"}, claims.Mercure.Publish)
+}
+
+func TestAuthorizeInvalidNamespacedClaim(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"https://example.com/mercure": "foo"})
+	tokenString, _ := token.SignedString([]byte("!UnsecureChangeMe!"))
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	config := &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256, claimsNamespace: "https://example.com/mercure"}
+	claims, err := authorize(r, &authorizationConfig{jwt: config, cookieName: defaultCookieName})
+	assert.Contains(t, err.Error(), "Invalid \"https://example.com/mercure\" claim")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeAuthorizationHeaderLeeway(t *testing.T) {
+	now := time.Now()
+	encode := func(c jwt.StandardClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{mercureClaim{Publish: []string{"foo"}}, c})
+		tokenString, _ := token.SignedString([]byte("!UnsecureChangeMe!"))
+
+		return tokenString
+	}
+
+	tokens := map[string]string{
+		"Token is expired":         encode(jwt.StandardClaims{ExpiresAt: now.Add(-2 * time.Second).Unix()}),
+		"Token used before issued": encode(jwt.StandardClaims{IssuedAt: now.Add(2 * time.Second).Unix()}),
+		"Token is not valid yet, it will be valid from " + time.Unix(now.Add(2*time.Second).Unix(), 0).UTC().Format(time.RFC3339): encode(jwt.StandardClaims{NotBefore: now.Add(2 * time.Second).Unix()}),
+	}
+
+	for message, token := range tokens {
+		r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+		r.Header.Add("Authorization", "Bearer "+token)
+
+		claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil))
+		assert.EqualError(t, err, message)
+		assert.Nil(t, claims)
+
+		claims, err = authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256, leeway: 5 * time.Second}, cookieName: defaultCookieName})
+		assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+		assert.Nil(t, err)
+	}
+}
+
+func TestAuthorizeAuthorizationHeaderKeyRotation(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+validFullHeader)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("new"), []byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName})
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+
+	claims, err = authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!"), []byte("new")}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName})
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+
+	claims, err = authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("new"), []byte("newer")}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "signature is invalid")
+	assert.Nil(t, claims)
+
+	claims, err = authorize(r, &authorizationConfig{jwt: &jwtConfig{signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "No JWT key configured")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeAuthorizationHeaderKeyID(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{Mercure: mercureClaim{Publish: []string{"foo"}}})
+	token.Header["kid"] = "v1"
+	tokenString, _ := token.SignedString([]byte("old"))
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+tokenString)
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("new"), []byte("old")}, keyIDs: []string{"v2", "v1"}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName})
+	assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+
+	// The key matching the "kid" header is the only one tried
+	claims, err = authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("new"), []byte("old")}, keyIDs: []string{"v1", "v2"}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName})
+	assert.EqualError(t, err, "signature is invalid")
+	assert.Nil(t, claims)
+
+	// Unknown key IDs fall back to trying all keys
+	claims, err = authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("new"), []byte("old")}, keyIDs: []string{"v3"}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName})
+	assert.Equal(t, []string{"foo"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeAuthorizationHeaderKeyRotationExpired(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{Mercure: mercureClaim{Publish: []string{"foo"}}, StandardClaims: jwt.StandardClaims{ExpiresAt: 1}})
+	tokenString, _ := token.SignedString([]byte("old"))
+
+	// The error of the key which verified the signature is returned, whatever the position of the key
+	for _, keys := range [][][]byte{{[]byte("old"), []byte("new")}, {[]byte("new"), []byte("old")}} {
+		claims, err := validateJWT(tokenString, &jwtConfig{keys: keys, signingMethod: jwt.SigningMethodHS256})
+		assert.True(t, errors.Is(err, ErrTokenExpired), "%s", err)
+		assert.False(t, errors.Is(err, ErrTokenInvalidSignature))
+		assert.Nil(t, claims)
+	}
+}
+
+func TestAuthorizeCustomTokenHeader(t *testing.T) {
+	config := createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil)
+	config.tokenHeader = "X-Mercure-Authorization"
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("X-Mercure-Authorization", "Bearer "+validFullHeader)
+
+	claims, err := authorize(r, config)
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+
+	// The "Authorization" header is ignored when a custom header is configured
+	r, _ = http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+validFullHeader)
+
+	claims, err = authorize(r, config)
+	assert.Nil(t, claims)
+	assert.Nil(t, err)
+
+	r, _ = http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("X-Mercure-Authorization", validFullHeader)
+
+	claims, err = authorize(r, config)
+	assert.EqualError(t, err, `Invalid "X-Mercure-Authorization" HTTP header`)
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeCustomTokenHeaderBare(t *testing.T) {
+	config := createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil)
+	config.tokenHeader = "x-mercure-authorization"
+	config.tokenHeaderBare = true
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("X-Mercure-Authorization", " "+validFullHeader+" ")
+
+	claims, err := authorize(r, config)
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+
+	r, _ = http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("X-Mercure-Authorization", " ")
+
+	claims, err = authorize(r, config)
+	assert.EqualError(t, err, `Invalid "x-mercure-authorization" HTTP header`)
+	assert.Nil(t, claims)
+}
+
 func TestAuthorizeCookieInvalidAlg(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: createDummyNoneSignedJWT()})
 
-	claims, err := authorize(r, []byte{}, []string{})
-	assert.EqualError(t, err, "Unexpected signing method: none")
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
+	assert.EqualError(t, err, "Unexpected signing method: none, expected: HS256")
 	assert.Nil(t, claims)
 }
 
@@ -89,7 +430,7 @@ func TestAuthorizeCookieInvalidKey(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validEmptyHeader})
 
-	claims, err := authorize(r, []byte{}, []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte{}, nil))
 	assert.EqualError(t, err, "signature is invalid")
 	assert.Nil(t, claims)
 }
@@ -98,7 +439,7 @@ func TestAuthorizeCookieNoContent(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validEmptyHeader})
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil))
 	assert.Nil(t, claims.Mercure.Publish)
 	assert.Nil(t, claims.Mercure.Subscribe)
 	assert.Nil(t, err)
@@ -108,27 +449,147 @@ func TestAuthorizeCookie(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil))
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Equal(t, []string{"foo", "baz"}, claims.Mercure.Subscribe)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeCustomCookieName(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
+	r.AddCookie(&http.Cookie{Name: "customAuthorization", Value: validEmptyHeader})
+
+	claims, err := authorize(r, &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256}, cookieName: "customAuthorization"})
+	assert.Nil(t, claims.Mercure.Publish)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeCookieSecure(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
+
+	config := &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName, cookieSecure: true}
+	claims, err := authorize(r, config)
+	assert.EqualError(t, err, "The cookie-based authorization mechanism requires HTTPS, use a TLS connection or send the JWT in the \"Authorization\" HTTP header")
+	assert.Nil(t, claims)
+
+	r.TLS = &tls.ConnectionState{}
+	claims, err = authorize(r, config)
 	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeCookieSecureForwarded(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
+	r.Header.Add("X-Forwarded-Proto", "https")
+
+	config := &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName, cookieSecure: true}
+	claims, err := authorize(r, config)
+	assert.Error(t, err)
+	assert.Nil(t, claims)
+
+	config.trustForwardedHeaders = true
+	claims, err = authorize(r, config)
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+
+	r.Header.Set("X-Forwarded-Proto", "http")
+	claims, err = authorize(r, config)
+	assert.Error(t, err)
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeCookieSecureBearer(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+validFullHeader)
+
+	config := &authorizationConfig{jwt: &jwtConfig{keys: [][]byte{[]byte("!UnsecureChangeMe!")}, signingMethod: jwt.SigningMethodHS256}, cookieName: defaultCookieName, cookieSecure: true}
+	claims, err := authorize(r, config)
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeQueryParameter(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub?authorization="+validFullHeader, nil)
+
+	config := createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil)
+	claims, err := authorize(r, config)
+	assert.Nil(t, claims)
+	assert.Nil(t, err)
+
+	config.queryParameter = defaultQueryAuthorizationParameter
+	claims, err = authorize(r, config)
 	assert.Equal(t, []string{"foo", "baz"}, claims.Mercure.Subscribe)
 	assert.Nil(t, err)
+
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validEmptyHeader})
+	claims, err = authorize(r, config)
+	assert.Nil(t, claims.Mercure.Subscribe)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizeQueryParameterNotGET(t *testing.T) {
+	r, _ := http.NewRequest("POST", "http://example.com/hub?authorization="+validFullHeader, nil)
+
+	config := createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil)
+	config.queryParameter = defaultQueryAuthorizationParameter
+	claims, err := authorize(r, config)
+	assert.Nil(t, claims)
+	assert.Nil(t, err)
 }
 
 func TestAuthorizeCookieNoOriginNoReferer(t *testing.T) {
 	r, _ := http.NewRequest("POST", "http://example.com/hub", nil)
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil))
 	assert.EqualError(t, err, "An \"Origin\" or a \"Referer\" HTTP header must be present to use the cookie-based authorization mechanism")
 	assert.Nil(t, claims)
 }
 
+func TestAuthorizeCookieNoOriginNoRefererFetchSite(t *testing.T) {
+	config := createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"http://example.net"})
+	config.publishAllowedFetchSites = []string{"same-origin"}
+
+	r, _ := http.NewRequest("POST", "http://example.com/hub", nil)
+	r.Header.Add("Sec-Fetch-Site", "same-origin")
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
+
+	claims, err := authorize(r, config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+
+	r.Header.Set("Sec-Fetch-Site", "same-site")
+	claims, err = authorize(r, config)
+	assert.EqualError(t, err, "An \"Origin\" or a \"Referer\" HTTP header must be present to use the cookie-based authorization mechanism")
+	assert.Nil(t, claims)
+
+	config.publishAllowedFetchSites = []string{"same-origin", "same-site"}
+	claims, err = authorize(r, config)
+	assert.Nil(t, err)
+	assert.NotNil(t, claims)
+
+	r.Header.Set("Sec-Fetch-Site", "cross-site")
+	claims, err = authorize(r, config)
+	assert.EqualError(t, err, "An \"Origin\" or a \"Referer\" HTTP header must be present to use the cookie-based authorization mechanism")
+	assert.Nil(t, claims)
+
+	// The origin is checked when it is known
+	r.Header.Set("Sec-Fetch-Site", "same-origin")
+	r.Header.Set("Origin", "http://example.com")
+	claims, err = authorize(r, config)
+	assert.EqualError(t, err, "The origin \"http://example.com\" is not allowed to post updates")
+	assert.Nil(t, claims)
+}
+
 func TestAuthorizeCookieOriginNotAllowed(t *testing.T) {
 	r, _ := http.NewRequest("POST", "http://example.com/hub", nil)
 	r.Header.Add("Origin", "http://example.com")
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{"http://example.net"})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"http://example.net"}))
 	assert.EqualError(t, err, "The origin \"http://example.com\" is not allowed to post updates")
 	assert.Nil(t, claims)
 }
@@ -138,9 +599,54 @@ func TestAuthorizeCookieRefererNotAllowed(t *testing.T) {
 	r.Header.Add("Referer", "http://example.com/foo/bar")
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{"http://example.net"})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"http://example.net"}))
+	assert.EqualError(t, err, "The origin \"http://example.com\" is not allowed to post updates")
+	assert.Nil(t, claims)
+}
+
+func TestAuthorizeCookieRefererForwardedProto(t *testing.T) {
+	r, _ := http.NewRequest("POST", "http://example.com/hub", nil)
+	r.Header.Add("Referer", "http://example.com/foo/bar")
+	r.Header.Add("X-Forwarded-Proto", "https")
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
+
+	config := createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"https://example.com"})
+	claims, err := authorize(r, config)
 	assert.EqualError(t, err, "The origin \"http://example.com\" is not allowed to post updates")
 	assert.Nil(t, claims)
+
+	config.trustForwardedHeaders = true
+	claims, err = authorize(r, config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
+}
+
+func TestForwardedProto(t *testing.T) {
+	r, _ := http.NewRequest("POST", "http://example.com/hub", nil)
+	assert.Equal(t, "", forwardedProto(r))
+
+	r.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	assert.Equal(t, "https", forwardedProto(r))
+
+	// Forwarded has priority over X-Forwarded-Proto
+	r.Header.Set("Forwarded", `for=192.0.2.60;proto=http;by=203.0.113.43, for=198.51.100.17;proto=https`)
+	assert.Equal(t, "http", forwardedProto(r))
+
+	r.Header.Set("Forwarded", `for=192.0.2.60;Proto="https"`)
+	assert.Equal(t, "https", forwardedProto(r))
+
+	r.Header.Set("Forwarded", "for=192.0.2.60;proto=javascript")
+	assert.Equal(t, "", forwardedProto(r))
+}
+
+func TestAuthorizeCookieOriginPattern(t *testing.T) {
+	r, _ := http.NewRequest("POST", "http://example.com/hub", nil)
+	r.Header.Add("Origin", "https://pr-42.example.com")
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
+
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"https://*.example.com"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
 }
 
 func TestAuthorizeCookieInvalidReferer(t *testing.T) {
@@ -148,7 +654,7 @@ func TestAuthorizeCookieInvalidReferer(t *testing.T) {
 	r.Header.Add("Referer", "http://192.168.0.%31/")
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{"http://example.net"})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"http://example.net"}))
 	assert.EqualError(t, err, "parse http://192.168.0.%31/: invalid URL escape \"%31\"")
 	assert.Nil(t, claims)
 }
@@ -159,16 +665,91 @@ func TestAuthorizeCookieOriginHasPriority(t *testing.T) {
 	r.Header.Add("Referer", "http://example.com")
 	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
 
-	claims, err := authorize(r, []byte("!UnsecureChangeMe!"), []string{"http://example.net"})
+	claims, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"http://example.net"}))
 	assert.Equal(t, []string{"foo", "bar"}, claims.Mercure.Publish)
 	assert.Equal(t, []string{"foo", "baz"}, claims.Mercure.Subscribe)
 	assert.Nil(t, err)
 }
 
+func TestAuthorizationErrorCodes(t *testing.T) {
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{StandardClaims: jwt.StandardClaims{ExpiresAt: 1}})
+	expiredString, _ := expired.SignedString([]byte("!UnsecureChangeMe!"))
+
+	notYetValid := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{StandardClaims: jwt.StandardClaims{NotBefore: time.Now().Add(time.Hour).Unix()}})
+	notYetValidString, _ := notYetValid.SignedString([]byte("!UnsecureChangeMe!"))
+
+	tokens := map[string]string{
+		"token_expired":        expiredString,
+		"token_not_yet_valid":  notYetValidString,
+		"invalid_signature":    createDummyUnauthorizedJWT(),
+		"unexpected_algorithm": createDummyNoneSignedJWT(),
+		"malformed_token":      "invalid",
+	}
+
+	for code, token := range tokens {
+		_, err := validateJWT(token, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil).jwt)
+
+		e, ok := err.(*authorizationError)
+		assert.True(t, ok)
+		assert.Equal(t, code, e.code)
+	}
+
+	r, _ := http.NewRequest("POST", "http://example.com/hub", nil)
+	r.Header.Add("Origin", "http://example.com")
+	r.AddCookie(&http.Cookie{Name: "mercureAuthorization", Value: validFullHeader})
+
+	_, err := authorize(r, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), []string{"http://example.net"}))
+	assert.Equal(t, "origin_not_allowed", err.(*authorizationError).code)
+}
+
+func TestAuthorizationErrorIs(t *testing.T) {
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{StandardClaims: jwt.StandardClaims{ExpiresAt: 1}})
+	expiredString, _ := expired.SignedString([]byte("!UnsecureChangeMe!"))
+
+	notYetValid := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{StandardClaims: jwt.StandardClaims{NotBefore: time.Now().Add(time.Hour).Unix()}})
+	notYetValidString, _ := notYetValid.SignedString([]byte("!UnsecureChangeMe!"))
+
+	tokens := map[error]string{
+		ErrTokenExpired:          expiredString,
+		ErrTokenInvalidSignature: createDummyUnauthorizedJWT(),
+		ErrTokenMalformed:        "invalid",
+		ErrTokenNotYetValid:      notYetValidString,
+	}
+
+	for expected, token := range tokens {
+		_, err := validateJWT(token, createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil).jwt)
+
+		for sentinel := range tokens {
+			assert.Equal(t, sentinel == expected, errors.Is(err, sentinel), "%s matching %s", err, sentinel)
+		}
+	}
+
+	_, err := validateJWT(createDummyNoneSignedJWT(), createDummyAuthorizationConfig([]byte("!UnsecureChangeMe!"), nil).jwt)
+	assert.False(t, errors.Is(err, ErrTokenInvalidSignature))
+}
+
+func TestSendUnauthorized(t *testing.T) {
+	w := httptest.NewRecorder()
+	sendUnauthorized(w, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	w = httptest.NewRecorder()
+	sendUnauthorized(w, &authorizationError{"origin_not_allowed", errors.New(`The origin "http://example.com" is not allowed to post updates`)})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer error="origin_not_allowed", error_description="The origin 'http://example.com' is not allowed to post updates"`, w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusText(http.StatusUnauthorized)+"\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	sendUnauthorized(w, errors.New("unknown"))
+	assert.Equal(t, `Bearer error="invalid_token", error_description="unknown"`, w.Header().Get("WWW-Authenticate"))
+}
+
 func TestAuthorizedNilClaim(t *testing.T) {
-	all, targets := authorizedTargets(nil, true)
+	all, targets, templateTargets := authorizedTargets(nil, true)
 	assert.False(t, all)
 	assert.Empty(t, targets)
+	assert.Empty(t, templateTargets)
 }
 
 func TestAuthorizedTargetsPublisher(t *testing.T) {
@@ -176,7 +757,7 @@ func TestAuthorizedTargetsPublisher(t *testing.T) {
 		Publish: []string{"foo", "bar"},
 	}}
 
-	all, targets := authorizedTargets(c, true)
+	all, targets, _ := authorizedTargets(c, true)
 	assert.False(t, all)
 	assert.Equal(t, map[string]struct{}{"foo": {}, "bar": {}}, targets)
 }
@@ -186,7 +767,7 @@ func TestAuthorizedAllTargetsPublisher(t *testing.T) {
 		Publish: []string{"*"},
 	}}
 
-	all, targets := authorizedTargets(c, true)
+	all, targets, _ := authorizedTargets(c, true)
 	assert.True(t, all)
 	assert.Empty(t, targets)
 }
@@ -196,7 +777,7 @@ func TestAuthorizedTargetsSubsciber(t *testing.T) {
 		Subscribe: []string{"foo", "bar"},
 	}}
 
-	all, targets := authorizedTargets(c, false)
+	all, targets, _ := authorizedTargets(c, false)
 	assert.False(t, all)
 	assert.Equal(t, map[string]struct{}{"foo": {}, "bar": {}}, targets)
 }
@@ -206,7 +787,100 @@ func TestAuthorizedAllTargetsSubsciber(t *testing.T) {
 		Subscribe: []string{"*"},
 	}}
 
-	all, targets := authorizedTargets(c, false)
+	all, targets, _ := authorizedTargets(c, false)
 	assert.True(t, all)
 	assert.Empty(t, targets)
 }
+
+func TestPublishDeniedTargets(t *testing.T) {
+	assert.False(t, publishDenied(nil)("foo"))
+	assert.False(t, publishDenied(&claims{Mercure: mercureClaim{Publish: []string{"*"}}})("foo"))
+
+	isDenied := publishDenied(&claims{Mercure: mercureClaim{
+		Publish:     []string{"*"},
+		PublishDeny: []string{"foo", "http://example.com/admin/{id}"},
+	}})
+	assert.True(t, isDenied("foo"))
+	assert.True(t, isDenied("http://example.com/admin/1"))
+	assert.True(t, isDenied("http://example.com/admin/{id}"))
+	assert.False(t, isDenied("bar"))
+
+	isDenied = publishDenied(&claims{Mercure: mercureClaim{PublishDeny: []string{"*"}}})
+	assert.True(t, isDenied("bar"))
+}
+
+func createDummyRSAKeys() (*rsa.PrivateKey, []byte) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+
+	return privateKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func createDummyECDSAKeys() (*ecdsa.PrivateKey, []byte) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+
+	return privateKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestAuthorizedTemplateTargets(t *testing.T) {
+	c := &claims{Mercure: mercureClaim{
+		Subscribe: []string{"foo", "https://example.com/books/{id}", "https://example.com/faulty{iri"},
+	}}
+
+	all, targets, templateTargets := authorizedTargets(c, false)
+	assert.False(t, all)
+	assert.Equal(t, map[string]struct{}{"foo": {}, "https://example.com/books/{id}": {}, "https://example.com/faulty{iri": {}}, targets)
+	assert.Len(t, templateTargets, 1)
+	assert.Equal(t, "https://example.com/books/{id}", templateTargets[0].Raw())
+
+	assert.True(t, matchTarget("foo", targets, templateTargets))
+	assert.True(t, matchTarget("https://example.com/books/1", targets, templateTargets))
+	assert.True(t, matchTarget("https://example.com/books/{id}", targets, templateTargets))
+	assert.False(t, matchTarget("https://example.com/reviews/1", targets, templateTargets))
+	assert.False(t, matchTarget("bar", targets, templateTargets))
+}
+
+func createDummyAuthorizationConfig(key []byte, publishAllowedOrigins []string) *authorizationConfig {
+	return &authorizationConfig{
+		jwt:                   &jwtConfig{keys: [][]byte{key}, signingMethod: jwt.SigningMethodHS256},
+		publishAllowedOrigins: newOriginPatterns(publishAllowedOrigins),
+		cookieName:            defaultCookieName,
+	}
+}
+
+func TestTargetsFromContext(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	assert.Nil(t, TargetsFromContext(r.Context()))
+
+	r = withAuthorizedTargets(r, false, map[string]struct{}{"foo": {}}, true)
+	assert.Equal(t, &AuthorizedTargets{false, map[string]struct{}{"foo": {}}, true}, TargetsFromContext(r.Context()))
+}
+
+func TestAuthorizeMaxClaimTargets(t *testing.T) {
+	h := createDummy()
+
+	targets := make([]string, defaultMaxClaimTargets+1)
+	for i := range targets {
+		targets[i] = fmt.Sprintf("https://example.com/users/%d", i)
+	}
+
+	r, _ := http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, false, targets[:defaultMaxClaimTargets]))
+	claims, err := authorize(r, h.getAuthorizationConfig(false))
+	assert.Nil(t, err)
+	assert.Len(t, claims.Mercure.Subscribe, defaultMaxClaimTargets)
+
+	r, _ = http.NewRequest("GET", "http://example.com/hub", nil)
+	r.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, false, targets))
+	claims, err = authorize(r, h.getAuthorizationConfig(false))
+	assert.EqualError(t, err, "The \"subscribe\" claim contains 1001 targets, the maximum is 1000")
+	assert.Equal(t, "invalid_token", err.(*authorizationError).code)
+	assert.Nil(t, claims)
+
+	// The limit can be raised
+	h.options.MaxClaimTargets = 5000
+	claims, err = authorize(r, h.getAuthorizationConfig(false))
+	assert.Nil(t, err)
+	assert.Len(t, claims.Mercure.Subscribe, defaultMaxClaimTargets+1)
+}
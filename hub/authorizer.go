@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"context"
+	"net/http"
+)
+
+// AuthorizationClaims contains the claims of the JWT provided by a publisher or a subscriber
+type AuthorizationClaims struct {
+	Subject   string
+	Publish   []string
+	Subscribe []string
+}
+
+// TopicAuthorizer is a hook called for every topic of a subscription or of an update, once the JWT has been validated
+// It allows to deny the access using rules unknown to the JWT (a permissions service...), it returns false to deny the access
+// It can never grant an access not allowed by the JWT, the claims are nil for anonymous subscribers
+type TopicAuthorizer func(ctx context.Context, claims *AuthorizationClaims, topic string) (bool, error)
+
+// DataRedactor is a hook called before sending an update to a subscriber, it returns the data the subscriber is allowed to see
+// It allows to strip the fields of the payload restricted to some subscribers, according to their claims (nil for anonymous subscribers)
+// It is called for every update sent to every subscriber, including the missed ones: it must be fast, and safe for concurrent use
+// Returning the data unchanged is free, the update is only serialized again for the subscribers receiving redacted data
+type DataRedactor func(claims *AuthorizationClaims, data string) string
+
+// newAuthorizationClaims exposes the claims of the JWT to the authorization hooks
+func newAuthorizationClaims(claims *claims) *AuthorizationClaims {
+	if claims == nil {
+		return nil
+	}
+
+	return &AuthorizationClaims{claims.Subject, claims.Mercure.Publish, claims.Mercure.Subscribe}
+}
+
+// authorizeTopics calls the hook for every topic, it returns the first denied topic, if any
+// All topics are authorized if the hook is nil
+func authorizeTopics(ctx context.Context, authorize TopicAuthorizer, claims *claims, topics []string) (denied string, err error) {
+	if authorize == nil {
+		return "", nil
+	}
+
+	ac := newAuthorizationClaims(claims)
+	for _, topic := range topics {
+		ok, err := authorize(ctx, ac, topic)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return topic, nil
+		}
+	}
+
+	return "", nil
+}
+
+// authorizationHookFailed logs the error returned by an authorization hook, and replies with a 500 status code
+func (h *Hub) authorizationHookFailed(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.Error("The authorization hook failed", "remote_addr", r.RemoteAddr, "error", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// denyReviews is a hook denying the access to the reviews, and failing for the topics of the users
+func denyReviews(_ context.Context, _ *AuthorizationClaims, topic string) (bool, error) {
+	if strings.HasPrefix(topic, "http://example.com/users/") {
+		return false, errors.New("permissions service unavailable")
+	}
+
+	return !strings.HasPrefix(topic, "http://example.com/reviews/"), nil
+}
+
+func TestAuthorizeTopics(t *testing.T) {
+	denied, err := authorizeTopics(context.Background(), nil, nil, []string{"http://example.com/reviews/1"})
+	assert.Empty(t, denied)
+	assert.Nil(t, err)
+
+	denied, err = authorizeTopics(context.Background(), denyReviews, nil, []string{"http://example.com/books/1", "http://example.com/reviews/1"})
+	assert.Equal(t, "http://example.com/reviews/1", denied)
+	assert.Nil(t, err)
+
+	_, err = authorizeTopics(context.Background(), denyReviews, nil, []string{"http://example.com/users/1"})
+	assert.EqualError(t, err, "permissions service unavailable")
+
+	var received *AuthorizationClaims
+	authorizeTopics(context.Background(), func(_ context.Context, claims *AuthorizationClaims, _ string) (bool, error) {
+		received = claims
+		return true, nil
+	}, &claims{Mercure: mercureClaim{Subscribe: []string{"foo"}}}, []string{"http://example.com/books/1"})
+	assert.Equal(t, &AuthorizationClaims{Subscribe: []string{"foo"}}, received)
+}
+
+func TestSubscribeAuthorizationHook(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.AuthorizeSubscribe = denyReviews
+
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/reviews/1", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="Not allowed to subscribe to the topic 'http://example.com/reviews/1'"`, w.Header().Get("WWW-Authenticate"))
+
+	w = httptest.NewRecorder()
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/users/1", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestPublishAuthorizationHook(t *testing.T) {
+	// Nothing consumes the updates channel: the test would block if an update was published
+	hub := createDummy()
+	hub.options.AuthorizePublish = denyReviews
+
+	publish := func(topic string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("topic", topic)
+		form.Add("data", "Hello!")
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		return w
+	}
+
+	w := publish("http://example.com/reviews/1")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="Not allowed to publish to the topic 'http://example.com/reviews/1'"`, w.Header().Get("WWW-Authenticate"))
+
+	assert.Equal(t, http.StatusInternalServerError, publish("http://example.com/users/1").Code)
+
+	body := `[{"topic": "http://example.com/books/1", "data": "foo"}, {"topic": ["http://example.com/books/2", "http://example.com/reviews/2"], "data": "foo"}]`
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+	w = httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="Not allowed to publish to the topic 'http://example.com/reviews/2' in update #1"`, w.Header().Get("WWW-Authenticate"))
+}
+
+// redactEmails strips the email of the author from the data sent to the subscribers not allowed to receive the private updates
+func redactEmails(claims *AuthorizationClaims, data string) string {
+	if claims != nil {
+		for _, target := range claims.Subscribe {
+			if target == "private" {
+				return data
+			}
+		}
+	}
+
+	return strings.Replace(data, `,"email":"kevin@example.com"`, "", 1)
+}
+
+func TestSubscribeRedactionHook(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.RedactForSubscriber = redactEmails
+	hub.Start()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			ready := len(hub.subscribers.m) == 3
+			hub.subscribers.RUnlock()
+
+			if !ready {
+				continue
+			}
+
+			hub.updates <- newSerializedUpdate(&Update{
+				Topics: []string{"http://example.com/books/1"},
+				Event:  Event{Data: `{"author":"Kévin","email":"kevin@example.com"}`, ID: "a"},
+			})
+
+			hub.Stop()
+			return
+		}
+	}()
+
+	subscribe := func(wg *sync.WaitGroup, query, jwt, expected string) {
+		defer wg.Done()
+
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1"+query, nil)
+		if jwt != "" {
+			req.Header.Add("Authorization", "Bearer "+jwt)
+		}
+		w := newCloseNotifyingRecorder()
+		hub.SubscribeHandler(w, req)
+
+		assert.Equal(t, expected, w.Body.String())
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go subscribe(&wg, "", "", ":\ntopic: http://example.com/books/1\nid: a\ndata: {\"author\":\"Kévin\"}\n\n")
+	go subscribe(&wg, "", createDummyAuthorizedJWT(hub, false, []string{"private"}), ":\ntopic: http://example.com/books/1\nid: a\ndata: {\"author\":\"Kévin\",\"email\":\"kevin@example.com\"}\n\n")
+	// The filters can't reveal the redacted fields
+	go subscribe(&wg, "&filter="+url.QueryEscape(`email == "kevin@example.com"`), "", ":\n")
+	wg.Wait()
+}
@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// stringList is a JSON value that can be either a single string or an array of strings
+type stringList []string
+
+// UnmarshalJSON decodes a string or an array of strings
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+
+	var a []string
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	*l = stringList(a)
+
+	return nil
+}
+
+// decodeJSONUpdates reads a JSON-encoded body, containing either a single update or an array of updates
+// The batch is nil if the body contains a single update, the error response is sent if the body is invalid
+func decodeJSONUpdates(w http.ResponseWriter, r *http.Request) ([]updateRequest, *updateRequest, bool) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		if isBodyTooLarge(err) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return nil, nil, false
+		}
+
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	if raw = bytes.TrimLeft(raw, " \t\r\n"); len(raw) > 0 && raw[0] == '[' {
+		batch := []updateRequest{}
+		if err := json.Unmarshal(raw, &batch); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return nil, nil, false
+		}
+
+		return batch, nil, true
+	}
+
+	var ur updateRequest
+	if err := json.Unmarshal(raw, &ur); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	return nil, &ur, true
+}
+
+// publishBatch publishes, in order, all the updates contained in a JSON array
+// All updates are validated first: if one of them is invalid, none is published
+// The response contains the JSON array of the IDs of the published updates, or of the dry run results if dryRun is true
+func (h *Hub) publishBatch(w http.ResponseWriter, r *http.Request, claims *claims, batch []updateRequest, canPublishTo, isDenied func(string) bool, dryRun bool) {
+	if len(batch) == 0 {
+		http.Error(w, "The batch must contain at least one update", http.StatusBadRequest)
+		return
+	}
+
+	updates := make([]*Update, len(batch))
+	denials := make([]*publishDenial, len(batch))
+	for i, bu := range batch {
+		u, denial, ok := h.newUpdate(w, r, claims, bu, canPublishTo, isDenied, dryRun, fmt.Sprintf(" in update #%d", i))
+		if !ok {
+			return
+		}
+
+		updates[i] = u
+		denials[i] = denial
+	}
+
+	if dryRun {
+		results := make([]dryRunResult, len(updates))
+		for i, u := range updates {
+			results[i] = newDryRunResult(u, denials[i])
+			h.logger.Info("Update dry run", "remote_addr", r.RemoteAddr, "event_id", results[i].ID, "topics", u.Topics, "granted", results[i].Granted, "subject", claims.Subject)
+		}
+
+		sendDryRun(w, results)
+		return
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	ids := make([]string, len(updates))
+	recipients := make([]string, 0, len(updates))
+	for i, u := range updates {
+		u.spanContext = span.SpanContext()
+		err := h.publisher.Publish(h, u)
+		if err != nil {
+			span.RecordError(err)
+			if err != errHubStopped {
+				h.logger.Error("Failed to publish the update", "event_id", u.ID, "topics", u.Topics, "error", err)
+			}
+			sendServiceUnavailable(w)
+			return
+		}
+		span.AddEvent("Update published", trace.WithAttributes(updateAttributes(u)...))
+
+		h.metrics.updatesPublished.Inc()
+		ids[i] = u.ID
+		if u.recipients != nil {
+			recipients = append(recipients, strconv.Itoa(<-u.recipients))
+		}
+		h.logger.Info("Update published", "remote_addr", r.RemoteAddr, "event_id", u.ID, "topics", u.Topics, "subject", claims.Subject)
+	}
+
+	if len(recipients) == len(updates) {
+		w.Header().Set(recipientsHeader, strings.Join(recipients, ","))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ids)
+}
@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringList(t *testing.T) {
+	var l stringList
+	assert.Nil(t, json.Unmarshal([]byte(`"foo"`), &l))
+	assert.Equal(t, stringList{"foo"}, l)
+
+	assert.Nil(t, json.Unmarshal([]byte(`["foo", "bar"]`), &l))
+	assert.Equal(t, stringList{"foo", "bar"}, l)
+
+	assert.Error(t, json.Unmarshal([]byte(`1`), &l))
+}
+
+func TestPublishBatchOK(t *testing.T) {
+	hub := createDummy()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		u := <-hub.updates
+		assert.Equal(t, "first", u.ID)
+		assert.Equal(t, []string{"http://example.com/books/1"}, u.Topics)
+		assert.Equal(t, "Hello", u.Data)
+		assert.Equal(t, uint64(10), u.Retry)
+		assert.Equal(t, struct{}{}, u.Targets["foo"])
+
+		u = <-hub.updates
+		assert.NotEmpty(t, u.ID)
+		assert.Equal(t, []string{"http://example.com/books/2", "http://example.com/alt/2"}, u.Topics)
+		assert.Equal(t, "World", u.Data)
+		assert.Empty(t, u.Targets)
+	}()
+
+	body := `[
+		{"id": "first", "topic": "http://example.com/books/1", "data": "Hello", "targets": ["foo"], "retry": 10},
+		{"topic": ["http://example.com/books/2", "http://example.com/alt/2"], "data": "World"}
+	]`
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	wg.Wait()
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var ids []string
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&ids))
+	assert.Len(t, ids, 2)
+	assert.Equal(t, "first", ids[0])
+}
+
+func TestPublishBatchInvalid(t *testing.T) {
+	testCases := []struct {
+		body       string
+		statusCode int
+		message    string
+	}{
+		{`{"topic": "http://example.com/books/1"`, http.StatusBadRequest, "Invalid JSON body\n"},
+		{`"http://example.com/books/1"`, http.StatusBadRequest, "Invalid JSON body\n"},
+		{`[]`, http.StatusBadRequest, "The batch must contain at least one update\n"},
+		{`[{"topic": "http://example.com/books/1", "data": "foo"}, {"data": "foo"}]`, http.StatusBadRequest, "Missing \"topic\" parameter in update #1\n"},
+		{`[{"topic": "http://example.com/books/1"}]`, http.StatusBadRequest, "Missing \"data\" parameter in update #0\n"},
+		{`[{"topic": ["http://example.com/books/1", "books/1"], "data": "foo"}]`, http.StatusBadRequest, "Invalid \"topic\" parameter \"books/1\": it must be an absolute IRI in update #0\n"},
+		{`[{"topic": "http://example.com/books/1", "data": "foo", "id": "a\rb"}]`, http.StatusBadRequest, "Invalid \"id\" parameter in update #0\n"},
+		{`[{"topic": "http://example.com/books/1", "data": "foo", "type": "a\nb"}]`, http.StatusBadRequest, "Invalid \"type\" parameter in update #0\n"},
+		{`[{"topic": "http://example.com/books/1", "data": "foo"}, {"topic": "http://example.com/books/1", "data": "foo", "ttl": "1 hour"}]`, http.StatusBadRequest, "Invalid \"ttl\" parameter in update #1\n"},
+		{`[{"topic": "http://example.com/books/1", "data": "foo"}, {"topic": "http://example.com/books/1", "data": "foo", "targets": "not-allowed"}]`, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized) + "\n"},
+	}
+
+	for _, tc := range testCases {
+		// Nothing consumes the updates channel: the test would block if an update was published
+		hub := createDummy()
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(tc.body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		assert.Equal(t, tc.statusCode, w.Code)
+		assert.Equal(t, tc.message, w.Body.String())
+	}
+}
+
+func TestPublishBatchDenied(t *testing.T) {
+	// Nothing consumes the updates channel: the test would block if an update was published
+	hub := createDummy()
+
+	body := `[{"topic": "http://example.com/books/1", "data": "foo"}, {"topic": "http://example.com/books/1", "data": "foo", "targets": "internal"}]`
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+createDummyDeniedJWT(hub, []string{"internal"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="Not allowed to publish to the target 'internal' in update #1"`, w.Header().Get("WWW-Authenticate"))
+}
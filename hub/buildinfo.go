@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Version and Commit identify the build of the hub, they are set when linking the binary:
+//
+//	go build -ldflags "-X github.com/dunglas/mercure/hub.Version=v0.10.0 -X github.com/dunglas/mercure/hub.Commit=$(git rev-parse HEAD)"
+//
+// When they are empty, they are read from the build information embedded by the Go toolchain, if any
+var (
+	Version string
+	Commit  string
+)
+
+// defaultVersion is reported when the version isn't set at link time, and the hub hasn't been built as a dependency of a versioned module
+const defaultVersion = "dev"
+
+// buildInfo describes the binary serving the hub
+type buildInfo struct {
+	Version   string
+	Commit    string
+	GoVersion string
+}
+
+var currentBuildInfo struct {
+	sync.Once
+	buildInfo
+}
+
+// getBuildInfo returns the information about the build, it is computed once, the variables set at link time take precedence
+func getBuildInfo() buildInfo {
+	currentBuildInfo.Do(func() {
+		currentBuildInfo.buildInfo = newBuildInfo(Version, Commit, runtime.Version())
+	})
+
+	return currentBuildInfo.buildInfo
+}
+
+// newBuildInfo completes the version and the commit using the build information embedded in the binary
+func newBuildInfo(version, commit, goVersion string) buildInfo {
+	if version == "" || commit == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			// The main module is "(devel)" when the binary has been built from a checkout of the repository
+			if version == "" && info.Main.Version != "(devel)" {
+				version = info.Main.Version
+			}
+			if commit == "" {
+				commit = vcsRevision(info)
+			}
+		}
+	}
+
+	if version == "" {
+		version = defaultVersion
+	}
+
+	return buildInfo{version, commit, goVersion}
+}
@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/handlers"
+)
+
+// compressionStatsContextKey is the key of the request's context value containing the compressionStats of the response
+const compressionStatsContextKey = contextKey("compressionStats")
+
+// compressionStats counts the bytes of a response written by the handler, and the ones actually sent once compressed
+// They are only updated and read by the goroutine serving the request
+type compressionStats struct {
+	uncompressed int64
+	compressed   int64
+}
+
+// withCompressionStats compresses the responses for the clients supporting it, and records the compressionStats of every response
+// The bytes are counted on both sides of the compressing writer, the subscribers report the achieved ratio when they disconnect
+func withCompressionStats(next http.Handler) http.Handler {
+	compress := handlers.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := r.Context().Value(compressionStatsContextKey).(*compressionStats)
+		next.ServeHTTP(&countingResponseWriter{w, &stats.uncompressed}, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := &compressionStats{}
+		compress.ServeHTTP(&countingResponseWriter{w, &stats.compressed}, r.WithContext(context.WithValue(r.Context(), compressionStatsContextKey, stats)))
+	})
+}
+
+// countingResponseWriter counts the bytes written to the response
+// The optional interfaces of the underlying writer used by the handlers are forwarded, as the compressing writer does
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	*w.n += int64(n)
+
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel never receiving anything if the underlying writer doesn't support it
+func (w *countingResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+
+	return make(chan bool)
+}
+
+// Hijack allows to upgrade the connection to the WebSocket protocol
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+
+	return nil, nil, errors.New("hijacking unsupported")
+}
+
+// Unwrap allows the http.ResponseController to reach the underlying writer
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// reportCompression records whether the response sent to a subscriber has been compressed, and the achieved ratio, when it disconnects
+// Nothing is reported if the compression is disabled
+func (h *Hub) reportCompression(w http.ResponseWriter, r *http.Request, s *Subscriber) {
+	stats, ok := r.Context().Value(compressionStatsContextKey).(*compressionStats)
+	if !ok {
+		return
+	}
+
+	encoding := w.Header().Get("Content-Encoding")
+	if encoding == "" {
+		h.metrics.subscribersCompression.WithLabelValues("none").Inc()
+		h.logger.Info("Uncompressed subscriber disconnected", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "bytes", stats.uncompressed)
+		return
+	}
+
+	h.metrics.subscribersCompression.WithLabelValues(encoding).Inc()
+	h.metrics.subscriberBytes.WithLabelValues("uncompressed").Add(float64(stats.uncompressed))
+	h.metrics.subscriberBytes.WithLabelValues("compressed").Add(float64(stats.compressed))
+
+	var ratio float64
+	if stats.uncompressed != 0 {
+		ratio = float64(stats.compressed) / float64(stats.uncompressed)
+	}
+	h.logger.Info("Compressed subscriber disconnected", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "encoding", encoding, "uncompressed_bytes", stats.uncompressed, "compressed_bytes", stats.compressed, "ratio", ratio)
+}
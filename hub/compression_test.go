@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeCompressionStats(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.Start()
+	handler := withCompressionStats(http.HandlerFunc(hub.SubscribeHandler))
+
+	data := strings.Repeat("compressible ", 100)
+	var wg sync.WaitGroup
+	for _, encoding := range []string{"gzip", ""} {
+		wg.Add(1)
+		go func(encoding string) {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+			if encoding != "" {
+				req.Header.Add("Accept-Encoding", encoding)
+			}
+			w := newCloseNotifyingRecorder()
+			handler.ServeHTTP(w, req)
+
+			if encoding == "" {
+				assert.Contains(t, w.Body.String(), data)
+				return
+			}
+
+			assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+			r, err := gzip.NewReader(w.Body)
+			assert.Nil(t, err)
+			body, _ := ioutil.ReadAll(r)
+			assert.Contains(t, string(body), data)
+		}(encoding)
+	}
+
+	for {
+		hub.subscribers.RLock()
+		ready := len(hub.subscribers.m) == 2
+		hub.subscribers.RUnlock()
+
+		if ready {
+			break
+		}
+	}
+
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: data}})
+	// The subscribers are disconnected once the update has been sent
+	hub.Stop()
+	wg.Wait()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.subscribersCompression.WithLabelValues("gzip")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.subscribersCompression.WithLabelValues("none")))
+
+	// Only the compressed response is counted
+	uncompressed := testutil.ToFloat64(hub.metrics.subscriberBytes.WithLabelValues("uncompressed"))
+	compressed := testutil.ToFloat64(hub.metrics.subscriberBytes.WithLabelValues("compressed"))
+	assert.True(t, uncompressed > float64(len(data)))
+	assert.True(t, compressed > 0 && compressed < uncompressed/10)
+}
+
+func TestReportCompressionDisabled(t *testing.T) {
+	hub := createDummy()
+	req := httptest.NewRequest("GET", "http://example.com/hub", nil)
+
+	hub.reportCompression(httptest.NewRecorder(), req, NewSubscriber(false, nil, nil, nil, nil, ""))
+	assert.Equal(t, 0.0, testutil.ToFloat64(hub.metrics.subscribersCompression.WithLabelValues("none")))
+}
+
+func TestCountingResponseWriter(t *testing.T) {
+	var n int64
+	recorder := httptest.NewRecorder()
+	w := &countingResponseWriter{recorder, &n}
+
+	w.Write([]byte("foo"))
+	w.Write([]byte("bar"))
+	w.Flush()
+
+	assert.Equal(t, int64(6), n)
+	assert.True(t, recorder.Flushed)
+	assert.Equal(t, recorder, w.Unwrap())
+
+	_, _, err := w.Hijack()
+	assert.Error(t, err)
+}
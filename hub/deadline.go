@@ -0,0 +1,48 @@
+//go:build go1.20
+// +build go1.20
+
+package hub
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// responseControllerContextKey is the key of the request's context value containing the controller of the response created by the HTTP server
+const responseControllerContextKey = contextKey("responseController")
+
+// withResponseController stores a controller of the response in the request's context, before the writer is wrapped by the other handlers
+// The writers of the middleware (compression, logging...) don't expose the underlying writer, the controller allows to set the write deadline anyway
+func withResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseControllerContextKey, http.NewResponseController(w))))
+	})
+}
+
+// responseController returns the controller stored by withResponseController, or a controller of the given writer
+func responseController(w http.ResponseWriter, r *http.Request) *http.ResponseController {
+	if rc, ok := r.Context().Value(responseControllerContextKey).(*http.ResponseController); ok {
+		return rc
+	}
+
+	return http.NewResponseController(w)
+}
+
+// setWriteDeadline sets the time before which the next writes of the response must be completed
+func setWriteDeadline(w http.ResponseWriter, r *http.Request, deadline time.Time) error {
+	return responseController(w, r).SetWriteDeadline(deadline)
+}
+
+// flushResponse sends the buffered data to the client, it returns the error of the write, if any
+func flushResponse(w http.ResponseWriter, r *http.Request) error {
+	rc, ok := r.Context().Value(responseControllerContextKey).(*http.ResponseController)
+	if !ok {
+		return http.NewResponseController(w).Flush()
+	}
+
+	// The data buffered by the wrapping writers is flushed first, their errors are only reported by the underlying writer
+	w.(http.Flusher).Flush()
+
+	return rc.Flush()
+}
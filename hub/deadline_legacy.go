@@ -0,0 +1,30 @@
+//go:build !go1.20
+// +build !go1.20
+
+package hub
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errWriteDeadlineUnsupported is returned when trying to set a write deadline with a version of Go older than 1.20
+var errWriteDeadlineUnsupported = errors.New("setting the write deadline of a response requires Go 1.20")
+
+// withResponseController does nothing, response controllers have been introduced in Go 1.20
+func withResponseController(next http.Handler) http.Handler {
+	return next
+}
+
+// setWriteDeadline always fails, the write deadline cannot be set with this version of Go
+func setWriteDeadline(http.ResponseWriter, *http.Request, time.Time) error {
+	return errWriteDeadlineUnsupported
+}
+
+// flushResponse sends the buffered data to the client, write errors cannot be detected with this version of Go
+func flushResponse(w http.ResponseWriter, _ *http.Request) error {
+	w.(http.Flusher).Flush()
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gofrs/uuid"
+)
+
+// dryRunHeader can be used instead of the "dry-run" query parameter to check what publishing would do, without dispatching nor storing anything
+const dryRunHeader = "X-Mercure-Dry-Run"
+
+// dryRunResult is the JSON representation of what would have happened if an update had been published
+type dryRunResult struct {
+	Granted bool     `json:"granted"`
+	Reason  string   `json:"reason,omitempty"`
+	Targets []string `json:"targets"`
+	ID      string   `json:"id,omitempty"`
+}
+
+// isDryRun checks if the publisher asked for a dry run, using the "dry-run" query parameter or the X-Mercure-Dry-Run header
+func isDryRun(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("dry-run")
+	if value == "" {
+		value = r.Header.Get(dryRunHeader)
+	}
+	if value == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// newDryRunResult describes the update that would have been dispatched, the ID is generated if the publisher didn't provide one
+func newDryRunResult(u *Update, denial *publishDenial) dryRunResult {
+	if denial != nil {
+		return dryRunResult{Reason: denial.err.Error(), Targets: []string{}}
+	}
+
+	id := u.ID
+	if id == "" {
+		id = uuid.Must(uuid.NewV4()).String()
+	}
+
+	targets := make([]string, 0, len(u.Targets))
+	for target := range u.Targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	return dryRunResult{true, "", targets, id}
+}
+
+// sendDryRun replies with the result of a dry run, or with the results of a batch
+func sendDryRun(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
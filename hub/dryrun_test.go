@@ -0,0 +1,150 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDryRun(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/hub", nil)
+	dryRun, err := isDryRun(req)
+	assert.False(t, dryRun)
+	assert.Nil(t, err)
+
+	req = httptest.NewRequest("POST", "http://example.com/hub?dry-run=1", nil)
+	dryRun, err = isDryRun(req)
+	assert.True(t, dryRun)
+	assert.Nil(t, err)
+
+	req = httptest.NewRequest("POST", "http://example.com/hub", nil)
+	req.Header.Add("X-Mercure-Dry-Run", "true")
+	dryRun, err = isDryRun(req)
+	assert.True(t, dryRun)
+	assert.Nil(t, err)
+
+	req = httptest.NewRequest("POST", "http://example.com/hub?dry-run=yes", nil)
+	_, err = isDryRun(req)
+	assert.Error(t, err)
+}
+
+func TestPublishDryRun(t *testing.T) {
+	// Nothing consumes the updates channel: the test would block if an update was published
+	hub := createDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("target", "foo")
+	form.Add("target", "bar")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub?dry-run=1", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo", "bar"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Empty(t, resp.Header.Get("X-Mercure-Event-ID"))
+
+	var result dryRunResult
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.True(t, result.Granted)
+	assert.Empty(t, result.Reason)
+	assert.Equal(t, []string{"bar", "foo"}, result.Targets)
+	_, err := uuid.FromString(result.ID)
+	assert.Nil(t, err)
+
+	// Nothing has been stored
+	assert.Nil(t, hub.history.FindFor(&Subscriber{From: time.Unix(0, 0), AllTargets: true, RawTopics: []string{"http://example.com/books/1"}}, func(*Update) bool {
+		t.Fail()
+		return false
+	}))
+}
+
+func TestPublishDryRunDenied(t *testing.T) {
+	hub := createDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("target", "not-allowed")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+	req.Header.Add("X-Mercure-Dry-Run", "1")
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result dryRunResult
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.False(t, result.Granted)
+	assert.Equal(t, `Not allowed to publish to the target "not-allowed"`, result.Reason)
+	assert.Empty(t, result.Targets)
+	assert.Empty(t, result.ID)
+}
+
+func TestPublishDryRunRequiresAuthorization(t *testing.T) {
+	hub := createAnonymousDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub?dry-run=1", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "http://example.com/hub?dry-run=maybe", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w = httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPublishBatchDryRun(t *testing.T) {
+	hub := createDummy()
+
+	body := `[
+		{"id": "first", "topic": "http://example.com/books/1", "data": "Hello", "targets": ["foo"]},
+		{"topic": "http://example.com/books/2", "data": "World", "targets": ["not-allowed"]}
+	]`
+	req := httptest.NewRequest("POST", "http://example.com/hub?dry-run=1", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var results []dryRunResult
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&results))
+	assert.Equal(t, []dryRunResult{
+		{true, "", []string{"foo"}, "first"},
+		{false, `Not allowed to publish to the target "not-allowed"`, []string{}, ""},
+	}, results)
+}
@@ -0,0 +1,11 @@
+//go:build go1.21
+// +build go1.21
+
+package hub
+
+import "net/http"
+
+// enableFullDuplex allows to read the body of the request while writing the response, the HTTP/1 server doesn't allow it by default
+func enableFullDuplex(w http.ResponseWriter, r *http.Request) error {
+	return responseController(w, r).EnableFullDuplex()
+}
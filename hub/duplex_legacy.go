@@ -0,0 +1,17 @@
+//go:build !go1.21
+// +build !go1.21
+
+package hub
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errFullDuplexUnsupported is returned when trying to enable full duplex with a version of Go older than 1.21
+var errFullDuplexUnsupported = errors.New("reading the request while writing the response requires Go 1.21 with HTTP/1")
+
+// enableFullDuplex always fails, full duplex cannot be enabled with this version of Go, HTTP/2 connections are always full duplex
+func enableFullDuplex(http.ResponseWriter, *http.Request) error {
+	return errFullDuplexUnsupported
+}
@@ -22,18 +22,24 @@ type Event struct {
 }
 
 // String serializes the event in a "text/event-stream" representation
+// Every line of the data is sent in its own "data" field, whatever its line terminator (CRLF, LF or CR), as required by the SSE specification
+// The type and the ID must not contain line breaks (they are validated when published), they are dropped otherwise to prevent forging fields or events
 func (e *Event) String() string {
 	var b strings.Builder
 
-	if e.Type != "" {
+	if e.Type != "" && isValidField(e.Type) {
 		fmt.Fprintf(&b, "event: %s\n", e.Type)
 	}
 	if e.Retry != 0 {
 		fmt.Fprintf(&b, "retry: %d\n", e.Retry)
 	}
 
+	if isValidField(e.ID) {
+		fmt.Fprintf(&b, "id: %s\n", e.ID)
+	}
+
 	r := strings.NewReplacer("\r\n", "\ndata: ", "\r", "\ndata: ", "\n", "\ndata: ")
-	fmt.Fprintf(&b, "id: %s\ndata: %s\n\n", e.ID, r.Replace(e.Data))
+	fmt.Fprintf(&b, "data: %s\n\n", r.Replace(e.Data))
 
 	return b.String()
 }
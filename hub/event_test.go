@@ -1,6 +1,7 @@
 package hub
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -23,3 +24,64 @@ func TestEncodeNoRetry(t *testing.T) {
 
 	assert.Equal(t, "id: custom-id\ndata: data\n\n", e.String())
 }
+
+// parseEvents decodes a "text/event-stream" as a browser would, following the SSE specification
+func parseEvents(stream string) []Event {
+	var events []Event
+	var e Event
+	var data []string
+	for _, line := range strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(stream), "\n") {
+		if line == "" {
+			if data != nil {
+				e.Data = strings.Join(data, "\n")
+				events = append(events, e)
+			}
+			e, data = Event{}, nil
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		value := strings.TrimPrefix(parts[1], " ")
+		switch parts[0] {
+		case "event":
+			e.Type = value
+		case "id":
+			e.ID = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	return events
+}
+
+func TestEncodeLineBreaks(t *testing.T) {
+	testCases := []struct {
+		data, expected string
+	}{
+		{"with\nLF", "with\nLF"},
+		{"with\r\nCRLF", "with\nCRLF"},
+		{"with\rCR", "with\nCR"},
+		{"trailing\n", "trailing\n"},
+		{"forged\n\nid: forged\ndata: second event", "forged\n\nid: forged\ndata: second event"},
+		{"forged\r\rid: forged\rdata: second event", "forged\n\nid: forged\ndata: second event"},
+	}
+
+	for _, tc := range testCases {
+		e := &Event{tc.data, "custom-id", "type", 0}
+
+		events := parseEvents(e.String())
+		assert.Len(t, events, 1)
+		assert.Equal(t, Event{tc.expected, "custom-id", "type", 0}, events[0])
+	}
+}
+
+func TestEncodeInvalidFields(t *testing.T) {
+	e := &Event{"data", "custom-id\n\ndata: forged", "type\r\rdata: forged", 0}
+
+	assert.Equal(t, "data: data\n\n", e.String())
+	assert.Equal(t, []Event{{Data: "data"}}, parseEvents(e.String()))
+}
@@ -0,0 +1,356 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxFilterLength is the maximum length of the "filter" query parameter, it also bounds the nesting of the expressions
+const maxFilterLength = 1024
+
+// filter is an expression evaluated against the JSON payload of the updates, only the matching updates are sent to the subscriber
+// The language is minimal on purpose, to be cheap to evaluate and safe to accept from any subscriber:
+//
+//	expression := and { "||" and }
+//	and        := unary { "&&" unary }
+//	unary      := "!" unary | "(" expression ")" | comparison
+//	comparison := path ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) literal
+//	path       := field { "." ( field | index ) }
+//	literal    := JSON string | number | "true" | "false" | "null"
+//
+// The missing fields are null, the ordering operators only match numbers with numbers and strings with strings
+type filter interface {
+	match(document interface{}) bool
+}
+
+type filterOr struct{ left, right filter }
+
+func (f filterOr) match(document interface{}) bool {
+	return f.left.match(document) || f.right.match(document)
+}
+
+type filterAnd struct{ left, right filter }
+
+func (f filterAnd) match(document interface{}) bool {
+	return f.left.match(document) && f.right.match(document)
+}
+
+type filterNot struct{ operand filter }
+
+func (f filterNot) match(document interface{}) bool {
+	return !f.operand.match(document)
+}
+
+type filterComparison struct {
+	path     []string
+	operator string
+	value    interface{}
+}
+
+func (f filterComparison) match(document interface{}) bool {
+	value := lookupFilterPath(document, f.path)
+
+	switch f.operator {
+	case "==":
+		return value == f.value
+	case "!=":
+		return value != f.value
+	}
+
+	var c int
+	switch v := value.(type) {
+	case float64:
+		expected, ok := f.value.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case v < expected:
+			c = -1
+		case v > expected:
+			c = 1
+		}
+	case string:
+		expected, ok := f.value.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(v, expected)
+	default:
+		return false
+	}
+
+	switch f.operator {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// lookupFilterPath returns the value of the field of the document designated by the path, or nil if it doesn't exist
+func lookupFilterPath(document interface{}, path []string) interface{} {
+	for _, segment := range path {
+		switch d := document.(type) {
+		case map[string]interface{}:
+			document = d[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i >= len(d) {
+				return nil
+			}
+			document = d[i]
+		default:
+			return nil
+		}
+	}
+
+	return document
+}
+
+// matchFilter checks if the data of the update matches the filter, data that isn't a valid JSON document never matches
+func matchFilter(f filter, data string) bool {
+	var document interface{}
+	if err := json.Unmarshal([]byte(data), &document); err != nil {
+		return false
+	}
+
+	return f.match(document)
+}
+
+// filterDocument decodes the data of an update the first time a filter is evaluated against it, the document is then reused by the other filters
+// One is created for each dispatched update, it must only be evaluated against the data it has been created for
+type filterDocument struct {
+	data     string
+	decoded  bool
+	valid    bool
+	document interface{}
+}
+
+// match checks if the data matches the filter, like matchFilter
+func (d *filterDocument) match(f filter) bool {
+	if !d.decoded {
+		d.decoded = true
+		d.valid = json.Unmarshal([]byte(d.data), &d.document) == nil
+	}
+
+	return d.valid && f.match(d.document)
+}
+
+// parseFilter parses the expression of a "filter" query parameter, it returns nil if the expression is empty
+func parseFilter(expression string) (filter, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+	if len(expression) > maxFilterLength {
+		return nil, fmt.Errorf("the expression exceeds %d bytes", maxFilterLength)
+	}
+
+	p := &filterParser{input: expression}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpaces(); p.pos != len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	return f, nil
+}
+
+// filterParser is a recursive descent parser of the filter expressions
+type filterParser struct {
+	input string
+	pos   int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) skipSpaces() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) != -1 {
+		p.pos++
+	}
+}
+
+// consume skips the token if it is the next one
+func (p *filterParser) consume(token string) bool {
+	p.skipSpaces()
+	if !strings.HasPrefix(p.input[p.pos:], token) {
+		return false
+	}
+	p.pos += len(token)
+
+	return true
+}
+
+func (p *filterParser) parseOr() (filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.consume("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filter, error) {
+	// "!=" is only valid after a path, "!" can't be confused with it here
+	if p.consume("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return filterNot{operand}, nil
+	}
+
+	if p.consume("(") {
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+
+		return f, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filter, error) {
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	var operator string
+	// The two-character operators must be tried first
+	for _, o := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.consume(o) {
+			operator = o
+			break
+		}
+	}
+	if operator == "" {
+		return nil, p.errorf("missing comparison operator after %q", strings.Join(path, "."))
+	}
+
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	return filterComparison{path, operator, value}, nil
+}
+
+func (p *filterParser) parsePath() ([]string, error) {
+	p.skipSpaces()
+
+	var path []string
+	for {
+		start := p.pos
+		for p.pos < len(p.input) && isFilterFieldChar(p.input[p.pos]) {
+			p.pos++
+		}
+		segment := p.input[start:p.pos]
+		// Only the segments following a dot can be array indexes
+		if segment == "" || (len(path) == 0 && segment[0] >= '0' && segment[0] <= '9') {
+			return nil, p.errorf("field name expected")
+		}
+		path = append(path, segment)
+
+		if p.pos == len(p.input) || p.input[p.pos] != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+func isFilterFieldChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *filterParser) parseLiteral() (interface{}, error) {
+	p.skipSpaces()
+	if p.pos == len(p.input) {
+		return nil, p.errorf("value expected")
+	}
+
+	if p.input[p.pos] == '"' {
+		end := p.pos + 1
+		for ; end < len(p.input) && p.input[end] != '"'; end++ {
+			if p.input[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(p.input) {
+			return nil, p.errorf("unterminated string")
+		}
+
+		var s string
+		if err := json.Unmarshal([]byte(p.input[p.pos:end+1]), &s); err != nil {
+			return nil, p.errorf("invalid string")
+		}
+		p.pos = end + 1
+
+		return s, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && (isFilterFieldChar(p.input[p.pos]) || strings.IndexByte("+-.", p.input[p.pos]) != -1) {
+		p.pos++
+	}
+	token := p.input[start:p.pos]
+
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	// The numbers use the JSON syntax, and are decoded as float64 to be compared with the ones of the documents
+	var n float64
+	if err := json.Unmarshal([]byte(token), &n); err != nil || token == "" {
+		p.pos = start
+		return nil, p.errorf("invalid value %q", token)
+	}
+
+	return n, nil
+}
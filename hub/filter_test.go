@@ -0,0 +1,87 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterMatch(t *testing.T) {
+	data := `{"status": "active", "count": 3, "author": {"name": "Kévin", "admin": false}, "tags": ["go", "sse"], "deleted": null}`
+
+	for expression, expected := range map[string]bool{
+		`status == "active"`:                 true,
+		`status != "active"`:                 false,
+		`status=="inactive"`:                 false,
+		`count > 2`:                          true,
+		`count >= 3 && count <= 3`:           true,
+		`count < 3`:                          false,
+		`count < 1e1`:                        true,
+		`count == "3"`:                       false,
+		`count > "2"`:                        false,
+		`status > "abc"`:                     true,
+		`author.name == "Kévin"`:             true,
+		`author.admin == false`:              true,
+		`author.missing == null`:             true,
+		`deleted == null`:                    true,
+		`tags.1 == "sse"`:                    true,
+		`tags.2 == "sse"`:                    false,
+		`status.foo == null`:                 true,
+		`!(status == "active")`:              false,
+		`status == "inactive" || count == 3`: true,
+		`status == "inactive" || count == 3 && !author.admin == true`:  true,
+		`(status == "inactive" || count == 3) && author.admin == true`: false,
+	} {
+		f, err := parseFilter(expression)
+		assert.Nil(t, err, expression)
+		assert.Equal(t, expected, matchFilter(f, data), expression)
+	}
+
+	f, _ := parseFilter(`status == "active"`)
+	assert.False(t, matchFilter(f, "not JSON"))
+	assert.False(t, matchFilter(f, `["active"]`))
+}
+
+func TestFilterDocument(t *testing.T) {
+	active, _ := parseFilter(`status == "active"`)
+	inactive, _ := parseFilter(`status == "inactive"`)
+
+	d := &filterDocument{data: `{"status": "active"}`}
+	assert.True(t, d.match(active))
+	assert.Equal(t, map[string]interface{}{"status": "active"}, d.document)
+	assert.False(t, d.match(inactive))
+
+	// The decoded document is reused by the next filters
+	d.document = map[string]interface{}{"status": "inactive"}
+	assert.True(t, d.match(inactive))
+
+	d = &filterDocument{data: "not JSON"}
+	assert.False(t, d.match(active))
+	assert.False(t, d.match(active))
+}
+
+func TestParseFilter(t *testing.T) {
+	f, err := parseFilter(" ")
+	assert.Nil(t, f)
+	assert.Nil(t, err)
+
+	for expression, expected := range map[string]string{
+		`status`:                       `at position 6: missing comparison operator after "status"`,
+		`status = "active"`:            `at position 7: missing comparison operator after "status"`,
+		`status == active`:             `at position 10: invalid value "active"`,
+		`status == "active`:            `at position 10: unterminated string`,
+		`status == "\x"`:               `at position 10: invalid string`,
+		`0.status == "active"`:         `at position 1: field name expected`,
+		`(status == "active"`:          `at position 19: missing closing parenthesis`,
+		`status == "active" count > 1`: `at position 19: unexpected "count > 1"`,
+		`count > NaN`:                  `at position 8: invalid value "NaN"`,
+		`&& count > 1`:                 `at position 0: field name expected`,
+	} {
+		_, err := parseFilter(expression)
+		assert.EqualError(t, err, expected, expression)
+	}
+
+	_, err = parseFilter(strings.Repeat("(", maxFilterLength+1))
+	assert.EqualError(t, err, "the expression exceeds 1024 bytes")
+}
@@ -0,0 +1,50 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// defaultHealthCheckPath is the path of the health check endpoint when it isn't configured
+const defaultHealthCheckPath = "/healthz"
+
+// healthStatus is the JSON document returned by the health check endpoint
+// StartedAt and Uptime (in seconds) are only set once the hub has been started
+type healthStatus struct {
+	Status      string     `json:"status"`
+	Subscribers int        `json:"subscribers"`
+	Version     string     `json:"version"`
+	Commit      string     `json:"commit,omitempty"`
+	GoVersion   string     `json:"go_version"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	Uptime      *int64     `json:"uptime,omitempty"`
+}
+
+// HealthCheckHandler reports if the hub is able to serve requests, along with its build and its uptime, it doesn't require any authorization
+// A 503 status code is returned once the hub is shutting down or stopped, to let load balancers stop routing requests to it
+func (h *Hub) HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	h.subscribers.RLock()
+	subscribers := len(h.subscribers.m)
+	h.subscribers.RUnlock()
+
+	build := getBuildInfo()
+	status := healthStatus{"ok", subscribers, build.Version, build.Commit, build.GoVersion, nil, nil}
+
+	h.state.RLock()
+	if h.state.started {
+		startedAt := h.state.startedAt.UTC()
+		uptime := int64(time.Since(h.state.startedAt) / time.Second)
+		status.StartedAt, status.Uptime = &startedAt, &uptime
+	}
+	h.state.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if h.isShuttingDown() {
+		status.Status = "shutting_down"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,74 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck(t *testing.T) {
+	hub := createDummy()
+	hub.subscribers.m[make(chan *serializedUpdate)] = nil
+
+	w := httptest.NewRecorder()
+	hub.HealthCheckHandler(w, httptest.NewRequest("GET", "http://example.com/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf("{\"status\":\"ok\",\"subscribers\":1,\"version\":\"dev\",\"go_version\":%q}\n", runtime.Version()), w.Body.String())
+
+	hub.Stop()
+	w = httptest.NewRecorder()
+	hub.HealthCheckHandler(w, httptest.NewRequest("GET", "http://example.com/healthz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, fmt.Sprintf("{\"status\":\"shutting_down\",\"subscribers\":1,\"version\":\"dev\",\"go_version\":%q}\n", runtime.Version()), w.Body.String())
+}
+
+func TestHealthCheckUptime(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	hub.state.Lock()
+	hub.state.startedAt = hub.state.startedAt.Add(-90 * time.Second)
+	startedAt := hub.state.startedAt
+	hub.state.Unlock()
+
+	w := httptest.NewRecorder()
+	hub.HealthCheckHandler(w, httptest.NewRequest("GET", "http://example.com/healthz", nil))
+
+	var status map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, startedAt.UTC().Format(time.RFC3339Nano), status["started_at"])
+	assert.Equal(t, float64(90), status["uptime"])
+	assert.Equal(t, "dev", status["version"])
+	assert.Equal(t, runtime.Version(), status["go_version"])
+}
+
+func TestNewBuildInfo(t *testing.T) {
+	// The variables set at link time take precedence
+	assert.Equal(t, buildInfo{"v0.10.0", "4d5c6e1", "go1.21.0"}, newBuildInfo("v0.10.0", "4d5c6e1", "go1.21.0"))
+
+	// The test binary isn't built from a versioned module
+	assert.Equal(t, "dev", newBuildInfo("", "4d5c6e1", "go1.21.0").Version)
+}
+
+func TestHealthCheckRoute(t *testing.T) {
+	hub := createDummy()
+
+	w := httptest.NewRecorder()
+	hub.chainHandlers().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/healthz", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	hub.options.HealthCheckPath = "/status"
+	w = httptest.NewRecorder()
+	hub.chainHandlers().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -4,7 +4,15 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gofrs/uuid"
+	"github.com/yosida95/uritemplate"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -36,12 +44,29 @@ func (*noHistory) FindFor(subscriber *Subscriber, onItem func(*Update) bool) err
 
 const bucketName = "updates"
 
+// sequencesBucketName is the name of the bucket containing the last sequence number of every topic, when TopicSequence is enabled
+const sequencesBucketName = "sequences"
+
 // BoltHistory is an implementation of the History interface using the Bolt DB
 type boltHistory struct {
 	*bolt.DB
+	// ttl is the retention duration of the updates, they are kept forever if it is 0
+	ttl time.Duration
+}
+
+// boltEntry is the value stored in the bolt DB
+type boltEntry struct {
+	Update
+	// Time is the date the update has been added, it is zero for the updates stored by previous versions
+	Time time.Time
+}
+
+// expired checks if the entry must not be retrieved anymore, because of the retention of the history or of the TTL of the update
+func (b *boltHistory) expired(e *boltEntry, now time.Time) bool {
+	return (b.ttl != 0 && e.Time.Before(now.Add(-b.ttl))) || e.Update.expired(e.Time, now)
 }
 
-// Add puts the update to the local bolt DB
+// Add puts the update to the local bolt DB, and removes the expired ones
 func (b *boltHistory) Add(update *Update) error {
 	return b.DB.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
@@ -49,7 +74,12 @@ func (b *boltHistory) Add(update *Update) error {
 			return err
 		}
 
-		buf, err := json.Marshal(*update)
+		now := time.Now()
+		if err := b.prune(bucket, now); err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(boltEntry{*update, now})
 		if err != nil {
 			return err
 		}
@@ -63,22 +93,107 @@ func (b *boltHistory) Add(update *Update) error {
 
 		// The sequence value is prepended to the update id to create an ordered list
 		key := bytes.Join([][]byte{prefix, []byte(update.ID)}, []byte{})
-		return bucket.Put(key, buf)
+		if err := bucket.Put(key, buf); err != nil {
+			return err
+		}
+
+		return putSequences(tx, update.Sequences)
 	})
 }
 
+// putSequences stores the sequence numbers of an update as the last ones of its topics, they are kept when the update is pruned
+func putSequences(tx *bolt.Tx, sequences map[string]uint64) error {
+	if len(sequences) == 0 {
+		return nil
+	}
+
+	bucket, err := tx.CreateBucketIfNotExists([]byte(sequencesBucketName))
+	if err != nil {
+		return err
+	}
+
+	for topic, seq := range sequences {
+		// Bolt doesn't allow empty keys, such relative topics are numbered from 1 again after a restart
+		if topic == "" {
+			continue
+		}
+
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, seq)
+		if err := bucket.Put([]byte(topic), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lastSequence returns the last sequence number stored for the topic, or 0 if no update of this topic has been numbered
+func (b *boltHistory) lastSequence(topic string) (uint64, error) {
+	var seq uint64
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(sequencesBucketName)); bucket != nil {
+			if value := bucket.Get([]byte(topic)); len(value) == 8 {
+				seq = binary.BigEndian.Uint64(value)
+			}
+		}
+
+		return nil
+	})
+
+	return seq, err
+}
+
+// prune removes the expired updates, as keys are ordered by insertion, it stops at the first update that isn't expired
+// Updates expired because of their own TTL but stored after this one are kept until then, FindFor skips them
+func (b *boltHistory) prune(bucket *bolt.Bucket, now time.Time) error {
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		var e boltEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+
+		if !b.expired(&e, now) {
+			return nil
+		}
+
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // FindFor searches in the local bolt DB
 func (b *boltHistory) FindFor(subscriber *Subscriber, onItem func(*Update) bool) error {
-	b.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		if b == nil {
+	now := time.Now()
+
+	return b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
 			// No data
 			return nil
 		}
 
-		c := b.Cursor()
-		afterLastEventID := false
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+		c := bucket.Cursor()
+		k, v := c.First()
+		if subscriber.resumePosition != "" {
+			// The keys start with the sequence number, the first update added after the position is retrieved directly
+			seq, err := strconv.ParseUint(subscriber.resumePosition, 10, 64)
+			if err != nil {
+				return err
+			}
+
+			prefix := make([]byte, 8)
+			binary.BigEndian.PutUint64(prefix, seq+1)
+			k, v = c.Seek(prefix)
+		}
+
+		// Without Last-Event-ID, the updates are selected using the resume token or the date requested by the subscriber
+		afterLastEventID := subscriber.LastEventID == ""
+		for ; k != nil; k, v = c.Next() {
 			if !afterLastEventID {
 				if string(k[8:]) == subscriber.LastEventID {
 					afterLastEventID = true
@@ -87,18 +202,275 @@ func (b *boltHistory) FindFor(subscriber *Subscriber, onItem func(*Update) bool)
 				continue
 			}
 
-			var update Update
-			if err := json.Unmarshal(v, &update); err != nil {
+			var e boltEntry
+			if err := json.Unmarshal(v, &e); err != nil {
 				return err
 			}
 
-			if subscriber.CanReceive(&update) && !onItem(&update) {
+			// The updates stored by previous versions have no date, they are older than any requested one
+			if subscriber.LastEventID == "" && e.Time.Before(subscriber.From) {
+				continue
+			}
+
+			if !b.expired(&e, now) && subscriber.CanReceive(&e.Update) && !onItem(&e.Update) {
 				return nil
 			}
 		}
 
 		return nil
 	})
+}
+
+// head returns the sequence number of the latest update added to the history, it is never reused even if the update has been pruned
+func (b *boltHistory) head() (string, error) {
+	var seq uint64
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(bucketName)); bucket != nil {
+			seq = bucket.Sequence()
+		}
+
+		return nil
+	})
+
+	return strconv.FormatUint(seq, 10), err
+}
+
+// validPosition checks that the position is a sequence number
+func (*boltHistory) validPosition(position string) bool {
+	_, err := strconv.ParseUint(position, 10, 64)
+
+	return err == nil
+}
+
+// memoryHistory is an implementation of the History interface keeping the latest updates of every topic in memory
+type memoryHistory struct {
+	sync.RWMutex
+	// id identifies this history in the resume tokens, the sequence numbers of another instance or of a previous run are meaningless
+	id         string
+	size       int
+	topicSizes topicHistorySizes
+	seq        uint64
+	topics     map[string]*ringBuffer
+}
+
+// ringBuffer stores the latest updates of a topic, the oldest ones are overwritten when it is full
+// The entries are allocated as the updates are added, a quiet topic doesn't use the memory of a full buffer
+type ringBuffer struct {
+	entries []*historyEntry
+	size    int
+	next    int
+}
+
+// topicHistorySizes overrides the number of updates kept in memory for the topics matching its rules
+type topicHistorySizes []topicHistorySizeRule
+
+type topicHistorySizeRule struct {
+	rawTopics      []string
+	templateTopics []*uritemplate.Template
+	size           int
+}
+
+// newTopicHistorySizes compiles the rules, the keys of the map are topics or URI templates
+func newTopicHistorySizes(m map[string]int) topicHistorySizes {
+	rules := make(topicHistorySizes, 0, len(m))
+	for topic, size := range m {
+		rule := topicHistorySizeRule{size: size}
+		rule.rawTopics, rule.templateTopics = compileTopicSelector(topic)
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// forTopic returns the number of updates of the topic to keep, or defaultSize if no rule matches
+// When several rules match, the largest size is applied
+func (s topicHistorySizes) forTopic(topic string, defaultSize int) int {
+	size := -1
+	for _, rule := range s {
+		if rule.size > size && matchTopic(topic, rule.rawTopics, rule.templateTopics) {
+			size = rule.size
+		}
+	}
+
+	if size == -1 {
+		return defaultSize
+	}
+
+	return size
+}
+
+type historyEntry struct {
+	seq    uint64
+	time   time.Time
+	update *Update
+}
+
+// latestHistory is implemented by the histories able to retrieve efficiently the latest update of every topic, to send the initial state to new subscribers
+type latestHistory interface {
+	// findLatestFor retrieves the latest update the subscriber can receive for each topic it is subscribed to, in the order they have been added
+	findLatestFor(subscriber *Subscriber, onItem func(*Update) bool) error
+}
+
+// errLastEventIDNotFound is returned by FindFor when the Last-Event-ID isn't in the history anymore
+// All the available updates have then been retrieved, starting from the oldest one
+var errLastEventIDNotFound = errors.New("last event ID not found in history")
+
+// newMemoryHistory creates a history keeping size updates by topic, unless topicSizes contains another size for the topic
+func newMemoryHistory(size int, topicSizes topicHistorySizes) *memoryHistory {
+	return &memoryHistory{id: uuid.Must(uuid.NewV4()).String(), size: size, topicSizes: topicSizes, topics: make(map[string]*ringBuffer)}
+}
+
+// head returns the ID of the history and the sequence number of the latest update added to it
+func (m *memoryHistory) head() (string, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.id + ":" + strconv.FormatUint(m.seq, 10), nil
+}
+
+// validPosition checks that the position has been returned by head
+func (*memoryHistory) validPosition(position string) bool {
+	_, _, ok := parseMemoryPosition(position)
+
+	return ok
+}
+
+// parseMemoryPosition splits a position returned by head into the ID of the history and the sequence number
+func parseMemoryPosition(position string) (string, uint64, bool) {
+	i := strings.LastIndex(position, ":")
+	if i <= 0 {
+		return "", 0, false
+	}
+
+	seq, err := strconv.ParseUint(position[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return position[:i], seq, true
+}
+
+// Add stores the update in the buffer of each of its topics
+func (m *memoryHistory) Add(update *Update) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.seq++
+	e := &historyEntry{m.seq, time.Now(), update}
+	for _, topic := range update.Topics {
+		b, ok := m.topics[topic]
+		if !ok {
+			b = &ringBuffer{size: m.topicSizes.forTopic(topic, m.size)}
+			m.topics[topic] = b
+		}
+
+		if len(b.entries) < b.size {
+			b.entries = append(b.entries, e)
+			continue
+		}
+		if b.size == 0 {
+			continue
+		}
+
+		b.entries[b.next] = e
+		b.next = (b.next + 1) % b.size
+	}
+
+	return nil
+}
+
+// FindFor retrieves the updates of the topics the subscriber is subscribed to, in the order they have been added
+func (m *memoryHistory) FindFor(subscriber *Subscriber, onItem func(*Update) bool) error {
+	m.RLock()
+	seen := make(map[uint64]struct{})
+	var entries []*historyEntry
+	for topic, b := range m.topics {
+		if !subscriber.isSubscribed(&Update{Topics: []string{topic}}) {
+			continue
+		}
+
+		for _, e := range b.entries {
+			if _, ok := seen[e.seq]; !ok {
+				seen[e.seq] = struct{}{}
+				entries = append(entries, e)
+			}
+		}
+	}
+	m.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	var start int
+	var notFound error
+	switch {
+	case subscriber.LastEventID != "":
+		notFound = errLastEventIDNotFound
+		for i := 0; notFound != nil && i < len(entries); i++ {
+			if entries[i].update.ID == subscriber.LastEventID {
+				start, notFound = i+1, nil
+			}
+		}
+
+	case subscriber.resumePosition != "":
+		id, seq, _ := parseMemoryPosition(subscriber.resumePosition)
+		if id == m.id {
+			start = sort.Search(len(entries), func(i int) bool { return entries[i].seq > seq })
+		} else {
+			notFound = errResumePositionNotFound
+		}
+
+	default:
+		// Without Last-Event-ID nor resume token, the updates are selected using the date requested by the subscriber
+		start = sort.Search(len(entries), func(i int) bool { return !entries[i].time.Before(subscriber.From) })
+	}
+
+	// The time of the entries contains a monotonic clock reading, changes of the wall clock don't affect the TTL
+	now := time.Now()
+	for _, e := range entries[start:] {
+		if !e.update.expired(e.time, now) && subscriber.CanReceive(e.update) && !onItem(e.update) {
+			break
+		}
+	}
+
+	return notFound
+}
+
+// findLatestFor retrieves the newest entry of the buffer of each topic the subscriber is subscribed to, skipping the ones it can't receive and the expired ones
+func (m *memoryHistory) findLatestFor(subscriber *Subscriber, onItem func(*Update) bool) error {
+	now := time.Now()
+
+	m.RLock()
+	seen := make(map[uint64]struct{})
+	var entries []*historyEntry
+	for topic, b := range m.topics {
+		if !subscriber.isSubscribed(&Update{Topics: []string{topic}}) {
+			continue
+		}
+
+		// The newest entry is the last one appended, or the one preceding the next to be overwritten once the buffer is full
+		l := len(b.entries)
+		for i := 0; i < l; i++ {
+			e := b.entries[(b.next-1-i+2*l)%l]
+			if e.update.expired(e.time, now) || !subscriber.CanReceive(e.update) {
+				continue
+			}
+
+			if _, ok := seen[e.seq]; !ok {
+				seen[e.seq] = struct{}{}
+				entries = append(entries, e)
+			}
+			break
+		}
+	}
+	m.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	for _, e := range entries {
+		if !onItem(e.update) {
+			break
+		}
+	}
 
 	return nil
 }
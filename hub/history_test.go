@@ -2,7 +2,9 @@ package hub
 
 import (
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/yosida95/uritemplate"
@@ -14,12 +16,12 @@ func TestBoltHistory(t *testing.T) {
 	defer db.Close()
 	defer os.Remove("test.db")
 
-	h := &boltHistory{db}
+	h := &boltHistory{DB: db}
 	assert.Implements(t, (*History)(nil), h)
 
 	count := 0
 	assert.Nil(t, h.FindFor(
-		NewSubscriber(false, map[string]struct{}{}, []string{}, []*uritemplate.Template{}, ""),
+		NewSubscriber(false, map[string]struct{}{}, nil, []string{}, []*uritemplate.Template{}, ""),
 		func(*Update) bool {
 			count++
 			return true
@@ -54,7 +56,7 @@ func TestBoltHistory(t *testing.T) {
 	}))
 
 	h.FindFor(
-		NewSubscriber(false, map[string]struct{}{"foo": {}}, []string{"http://example.com/alt/3"}, []*uritemplate.Template{}, "first"),
+		NewSubscriber(false, map[string]struct{}{"foo": {}}, nil, []string{"http://example.com/alt/3"}, []*uritemplate.Template{}, "first"),
 		func(u *Update) bool {
 			count++
 
@@ -75,8 +77,352 @@ func TestBoltHistory(t *testing.T) {
 	assert.Equal(t, 2, count)
 }
 
+func TestBoltHistoryFrom(t *testing.T) {
+	db, _ := bolt.Open("test.db", 0600, nil)
+	defer db.Close()
+	defer os.Remove("test.db")
+
+	h := &boltHistory{DB: db}
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "second"}}))
+
+	find := func(lastEventID string, from time.Time) []string {
+		s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, lastEventID)
+		s.From = from
+
+		var ids []string
+		assert.Nil(t, h.FindFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+
+		return ids
+	}
+
+	assert.Equal(t, []string{"first", "second"}, find("", time.Now().Add(-time.Hour)))
+	assert.Empty(t, find("", time.Now().Add(time.Hour)))
+	// The Last-Event-ID takes precedence
+	assert.Equal(t, []string{"second"}, find("first", time.Now().Add(time.Hour)))
+}
+
+func TestBoltHistoryResume(t *testing.T) {
+	db, _ := bolt.Open("test.db", 0600, nil)
+	defer db.Close()
+	defer os.Remove("test.db")
+
+	h := &boltHistory{DB: db}
+	empty, err := h.head()
+	assert.Nil(t, err)
+	assert.Equal(t, "0", empty)
+
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}}))
+	position, err := h.head()
+	assert.Nil(t, err)
+	assert.Equal(t, "1", position)
+	assert.True(t, h.validPosition(position))
+	assert.False(t, h.validPosition("foo"))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "second"}}))
+
+	find := func(lastEventID, position string) []string {
+		s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, lastEventID)
+		s.resumePosition = position
+
+		var ids []string
+		assert.Nil(t, h.FindFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+
+		return ids
+	}
+
+	assert.Equal(t, []string{"first", "second"}, find("", empty))
+	assert.Equal(t, []string{"second"}, find("", position))
+	assert.Empty(t, find("", "2"))
+	// The Last-Event-ID takes precedence
+	assert.Empty(t, find("second", empty))
+}
+
+func TestBoltHistoryTTL(t *testing.T) {
+	db, _ := bolt.Open("test.db", 0600, nil)
+	defer db.Close()
+	defer os.Remove("test.db")
+
+	// Every write is synced to the disk, the retention leaves time for "third" to not be removed by the next write
+	h := &boltHistory{DB: db, ttl: 500 * time.Millisecond}
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "second"}}))
+	time.Sleep(600 * time.Millisecond)
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "third"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "fourth"}}))
+
+	// Expired updates have been removed
+	db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, 2, tx.Bucket([]byte(bucketName)).Stats().KeyN)
+		return nil
+	})
+
+	var ids []string
+	assert.Nil(t, h.FindFor(
+		NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "third"),
+		func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+	assert.Equal(t, []string{"fourth"}, ids)
+
+	// Updates that are expired but not removed yet aren't retrieved
+	time.Sleep(600 * time.Millisecond)
+	ids = nil
+	assert.Nil(t, h.FindFor(
+		NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "third"),
+		func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+	assert.Empty(t, ids)
+}
+
+func TestBoltHistoryUpdateTTL(t *testing.T) {
+	db, _ := bolt.Open("test.db", 0600, nil)
+	defer db.Close()
+	defer os.Remove("test.db")
+
+	// Every write is synced to the disk, the TTL leaves time for "first" to not be removed by the next writes
+	h := &boltHistory{DB: db}
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}, TTL: 500 * time.Millisecond}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "second"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "third"}, TTL: 500 * time.Millisecond}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "fourth"}, TTL: time.Hour}))
+	time.Sleep(600 * time.Millisecond)
+
+	var ids []string
+	assert.Nil(t, h.FindFor(
+		NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "first"),
+		func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+	assert.Equal(t, []string{"second", "fourth"}, ids)
+
+	// The expired updates at the beginning of the history are removed
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "fifth"}}))
+	db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, 4, tx.Bucket([]byte(bucketName)).Stats().KeyN)
+		return nil
+	})
+}
+
+func TestBoltHistorySequences(t *testing.T) {
+	db, _ := bolt.Open("test.db", 0600, nil)
+	defer os.Remove("test.db")
+
+	h := &boltHistory{DB: db}
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1", "http://example.com/2"}, Event: Event{ID: "first"}, Sequences: map[string]uint64{"http://example.com/1": 1, "http://example.com/2": 5}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "second"}, Sequences: map[string]uint64{"http://example.com/1": 2}}))
+	db.Close()
+
+	// The sequences survive a restart
+	db, _ = bolt.Open("test.db", 0600, nil)
+	defer db.Close()
+	h = &boltHistory{DB: db}
+
+	for topic, expected := range map[string]uint64{"http://example.com/1": 2, "http://example.com/2": 5, "http://example.com/3": 0} {
+		seq, err := h.lastSequence(topic)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, seq)
+	}
+
+	var sequences []uint64
+	assert.Nil(t, h.FindFor(
+		NewSubscriber(true, nil, nil, []string{"http://example.com/1"}, nil, "first"),
+		func(u *Update) bool {
+			sequences = append(sequences, u.Sequences["http://example.com/1"])
+			return true
+		}))
+	assert.Equal(t, []uint64{2}, sequences)
+}
+
 func TestNoHistory(t *testing.T) {
 	h := &noHistory{}
 	assert.Nil(t, h.Add(nil))
 	assert.Nil(t, h.FindFor(nil, func(*Update) bool { return true }))
 }
+
+func TestMemoryHistory(t *testing.T) {
+	h := newMemoryHistory(2, nil)
+	assert.Implements(t, (*History)(nil), h)
+
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/2"}, Event: Event{ID: "second"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1", "http://example.com/2"}, Event: Event{ID: "third"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{ID: "fourth"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "fifth"}}))
+
+	find := func(s *Subscriber) ([]string, error) {
+		var ids []string
+		err := h.FindFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		})
+
+		return ids, err
+	}
+
+	tpl, _ := uritemplate.New("http://example.com/{id}")
+	ids, err := find(NewSubscriber(false, map[string]struct{}{}, nil, []string{}, []*uritemplate.Template{tpl}, "second"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"third", "fifth"}, ids)
+
+	ids, err = find(NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "fourth"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fifth"}, ids)
+
+	// The first update has been evicted from the buffer of its topic
+	ids, err = find(NewSubscriber(false, map[string]struct{}{"foo": {}}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "first"))
+	assert.Equal(t, errLastEventIDNotFound, err)
+	assert.Equal(t, []string{"fourth", "fifth"}, ids)
+}
+
+func TestMemoryHistoryTopicSizes(t *testing.T) {
+	h := newMemoryHistory(3, newTopicHistorySizes(map[string]int{
+		"http://example.com/ticks/{id}":    100,
+		"http://example.com/ticks/hot":     1000,
+		"http://example.com/audit/{id}":    0,
+		"http://example.com/ticks/faulty{": 1,
+	}))
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/ticks/1", "http://example.com/ticks/hot"}, Event: Event{ID: strconv.Itoa(i)}}))
+		if i%100 == 0 {
+			assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/quiet", "http://example.com/audit/1"}}))
+		}
+	}
+
+	assert.Len(t, h.topics["http://example.com/ticks/1"].entries, 100)
+	// The largest size of the matching rules is applied
+	assert.Len(t, h.topics["http://example.com/ticks/hot"].entries, 1000)
+	assert.Len(t, h.topics["http://example.com/quiet"].entries, 3)
+	assert.Empty(t, h.topics["http://example.com/audit/1"].entries)
+
+	var ids []string
+	tpl, _ := uritemplate.New("http://example.com/ticks/{id}")
+	assert.Nil(t, h.FindFor(NewSubscriber(false, map[string]struct{}{}, nil, []string{}, []*uritemplate.Template{tpl}, "1990"), func(u *Update) bool {
+		ids = append(ids, u.ID)
+		return true
+	}))
+	assert.Equal(t, []string{"1991", "1992", "1993", "1994", "1995", "1996", "1997", "1998", "1999"}, ids)
+}
+
+func TestMemoryHistoryFindLatestFor(t *testing.T) {
+	h := newMemoryHistory(2, nil)
+	assert.Implements(t, (*latestHistory)(nil), h)
+
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1", "http://example.com/2"}, Event: Event{ID: "second"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "third"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{ID: "fourth"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/3"}, TTL: time.Nanosecond, Event: Event{ID: "fifth"}}))
+	time.Sleep(time.Millisecond)
+
+	find := func(s *Subscriber) []string {
+		var ids []string
+		assert.Nil(t, h.findLatestFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+
+		return ids
+	}
+
+	tpl, _ := uritemplate.New("http://example.com/{id}")
+	assert.Equal(t, []string{"second", "third"}, find(NewSubscriber(false, map[string]struct{}{}, nil, []string{}, []*uritemplate.Template{tpl}, "")))
+	assert.Equal(t, []string{"fourth"}, find(NewSubscriber(false, map[string]struct{}{"foo": {}}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "")))
+	// The update is sent once, even if it is the latest of several topics
+	assert.Equal(t, []string{"second"}, find(NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/2", "http://example.com/4"}, []*uritemplate.Template{}, "")))
+}
+
+func TestMemoryHistoryFrom(t *testing.T) {
+	h := newMemoryHistory(10, nil)
+	start := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"first", "second", "third"} {
+		assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: id}}))
+		h.topics["http://example.com/1"].entries[i].time = start.Add(time.Duration(i) * time.Minute)
+	}
+
+	find := func(lastEventID string, from time.Time) []string {
+		s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, lastEventID)
+		s.From = from
+
+		var ids []string
+		assert.Nil(t, h.FindFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+
+		return ids
+	}
+
+	assert.Equal(t, []string{"second", "third"}, find("", start.Add(time.Minute)))
+	assert.Equal(t, []string{"second", "third"}, find("", start.Add(30*time.Second)))
+	// Older than the history, all the available updates are retrieved
+	assert.Equal(t, []string{"first", "second", "third"}, find("", start.Add(-time.Hour)))
+	assert.Empty(t, find("", start.Add(time.Hour)))
+	// The Last-Event-ID takes precedence
+	assert.Equal(t, []string{"third"}, find("second", start.Add(-time.Hour)))
+}
+
+func TestMemoryHistoryResume(t *testing.T) {
+	h := newMemoryHistory(10, nil)
+	empty, _ := h.head()
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}}))
+	position, err := h.head()
+	assert.Nil(t, err)
+	assert.True(t, h.validPosition(position))
+	assert.False(t, h.validPosition("foo"))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/2"}, Event: Event{ID: "other"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "second"}}))
+
+	find := func(position string) ([]string, error) {
+		s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "")
+		s.resumePosition = position
+
+		var ids []string
+		err := h.FindFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		})
+
+		return ids, err
+	}
+
+	ids, err := find(empty)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second"}, ids)
+
+	ids, err = find(position)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"second"}, ids)
+
+	// The positions of another history, or of a previous run, can't be used
+	ids, err = find(newMemoryHistory(10, nil).id + ":1")
+	assert.Equal(t, errResumePositionNotFound, err)
+	assert.Equal(t, []string{"first", "second"}, ids)
+}
+
+func TestMemoryHistoryUpdateTTL(t *testing.T) {
+	h := newMemoryHistory(10, nil)
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "first"}}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "second"}, TTL: 10 * time.Millisecond}))
+	assert.Nil(t, h.Add(&Update{Topics: []string{"http://example.com/1"}, Event: Event{ID: "third"}, TTL: time.Hour}))
+	time.Sleep(20 * time.Millisecond)
+
+	var ids []string
+	assert.Nil(t, h.FindFor(
+		NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/1"}, []*uritemplate.Template{}, "first"),
+		func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+	assert.Equal(t, []string{"third"}, ids)
+}
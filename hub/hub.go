@@ -1,11 +1,17 @@
 package hub
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/yosida95/uritemplate"
 	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // uriTemplates caches uritemplate.Template to improve memory and CPU usage
@@ -21,97 +27,494 @@ type templateCache struct {
 	template *uritemplate.Template
 }
 
+// Policies applied when a subscriber doesn't consume its updates fast enough and its buffer is full
+const (
+	// SlowSubscriberDisconnect disconnects the subscriber, it will reconnect and retrieve the missed updates using Last-Event-ID
+	SlowSubscriberDisconnect = "disconnect"
+	// SlowSubscriberDropOldest discards the oldest update waiting in the buffer of the subscriber
+	SlowSubscriberDropOldest = "drop_oldest"
+)
+
+// slowSubscriberMarker is the last value sent to a subscriber disconnected because it was too slow
+var slowSubscriberMarker = &serializedUpdate{}
+
+// defaultSubscriberBufferSize is the number of updates waiting to be sent to a subscriber when no buffer size is configured
+const defaultSubscriberBufferSize = 100
+
+// defaultMaxClaimTargets is the maximum number of targets of each list of the Mercure claim when no limit is configured
+const defaultMaxClaimTargets = 1000
+
+// hubState tracks if the hub has been stopped, updates and subscribers aren't accepted anymore once it is
+type hubState struct {
+	sync.RWMutex
+	stopped bool
+	// started is true once the goroutine dispatching the updates has been started, at startedAt
+	started   bool
+	startedAt time.Time
+	// shutdown is true if the hub has been stopped by Shutdown, subscribers are then asked to reconnect later
+	shutdown bool
+}
+
+// errHubStopped is returned when an update is dispatched after the hub has been stopped
+var errHubStopped = errors.New("the hub has been stopped")
+
 // Hub stores channels with clients currently subscribed and allows to dispatch updates
 type Hub struct {
-	subscribers        subscribers
-	updates            chan *serializedUpdate
-	options            *Options
-	newSubscribers     chan chan *serializedUpdate
-	removedSubscribers chan chan *serializedUpdate
-	publisher          Publisher
-	history            History
-	server             *http.Server
-	uriTemplates       uriTemplates
+	subscribers           subscribers
+	updates               chan *serializedUpdate
+	options               *Options
+	newSubscribers        chan subscriberRegistration
+	removedSubscribers    chan chan *serializedUpdate
+	publisher             Publisher
+	history               History
+	server                *http.Server
+	uriTemplates          uriTemplates
+	revokedTokens         revokedTokens
+	subscriptions         subscriptions
+	publishAllowedOrigins *originPatterns
+	topicDefaultTargets   topicDefaultTargets
+	// jwtKeyFiles is nil if the JWT keys aren't read from files
+	jwtKeyFiles *jwtKeyFiles
+	// jwks is nil if no JWKS URL is configured
+	jwks *jwks
+	// webhooks is nil if the webhooks aren't enabled
+	webhooks *webhooks
+	// sequences is nil if TopicSequence isn't enabled, or if the publisher assigns the sequence numbers itself
+	sequences   *topicSequences
+	rateLimiter *rateLimiter
+	jitter      *jitter
+	state       hubState
+	publishes   sync.WaitGroup
+	metrics     *Metrics
+	tracer      trace.Tracer
+	logger      Logger
 }
 
 // Start starts the hub
+// A single goroutine stores and dispatches the updates: all subscribers receive them in the order they have been accepted
 func (h *Hub) Start() {
+	if l, ok := h.publisher.(listener); ok {
+		go l.listen(h)
+	}
+
+	h.state.Lock()
+	h.state.started = true
+	h.state.startedAt = time.Now()
+	h.state.Unlock()
+
+	if h.jwtKeyFiles != nil && h.options.JWTKeyReloadInterval > 0 {
+		go h.reloadJWTKeys(h.options.JWTKeyReloadInterval)
+	}
+
 	go func() {
 		for {
 			select {
 
-			case s := <-h.newSubscribers:
+			case registration := <-h.newSubscribers:
 				h.subscribers.Lock()
-				h.subscribers.m[s] = struct{}{}
+				h.subscribers.m[registration.updates] = registration.subscriber
 				h.subscribers.Unlock()
 
 			case s := <-h.removedSubscribers:
 				h.subscribers.Lock()
-				delete(h.subscribers.m, s)
+				// The subscriber may already have been disconnected because it was too slow
+				if _, ok := h.subscribers.m[s]; ok {
+					delete(h.subscribers.m, s)
+					close(s)
+				}
 				h.subscribers.Unlock()
-				close(s)
 
 			case serializedUpdate, ok := <-h.updates:
-				if ok {
-					if err := h.history.Add(serializedUpdate.Update); err != nil {
-						panic(err)
+				if !ok {
+					h.subscribers.Lock()
+					for s := range h.subscribers.m {
+						close(s)
 					}
+					h.subscribers.Unlock()
+
+					return
 				}
 
-				h.subscribers.RLock()
-				for s := range h.subscribers.m {
-					if ok {
-						s <- serializedUpdate
+				// The sequence numbers are assigned before storing the update, the replayed updates contain them too
+				if h.sequences != nil && !serializedUpdate.internal {
+					if err := h.sequences.assign(serializedUpdate.Update); err != nil {
+						h.logger.Error("Failed to assign the sequence numbers of the update", "event_id", serializedUpdate.ID, "topics", serializedUpdate.Topics, "error", err)
 					} else {
-						close(s)
+						serializedUpdate.event = h.serialize(serializedUpdate.Update)
 					}
 				}
-				h.subscribers.RUnlock()
 
-				if !ok {
-					return
+				// The update is still dispatched to the connected subscribers if it cannot be stored
+				if !serializedUpdate.internal {
+					span := h.startUpdateSpan(serializedUpdate, "mercure.history.add", updateAttributes(serializedUpdate.Update)...)
+					if err := h.history.Add(serializedUpdate.Update); err != nil {
+						span.RecordError(err)
+						h.logger.Error("Failed to add the update to the history", "event_id", serializedUpdate.ID, "topics", serializedUpdate.Topics, "error", err)
+					}
+					span.End()
+				}
+
+				span := h.startUpdateSpan(serializedUpdate, "mercure.dispatch", updateAttributes(serializedUpdate.Update)...)
+				h.subscribers.Lock()
+				span.SetAttributes(attribute.Int("mercure.subscribers", len(h.subscribers.m)))
+				var recipients int
+				aliases := topicAliases{update: serializedUpdate}
+				// The data is decoded at most once for all the subscribers using a filter
+				document := filterDocument{data: serializedUpdate.Data}
+				for s, subscriber := range h.subscribers.m {
+					// The updates generated by the hub are only sent to the streams of subscription events, whatever the targets and the topics of the other subscribers
+					if serializedUpdate.internal != (subscriber != nil && subscriber.subscriptionEvents) {
+						continue
+					}
+
+					// Channels registered without a subscriber receive all the other updates
+					u, lane := serializedUpdate, s
+					if subscriber != nil {
+						if !subscriber.canReceive(serializedUpdate.Update, &document) {
+							continue
+						}
+
+						u = aliases.forSubscriber(h, subscriber)
+						if u.Priority == PriorityHigh && subscriber.priorityUpdates != nil {
+							lane = subscriber.priorityUpdates
+						}
+					}
+
+					if h.dispatch(s, lane, u) {
+						recipients++
+					}
+				}
+				h.subscribers.Unlock()
+				span.SetAttributes(attribute.Int("mercure.recipients", recipients))
+				span.End()
+
+				h.metrics.updateRecipients.Observe(float64(recipients))
+				if serializedUpdate.recipients != nil {
+					serializedUpdate.recipients <- recipients
 				}
 			}
 		}
 	}()
 }
 
+// topicAliases serializes an update once for each alternate topic subscribers have subscribed to, and for each list of matching selectors, while it is dispatched
+type topicAliases struct {
+	update *serializedUpdate
+	m      map[string]*serializedUpdate
+}
+
+// forSubscriber returns the serialized update to send to a subscriber, its "topic" field is the topic the subscriber has subscribed to
+// When the selectors are sent, they are the topics and the URI templates of the subscriber matching the update
+func (a *topicAliases) forSubscriber(h *Hub, s *Subscriber) *serializedUpdate {
+	topic, _ := s.matchedTopic(a.update.Update)
+	key := topic
+	var selectors []string
+	if s.sendSelectors {
+		selectors = s.selectors(a.update.Update)
+		// The selectors are encoded unambiguously, a subscriber must never receive the selectors of another one
+		b, _ := json.Marshal(append([]string{topic}, selectors...))
+		key = string(b)
+	} else if topic == a.update.Topics[0] {
+		return a.update
+	}
+
+	if su, ok := a.m[key]; ok {
+		return su
+	}
+	if a.m == nil {
+		a.m = make(map[string]*serializedUpdate)
+	}
+
+	u := a.update.Update
+	if topic != u.Topics[0] {
+		u = u.withTopic(topic)
+	}
+	if s.sendSelectors {
+		u = u.withSelectors(selectors)
+	}
+	su := &serializedUpdate{u, h.serialize(u), nil}
+	a.m[key] = su
+
+	return su
+}
+
+// dispatch sends the update to a subscriber without blocking, the other subscribers must not wait for a slow one
+// The lane is the channel of the subscriber the update is queued in: the one of the normal updates, or the one of the high priority updates
+// When the lane is full, the slow subscriber policy is applied
+// It returns false if the update hasn't been sent, because it has been dropped or the subscriber has been disconnected
+// It must be called by the goroutine started by Start, with the subscribers lock held
+func (h *Hub) dispatch(s, lane chan *serializedUpdate, u *serializedUpdate) bool {
+	select {
+	case lane <- u:
+		return true
+	default:
+	}
+
+	if h.options.SlowSubscriberPolicy == SlowSubscriberDropOldest {
+		// Only this goroutine sends to the channel, there is room for the update once an event has been discarded
+		select {
+		case <-lane:
+			h.metrics.updatesDropped.Inc()
+		default:
+		}
+
+		select {
+		case lane <- u:
+			return true
+		default:
+			h.metrics.updatesDropped.Inc()
+		}
+
+		return false
+	}
+
+	// The marker telling the subscriber it has been disconnected is always sent after the normal updates,
+	// if needed, the oldest one is discarded to make room for it, it will be retrieved from the history when reconnecting
+	select {
+	case s <- slowSubscriberMarker:
+	default:
+		select {
+		case <-s:
+		default:
+		}
+		s <- slowSubscriberMarker
+	}
+	delete(h.subscribers.m, s)
+	close(s)
+	h.metrics.slowSubscribersDisconnected.Inc()
+
+	return false
+}
+
 // Stop stops disconnect all connected clients
+// Calling it several times is safe
 func (h *Hub) Stop() {
-	close(h.updates)
+	h.state.Lock()
+	defer h.state.Unlock()
+
+	if !h.state.stopped {
+		h.state.stopped = true
+		close(h.updates)
+	}
+}
+
+// Metrics returns the Prometheus metrics of the hub, to register them in a custom registry
+func (h *Hub) Metrics() *Metrics {
+	return h.metrics
+}
+
+// isStopped checks if the hub has been stopped
+func (h *Hub) isStopped() bool {
+	h.state.RLock()
+	defer h.state.RUnlock()
+
+	return h.state.stopped
+}
+
+// isShuttingDown checks if the hub is being shut down gracefully or has been stopped, new subscribers aren't accepted anymore then
+func (h *Hub) isShuttingDown() bool {
+	h.state.RLock()
+	defer h.state.RUnlock()
+
+	return h.state.shutdown || h.state.stopped
 }
 
 // DispatchUpdate dispatches an update to all subscribers
-func (h *Hub) DispatchUpdate(u *Update) {
-	h.updates <- newSerializedUpdate(u)
+// It returns an error if the hub has been stopped
+func (h *Hub) DispatchUpdate(u *Update) error {
+	h.state.RLock()
+	defer h.state.RUnlock()
+
+	if h.state.stopped {
+		return errHubStopped
+	}
+
+	su := &serializedUpdate{u, h.serialize(u), nil}
+	if h.state.started {
+		// The dispatching goroutine reports the number of subscribers the update has been sent to
+		recipients := make(chan int, 1)
+		su.recipients, u.recipients = recipients, recipients
+	}
+	h.updates <- su
+
+	return nil
+}
+
+// serialize encodes the update in the "text/event-stream" format, using the data format set in the options
+func (h *Hub) serialize(u *Update) string {
+	if h.options.DataFormat == DataFormatEnvelope {
+		return u.envelope().String()
+	}
+
+	return u.String()
+}
+
+// getJWTConfig returns the configuration used to validate publishers' or subscribers' JWTs
+func (h *Hub) getJWTConfig(publisher bool) *jwtConfig {
+	// When only one key is configured, it is used for both publishers and subscribers
+	key, fallbackKey := h.options.SubscriberJWTKey, h.options.PublisherJWTKey
+	if h.jwtKeyFiles != nil {
+		fallbackKey, key = h.jwtKeyFiles.get()
+	}
+	if publisher {
+		key, fallbackKey = fallbackKey, key
+	}
+	if len(key) == 0 {
+		key = fallbackKey
+	}
+
+	algorithm := h.options.JWTAlgorithm
+	if algorithm == "" {
+		algorithm = "HS256"
+	}
+
+	maxClaimTargets := h.options.MaxClaimTargets
+	if maxClaimTargets == 0 {
+		maxClaimTargets = defaultMaxClaimTargets
+	}
+
+	// The role's key is always tried first, then the extra keys used during a rotation
+	keys, keyIDs := h.options.JWTKeys, h.options.JWTKeyIDs
+	if len(key) != 0 || (len(keys) == 0 && h.jwks == nil) {
+		keys = append([][]byte{key}, keys...)
+		keyIDs = append([]string{""}, keyIDs...)
+	}
+
+	return &jwtConfig{
+		keys:            keys,
+		keyIDs:          keyIDs,
+		signingMethod:   jwt.GetSigningMethod(algorithm),
+		issuer:          h.options.JWTExpectedIssuer,
+		audience:        h.options.JWTExpectedAudience,
+		leeway:          h.options.JWTLeeway,
+		revokedTokens:   &h.revokedTokens,
+		claimsNamespace: h.options.JWTClaimsNamespace,
+		maxClaimTargets: maxClaimTargets,
+		jwks:            h.jwks,
+	}
+}
+
+// getAuthorizationConfig returns the configuration used to authorize publishers or subscribers
+func (h *Hub) getAuthorizationConfig(publisher bool) *authorizationConfig {
+	var publishAllowedOrigins *originPatterns
+	var publishAllowedFetchSites []string
+	var queryParameter string
+	if publisher {
+		publishAllowedOrigins = h.publishAllowedOrigins
+		publishAllowedFetchSites = h.options.PublishAllowedFetchSites
+	} else if h.options.AllowQueryAuthorization {
+		// Tokens passed in the query leak in logs, so it's never allowed for publishers
+		queryParameter = h.options.QueryAuthorizationParameter
+		if queryParameter == "" {
+			queryParameter = defaultQueryAuthorizationParameter
+		}
+	}
+
+	cookieName := h.options.CookieName
+	if cookieName == "" {
+		cookieName = defaultCookieName
+	}
+
+	return &authorizationConfig{
+		jwt:                      h.getJWTConfig(publisher),
+		publishAllowedOrigins:    publishAllowedOrigins,
+		publishAllowedFetchSites: publishAllowedFetchSites,
+		trustForwardedHeaders:    h.options.TrustForwardedHeaders,
+		cookieName:               cookieName,
+		cookieSecure:             h.options.CookieSecure,
+		queryParameter:           queryParameter,
+		tokenHeader:              h.options.TokenHeader,
+		tokenHeaderBare:          h.options.TokenHeaderBare,
+		anonymousPublish:         publisher && h.options.Debug && h.options.DebugAllowAnonymousPublish,
+	}
 }
 
 // NewHubFromEnv creates a hub using the configuration set in env vars
+// The returned DB is nil when the history is stored in memory or in Redis
 func NewHubFromEnv() (*Hub, *bolt.DB, error) {
 	options, err := NewOptionsFromEnv()
 	if err != nil {
 		return nil, nil, err
 	}
 
+	if options.Transport == TransportRedis {
+		transport, err := newRedisTransport(options.RedisURL, options.RedisStream, options.RedisStreamMaxLen)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return NewHub(transport, transport, options), nil, nil
+	}
+
+	if options.HistorySize > 0 {
+		return NewHub(&localPublisher{}, newMemoryHistory(options.HistorySize, newTopicHistorySizes(options.TopicHistorySizes)), options), nil, nil
+	}
+
 	db, err := bolt.Open(options.DBPath, 0600, nil)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return NewHub(&localPublisher{}, &boltHistory{DB: db}, options), db, nil
+	return NewHub(&localPublisher{}, &boltHistory{DB: db, ttl: options.HistoryTTL}, options), db, nil
 }
 
 // NewHub creates a hub
+// If no logger is set in the options, nothing is logged
 func NewHub(publisher Publisher, history History, options *Options) *Hub {
+	var logger Logger = nopLogger{}
+	if options.Logger != nil {
+		logger = options.Logger
+	}
+
+	publishAllowedOrigins := newOriginPatterns(options.PublishAllowedOrigins)
+	if publishAllowedOrigins.any {
+		logger.Warn("All origins are allowed to publish using the cookie-based authorization mechanism, this exposes the hub to CSRF attacks: do not use \"*\" in production")
+	}
+
+	for _, origin := range options.WebhookAllowedOrigins {
+		if origin == "*" {
+			logger.Warn("Webhooks can be registered with any callback, this allows subscribers to send requests to the internal services reachable from the hub: do not use \"*\" in production")
+		}
+	}
+
+	if options.Debug && options.DebugAllowAnonymousPublish {
+		logger.Warn("Anonymous publishers are allowed to publish to all topics and targets: never enable this option in production")
+	}
+
+	jwtKeyFiles := newJWTKeyFiles(options)
+	if jwtKeyFiles != nil {
+		jwtKeyFiles.reload(options.JWTAlgorithm, logger)
+	}
+
+	var sequences *topicSequences
+	if _, ok := publisher.(sequenceAssigner); options.TopicSequence && !ok {
+		sequences = newTopicSequences(history)
+	}
+
 	return &Hub{
-		subscribers{m: make(map[chan *serializedUpdate]struct{})},
+		subscribers{m: make(map[chan *serializedUpdate]*Subscriber)},
 		make(chan *serializedUpdate),
 		options,
-		make(chan (chan *serializedUpdate)),
+		make(chan subscriberRegistration),
 		make(chan (chan *serializedUpdate)),
 		publisher,
 		history,
 		nil,
 		uriTemplates{m: make(map[string]*templateCache)},
+		revokedTokens{m: make(map[string]struct{})},
+		subscriptions{m: make(map[string]*subscription)},
+		publishAllowedOrigins,
+		newTopicDefaultTargets(options.TopicDefaultTargets),
+		jwtKeyFiles,
+		newJWKS(options, logger),
+		newWebhooks(options.WebhookAllowedOrigins),
+		sequences,
+		newRateLimiter(options.PublishRateLimit, options.PublishRateBurst),
+		newJitter(),
+		hubState{},
+		sync.WaitGroup{},
+		NewMetrics(),
+		newTracer(options.TracerProvider),
+		logger,
 	}
 }
@@ -1,11 +1,17 @@
 package hub
 
 import (
+	"fmt"
+	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/yosida95/uritemplate"
+	bolt "go.etcd.io/bbolt"
 )
 
 const testAddr = "127.0.0.1:4242"
@@ -14,12 +20,350 @@ func TestNewHub(t *testing.T) {
 	h := createDummy()
 
 	assert.IsType(t, &Options{}, h.options)
-	assert.IsType(t, map[chan *serializedUpdate]struct{}{}, h.subscribers.m)
-	assert.IsType(t, make(chan (chan *serializedUpdate)), h.newSubscribers)
+	assert.IsType(t, map[chan *serializedUpdate]*Subscriber{}, h.subscribers.m)
+	assert.IsType(t, make(chan subscriberRegistration), h.newSubscribers)
 	assert.IsType(t, make(chan (chan *serializedUpdate)), h.removedSubscribers)
 	assert.IsType(t, make(chan *serializedUpdate), h.updates)
 }
 
+func TestDispatchSlowSubscriberDisconnect(t *testing.T) {
+	h := createDummy()
+	s := make(chan *serializedUpdate, 1)
+	h.subscribers.m[s] = nil
+
+	h.dispatch(s, s, newSerializedUpdate(&Update{Event: Event{ID: "first"}}))
+	h.dispatch(s, s, newSerializedUpdate(&Update{Event: Event{ID: "second"}}))
+
+	assert.Empty(t, h.subscribers.m)
+	assert.Equal(t, slowSubscriberMarker, <-s)
+	_, open := <-s
+	assert.False(t, open)
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.slowSubscribersDisconnected))
+}
+
+func TestDispatchSlowSubscriberDropOldest(t *testing.T) {
+	h := createDummy()
+	h.options.SlowSubscriberPolicy = SlowSubscriberDropOldest
+	s := make(chan *serializedUpdate, 1)
+	h.subscribers.m[s] = nil
+
+	second := newSerializedUpdate(&Update{Event: Event{ID: "second"}})
+	h.dispatch(s, s, newSerializedUpdate(&Update{Event: Event{ID: "first"}}))
+	h.dispatch(s, s, second)
+
+	assert.Len(t, h.subscribers.m, 1)
+	assert.Equal(t, second, <-s)
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.updatesDropped))
+}
+
+func TestDispatchSlowSubscriberPriorityLane(t *testing.T) {
+	h := createDummy()
+	s, lane := make(chan *serializedUpdate, 2), make(chan *serializedUpdate, 1)
+	h.subscribers.m[s] = nil
+
+	normal := newSerializedUpdate(&Update{Event: Event{ID: "normal"}})
+	h.dispatch(s, s, normal)
+	h.dispatch(s, lane, newSerializedUpdate(&Update{Event: Event{ID: "first"}, Priority: PriorityHigh}))
+	h.dispatch(s, lane, newSerializedUpdate(&Update{Event: Event{ID: "second"}, Priority: PriorityHigh}))
+
+	// The normal updates aren't discarded when there is room left for the marker
+	assert.Empty(t, h.subscribers.m)
+	assert.Equal(t, normal, <-s)
+	assert.Equal(t, slowSubscriberMarker, <-s)
+	_, open := <-s
+	assert.False(t, open)
+}
+
+func TestDispatchPriority(t *testing.T) {
+	h := createDummy()
+	h.Start()
+	defer h.Stop()
+
+	s := NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, "")
+	updates, ok := h.registerSubscriber(s)
+	assert.True(t, ok)
+
+	for _, u := range []*Update{
+		{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "first"}},
+		{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "second"}},
+		{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "urgent"}, Priority: PriorityHigh},
+		// The updates are dispatched one at a time, the previous ones are queued once this one has been accepted
+		{Topics: []string{"http://example.com/books/2"}, Event: Event{ID: "other"}},
+	} {
+		assert.Nil(t, h.DispatchUpdate(u))
+	}
+
+	// The high priority update jumps ahead, the order of the normal ones is preserved
+	for _, id := range []string{"urgent", "first", "second"} {
+		u, open := s.nextUpdate(updates)
+		assert.True(t, open)
+		assert.Equal(t, id, u.ID)
+	}
+}
+
+func TestDispatchTopicSequence(t *testing.T) {
+	defer os.Remove("test.db")
+
+	dispatch := func(topics ...string) *serializedUpdate {
+		db, _ := bolt.Open("test.db", 0600, nil)
+		defer db.Close()
+
+		h := NewHub(&localPublisher{}, &boltHistory{DB: db}, &Options{TopicSequence: true, DataFormat: DataFormatEnvelope})
+		h.Start()
+		defer h.Stop()
+
+		updates, _ := h.registerSubscriber(nil)
+		assert.Nil(t, h.DispatchUpdate(&Update{Topics: topics, Event: Event{ID: "id", Data: "{}"}}))
+
+		return <-updates
+	}
+
+	u := dispatch("http://example.com/books/1", "http://example.com/books/2")
+	assert.Equal(t, map[string]uint64{"http://example.com/books/1": 1, "http://example.com/books/2": 1}, u.Sequences)
+	assert.Equal(t, "topic: http://example.com/books/1\nid: id\ndata: {\"topic\":\"http://example.com/books/1\",\"id\":\"id\",\"seq\":1,\"data\":{}}\n\n", u.event)
+
+	// The numbering continues after a restart, every topic has its own counter
+	u = dispatch("http://example.com/books/1")
+	assert.Equal(t, map[string]uint64{"http://example.com/books/1": 2}, u.Sequences)
+	assert.Contains(t, u.event, `"seq":2`)
+
+	u = dispatch("http://example.com/books/2", "http://example.com/books/1")
+	assert.Equal(t, map[string]uint64{"http://example.com/books/1": 3, "http://example.com/books/2": 2}, u.Sequences)
+	assert.Contains(t, u.event, `"seq":2`)
+}
+
+func TestDispatchOrder(t *testing.T) {
+	const publishers, updatesPerPublisher = 10, 100
+
+	h := createDummy()
+	h.options.SubscriberBufferSize = publishers * updatesPerPublisher
+	h.Start()
+	defer h.Stop()
+
+	var subscribers []chan *serializedUpdate
+	for i := 0; i < 2; i++ {
+		s, ok := h.registerSubscriber(nil)
+		assert.True(t, ok)
+		subscribers = append(subscribers, s)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(publishers)
+	for p := 0; p < publishers; p++ {
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < updatesPerPublisher; i++ {
+				h.DispatchUpdate(&Update{
+					Topics: []string{"http://example.com/books/1"},
+					Event:  Event{Data: "foo", ID: fmt.Sprintf("%d-%d", p, i)},
+				})
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	var expected []string
+	for n, s := range subscribers {
+		received := make([]string, 0, publishers*updatesPerPublisher)
+		next := make([]int, publishers)
+		for i := 0; i < publishers*updatesPerPublisher; i++ {
+			u := <-s
+			received = append(received, u.ID)
+
+			// The updates of every publisher are received in the order they have been published
+			var p, seq int
+			fmt.Sscanf(u.ID, "%d-%d", &p, &seq)
+			assert.Equal(t, next[p], seq)
+			next[p]++
+		}
+
+		// All subscribers receive the updates in the same order
+		if n == 0 {
+			expected = received
+		} else {
+			assert.Equal(t, expected, received)
+		}
+	}
+}
+
+func TestDispatchRecipients(t *testing.T) {
+	h := createDummy()
+	h.Start()
+	defer h.Stop()
+
+	books, _ := h.registerSubscriber(NewSubscriber(false, map[string]struct{}{"foo": {}}, nil, []string{"http://example.com/books/1"}, nil, ""))
+	reviews, _ := h.registerSubscriber(NewSubscriber(true, nil, nil, []string{"http://example.com/reviews/1"}, nil, ""))
+
+	u := &Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "foo"}}
+	assert.Nil(t, h.DispatchUpdate(u))
+	assert.Equal(t, 1, <-u.recipients)
+	assert.Equal(t, "a", (<-books).ID)
+
+	// The subscriber isn't allowed to receive this private update
+	u = &Update{Topics: []string{"http://example.com/books/1"}, Targets: map[string]struct{}{"bar": {}}, Event: Event{ID: "b", Data: "foo"}}
+	assert.Nil(t, h.DispatchUpdate(u))
+	assert.Equal(t, 0, <-u.recipients)
+
+	u = &Update{Topics: []string{"http://example.com/reviews/1"}, Event: Event{ID: "c", Data: "foo"}}
+	assert.Nil(t, h.DispatchUpdate(u))
+	assert.Equal(t, 1, <-u.recipients)
+	assert.Equal(t, "c", (<-reviews).ID)
+	assert.Empty(t, books)
+
+	h.options.Metrics = true
+	w := httptest.NewRecorder()
+	h.chainHandlers().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/metrics", nil))
+	assert.Contains(t, w.Body.String(), `mercure_update_recipients_bucket{le="0"} 1`)
+	assert.Contains(t, w.Body.String(), "mercure_update_recipients_count 3")
+}
+
+func TestDispatchFilter(t *testing.T) {
+	h := createDummy()
+	h.Start()
+	defer h.Stop()
+
+	active, _ := parseFilter(`status == "active"`)
+	inactive, _ := parseFilter(`status == "inactive"`)
+	withoutEmail, _ := parseFilter(`email == null`)
+
+	var matching []chan *serializedUpdate
+	for i := 0; i < 100; i++ {
+		s := NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, "")
+		s.filter = inactive
+		if i%2 == 0 {
+			s.filter = active
+		}
+
+		updates, _ := h.registerSubscriber(s)
+		if i%2 == 0 {
+			matching = append(matching, updates)
+		}
+	}
+
+	// The document shared by the other subscribers isn't used when the redaction hook changed the data
+	redacted := NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, "")
+	redacted.filter, redacted.redactor = withoutEmail, redactEmails
+	redactedUpdates, _ := h.registerSubscriber(redacted)
+	unredacted := NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, "")
+	unredacted.filter = withoutEmail
+	h.registerSubscriber(unredacted)
+
+	u := &Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: `{"status":"active","email":"kevin@example.com"}`}}
+	assert.Nil(t, h.DispatchUpdate(u))
+	assert.Equal(t, 51, <-u.recipients)
+
+	for _, updates := range matching {
+		assert.Equal(t, "a", (<-updates).ID)
+	}
+	assert.Equal(t, "a", (<-redactedUpdates).ID)
+}
+
+func BenchmarkDispatchFilter(b *testing.B) {
+	h := createDummy()
+	h.Start()
+	defer h.Stop()
+
+	f, _ := parseFilter(`status == "active" && author.name == "Kévin"`)
+	var subscribers []chan *serializedUpdate
+	for i := 0; i < 1000; i++ {
+		s := NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, "")
+		s.filter = f
+		updates, _ := h.registerSubscriber(s)
+		subscribers = append(subscribers, updates)
+	}
+
+	data := `{"status":"active","author":{"name":"Kévin","email":"kevin@example.com"},"tags":["go","sse"]}`
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		u := &Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: data}}
+		h.DispatchUpdate(u)
+		<-u.recipients
+
+		for _, updates := range subscribers {
+			<-updates
+		}
+	}
+}
+
+func TestDispatchTopicAliases(t *testing.T) {
+	h := createDummy()
+	h.Start()
+	defer h.Stop()
+
+	canonical, _ := h.registerSubscriber(NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, ""))
+	alias, _ := h.registerSubscriber(NewSubscriber(false, map[string]struct{}{"foo": {}}, nil, []string{"http://example.com/old/books/1"}, nil, ""))
+	other, _ := h.registerSubscriber(NewSubscriber(false, map[string]struct{}{"bar": {}}, nil, []string{"http://example.com/old/books/1"}, nil, ""))
+
+	u := &Update{
+		Topics:  []string{"http://example.com/books/1", "http://example.com/old/books/1"},
+		Targets: map[string]struct{}{"foo": {}},
+		Event:   Event{ID: "a", Data: "foo"},
+	}
+	assert.Nil(t, h.DispatchUpdate(u))
+	assert.Equal(t, 2, <-u.recipients)
+
+	assert.Equal(t, "topic: http://example.com/books/1\nid: a\ndata: foo\n\n", (<-canonical).event)
+	// The event carries the topic the subscriber matched
+	aliased := <-alias
+	assert.Equal(t, "topic: http://example.com/old/books/1\nid: a\ndata: foo\n\n", aliased.event)
+	assert.Equal(t, []string{"http://example.com/old/books/1", "http://example.com/books/1"}, aliased.Topics)
+	// The targets still apply, whatever the topic used to address the update
+	assert.Empty(t, other)
+}
+
+func TestDispatchEnvelope(t *testing.T) {
+	h := createDummy()
+	h.options.DataFormat = DataFormatEnvelope
+	h.Start()
+	defer h.Stop()
+
+	updates, _ := h.registerSubscriber(nil)
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: `{"title": "Mercure"}`}})
+
+	u := <-updates
+	assert.Equal(t, `{"title": "Mercure"}`, u.Data)
+	assert.Equal(t, "topic: http://example.com/books/1\nid: a\ndata: {\"topic\":\"http://example.com/books/1\",\"id\":\"a\",\"data\":{\"title\":\"Mercure\"}}\n\n", u.event)
+}
+
+func TestDispatchSelectors(t *testing.T) {
+	h := createDummy()
+	h.options.DataFormat = DataFormatEnvelope
+	h.Start()
+	defer h.Stop()
+
+	subscribe := func(rawTopics []string, templates ...string) chan *serializedUpdate {
+		var templateTopics []*uritemplate.Template
+		for _, tpl := range templates {
+			templateTopics = append(templateTopics, uritemplate.MustNew(tpl))
+		}
+
+		s := NewSubscriber(true, nil, nil, rawTopics, templateTopics, "")
+		s.sendSelectors = true
+		updates, _ := h.registerSubscriber(s)
+
+		return updates
+	}
+
+	exact := subscribe([]string{"http://example.com/books/1"})
+	overlapping := subscribe([]string{"http://example.com/books/1"}, "http://example.com/books/{id}", "http://example.com/{collection}/{id}", "http://example.com/users/{id}")
+	sameTemplates := subscribe(nil, "http://example.com/books/{id}", "http://example.com/{collection}/{id}")
+	otherTemplates := subscribe(nil, "http://example.com/{collection}/{id}")
+
+	u := &Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "{}"}}
+	assert.Nil(t, h.DispatchUpdate(u))
+	assert.Equal(t, 4, <-u.recipients)
+
+	assert.Equal(t, "topic: http://example.com/books/1\nid: a\ndata: {\"topic\":\"http://example.com/books/1\",\"id\":\"a\",\"selectors\":[\"http://example.com/books/1\"],\"data\":{}}\n\n", (<-exact).event)
+	assert.Contains(t, (<-overlapping).event, `"selectors":["http://example.com/books/1","http://example.com/books/{id}","http://example.com/{collection}/{id}"]`)
+
+	// The subscribers matching the update with the same selectors share the serialized update
+	same := <-sameTemplates
+	assert.Equal(t, []string{"http://example.com/books/{id}", "http://example.com/{collection}/{id}"}, same.selectors)
+	assert.Contains(t, same.event, `"selectors":["http://example.com/books/{id}","http://example.com/{collection}/{id}"]`)
+	assert.Equal(t, []string{"http://example.com/{collection}/{id}"}, (<-otherTemplates).selectors)
+	assert.Nil(t, u.selectors)
+}
+
 func TestNewHubFromEnv(t *testing.T) {
 	os.Setenv("PUBLISHER_JWT_KEY", "foo")
 	os.Setenv("JWT_KEY", "bar")
@@ -33,6 +377,18 @@ func TestNewHubFromEnv(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNewHubFromEnvMemoryHistory(t *testing.T) {
+	os.Setenv("JWT_KEY", "bar")
+	os.Setenv("HISTORY_SIZE", "10")
+	defer os.Unsetenv("JWT_KEY")
+	defer os.Unsetenv("HISTORY_SIZE")
+
+	h, db, err := NewHubFromEnv()
+	assert.Nil(t, err)
+	assert.Nil(t, db)
+	assert.IsType(t, &memoryHistory{}, h.history)
+}
+
 func TestNewHubFromEnvError(t *testing.T) {
 	h, db, err := NewHubFromEnv()
 	assert.Nil(t, h)
@@ -40,6 +396,43 @@ func TestNewHubFromEnvError(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestGetJWTConfig(t *testing.T) {
+	h := createDummy()
+	assert.Equal(t, &jwtConfig{keys: [][]byte{[]byte("publisher")}, keyIDs: []string{""}, signingMethod: jwt.SigningMethodHS256, revokedTokens: &h.revokedTokens, maxClaimTargets: defaultMaxClaimTargets}, h.getJWTConfig(true))
+	assert.Equal(t, &jwtConfig{keys: [][]byte{[]byte("subscriber")}, keyIDs: []string{""}, signingMethod: jwt.SigningMethodHS256, revokedTokens: &h.revokedTokens, maxClaimTargets: defaultMaxClaimTargets}, h.getJWTConfig(false))
+
+	h.options.SubscriberJWTKey = nil
+	h.options.JWTAlgorithm = "HS512"
+	assert.Equal(t, &jwtConfig{keys: [][]byte{[]byte("publisher")}, keyIDs: []string{""}, signingMethod: jwt.SigningMethodHS512, revokedTokens: &h.revokedTokens, maxClaimTargets: defaultMaxClaimTargets}, h.getJWTConfig(false))
+
+	h.options.SubscriberJWTKey = []byte("subscriber")
+	h.options.PublisherJWTKey = nil
+	assert.Equal(t, &jwtConfig{keys: [][]byte{[]byte("subscriber")}, keyIDs: []string{""}, signingMethod: jwt.SigningMethodHS512, revokedTokens: &h.revokedTokens, maxClaimTargets: defaultMaxClaimTargets}, h.getJWTConfig(true))
+
+	h.options.JWTKeys = [][]byte{[]byte("old")}
+	h.options.JWTKeyIDs = []string{"v1"}
+	assert.Equal(t, &jwtConfig{keys: [][]byte{[]byte("subscriber"), []byte("old")}, keyIDs: []string{"", "v1"}, signingMethod: jwt.SigningMethodHS512, revokedTokens: &h.revokedTokens, maxClaimTargets: defaultMaxClaimTargets}, h.getJWTConfig(true))
+}
+
+func TestGetAuthorizationConfig(t *testing.T) {
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{PublishAllowedOrigins: []string{"http://example.com"}})
+
+	config := h.getAuthorizationConfig(true)
+	assert.True(t, config.publishAllowedOrigins.match("http://example.com"))
+	assert.Equal(t, defaultCookieName, config.cookieName)
+	assert.Empty(t, config.queryParameter)
+
+	h.options.CookieName = "custom"
+	h.options.AllowQueryAuthorization = true
+
+	config = h.getAuthorizationConfig(false)
+	assert.Nil(t, config.publishAllowedOrigins)
+	assert.Equal(t, "custom", config.cookieName)
+	assert.Equal(t, defaultQueryAuthorizationParameter, config.queryParameter)
+
+	assert.Empty(t, h.getAuthorizationConfig(true).queryParameter)
+}
+
 func createDummy() *Hub {
 	return NewHub(&localPublisher{}, &noHistory{}, &Options{PublisherJWTKey: []byte("publisher"), SubscriberJWTKey: []byte("subscriber")})
 }
@@ -80,6 +473,14 @@ func createDummyAuthorizedJWT(h *Hub, publisher bool, targets []string) string {
 	return tokenString
 }
 
+func createDummyDeniedJWT(h *Hub, denied []string) string {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims = &claims{mercureClaim{Publish: []string{"*"}, PublishDeny: denied}, jwt.StandardClaims{}}
+	tokenString, _ := token.SignedString(h.options.PublisherJWTKey)
+
+	return tokenString
+}
+
 func createDummyUnauthorizedJWT() string {
 	token := jwt.New(jwt.SigningMethodHS256)
 	tokenString, _ := token.SignedString([]byte("unauthorized"))
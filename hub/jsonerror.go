@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Codes of the JSON error responses of the publish endpoint, they are stable and can be relied upon by the publishers
+const (
+	errorCodeInvalidRequest       = "invalid_request"
+	errorCodeUnauthorized         = "unauthorized"
+	errorCodeForbidden            = "forbidden"
+	errorCodeMethodNotAllowed     = "method_not_allowed"
+	errorCodePayloadTooLarge      = "payload_too_large"
+	errorCodeUnsupportedMediaType = "unsupported_media_type"
+	errorCodeRateLimited          = "rate_limited"
+	errorCodeInternal             = "internal_error"
+	errorCodeUnavailable          = "unavailable"
+)
+
+// jsonError is the body of the error responses sent to the publishers accepting JSON
+type jsonError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorCode returns the code of the error responses with this status
+func errorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return errorCodeUnauthorized
+	case http.StatusForbidden:
+		return errorCodeForbidden
+	case http.StatusMethodNotAllowed:
+		return errorCodeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return errorCodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return errorCodeUnsupportedMediaType
+	case http.StatusTooManyRequests:
+		return errorCodeRateLimited
+	case http.StatusServiceUnavailable:
+		return errorCodeUnavailable
+	}
+
+	if status >= http.StatusInternalServerError {
+		return errorCodeInternal
+	}
+
+	return errorCodeInvalidRequest
+}
+
+// acceptsJSON checks if the "Accept" HTTP header contains "application/json"
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		if strings.Contains(accept, "application/json") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonErrorWriter converts the plain text error responses, as sent by http.Error, to JSON objects containing the message and its code
+// The successful responses are written as is
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	// status is set once an error status has been written, the body is then buffered until close is called
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	if status < http.StatusBadRequest {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.status = status
+}
+
+func (w *jsonErrorWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		return w.ResponseWriter.Write(b)
+	}
+
+	return w.body.Write(b)
+}
+
+// Flush flushes the successful responses, the publish streams are flushed after every result
+func (w *jsonErrorWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.status == 0 {
+		f.Flush()
+	}
+}
+
+// Unwrap allows the http.ResponseController to reach the underlying writer
+func (w *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close sends the buffered error response, if any
+func (w *jsonErrorWriter) close() {
+	if w.status == 0 {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(w.status)
+	json.NewEncoder(w.ResponseWriter).Encode(jsonError{strings.TrimSpace(w.body.String()), errorCode(w.status)})
+}
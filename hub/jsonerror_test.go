@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func publishAcceptingJSON(hub *Hub, form url.Values, jwt string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json, text/plain;q=0.9")
+	if jwt != "" {
+		req.Header.Add("Authorization", "Bearer "+jwt)
+	}
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	return w
+}
+
+func decodeJSONError(t *testing.T, w *httptest.ResponseRecorder) jsonError {
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var e jsonError
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &e))
+
+	return e
+}
+
+func TestPublishJSONErrorUnauthorized(t *testing.T) {
+	hub := createDummy()
+	form := url.Values{"topic": {"http://example.com/books/1"}, "data": {"foo"}}
+
+	w := publishAcceptingJSON(hub, form, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, jsonError{"Unauthorized", errorCodeUnauthorized}, decodeJSONError(t, w))
+
+	// Publishing to a target not allowed by the JWT
+	form.Set("target", "bar")
+	w = publishAcceptingJSON(hub, form, createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, errorCodeUnauthorized, decodeJSONError(t, w).Code)
+}
+
+func TestPublishJSONErrorInvalidRequest(t *testing.T) {
+	hub := createDummy()
+
+	w := publishAcceptingJSON(hub, url.Values{"data": {"foo"}}, createDummyAuthorizedJWT(hub, true, []string{}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, jsonError{"Missing \"topic\" parameter", errorCodeInvalidRequest}, decodeJSONError(t, w))
+}
+
+func TestPublishJSONErrorPayloadTooLarge(t *testing.T) {
+	hub := createDummy()
+	hub.options.MaxPublishBodySize = 10
+
+	w := publishAcceptingJSON(hub, url.Values{"topic": {"http://example.com/books/1"}, "data": {"foo"}}, createDummyAuthorizedJWT(hub, true, []string{}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, jsonError{"Request Entity Too Large", errorCodePayloadTooLarge}, decodeJSONError(t, w))
+}
+
+func TestPublishJSONErrorRateLimited(t *testing.T) {
+	hub := createDummy()
+	hub.rateLimiter = newRateLimiter(0.5, 1)
+	jwt := createDummyAuthorizedJWT(hub, true, []string{})
+
+	publishAcceptingJSON(hub, url.Values{}, jwt)
+	w := publishAcceptingJSON(hub, url.Values{}, jwt)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, jsonError{"Too Many Requests", errorCodeRateLimited}, decodeJSONError(t, w))
+}
+
+func TestPublishJSONErrorSuccess(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	form := url.Values{"id": {"first"}, "topic": {"http://example.com/books/1"}, "data": {"foo"}}
+	w := publishAcceptingJSON(hub, form, createDummyAuthorizedJWT(hub, true, []string{}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first", w.Body.String())
+}
+
+func TestPublishPlainTextError(t *testing.T) {
+	hub := createDummy()
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(url.Values{"data": {"foo"}}.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Missing \"topic\" parameter\n", w.Body.String())
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, errorCodeInvalidRequest, errorCode(http.StatusBadRequest))
+	assert.Equal(t, errorCodeForbidden, errorCode(http.StatusForbidden))
+	assert.Equal(t, errorCodeMethodNotAllowed, errorCode(http.StatusMethodNotAllowed))
+	assert.Equal(t, errorCodeUnsupportedMediaType, errorCode(http.StatusUnsupportedMediaType))
+	assert.Equal(t, errorCodeInternal, errorCode(http.StatusInternalServerError))
+	assert.Equal(t, errorCodeUnavailable, errorCode(http.StatusServiceUnavailable))
+}
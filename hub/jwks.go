@@ -0,0 +1,293 @@
+package hub
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultJWKSTimeout  = 5 * time.Second
+	defaultJWKSCacheTTL = 5 * time.Minute
+	// jwksRetryDelay is the minimum delay between two fetches after a failure, to not make every request wait for an unavailable endpoint
+	jwksRetryDelay = 5 * time.Second
+	// maxJWKSBytes is the maximum size of a JWKS document
+	maxJWKSBytes = 1 << 20
+)
+
+// ErrJWKSUnavailable is returned when the keys of the JWKS can't be fetched and none has been cached, the hub responds with a 503 status code
+var ErrJWKSUnavailable = errors.New("JWKS unavailable")
+
+// jwksUnavailableError explains why the keys of the JWKS are unavailable, it matches ErrJWKSUnavailable
+type jwksUnavailableError struct {
+	err error
+}
+
+func (e *jwksUnavailableError) Error() string {
+	return ErrJWKSUnavailable.Error() + ": " + e.err.Error()
+}
+
+// Is allows to match the error with ErrJWKSUnavailable using errors.Is
+func (e *jwksUnavailableError) Is(target error) bool {
+	return target == ErrJWKSUnavailable
+}
+
+// jwk contains the members of a JSON Web Key (RFC 7517) used to validate the signature of a JWT
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// N and E are the modulus and the exponent of RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// Crv, X and Y are the curve and the coordinates of EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// K is the value of symmetric keys
+	K string `json:"k"`
+}
+
+// jwks caches the keys of a remote JSON Web Key Set, in the format used by the other keys: HMAC secrets or PEM-encoded public keys
+// The keys are fetched again once the TTL has elapsed, the cached keys are kept when the endpoint is unavailable
+type jwks struct {
+	sync.Mutex
+	url           string
+	signingMethod jwt.SigningMethod
+	client        *http.Client
+	timeout       time.Duration
+	ttl           time.Duration
+	keys          [][]byte
+	keyIDs        []string
+	fetchedAt     time.Time
+	failedAt      time.Time
+	err           error
+	// fetching is closed when the fetch in progress, if any, is done
+	fetching chan struct{}
+	logger   Logger
+}
+
+// newJWKS returns nil if no JWKS URL is set
+func newJWKS(options *Options, logger Logger) *jwks {
+	if options.JWKSURL == "" {
+		return nil
+	}
+
+	algorithm := options.JWTAlgorithm
+	if algorithm == "" {
+		algorithm = "HS256"
+	}
+
+	timeout := options.JWKSTimeout
+	if timeout <= 0 {
+		timeout = defaultJWKSTimeout
+	}
+
+	ttl := options.JWKSCacheTTL
+	if ttl <= 0 {
+		ttl = defaultJWKSCacheTTL
+	}
+
+	return &jwks{url: options.JWKSURL, signingMethod: jwt.GetSigningMethod(algorithm), client: &http.Client{}, timeout: timeout, ttl: ttl, logger: logger}
+}
+
+// get returns the cached keys and their IDs, they are fetched first if the TTL has elapsed
+// It never blocks longer than the timeout: if the fetch isn't done by then, the cached keys are returned
+func (k *jwks) get() ([][]byte, []string, error) {
+	k.Lock()
+	if !k.fetchedAt.IsZero() && time.Since(k.fetchedAt) < k.ttl {
+		defer k.Unlock()
+		return k.keys, k.keyIDs, nil
+	}
+
+	if k.fetching == nil && (k.failedAt.IsZero() || time.Since(k.failedAt) >= jwksRetryDelay) {
+		k.fetching = make(chan struct{})
+		go k.refresh(k.fetching)
+	}
+	fetching := k.fetching
+	k.Unlock()
+
+	if fetching != nil {
+		timer := time.NewTimer(k.timeout)
+		select {
+		case <-fetching:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	if len(k.keys) == 0 {
+		err := k.err
+		if err == nil {
+			err = errors.New("the keys are being fetched")
+		}
+
+		return nil, nil, &jwksUnavailableError{err}
+	}
+
+	return k.keys, k.keyIDs, nil
+}
+
+// refresh fetches the keys and replaces the cached ones, which are kept if the fetch fails
+func (k *jwks) refresh(done chan struct{}) {
+	keys, keyIDs, err := k.fetch()
+
+	k.Lock()
+	if err == nil {
+		k.keys, k.keyIDs, k.fetchedAt, k.failedAt, k.err = keys, keyIDs, time.Now(), time.Time{}, nil
+	} else {
+		k.failedAt, k.err = time.Now(), err
+		k.logger.Error("Failed to fetch the JWKS, the cached keys are used", "url", k.url, "cached_keys", len(k.keys), "error", err)
+	}
+	k.fetching = nil
+	k.Unlock()
+
+	close(done)
+}
+
+// fetch downloads the JWKS and returns the keys usable with the signing method, the request is canceled once the timeout is reached
+func (k *jwks) fetch() ([][]byte, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", k.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("the JWKS endpoint responded with the status code %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&set); err != nil {
+		return nil, nil, fmt.Errorf("invalid JWKS: %s", err)
+	}
+
+	var keys [][]byte
+	var keyIDs []string
+	for _, j := range set.Keys {
+		key, err := j.key(k.signingMethod)
+		if err != nil {
+			k.logger.Info("JWK ignored", "url", k.url, "kid", j.Kid, "error", err)
+			continue
+		}
+
+		keys = append(keys, key)
+		keyIDs = append(keyIDs, j.Kid)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("the JWKS contains no key usable with the %s algorithm", k.signingMethod.Alg())
+	}
+
+	return keys, keyIDs, nil
+}
+
+// key converts the JWK to an HMAC secret or a PEM-encoded public key, it fails if the key can't be used with the signing method
+func (j jwk) key(signingMethod jwt.SigningMethod) ([]byte, error) {
+	if j.Use != "" && j.Use != "sig" {
+		return nil, fmt.Errorf("unexpected use %q", j.Use)
+	}
+	if j.Alg != "" && j.Alg != signingMethod.Alg() {
+		return nil, fmt.Errorf("unexpected algorithm %q", j.Alg)
+	}
+
+	var publicKey interface{}
+	switch signingMethod.(type) {
+	case *jwt.SigningMethodHMAC:
+		if j.Kty != "oct" {
+			return nil, fmt.Errorf("unexpected key type %q", j.Kty)
+		}
+
+		return decodeJWKMember("k", j.K)
+
+	case *jwt.SigningMethodRSA:
+		if j.Kty != "RSA" {
+			return nil, fmt.Errorf("unexpected key type %q", j.Kty)
+		}
+
+		n, err := decodeJWKMember("n", j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKMember("e", j.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 4 {
+			return nil, errors.New("invalid \"e\" member")
+		}
+
+		publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	case *jwt.SigningMethodECDSA:
+		if j.Kty != "EC" {
+			return nil, fmt.Errorf("unexpected key type %q", j.Kty)
+		}
+
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[j.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+
+		x, err := decodeJWKMember("x", j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKMember("y", j.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		publicKey = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	default:
+		return nil, fmt.Errorf("unsupported signing method %s", signingMethod.Alg())
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// decodeJWKMember decodes a base64url-encoded member of a JWK, it must not be empty
+func decodeJWKMember(name, value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid %q member", name)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,255 @@
+package hub
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeJWKMember(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func createRSAJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: encodeJWKMember(key.N.Bytes()), E: encodeJWKMember(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func createRS256JWT(kid string, key *rsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims{mercureClaim{Subscribe: []string{"foo"}}, jwt.StandardClaims{}})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, _ := token.SignedString(key)
+
+	return signed
+}
+
+// createJWKSServer serves the keys, or calls the handler first if it isn't nil, the response is sent if the handler returns true
+func createJWKSServer(handler func(w http.ResponseWriter, r *http.Request) bool, keys ...jwk) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if handler != nil && !handler(w, r) {
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+	}))
+
+	return server, &requests
+}
+
+func TestJWKS(t *testing.T) {
+	privateKey, _ := createDummyRSAKeys()
+	otherKey, _ := createDummyRSAKeys()
+	encryptionKey, _ := createDummyRSAKeys()
+	ecdsaKey, _ := createDummyECDSAKeys()
+
+	encryptionJWK := createRSAJWK("enc", &encryptionKey.PublicKey)
+	encryptionJWK.Use = "enc"
+	server, requests := createJWKSServer(nil,
+		jwk{Kty: "EC", Kid: "ec", Crv: "P-256", X: encodeJWKMember(ecdsaKey.X.Bytes()), Y: encodeJWKMember(ecdsaKey.Y.Bytes())},
+		encryptionJWK,
+		createRSAJWK("other", &otherKey.PublicKey),
+		createRSAJWK("key", &privateKey.PublicKey),
+	)
+	defer server.Close()
+
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{JWTAlgorithm: "RS256", JWKSURL: server.URL})
+
+	claims, err := validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo"}, claims.Mercure.Subscribe)
+
+	// The keys are tried in turn when the token has no "kid"
+	_, err = validateJWT(createRS256JWT("", privateKey), h.getJWTConfig(true))
+	assert.Nil(t, err)
+
+	// Only the keys usable with the algorithm are cached
+	_, keyIDs, _ := h.jwks.get()
+	assert.Equal(t, []string{"other", "key"}, keyIDs)
+
+	_, err = validateJWT(createRS256JWT("enc", encryptionKey), h.getJWTConfig(false))
+	assert.True(t, errors.Is(err, ErrTokenInvalidSignature))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	// The keys are fetched again once the TTL has elapsed
+	h.jwks.fetchedAt = time.Now().Add(-defaultJWKSCacheTTL)
+	_, err = validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+}
+
+func TestJWKSWithConfiguredKeys(t *testing.T) {
+	privateKey, publicKey := createDummyRSAKeys()
+	jwksKey, _ := createDummyRSAKeys()
+	server, _ := createJWKSServer(func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	})
+	defer server.Close()
+
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{JWTAlgorithm: "RS256", SubscriberJWTKey: publicKey, JWKSURL: server.URL})
+
+	// The configured keys are still used when the JWKS is unavailable
+	_, err := validateJWT(createRS256JWT("", privateKey), h.getJWTConfig(false))
+	assert.Nil(t, err)
+
+	_, err = validateJWT(createRS256JWT("", jwksKey), h.getJWTConfig(false))
+	assert.True(t, errors.Is(err, ErrTokenInvalidSignature))
+	assert.False(t, errors.Is(err, ErrJWKSUnavailable))
+}
+
+func TestJWKSSlowServer(t *testing.T) {
+	privateKey, _ := createDummyRSAKeys()
+	var slow int32
+	release := make(chan struct{})
+	server, _ := createJWKSServer(func(w http.ResponseWriter, r *http.Request) bool {
+		if atomic.LoadInt32(&slow) == 0 {
+			return true
+		}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+
+		return false
+	}, createRSAJWK("key", &privateKey.PublicKey))
+	defer server.Close()
+	defer close(release)
+
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{JWTAlgorithm: "RS256", JWKSURL: server.URL, JWKSTimeout: 50 * time.Millisecond})
+	atomic.StoreInt32(&slow, 1)
+
+	start := time.Now()
+	_, err := validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.True(t, errors.Is(err, ErrJWKSUnavailable))
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The cached keys are used when the endpoint is too slow
+	waitForJWKSFetch(h.jwks)
+	atomic.StoreInt32(&slow, 0)
+	h.jwks.failedAt = time.Time{}
+	_, err = validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.Nil(t, err)
+
+	atomic.StoreInt32(&slow, 1)
+	h.jwks.fetchedAt = time.Now().Add(-defaultJWKSCacheTTL)
+	start = time.Now()
+	_, err = validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestJWKSFailingServer(t *testing.T) {
+	privateKey, _ := createDummyRSAKeys()
+	var failing int32 = 1
+	server, requests := createJWKSServer(func(w http.ResponseWriter, r *http.Request) bool {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+
+		return true
+	}, createRSAJWK("key", &privateKey.PublicKey))
+	defer server.Close()
+
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{JWTAlgorithm: "RS256", JWKSURL: server.URL})
+
+	_, err := validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.EqualError(t, err, "JWKS unavailable: the JWKS endpoint responded with the status code 500")
+
+	// The endpoint isn't requested again right after a failure
+	_, err = validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.True(t, errors.Is(err, ErrJWKSUnavailable))
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	atomic.StoreInt32(&failing, 0)
+	h.jwks.failedAt = time.Now().Add(-jwksRetryDelay)
+	_, err = validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.Nil(t, err)
+
+	// The cached keys are kept when the endpoint fails
+	atomic.StoreInt32(&failing, 1)
+	h.jwks.fetchedAt = time.Now().Add(-defaultJWKSCacheTTL)
+	_, err = validateJWT(createRS256JWT("key", privateKey), h.getJWTConfig(false))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+}
+
+func TestJWKSUnavailableResponse(t *testing.T) {
+	privateKey, _ := createDummyRSAKeys()
+	server, _ := createJWKSServer(func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusBadGateway)
+		return false
+	})
+	defer server.Close()
+
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{JWTAlgorithm: "RS256", JWKSURL: server.URL})
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=foo", nil)
+	req.Header.Add("Authorization", "Bearer "+createRS256JWT("key", privateKey))
+	w := httptest.NewRecorder()
+	h.SubscribeHandler(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+
+	req = httptest.NewRequest("POST", "http://example.com/hub", nil)
+	req.Header.Add("Authorization", "Bearer "+createRS256JWT("key", privateKey))
+	w = httptest.NewRecorder()
+	h.PublishHandler(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestJWKKey(t *testing.T) {
+	secret, err := jwk{Kty: "oct", K: encodeJWKMember([]byte("secret"))}.key(jwt.SigningMethodHS256)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret"), secret)
+
+	ecdsaKey, publicKey := createDummyECDSAKeys()
+	key, err := jwk{Kty: "EC", Alg: "ES256", Crv: "P-256", X: encodeJWKMember(ecdsaKey.X.Bytes()), Y: encodeJWKMember(ecdsaKey.Y.Bytes())}.key(jwt.SigningMethodES256)
+	assert.Nil(t, err)
+	assert.Equal(t, publicKey, key)
+
+	_, err = jwk{Kty: "EC", Crv: "P-256", X: encodeJWKMember(ecdsaKey.X.Bytes()), Y: encodeJWKMember(ecdsaKey.X.Bytes())}.key(jwt.SigningMethodES256)
+	assert.Error(t, err)
+
+	_, err = jwk{Kty: "EC", Alg: "ES384", Crv: "P-256"}.key(jwt.SigningMethodES256)
+	assert.EqualError(t, err, `unexpected algorithm "ES384"`)
+
+	_, err = jwk{Kty: "RSA", N: "AQAB", E: "AQAB"}.key(jwt.SigningMethodES256)
+	assert.EqualError(t, err, `unexpected key type "RSA"`)
+
+	_, err = jwk{Kty: "oct"}.key(jwt.SigningMethodHS256)
+	assert.EqualError(t, err, `invalid "k" member`)
+}
+
+func TestNewJWKSDisabled(t *testing.T) {
+	assert.Nil(t, createDummy().jwks)
+}
+
+// waitForJWKSFetch waits until the fetch in progress, if any, is done
+func waitForJWKSFetch(k *jwks) {
+	for {
+		k.Lock()
+		fetching := k.fetching
+		k.Unlock()
+
+		if fetching == nil {
+			return
+		}
+		<-fetching
+	}
+}
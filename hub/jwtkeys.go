@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// jwtKeyFiles contains the keys of the publishers and the subscribers read from the files set in the options, they are reloaded to pick up a rotation without restarting the hub
+// A key is replaced as a whole: every validation uses either the old or the new key
+type jwtKeyFiles struct {
+	sync.RWMutex
+	publisherFile  string
+	subscriberFile string
+	publisher      []byte
+	subscriber     []byte
+}
+
+// newJWTKeyFiles returns nil if no key file is set, the keys set directly in the options are used until the files have been read
+func newJWTKeyFiles(options *Options) *jwtKeyFiles {
+	if options.PublisherJWTKeyFile == "" && options.SubscriberJWTKeyFile == "" {
+		return nil
+	}
+
+	return &jwtKeyFiles{sync.RWMutex{}, options.PublisherJWTKeyFile, options.SubscriberJWTKeyFile, options.PublisherJWTKey, options.SubscriberJWTKey}
+}
+
+// get returns the current keys of the publishers and the subscribers
+func (k *jwtKeyFiles) get() ([]byte, []byte) {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.publisher, k.subscriber
+}
+
+// reload reads the key files again, and replaces the keys which changed
+// A key which can't be read or isn't valid for the algorithm is logged and the current one is kept: a file being rotated must not lock everyone out
+func (k *jwtKeyFiles) reload(algorithm string, logger Logger) {
+	publisher, subscriber := k.get()
+	publisher = k.read("publisher", k.publisherFile, publisher, algorithm, logger)
+	subscriber = k.read("subscriber", k.subscriberFile, subscriber, algorithm, logger)
+
+	k.Lock()
+	k.publisher, k.subscriber = publisher, subscriber
+	k.Unlock()
+}
+
+// read returns the key contained in the file, or the current one if the file isn't set or can't be used
+func (k *jwtKeyFiles) read(role, file string, current []byte, algorithm string, logger Logger) []byte {
+	if file == "" {
+		return current
+	}
+
+	key, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = validateJWTKey(key, algorithm)
+	}
+	if err != nil {
+		logger.Error("Failed to reload the JWT key, the current one is kept", "role", role, "file", file, "error", err)
+		return current
+	}
+
+	if !bytes.Equal(key, current) {
+		logger.Info("JWT key reloaded", "role", role, "file", file)
+	}
+
+	return key
+}
+
+// validateJWTKey checks that the key can be used with the algorithm, the public keys of asymmetric algorithms must be PEM-encoded
+// An empty key is never valid, a token signed with an empty HMAC secret would be accepted
+func validateJWTKey(key []byte, algorithm string) error {
+	if len(key) == 0 {
+		return errors.New("the key is empty")
+	}
+
+	var err error
+	switch jwt.GetSigningMethod(algorithm).(type) {
+	case *jwt.SigningMethodRSA:
+		_, err = jwt.ParseRSAPublicKeyFromPEM(key)
+	case *jwt.SigningMethodECDSA:
+		_, err = jwt.ParseECPublicKeyFromPEM(key)
+	}
+
+	return err
+}
+
+// reloadJWTKeys reloads the key files periodically, until the hub is stopped
+func (h *Hub) reloadJWTKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if h.isStopped() {
+			return
+		}
+
+		h.jwtKeyFiles.reload(h.options.JWTAlgorithm, h.logger)
+	}
+}
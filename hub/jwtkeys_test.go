@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func createJWTSignedWith(key string) string {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims = &claims{mercureClaim{Publish: []string{"*"}}, jwt.StandardClaims{}}
+	tokenString, _ := token.SignedString([]byte(key))
+
+	return tokenString
+}
+
+func TestJWTKeyFilesReload(t *testing.T) {
+	ioutil.WriteFile("test.key", []byte("first"), 0600)
+	defer os.Remove("test.key")
+
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{PublisherJWTKey: []byte("initial"), PublisherJWTKeyFile: "test.key", SubscriberJWTKey: []byte("subscriber")})
+
+	// The file is read when the hub is created
+	_, err := validateJWT(createJWTSignedWith("first"), h.getJWTConfig(true))
+	assert.Nil(t, err)
+	_, err = validateJWT(createJWTSignedWith("initial"), h.getJWTConfig(true))
+	assert.Error(t, err)
+
+	ioutil.WriteFile("test.key", []byte("second"), 0600)
+	h.jwtKeyFiles.reload("", h.logger)
+	_, err = validateJWT(createJWTSignedWith("second"), h.getJWTConfig(true))
+	assert.Nil(t, err)
+	_, err = validateJWT(createJWTSignedWith("first"), h.getJWTConfig(true))
+	assert.Error(t, err)
+
+	// The subscriber key isn't read from a file
+	_, err = validateJWT(createJWTSignedWith("subscriber"), h.getJWTConfig(false))
+	assert.Nil(t, err)
+}
+
+func TestJWTKeyFilesKeepCurrentKey(t *testing.T) {
+	ioutil.WriteFile("test.key", []byte("first"), 0600)
+	defer os.Remove("test.key")
+
+	k := newJWTKeyFiles(&Options{SubscriberJWTKeyFile: "test.key"})
+	k.reload("", nopLogger{})
+
+	ioutil.WriteFile("test.key", []byte(""), 0600)
+	k.reload("", nopLogger{})
+	_, subscriber := k.get()
+	assert.Equal(t, []byte("first"), subscriber)
+
+	os.Remove("test.key")
+	k.reload("", nopLogger{})
+	_, subscriber = k.get()
+	assert.Equal(t, []byte("first"), subscriber)
+
+	// A public key must be PEM-encoded
+	ioutil.WriteFile("test.key", []byte("second"), 0600)
+	k.reload("RS256", nopLogger{})
+	_, subscriber = k.get()
+	assert.Equal(t, []byte("first"), subscriber)
+}
+
+func TestNewJWTKeyFilesDisabled(t *testing.T) {
+	assert.Nil(t, newJWTKeyFiles(&Options{PublisherJWTKey: []byte("publisher")}))
+	assert.Nil(t, createDummy().jwtKeyFiles)
+}
+
+func TestValidateJWTKey(t *testing.T) {
+	_, publicKey := createDummyRSAKeys()
+	assert.Nil(t, validateJWTKey(publicKey, "RS256"))
+	assert.Error(t, validateJWTKey(publicKey, "ES256"))
+	assert.Nil(t, validateJWTKey([]byte("secret"), "HS256"))
+	assert.EqualError(t, validateJWTKey(nil, "HS256"), "the key is empty")
+}
+
+func TestReloadJWTKeys(t *testing.T) {
+	ioutil.WriteFile("test.key", []byte("first"), 0600)
+	defer os.Remove("test.key")
+
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{PublisherJWTKeyFile: "test.key", JWTKeyReloadInterval: time.Millisecond})
+	h.Start()
+	defer h.Stop()
+
+	// Validations can happen during a reload, they use either key
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			validateJWT(createJWTSignedWith("first"), h.getJWTConfig(true))
+		}
+	}()
+
+	ioutil.WriteFile("test.key", []byte("second"), 0600)
+	wg.Wait()
+	for {
+		if _, err := validateJWT(createJWTSignedWith("second"), h.getJWTConfig(true)); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
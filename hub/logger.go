@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is the structured and leveled logger used by the hub
+// The keysAndValues arguments are alternating keys and values, for instance "remote_addr", "127.0.0.1"
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// nopLogger is the default logger, it discards all messages
+type nopLogger struct {
+}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// stdLogger adapts a logger of the standard library
+type stdLogger struct {
+	*log.Logger
+}
+
+// NewStdLogger creates a Logger writing to a logger of the standard library
+// Messages are written as: LEVEL message key=value key=value
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l}
+}
+
+func (l *stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.write("DEBUG", msg, keysAndValues)
+}
+
+func (l *stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.write("INFO", msg, keysAndValues)
+}
+
+func (l *stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.write("WARN", msg, keysAndValues)
+}
+
+func (l *stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.write("ERROR", msg, keysAndValues)
+}
+
+func (l *stdLogger) write(level, msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", level, msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var v interface{}
+		if i+1 < len(keysAndValues) {
+			v = keysAndValues[i+1]
+		}
+
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], v)
+	}
+
+	l.Output(3, b.String())
+}
+
+// logrusLogger writes to the standard logger of logrus, it is used by the hub created from env vars
+type logrusLogger struct {
+}
+
+func (logrusLogger) Debug(msg string, keysAndValues ...interface{}) {
+	logrus.WithFields(fields(keysAndValues)).Debug(msg)
+}
+
+func (logrusLogger) Info(msg string, keysAndValues ...interface{}) {
+	logrus.WithFields(fields(keysAndValues)).Info(msg)
+}
+
+func (logrusLogger) Warn(msg string, keysAndValues ...interface{}) {
+	logrus.WithFields(fields(keysAndValues)).Warn(msg)
+}
+
+func (logrusLogger) Error(msg string, keysAndValues ...interface{}) {
+	logrus.WithFields(fields(keysAndValues)).Error(msg)
+}
+
+// fields converts alternating keys and values to a map, a missing value is replaced by nil
+func fields(keysAndValues []interface{}) logrus.Fields {
+	f := make(logrus.Fields, len(keysAndValues)/2)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var v interface{}
+		if i+1 < len(keysAndValues) {
+			v = keysAndValues[i+1]
+		}
+
+		f[fmt.Sprint(keysAndValues[i])] = v
+	}
+
+	return f
+}
+
+// recoveryLogger adapts a Logger to the interface expected by handlers.RecoveryHandler
+type recoveryLogger struct {
+	Logger
+}
+
+func (l recoveryLogger) Println(v ...interface{}) {
+	l.Error(fmt.Sprint(v...))
+}
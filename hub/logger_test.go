@@ -0,0 +1,42 @@
+package hub
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := NewStdLogger(log.New(&b, "", 0))
+
+	l.Debug("debug")
+	l.Info("info", "remote_addr", "127.0.0.1", "topics", []string{"foo", "bar"})
+	l.Warn("warn", "odd")
+	l.Error("error", "error", nil)
+
+	assert.Equal(t, "DEBUG debug\nINFO info remote_addr=127.0.0.1 topics=[foo bar]\nWARN warn odd=<nil>\nERROR error error=<nil>\n", b.String())
+}
+
+func TestFields(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{"foo": "bar", "baz": nil}, map[string]interface{}(fields([]interface{}{"foo", "bar", "baz"})))
+}
+
+func TestNewHubDefaultLogger(t *testing.T) {
+	assert.Equal(t, nopLogger{}, createDummy().logger)
+
+	l := NewStdLogger(log.New(&bytes.Buffer{}, "", 0))
+	assert.Equal(t, l, NewHub(&localPublisher{}, &noHistory{}, &Options{Logger: l}).logger)
+}
+
+func TestUnauthorizedLogged(t *testing.T) {
+	var b bytes.Buffer
+	hub := createDummy()
+	hub.logger = NewStdLogger(log.New(&b, "", 0))
+
+	hub.PublishHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/hub", nil))
+	assert.Equal(t, "INFO Authorization failed remote_addr=192.0.2.1:1234 reason=missing_token error=<nil>\n", b.String())
+}
@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// probedMethods are the methods tried to find the ones supported by a route
+var probedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// allowMethods checks that the request uses one of the given methods
+// Otherwise, it replies to OPTIONS requests with the list of allowed methods, and rejects the other ones with a 405 status code
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	sendAllowedMethods(w, r, methods)
+
+	return false
+}
+
+// sendAllowedMethods sends the "Allow" HTTP header, along with a 204 status code for OPTIONS requests and a 405 status code for the other ones
+// Preflight requests are handled by the CORS middleware when it is enabled, and never reach this function
+func sendAllowedMethods(w http.ResponseWriter, r *http.Request, methods []string) {
+	w.Header().Set("Allow", strings.Join(append(methods, "OPTIONS"), ", "))
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// methodNotAllowedHandler replies to the requests matching a route of the router, but not its methods
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var methods []string
+		for _, method := range probedMethods {
+			probe := *r
+			probe.Method = method
+
+			var match mux.RouteMatch
+			if router.Match(&probe, &match) && match.MatchErr == nil {
+				methods = append(methods, method)
+			}
+		}
+
+		sendAllowedMethods(w, r, methods)
+	})
+}
@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlersMethodNotAllowed(t *testing.T) {
+	h := createAnonymousDummy()
+
+	w := httptest.NewRecorder()
+	h.SubscribeHandler(w, httptest.NewRequest("POST", "http://example.com/hub?topic=foo", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", w.Header().Get("Allow"))
+
+	w = httptest.NewRecorder()
+	h.PublishHandler(w, httptest.NewRequest("GET", "http://example.com/hub", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "POST, OPTIONS", w.Header().Get("Allow"))
+
+	w = httptest.NewRecorder()
+	h.PublishHandler(w, httptest.NewRequest("OPTIONS", "http://example.com/hub", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "POST, OPTIONS", w.Header().Get("Allow"))
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	h := createAnonymousDummy()
+	handler := h.chainHandlers()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "http://example.com/hub", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD, POST, OPTIONS", w.Header().Get("Allow"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/hub/revoked-tokens", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "POST, DELETE, OPTIONS", w.Header().Get("Allow"))
+
+	// Without CORS configuration, OPTIONS requests get the list of allowed methods
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("OPTIONS", "http://example.com/hub", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET, HEAD, POST, OPTIONS", w.Header().Get("Allow"))
+}
+
+func TestRouterPreflightRequest(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.CorsAllowedOrigins = []string{"https://app.example.com"}
+	handler := h.chainHandlers()
+
+	req := httptest.NewRequest("OPTIONS", "http://example.com/hub", nil)
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+}
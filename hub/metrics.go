@@ -0,0 +1,135 @@
+package hub
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics stores the Prometheus metrics of the hub
+// It implements prometheus.Collector, and can be registered in any registry
+type Metrics struct {
+	subscribers                 prometheus.Gauge
+	updatesPublished            prometheus.Counter
+	updatesDispatched           prometheus.Counter
+	publishDuration             prometheus.Histogram
+	authorizationFailures       *prometheus.CounterVec
+	updatesDropped              prometheus.Counter
+	slowSubscribersDisconnected prometheus.Counter
+	subscribersQuotaExceeded    *prometheus.CounterVec
+	subscribersWriteTimeout     prometheus.Counter
+	updateRecipients            prometheus.Histogram
+	subscribersIdleTimeout      prometheus.Counter
+	subscribersCompression      *prometheus.CounterVec
+	subscriberBytes             *prometheus.CounterVec
+}
+
+// NewMetrics creates the Prometheus metrics of a hub
+func NewMetrics() *Metrics {
+	return &Metrics{
+		prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "mercure",
+			Name:      "subscribers",
+			Help:      "The current number of connected subscribers",
+		}),
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "updates_published_total",
+			Help:      "The total number of published updates",
+		}),
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "updates_dispatched_total",
+			Help:      "The total number of updates sent to subscribers",
+		}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "mercure",
+			Name:      "publish_request_duration_seconds",
+			Help:      "The duration of publish requests",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "authorization_failures_total",
+			Help:      "The total number of rejected requests, by reason",
+		}, []string{"reason"}),
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "updates_dropped_total",
+			Help:      "The total number of updates discarded because subscribers were too slow",
+		}),
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "slow_subscribers_disconnected_total",
+			Help:      "The total number of subscribers disconnected because they were too slow",
+		}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "subscribers_quota_exceeded_total",
+			Help:      "The total number of subscribers disconnected because they exceeded a quota, by quota",
+		}, []string{"quota"}),
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "subscribers_write_timeout_total",
+			Help:      "The total number of subscribers disconnected because an event couldn't be written in time",
+		}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "mercure",
+			Name:      "update_recipients",
+			Help:      "The number of subscribers connected to this hub an update has been sent to",
+			Buckets:   []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000},
+		}),
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "subscribers_idle_timeout_total",
+			Help:      "The total number of subscribers disconnected because nothing could be written to them during the idle timeout",
+		}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "subscribers_compression_total",
+			Help:      "The total number of disconnected subscribers when the compression is enabled, by negotiated content encoding (none if the response wasn't compressed)",
+		}, []string{"encoding"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mercure",
+			Name:      "subscriber_bytes_total",
+			Help:      "The total number of bytes sent to the disconnected subscribers whose response was compressed, before (uncompressed) and after (compressed) compression",
+		}, []string{"stage"}),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.subscribers.Describe(ch)
+	m.updatesPublished.Describe(ch)
+	m.updatesDispatched.Describe(ch)
+	m.publishDuration.Describe(ch)
+	m.authorizationFailures.Describe(ch)
+	m.updatesDropped.Describe(ch)
+	m.slowSubscribersDisconnected.Describe(ch)
+	m.subscribersQuotaExceeded.Describe(ch)
+	m.subscribersWriteTimeout.Describe(ch)
+	m.updateRecipients.Describe(ch)
+	m.subscribersIdleTimeout.Describe(ch)
+	m.subscribersCompression.Describe(ch)
+	m.subscriberBytes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.subscribers.Collect(ch)
+	m.updatesPublished.Collect(ch)
+	m.updatesDispatched.Collect(ch)
+	m.publishDuration.Collect(ch)
+	m.authorizationFailures.Collect(ch)
+	m.updatesDropped.Collect(ch)
+	m.slowSubscribersDisconnected.Collect(ch)
+	m.subscribersQuotaExceeded.Collect(ch)
+	m.subscribersWriteTimeout.Collect(ch)
+	m.updateRecipients.Collect(ch)
+	m.subscribersIdleTimeout.Collect(ch)
+	m.subscribersCompression.Collect(ch)
+	m.subscriberBytes.Collect(ch)
+}
+
+// authorizationFailed counts a rejected request, see authorizationFailureReason
+func (m *Metrics) authorizationFailed(reason string) {
+	m.authorizationFailures.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsAuthorizationFailed(t *testing.T) {
+	m := NewMetrics()
+	m.authorizationFailed(authorizationFailureReason(nil))
+	m.authorizationFailed(authorizationFailureReason(errors.New("unknown")))
+	m.authorizationFailed(authorizationFailureReason(&authorizationError{"insufficient_scope", errors.New("scope")}))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.authorizationFailures.WithLabelValues("missing_token")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.authorizationFailures.WithLabelValues("invalid_token")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.authorizationFailures.WithLabelValues("insufficient_scope")))
+}
+
+func TestMetricsCustomRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, registry.Register(createDummy().Metrics()))
+}
+
+func TestMetricsPublish(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+	hub.PublishHandler(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("POST", "http://example.com/hub", nil)
+	hub.PublishHandler(httptest.NewRecorder(), req)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.updatesPublished))
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.authorizationFailures.WithLabelValues("missing_token")))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	hub := createDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	w := httptest.NewRecorder()
+	hub.chainHandlers().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	hub.options.Metrics = true
+	w = httptest.NewRecorder()
+	hub.chainHandlers().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "mercure_subscribers 0")
+	assert.Contains(t, w.Body.String(), "mercure_updates_published_total 0")
+	assert.Contains(t, w.Body.String(), "mercure_update_recipients_count 0")
+}
@@ -1,40 +1,139 @@
 package hub
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/yosida95/uritemplate"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Options stores the hub's options
 type Options struct {
-	Debug                 bool
-	DBPath                string
-	PublisherJWTKey       []byte
-	SubscriberJWTKey      []byte
-	AllowAnonymous        bool
-	CorsAllowedOrigins    []string
-	PublishAllowedOrigins []string
-	Addr                  string
-	AcmeHosts             []string
-	AcmeCertDir           string
-	CertFile              string
-	KeyFile               string
-	HeartbeatInterval     time.Duration
-	ReadTimeout           time.Duration
-	WriteTimeout          time.Duration
-	Compress              bool
-	Demo                  bool
+	Debug                       bool
+	DBPath                      string
+	HistorySize                 int
+	TopicHistorySizes           map[string]int
+	HistoryTTL                  time.Duration
+	MaxReplayUpdates            int
+	Transport                   string
+	RedisURL                    string
+	RedisStream                 string
+	RedisStreamMaxLen           int
+	PublisherJWTKey             []byte
+	SubscriberJWTKey            []byte
+	PublisherJWTKeyFile         string
+	SubscriberJWTKeyFile        string
+	JWTKeyReloadInterval        time.Duration
+	JWKSURL                     string
+	JWKSTimeout                 time.Duration
+	JWKSCacheTTL                time.Duration
+	JWTKeys                     [][]byte
+	JWTKeyIDs                   []string
+	JWTAlgorithm                string
+	JWTExpectedIssuer           string
+	JWTExpectedAudience         string
+	JWTLeeway                   time.Duration
+	JWTClaimsNamespace          string
+	MaxClaimTargets             int
+	AllowAnonymous              bool
+	DebugAllowAnonymousPublish  bool
+	RejectEmptyTargets          bool
+	RestrictedTopicsStatus      int
+	RestrictedTopicsBody        string
+	AllowRelativeTopics         bool
+	CorsAllowedOrigins          []string
+	CorsAllowedHeaders          []string
+	CorsMaxAge                  time.Duration
+	PublishAllowedOrigins       []string
+	PublishAllowedFetchSites    []string
+	TrustForwardedHeaders       bool
+	CookieName                  string
+	CookieSecure                bool
+	AllowQueryAuthorization     bool
+	QueryAuthorizationParameter string
+	TokenHeader                 string
+	TokenHeaderBare             bool
+	Addr                        string
+	AcmeHosts                   []string
+	AcmeCertDir                 string
+	AcmeHTTP01Addr              string
+	CertFile                    string
+	KeyFile                     string
+	HeartbeatInterval           time.Duration
+	FlushInterval               time.Duration
+	SendConnectionEvent         bool
+	SendResumeToken             bool
+	SendInitialState            bool
+	CatchUpMarker               string
+	DataFormat                  string
+	TopicSequence               bool
+	SendSelectors               bool
+	SubscriberBufferSize        int
+	SlowSubscriberPolicy        string
+	MaxSubscribers              int
+	OverloadRetry               time.Duration
+	MaxSubscriberMessages       int
+	MaxSubscriberBytes          int64
+	MaxSubscribeTopics          int
+	MaxTopicLength              int
+	DefaultRetry                uint64
+	ReadTimeout                 time.Duration
+	ReadHeaderTimeout           time.Duration
+	WriteTimeout                time.Duration
+	IdleTimeout                 time.Duration
+	EventWriteTimeout           time.Duration
+	SubscriberIdleTimeout       time.Duration
+	TCPKeepAlive                time.Duration
+	MaxPublishBodySize          int64
+	TopicDefaultTargets         map[string][]string
+	PublishRateLimit            float64
+	PublishRateBurst            int
+	PublishDrainTimeout         time.Duration
+	Compress                    bool
+	WebSocket                   bool
+	WebSocketMessageType        string
+	WebhookAllowedOrigins       []string
+	WebhookMaxRetries           int
+	WebhookRetryDelay           time.Duration
+	Demo                        bool
+	Metrics                     bool
+	HealthCheckPath             string
+	BasePath                    string
+	SubscribePath               string
+	PublishPath                 string
+	TracerProvider              trace.TracerProvider
+	AuthorizePublish            TopicAuthorizer
+	AuthorizeSubscribe          TopicAuthorizer
+	RedactForSubscriber         DataRedactor
+	Logger                      Logger
 }
 
-func getJWTKey(role string) string {
-	key := os.Getenv(fmt.Sprintf("%s_JWT_KEY", role))
-	if key == "" {
-		return os.Getenv("JWT_KEY")
+// getJWTKey retrieves the key of the role, or the key shared by publishers and subscribers
+// Keys can be set directly, or read from a file (useful for PEM-encoded public keys) using the variables suffixed by "_FILE", the path of the file is returned too
+func getJWTKey(role string) ([]byte, string, error) {
+	for _, name := range []string{role + "_JWT_KEY", "JWT_KEY"} {
+		if key := os.Getenv(name); key != "" {
+			return []byte(key), "", nil
+		}
+
+		if file := os.Getenv(name + "_FILE"); file != "" {
+			key, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, "", fmt.Errorf("%s_FILE: %s", name, err)
+			}
+
+			return key, file, nil
+		}
 	}
 
-	return key
+	return nil, "", nil
 }
 
 // NewOptionsFromEnv creates a new option instance from environment
@@ -45,47 +144,434 @@ func NewOptionsFromEnv() (*Options, error) {
 		dbPath = "updates.db"
 	}
 
+	healthCheckPath := os.Getenv("HEALTH_CHECK_PATH")
+	if healthCheckPath == "" {
+		healthCheckPath = defaultHealthCheckPath
+	}
+
+	basePath, err := parsePathFromEnvVar("BASE_PATH", defaultHubPath)
+	if err != nil {
+		return nil, err
+	}
+
+	subscribePath, err := parsePathFromEnvVar("SUBSCRIBE_PATH", basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	publishPath, err := parsePathFromEnvVar("PUBLISH_PATH", basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	acmeHTTP01Addr := os.Getenv("ACME_HTTP01_ADDR")
+	if acmeHTTP01Addr == "" {
+		acmeHTTP01Addr = ":http"
+	}
+
+	historySize, err := parseUintFromEnvVar("HISTORY_SIZE")
+	if err != nil {
+		return nil, err
+	}
+
+	topicHistorySizes, err := parseTopicHistorySizesFromEnvVar("TOPIC_HISTORY_SIZES")
+	if err != nil {
+		return nil, err
+	}
+	if topicHistorySizes != nil && historySize == 0 {
+		return nil, fmt.Errorf("TOPIC_HISTORY_SIZES: HISTORY_SIZE must be set")
+	}
+
+	if os.Getenv("SEND_INITIAL_STATE") == "1" && historySize == 0 {
+		return nil, fmt.Errorf("SEND_INITIAL_STATE: HISTORY_SIZE must be set")
+	}
+
+	historyTTL, err := parseDurationFromEnvVar("HISTORY_TTL")
+	if err != nil {
+		return nil, err
+	}
+
+	transport := os.Getenv("TRANSPORT")
+	switch transport {
+	case "":
+		transport = TransportLocal
+	case TransportLocal, TransportRedis:
+	default:
+		return nil, fmt.Errorf("TRANSPORT: unsupported transport \"%s\"", transport)
+	}
+
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisURL = "redis://localhost:6379"
+	}
+
+	redisStream := os.Getenv("REDIS_STREAM")
+	if redisStream == "" {
+		redisStream = "mercure"
+	}
+
+	redisStreamMaxLen, err := parseUintFromEnvVar("REDIS_STREAM_MAX_LEN")
+	if err != nil {
+		return nil, err
+	}
+
 	heartbeatInterval, err := parseDurationFromEnvVar("HEARTBEAT_INTERVAL")
 	if err != nil {
 		return nil, err
 	}
 
+	flushInterval, err := parseDurationFromEnvVar("FLUSH_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+
+	subscriberBufferSize, err := parseUintFromEnvVar("SUBSCRIBER_BUFFER_SIZE")
+	if err != nil {
+		return nil, err
+	}
+
+	maxReplayUpdates, err := parseUintFromEnvVar("MAX_REPLAY_UPDATES")
+	if err != nil {
+		return nil, err
+	}
+
+	webhookMaxRetries, err := parseUintFromEnvVar("WEBHOOK_MAX_RETRIES")
+	if err != nil {
+		return nil, err
+	}
+
+	webhookRetryDelay, err := parseDurationFromEnvVar("WEBHOOK_RETRY_DELAY")
+	if err != nil {
+		return nil, err
+	}
+
+	restrictedTopicsStatus, err := parseUintFromEnvVar("RESTRICTED_TOPICS_STATUS")
+	if err != nil {
+		return nil, err
+	}
+	if restrictedTopicsStatus != 0 && (restrictedTopicsStatus < 400 || restrictedTopicsStatus > 599) {
+		return nil, fmt.Errorf("RESTRICTED_TOPICS_STATUS: must be an error status code, got %d", restrictedTopicsStatus)
+	}
+
+	// Anonymous publishers are only allowed for local development, the debug mode must be explicitly enabled too
+	if os.Getenv("DEBUG_ALLOW_ANONYMOUS_PUBLISH") == "1" && os.Getenv("DEBUG") != "1" {
+		return nil, fmt.Errorf("DEBUG_ALLOW_ANONYMOUS_PUBLISH: can only be enabled in debug mode (DEBUG=1)")
+	}
+
+	dataFormat := os.Getenv("DATA_FORMAT")
+	switch dataFormat {
+	case "":
+		dataFormat = DataFormatRaw
+	case DataFormatRaw, DataFormatEnvelope:
+	default:
+		return nil, fmt.Errorf("DATA_FORMAT: unsupported format \"%s\"", dataFormat)
+	}
+
+	catchUpMarker := os.Getenv("CATCH_UP_MARKER")
+	switch catchUpMarker {
+	case "", CatchUpMarkerComment, CatchUpMarkerEvent:
+	default:
+		return nil, fmt.Errorf("CATCH_UP_MARKER: unsupported marker \"%s\"", catchUpMarker)
+	}
+
+	webSocketMessageType := os.Getenv("WEBSOCKET_MESSAGE_TYPE")
+	switch webSocketMessageType {
+	case "":
+		webSocketMessageType = WebSocketMessageText
+	case WebSocketMessageText, WebSocketMessageBinary, WebSocketMessageAuto:
+	default:
+		return nil, fmt.Errorf("WEBSOCKET_MESSAGE_TYPE: unsupported type \"%s\"", webSocketMessageType)
+	}
+
+	slowSubscriberPolicy := os.Getenv("SLOW_SUBSCRIBER_POLICY")
+	switch slowSubscriberPolicy {
+	case "":
+		slowSubscriberPolicy = SlowSubscriberDisconnect
+	case SlowSubscriberDisconnect, SlowSubscriberDropOldest:
+	default:
+		return nil, fmt.Errorf("SLOW_SUBSCRIBER_POLICY: unsupported policy \"%s\"", slowSubscriberPolicy)
+	}
+
+	maxSubscribers, err := parseUintFromEnvVar("MAX_SUBSCRIBERS")
+	if err != nil {
+		return nil, err
+	}
+
+	overloadRetry, err := parseDurationFromEnvVar("OVERLOAD_RETRY")
+	if err != nil {
+		return nil, err
+	}
+
+	maxSubscriberMessages, err := parseUintFromEnvVar("MAX_SUBSCRIBER_MESSAGES")
+	if err != nil {
+		return nil, err
+	}
+
+	maxSubscriberBytes, err := parseUintFromEnvVar("MAX_SUBSCRIBER_BYTES")
+	if err != nil {
+		return nil, err
+	}
+
+	defaultRetry, err := parseUintFromEnvVar("DEFAULT_RETRY")
+	if err != nil {
+		return nil, err
+	}
+
+	maxPublishBodySize, err := parseUintFromEnvVar("MAX_PUBLISH_BODY_SIZE")
+	if err != nil {
+		return nil, err
+	}
+
+	topicDefaultTargets, err := parseTopicDefaultTargetsFromEnvVar("TOPIC_DEFAULT_TARGETS")
+	if err != nil {
+		return nil, err
+	}
+
+	publishRateLimit, err := parseFloatFromEnvVar("PUBLISH_RATE_LIMIT")
+	if err != nil {
+		return nil, err
+	}
+
+	publishDrainTimeout, err := parseDurationFromEnvVar("PUBLISH_DRAIN_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	publishRateBurst, err := parseUintFromEnvVar("PUBLISH_RATE_BURST")
+	if err != nil {
+		return nil, err
+	}
+
 	readTimeout, err := parseDurationFromEnvVar("READ_TIMEOUT")
 	if err != nil {
 		return nil, err
 	}
 
+	readHeaderTimeout, err := parseDurationFromEnvVar("READ_HEADER_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
 	writeTimeout, err := parseDurationFromEnvVar("WRITE_TIMEOUT")
 	if err != nil {
 		return nil, err
 	}
 
+	idleTimeout, err := parseDurationFromEnvVar("IDLE_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	eventWriteTimeout, err := parseDurationFromEnvVar("EVENT_WRITE_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	subscriberIdleTimeout, err := parseDurationFromEnvVar("SUBSCRIBER_IDLE_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	// Without heartbeats, the connections of the subscribers of quiet topics would be closed too
+	if subscriberIdleTimeout != time.Duration(0) && (heartbeatInterval == time.Duration(0) || subscriberIdleTimeout <= heartbeatInterval) {
+		return nil, fmt.Errorf("SUBSCRIBER_IDLE_TIMEOUT: must be greater than HEARTBEAT_INTERVAL, which must be set")
+	}
+
+	tcpKeepAlive, err := parseDurationFromEnvVar("TCP_KEEPALIVE")
+	if err != nil {
+		return nil, err
+	}
+
+	corsMaxAge, err := parseDurationFromEnvVar("CORS_MAX_AGE")
+	if err != nil {
+		return nil, err
+	}
+
+	publishAllowedFetchSites := splitVar(os.Getenv("PUBLISH_ALLOWED_FETCH_SITES"))
+	for _, site := range publishAllowedFetchSites {
+		if site != fetchSiteSameOrigin && site != fetchSiteSameSite {
+			return nil, fmt.Errorf("PUBLISH_ALLOWED_FETCH_SITES: unsupported value %q, must be %q or %q", site, fetchSiteSameOrigin, fetchSiteSameSite)
+		}
+	}
+
+	cookieName := os.Getenv("COOKIE_NAME")
+	if cookieName == "" {
+		cookieName = defaultCookieName
+	}
+
+	queryAuthorizationParameter := os.Getenv("QUERY_AUTHORIZATION_PARAMETER")
+	if queryAuthorizationParameter == "" {
+		queryAuthorizationParameter = defaultQueryAuthorizationParameter
+	}
+
+	tokenHeader := os.Getenv("TOKEN_HEADER")
+	if tokenHeader == "" {
+		tokenHeader = defaultTokenHeader
+	}
+
+	jwtLeeway, err := parseDurationFromEnvVar("JWT_LEEWAY")
+	if err != nil {
+		return nil, err
+	}
+
+	maxClaimTargets, err := parseUintFromEnvVar("MAX_CLAIM_TARGETS")
+	if err != nil {
+		return nil, err
+	}
+
+	maxSubscribeTopics, err := parseUintFromEnvVar("MAX_SUBSCRIBE_TOPICS")
+	if err != nil {
+		return nil, err
+	}
+
+	maxTopicLength, err := parseUintFromEnvVar("MAX_TOPIC_LENGTH")
+	if err != nil {
+		return nil, err
+	}
+
+	jwtClaimsNamespace := os.Getenv("JWT_CLAIMS_NAMESPACE")
+	if jwtClaimsNamespace == "" {
+		jwtClaimsNamespace = defaultClaimsNamespace
+	}
+
+	jwtAlgorithm := os.Getenv("JWT_ALGORITHM")
+	if jwtAlgorithm == "" {
+		jwtAlgorithm = "HS256"
+	}
+
+	switch jwt.GetSigningMethod(jwtAlgorithm).(type) {
+	case *jwt.SigningMethodHMAC, *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+	default:
+		return nil, fmt.Errorf("JWT_ALGORITHM: unsupported signing method \"%s\"", jwtAlgorithm)
+	}
+
+	publisherJWTKey, publisherJWTKeyFile, err := getJWTKey("PUBLISHER")
+	if err != nil {
+		return nil, err
+	}
+
+	subscriberJWTKey, subscriberJWTKeyFile, err := getJWTKey("SUBSCRIBER")
+	if err != nil {
+		return nil, err
+	}
+
+	jwtKeyReloadInterval, err := parseDurationFromEnvVar("JWT_KEY_RELOAD_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+
+	jwksTimeout, err := parseDurationFromEnvVar("JWKS_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+
+	jwksCacheTTL, err := parseDurationFromEnvVar("JWKS_CACHE_TTL")
+	if err != nil {
+		return nil, err
+	}
+
 	options := &Options{
 		os.Getenv("DEBUG") == "1",
 		dbPath,
-		[]byte(getJWTKey("PUBLISHER")),
-		[]byte(getJWTKey("SUBSCRIBER")),
+		int(historySize),
+		topicHistorySizes,
+		historyTTL,
+		int(maxReplayUpdates),
+		transport,
+		redisURL,
+		redisStream,
+		int(redisStreamMaxLen),
+		publisherJWTKey,
+		subscriberJWTKey,
+		publisherJWTKeyFile,
+		subscriberJWTKeyFile,
+		jwtKeyReloadInterval,
+		os.Getenv("JWKS_URL"),
+		jwksTimeout,
+		jwksCacheTTL,
+		splitKeysVar(os.Getenv("JWT_KEYS")),
+		splitVar(os.Getenv("JWT_KEY_IDS")),
+		jwtAlgorithm,
+		os.Getenv("JWT_EXPECTED_ISSUER"),
+		os.Getenv("JWT_EXPECTED_AUDIENCE"),
+		jwtLeeway,
+		jwtClaimsNamespace,
+		int(maxClaimTargets),
 		os.Getenv("ALLOW_ANONYMOUS") == "1",
+		os.Getenv("DEBUG_ALLOW_ANONYMOUS_PUBLISH") == "1",
+		os.Getenv("REJECT_EMPTY_TARGETS") == "1",
+		int(restrictedTopicsStatus),
+		os.Getenv("RESTRICTED_TOPICS_BODY"),
+		os.Getenv("ALLOW_RELATIVE_TOPICS") == "1",
 		splitVar(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		splitVar(os.Getenv("CORS_ALLOWED_HEADERS")),
+		corsMaxAge,
 		splitVar(os.Getenv("PUBLISH_ALLOWED_ORIGINS")),
+		publishAllowedFetchSites,
+		os.Getenv("TRUST_FORWARDED_HEADERS") == "1",
+		cookieName,
+		os.Getenv("COOKIE_SECURE") == "1",
+		os.Getenv("ALLOW_QUERY_AUTHORIZATION") == "1",
+		queryAuthorizationParameter,
+		tokenHeader,
+		os.Getenv("TOKEN_HEADER_BARE") == "1",
 		os.Getenv("ADDR"),
 		splitVar(os.Getenv("ACME_HOSTS")),
 		os.Getenv("ACME_CERT_DIR"),
+		acmeHTTP01Addr,
 		os.Getenv("CERT_FILE"),
 		os.Getenv("KEY_FILE"),
 		heartbeatInterval,
+		flushInterval,
+		os.Getenv("SEND_CONNECTION_EVENT") == "1",
+		os.Getenv("SEND_RESUME_TOKEN") == "1",
+		os.Getenv("SEND_INITIAL_STATE") == "1",
+		catchUpMarker,
+		dataFormat,
+		os.Getenv("TOPIC_SEQUENCE") == "1",
+		os.Getenv("SEND_SELECTORS") == "1",
+		int(subscriberBufferSize),
+		slowSubscriberPolicy,
+		int(maxSubscribers),
+		overloadRetry,
+		int(maxSubscriberMessages),
+		int64(maxSubscriberBytes),
+		int(maxSubscribeTopics),
+		int(maxTopicLength),
+		defaultRetry,
 		readTimeout,
+		readHeaderTimeout,
 		writeTimeout,
+		idleTimeout,
+		eventWriteTimeout,
+		subscriberIdleTimeout,
+		tcpKeepAlive,
+		int64(maxPublishBodySize),
+		topicDefaultTargets,
+		publishRateLimit,
+		int(publishRateBurst),
+		publishDrainTimeout,
 		os.Getenv("COMPRESS") != "0",
+		os.Getenv("WEBSOCKET") == "1",
+		webSocketMessageType,
+		splitVar(os.Getenv("WEBHOOK_ALLOWED_ORIGINS")),
+		int(webhookMaxRetries),
+		webhookRetryDelay,
 		os.Getenv("DEMO") == "1" || os.Getenv("DEBUG") == "1",
+		os.Getenv("METRICS") == "1",
+		healthCheckPath,
+		basePath,
+		subscribePath,
+		publishPath,
+		nil,
+		nil,
+		nil,
+		nil,
+		logrusLogger{},
 	}
 
 	missingEnv := make([]string, 0, 4)
-	if len(options.PublisherJWTKey) == 0 {
-		missingEnv = append(missingEnv, "PUBLISHER_JWT_KEY")
-	}
-	if len(options.SubscriberJWTKey) == 0 {
-		missingEnv = append(missingEnv, "SUBSCRIBER_JWT_KEY")
+	if len(options.PublisherJWTKey) == 0 && len(options.SubscriberJWTKey) == 0 && options.JWKSURL == "" {
+		missingEnv = append(missingEnv, "PUBLISHER_JWT_KEY", "SUBSCRIBER_JWT_KEY")
 	}
 	if len(options.CertFile) != 0 && len(options.KeyFile) == 0 {
 		missingEnv = append(missingEnv, "KEY_FILE")
@@ -109,6 +595,30 @@ func splitVar(v string) []string {
 	return strings.Split(v, ",")
 }
 
+func splitKeysVar(v string) [][]byte {
+	values := splitVar(v)
+	keys := make([][]byte, len(values))
+	for i, value := range values {
+		keys[i] = []byte(value)
+	}
+
+	return keys
+}
+
+// parsePathFromEnvVar returns the path of an endpoint of the hub, or the default path if it isn't set
+func parsePathFromEnvVar(k, defaultPath string) (string, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return defaultPath, nil
+	}
+
+	if !strings.HasPrefix(v, "/") {
+		return "", fmt.Errorf("%s: the path must start with \"/\"", k)
+	}
+
+	return v, nil
+}
+
 func parseDurationFromEnvVar(k string) (time.Duration, error) {
 	v := os.Getenv(k)
 	if v == "" {
@@ -122,3 +632,89 @@ func parseDurationFromEnvVar(k string) (time.Duration, error) {
 
 	return time.Duration(0), fmt.Errorf("%s: %s", k, err)
 }
+
+func parseUintFromEnvVar(k string) (uint64, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.ParseUint(v, 10, 64)
+	if err == nil {
+		return i, nil
+	}
+
+	return 0, fmt.Errorf("%s: %s", k, err)
+}
+
+func parseFloatFromEnvVar(k string) (float64, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return 0, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil {
+		return f, nil
+	}
+
+	return 0, fmt.Errorf("%s: %s", k, err)
+}
+
+// parseTopicDefaultTargetsFromEnvVar decodes a JSON object associating topics (or URI templates) to their default targets
+func parseTopicDefaultTargetsFromEnvVar(k string) (map[string][]string, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return nil, nil
+	}
+
+	var m map[string][]string
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		return nil, fmt.Errorf("%s: %s", k, err)
+	}
+
+	for topic := range m {
+		if err := validateTopicTemplate(k, topic); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// parseTopicHistorySizesFromEnvVar decodes a JSON object associating topics (or URI templates) to the number of updates to keep in the history
+func parseTopicHistorySizesFromEnvVar(k string) (map[string]int, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return nil, nil
+	}
+
+	var m map[string]int
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		return nil, fmt.Errorf("%s: %s", k, err)
+	}
+
+	for topic, size := range m {
+		if size < 0 {
+			return nil, fmt.Errorf("%s: the size of %q can't be negative", k, topic)
+		}
+		if err := validateTopicTemplate(k, topic); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// validateTopicTemplate checks that a topic containing a brace is a valid URI template
+func validateTopicTemplate(k, topic string) error {
+	if !strings.Contains(topic, "{") {
+		return nil
+	}
+
+	if _, err := uritemplate.New(topic); err != nil {
+		return fmt.Errorf("%s: invalid URI template %q: %s", k, topic, err)
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package hub
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -10,23 +11,96 @@ import (
 
 func TestNewOptionsFormNew(t *testing.T) {
 	testEnv := map[string]string{
-		"ACME_CERT_DIR":           "/tmp",
-		"ACME_HOSTS":              "example.com,example.org",
-		"ADDR":                    "127.0.0.1:8080",
-		"ALLOW_ANONYMOUS":         "1",
-		"CERT_FILE":               "foo",
-		"COMPRESS":                "0",
-		"CORS_ALLOWED_ORIGINS":    "*",
-		"DB_PATH":                 "test.db",
-		"DEBUG":                   "1",
-		"DEMO":                    "1",
-		"KEY_FILE":                "bar",
-		"PUBLISHER_JWT_KEY":       "foo",
-		"PUBLISH_ALLOWED_ORIGINS": "http://127.0.0.1:8080",
-		"SUBSCRIBER_JWT_KEY":      "bar",
-		"HEARTBEAT_INTERVAL":      "30s",
-		"READ_TIMEOUT":            "1m",
-		"WRITE_TIMEOUT":           "40s",
+		"ACME_CERT_DIR":                 "/tmp",
+		"ACME_HOSTS":                    "example.com,example.org",
+		"ADDR":                          "127.0.0.1:8080",
+		"ALLOW_ANONYMOUS":               "1",
+		"ALLOW_QUERY_AUTHORIZATION":     "1",
+		"QUERY_AUTHORIZATION_PARAMETER": "token",
+		"CERT_FILE":                     "foo",
+		"COMPRESS":                      "0",
+		"COOKIE_NAME":                   "customAuthorization",
+		"COOKIE_SECURE":                 "1",
+		"CORS_ALLOWED_ORIGINS":          "*",
+		"DB_PATH":                       "test.db",
+		"DEBUG":                         "1",
+		"DEMO":                          "1",
+		"KEY_FILE":                      "bar",
+		"PUBLISHER_JWT_KEY":             "foo",
+		"PUBLISH_ALLOWED_ORIGINS":       "http://127.0.0.1:8080",
+		"SUBSCRIBER_JWT_KEY":            "bar",
+		"JWT_ALGORITHM":                 "RS256",
+		"JWT_KEYS":                      "old,older",
+		"JWT_KEY_IDS":                   "v1,v0",
+		"JWT_EXPECTED_ISSUER":           "https://auth.example.com",
+		"JWT_EXPECTED_AUDIENCE":         "https://hub.example.com",
+		"JWT_LEEWAY":                    "2s",
+		"HEARTBEAT_INTERVAL":            "30s",
+		"DEFAULT_RETRY":                 "3000",
+		"READ_TIMEOUT":                  "1m",
+		"WRITE_TIMEOUT":                 "40s",
+		"MAX_PUBLISH_BODY_SIZE":         "1024",
+		"PUBLISH_RATE_LIMIT":            "2.5",
+		"PUBLISH_RATE_BURST":            "5",
+		"HISTORY_SIZE":                  "100",
+		"METRICS":                       "1",
+		"WEBSOCKET":                     "1",
+		"HISTORY_TTL":                   "1h",
+		"HEALTH_CHECK_PATH":             "/status",
+		"SEND_CONNECTION_EVENT":         "1",
+		"ACME_HTTP01_ADDR":              ":8080",
+		"ALLOW_RELATIVE_TOPICS":         "1",
+		"SUBSCRIBER_BUFFER_SIZE":        "100",
+		"SLOW_SUBSCRIBER_POLICY":        "drop_oldest",
+		"TRUST_FORWARDED_HEADERS":       "1",
+		"FLUSH_INTERVAL":                "50ms",
+		"TOPIC_DEFAULT_TARGETS":         `{"https://example.com/users/{id}": ["admin"]}`,
+		"REJECT_EMPTY_TARGETS":          "1",
+		"TRANSPORT":                     "redis",
+		"REDIS_URL":                     "redis://redis.example.com:6379/1",
+		"REDIS_STREAM":                  "updates",
+		"REDIS_STREAM_MAX_LEN":          "1000",
+		"MAX_SUBSCRIBER_MESSAGES":       "10",
+		"MAX_SUBSCRIBER_BYTES":          "2048",
+		"JWT_CLAIMS_NAMESPACE":          "https://example.com/mercure",
+		"DEBUG_ALLOW_ANONYMOUS_PUBLISH": "1",
+		"DATA_FORMAT":                   "envelope",
+		"EVENT_WRITE_TIMEOUT":           "5s",
+		"MAX_SUBSCRIBERS":               "1000",
+		"TOKEN_HEADER":                  "X-Mercure-Authorization",
+		"TOKEN_HEADER_BARE":             "1",
+		"SUBSCRIBE_PATH":                "/mercure/subscribe",
+		"PUBLISH_PATH":                  "/mercure/publish",
+		"SUBSCRIBER_IDLE_TIMEOUT":       "2m",
+		"SEND_RESUME_TOKEN":             "1",
+		"TCP_KEEPALIVE":                 "45s",
+		"TOPIC_HISTORY_SIZES":           `{"https://example.com/ticks/{id}": 1000}`,
+		"CORS_ALLOWED_HEADERS":          "x-request-id,x-tenant",
+		"CORS_MAX_AGE":                  "5m",
+		"SEND_INITIAL_STATE":            "1",
+		"MAX_CLAIM_TARGETS":             "5000",
+		"PUBLISH_ALLOWED_FETCH_SITES":   "same-origin",
+		"OVERLOAD_RETRY":                "30s",
+		"READ_HEADER_TIMEOUT":           "5s",
+		"IDLE_TIMEOUT":                  "2m",
+		"WEBSOCKET_MESSAGE_TYPE":        "auto",
+		"CATCH_UP_MARKER":               "event",
+		"PUBLISH_DRAIN_TIMEOUT":         "3s",
+		"TOPIC_SEQUENCE":                "1",
+		"SEND_SELECTORS":                "1",
+		"MAX_REPLAY_UPDATES":            "50",
+		"JWT_KEY_RELOAD_INTERVAL":       "1m",
+		"MAX_SUBSCRIBE_TOPICS":          "20",
+		"MAX_TOPIC_LENGTH":              "512",
+		"WEBHOOK_ALLOWED_ORIGINS":       "https://example.com,https://*.example.net",
+		"WEBHOOK_MAX_RETRIES":           "3",
+		"WEBHOOK_RETRY_DELAY":           "2s",
+		"JWKS_URL":                      "https://example.com/.well-known/jwks.json",
+		"JWKS_TIMEOUT":                  "2s",
+		"JWKS_CACHE_TTL":                "10m",
+		"RESTRICTED_TOPICS_STATUS":      "403",
+		"RESTRICTED_TOPICS_BODY":        "Authentication required.",
+		"BASE_PATH":                     "/mercure",
 	}
 	for k, v := range testEnv {
 		os.Setenv(k, v)
@@ -37,21 +111,101 @@ func TestNewOptionsFormNew(t *testing.T) {
 	assert.Equal(t, &Options{
 		true,
 		"test.db",
+		100,
+		map[string]int{"https://example.com/ticks/{id}": 1000},
+		time.Hour,
+		50,
+		"redis",
+		"redis://redis.example.com:6379/1",
+		"updates",
+		1000,
 		[]byte("foo"),
 		[]byte("bar"),
+		"",
+		"",
+		time.Minute,
+		"https://example.com/.well-known/jwks.json",
+		2 * time.Second,
+		10 * time.Minute,
+		[][]byte{[]byte("old"), []byte("older")},
+		[]string{"v1", "v0"},
+		"RS256",
+		"https://auth.example.com",
+		"https://hub.example.com",
+		2 * time.Second,
+		"https://example.com/mercure",
+		5000,
+		true,
+		true,
+		true,
+		403,
+		"Authentication required.",
 		true,
 		[]string{"*"},
+		[]string{"x-request-id", "x-tenant"},
+		5 * time.Minute,
 		[]string{"http://127.0.0.1:8080"},
+		[]string{"same-origin"},
+		true,
+		"customAuthorization",
+		true,
+		true,
+		"token",
+		"X-Mercure-Authorization",
+		true,
 		"127.0.0.1:8080",
 		[]string{"example.com", "example.org"},
 		"/tmp",
+		":8080",
 		"foo",
 		"bar",
 		30 * time.Second,
+		50 * time.Millisecond,
+		true,
+		true,
+		true,
+		CatchUpMarkerEvent,
+		"envelope",
+		true,
+		true,
+		100,
+		"drop_oldest",
+		1000,
+		30 * time.Second,
+		10,
+		2048,
+		20,
+		512,
+		3000,
 		time.Minute,
+		5 * time.Second,
 		40 * time.Second,
+		2 * time.Minute,
+		5 * time.Second,
+		2 * time.Minute,
+		45 * time.Second,
+		1024,
+		map[string][]string{"https://example.com/users/{id}": {"admin"}},
+		2.5,
+		5,
+		3 * time.Second,
 		false,
 		true,
+		WebSocketMessageAuto,
+		[]string{"https://example.com", "https://*.example.net"},
+		3,
+		2 * time.Second,
+		true,
+		true,
+		"/status",
+		"/mercure",
+		"/mercure/subscribe",
+		"/mercure/publish",
+		nil,
+		nil,
+		nil,
+		nil,
+		logrusLogger{},
 	}, opts)
 	assert.Nil(t, err)
 }
@@ -61,6 +215,47 @@ func TestMissingEnv(t *testing.T) {
 	assert.EqualError(t, err, "The following environment variable must be defined: [PUBLISHER_JWT_KEY SUBSCRIBER_JWT_KEY]")
 }
 
+func TestOnlyOneJWTKey(t *testing.T) {
+	os.Setenv("SUBSCRIBER_JWT_KEY", "foo")
+	defer os.Unsetenv("SUBSCRIBER_JWT_KEY")
+
+	opts, err := NewOptionsFromEnv()
+	assert.Empty(t, opts.PublisherJWTKey)
+	assert.Equal(t, []byte("foo"), opts.SubscriberJWTKey)
+	assert.Nil(t, err)
+}
+
+func TestOnlyJWKS(t *testing.T) {
+	os.Setenv("JWKS_URL", "https://example.com/.well-known/jwks.json")
+	defer os.Unsetenv("JWKS_URL")
+
+	opts, err := NewOptionsFromEnv()
+	assert.Nil(t, err)
+	assert.Empty(t, opts.PublisherJWTKey)
+	assert.Empty(t, opts.SubscriberJWTKey)
+}
+
+func TestJWTKeyFile(t *testing.T) {
+	ioutil.WriteFile("test.pem", []byte("-----BEGIN PUBLIC KEY-----"), 0600)
+	defer os.Remove("test.pem")
+
+	os.Setenv("JWT_KEY_FILE", "test.pem")
+	os.Setenv("SUBSCRIBER_JWT_KEY", "foo")
+	defer os.Unsetenv("JWT_KEY_FILE")
+	defer os.Unsetenv("SUBSCRIBER_JWT_KEY")
+
+	opts, err := NewOptionsFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("-----BEGIN PUBLIC KEY-----"), opts.PublisherJWTKey)
+	assert.Equal(t, "test.pem", opts.PublisherJWTKeyFile)
+	assert.Equal(t, []byte("foo"), opts.SubscriberJWTKey)
+	assert.Empty(t, opts.SubscriberJWTKeyFile)
+
+	os.Setenv("JWT_KEY_FILE", "missing.pem")
+	_, err = NewOptionsFromEnv()
+	assert.EqualError(t, err, "JWT_KEY_FILE: open missing.pem: no such file or directory")
+}
+
 func TestMissingKeyFile(t *testing.T) {
 	os.Setenv("CERT_FILE", "foo")
 	defer os.Unsetenv("CERT_FILE")
@@ -77,6 +272,146 @@ func TestMissingCertFile(t *testing.T) {
 	assert.EqualError(t, err, "The following environment variable must be defined: [PUBLISHER_JWT_KEY SUBSCRIBER_JWT_KEY CERT_FILE]")
 }
 
+func TestUnsupportedJWTAlgorithm(t *testing.T) {
+	os.Setenv("JWT_ALGORITHM", "none")
+	defer os.Unsetenv("JWT_ALGORITHM")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "JWT_ALGORITHM: unsupported signing method \"none\"")
+}
+
+func TestInvalidRestrictedTopicsStatus(t *testing.T) {
+	os.Setenv("RESTRICTED_TOPICS_STATUS", "200")
+	defer os.Unsetenv("RESTRICTED_TOPICS_STATUS")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "RESTRICTED_TOPICS_STATUS: must be an error status code, got 200")
+}
+
+func TestAnonymousPublishWithoutDebug(t *testing.T) {
+	os.Setenv("DEBUG_ALLOW_ANONYMOUS_PUBLISH", "1")
+	defer os.Unsetenv("DEBUG_ALLOW_ANONYMOUS_PUBLISH")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "DEBUG_ALLOW_ANONYMOUS_PUBLISH: can only be enabled in debug mode (DEBUG=1)")
+}
+
+func TestUnsupportedTransport(t *testing.T) {
+	os.Setenv("TRANSPORT", "kafka")
+	defer os.Unsetenv("TRANSPORT")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "TRANSPORT: unsupported transport \"kafka\"")
+}
+
+func TestUnsupportedCatchUpMarker(t *testing.T) {
+	os.Setenv("CATCH_UP_MARKER", "retry")
+	defer os.Unsetenv("CATCH_UP_MARKER")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "CATCH_UP_MARKER: unsupported marker \"retry\"")
+}
+
+func TestUnsupportedWebSocketMessageType(t *testing.T) {
+	os.Setenv("WEBSOCKET_MESSAGE_TYPE", "json")
+	defer os.Unsetenv("WEBSOCKET_MESSAGE_TYPE")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "WEBSOCKET_MESSAGE_TYPE: unsupported type \"json\"")
+}
+
+func TestUnsupportedDataFormat(t *testing.T) {
+	os.Setenv("DATA_FORMAT", "xml")
+	defer os.Unsetenv("DATA_FORMAT")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "DATA_FORMAT: unsupported format \"xml\"")
+}
+
+func TestInvalidPath(t *testing.T) {
+	os.Setenv("PUBLISH_PATH", "publish")
+	defer os.Unsetenv("PUBLISH_PATH")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "PUBLISH_PATH: the path must start with \"/\"")
+}
+
+func TestInvalidSubscriberIdleTimeout(t *testing.T) {
+	os.Setenv("SUBSCRIBER_IDLE_TIMEOUT", "1m")
+	defer os.Unsetenv("SUBSCRIBER_IDLE_TIMEOUT")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "SUBSCRIBER_IDLE_TIMEOUT: must be greater than HEARTBEAT_INTERVAL, which must be set")
+
+	os.Setenv("HEARTBEAT_INTERVAL", "1m")
+	defer os.Unsetenv("HEARTBEAT_INTERVAL")
+	_, err = NewOptionsFromEnv()
+	assert.EqualError(t, err, "SUBSCRIBER_IDLE_TIMEOUT: must be greater than HEARTBEAT_INTERVAL, which must be set")
+}
+
+func TestUnsupportedSlowSubscriberPolicy(t *testing.T) {
+	os.Setenv("SLOW_SUBSCRIBER_POLICY", "block")
+	defer os.Unsetenv("SLOW_SUBSCRIBER_POLICY")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "SLOW_SUBSCRIBER_POLICY: unsupported policy \"block\"")
+}
+
+func TestInvalidTopicDefaultTargets(t *testing.T) {
+	os.Setenv("TOPIC_DEFAULT_TARGETS", `{"https://example.com/faulty{iri": ["admin"]}`)
+	defer os.Unsetenv("TOPIC_DEFAULT_TARGETS")
+
+	_, err := NewOptionsFromEnv()
+	assert.Contains(t, err.Error(), "TOPIC_DEFAULT_TARGETS: invalid URI template \"https://example.com/faulty{iri\"")
+
+	os.Setenv("TOPIC_DEFAULT_TARGETS", `["admin"]`)
+	_, err = NewOptionsFromEnv()
+	assert.Contains(t, err.Error(), "TOPIC_DEFAULT_TARGETS: json: cannot unmarshal")
+}
+
+func TestInvalidTopicHistorySizes(t *testing.T) {
+	os.Setenv("TOPIC_HISTORY_SIZES", `{"https://example.com/ticks/{id}": 1000}`)
+	defer os.Unsetenv("TOPIC_HISTORY_SIZES")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "TOPIC_HISTORY_SIZES: HISTORY_SIZE must be set")
+
+	os.Setenv("HISTORY_SIZE", "10")
+	defer os.Unsetenv("HISTORY_SIZE")
+
+	os.Setenv("TOPIC_HISTORY_SIZES", `{"https://example.com/ticks/{id}": -1}`)
+	_, err = NewOptionsFromEnv()
+	assert.EqualError(t, err, "TOPIC_HISTORY_SIZES: the size of \"https://example.com/ticks/{id}\" can't be negative")
+
+	os.Setenv("TOPIC_HISTORY_SIZES", `{"https://example.com/faulty{iri": 10}`)
+	_, err = NewOptionsFromEnv()
+	assert.Contains(t, err.Error(), "TOPIC_HISTORY_SIZES: invalid URI template \"https://example.com/faulty{iri\"")
+}
+
+func TestInvalidSendInitialState(t *testing.T) {
+	os.Setenv("SEND_INITIAL_STATE", "1")
+	defer os.Unsetenv("SEND_INITIAL_STATE")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "SEND_INITIAL_STATE: HISTORY_SIZE must be set")
+}
+
+func TestInvalidPublishAllowedFetchSites(t *testing.T) {
+	os.Setenv("PUBLISH_ALLOWED_FETCH_SITES", "same-origin,cross-site")
+	defer os.Unsetenv("PUBLISH_ALLOWED_FETCH_SITES")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "PUBLISH_ALLOWED_FETCH_SITES: unsupported value \"cross-site\", must be \"same-origin\" or \"same-site\"")
+}
+
+func TestInvalidUint(t *testing.T) {
+	os.Setenv("DEFAULT_RETRY", "-1")
+	defer os.Unsetenv("DEFAULT_RETRY")
+
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, "DEFAULT_RETRY: strconv.ParseUint: parsing \"-1\": invalid syntax")
+}
+
 func TestInvalidDuration(t *testing.T) {
 	vars := [3]string{"HEARTBEAT_INTERVAL", "READ_TIMEOUT", "WRITE_TIMEOUT"}
 	for _, elem := range vars {
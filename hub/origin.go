@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"regexp"
+	"strings"
+)
+
+// originPatterns matches the origins allowed to publish using the cookie-based authorization mechanism
+// Origins can be exact values (https://example.com), glob-style patterns (https://*.example.com) or "*" to allow any origin
+type originPatterns struct {
+	any      bool
+	exact    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+// newOriginPatterns compiles the allowed origins, it must be called only once as compiling patterns is expensive
+func newOriginPatterns(origins []string) *originPatterns {
+	p := &originPatterns{exact: make(map[string]struct{}, len(origins))}
+	for _, origin := range origins {
+		switch {
+		case origin == "*":
+			p.any = true
+		case strings.Contains(origin, "*"):
+			p.patterns = append(p.patterns, compileOriginPattern(origin))
+		default:
+			p.exact[origin] = struct{}{}
+		}
+	}
+
+	return p
+}
+
+// compileOriginPattern converts a glob-style pattern to a regular expression
+// A wildcard matches one or several DNS labels, it never matches the separators of the scheme or of the port
+func compileOriginPattern(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, `[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*`) + "$")
+}
+
+// match checks if the origin is allowed
+func (p *originPatterns) match(origin string) bool {
+	if p == nil {
+		return false
+	}
+	if p.any {
+		return true
+	}
+	if _, ok := p.exact[origin]; ok {
+		return true
+	}
+
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
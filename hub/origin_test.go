@@ -0,0 +1,42 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginPatternsExact(t *testing.T) {
+	p := newOriginPatterns([]string{"https://example.com"})
+
+	assert.True(t, p.match("https://example.com"))
+	assert.False(t, p.match("https://example.com:8443"))
+	assert.False(t, p.match("https://example.net"))
+}
+
+func TestOriginPatternsSubdomain(t *testing.T) {
+	p := newOriginPatterns([]string{"https://*.example.com"})
+
+	assert.True(t, p.match("https://pr-42.example.com"))
+	assert.True(t, p.match("https://a.b.example.com"))
+	assert.False(t, p.match("https://example.com"))
+	assert.False(t, p.match("https://evilexample.com"))
+	assert.False(t, p.match("https://pr-42.example.com.evil.com"))
+	assert.False(t, p.match("https://evil.com/.example.com"))
+	assert.False(t, p.match("https://pr-42.example.com:8443"))
+}
+
+func TestOriginPatternsSchemeDiffers(t *testing.T) {
+	p := newOriginPatterns([]string{"https://*.example.com"})
+
+	assert.False(t, p.match("http://pr-42.example.com"))
+	assert.False(t, p.match("wss://pr-42.example.com"))
+}
+
+func TestOriginPatternsAny(t *testing.T) {
+	p := newOriginPatterns([]string{"*"})
+	assert.True(t, p.match("https://example.com"))
+
+	var none *originPatterns
+	assert.False(t, none.match("https://example.com"))
+}
@@ -1,12 +1,18 @@
 package hub
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
-	log "github.com/sirupsen/logrus"
 )
 
 // Publisher must be implemented to publish an update
@@ -14,6 +20,19 @@ type Publisher interface {
 	Publish(hub *Hub, update *Update) error
 }
 
+// Transports used to dispatch the updates to the subscribers
+const (
+	// TransportLocal dispatches the updates to the subscribers connected to this hub only
+	TransportLocal = "local"
+	// TransportRedis dispatches the updates to the subscribers connected to all the hubs sharing the same Redis stream
+	TransportRedis = "redis"
+)
+
+// listener is implemented by the publishers receiving the updates to dispatch from an external source, it is started by Hub.Start
+type listener interface {
+	listen(h *Hub)
+}
+
 // LocalPublisher dispatch an update locally
 type localPublisher struct {
 }
@@ -24,76 +43,461 @@ func (*localPublisher) Publish(h *Hub, u *Update) error {
 		u.ID = uuid.Must(uuid.NewV4()).String()
 	}
 
-	h.DispatchUpdate(u)
-
-	return nil
+	return h.DispatchUpdate(u)
 }
 
 // PublishHandler allows publisher to broadcast updates to all subscribers
+// The update can be form-encoded or JSON-encoded, several updates can be published at once by sending a JSON array of updates (see publishBatch)
+// The error responses are JSON objects containing the message and a code identifying the error when the publisher accepts JSON
 func (h *Hub) PublishHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := authorize(r, h.options.PublisherJWTKey, h.options.PublishAllowedOrigins)
-	if err != nil || claims == nil || claims.Mercure.Publish == nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	if acceptsJSON(r) {
+		jw := &jsonErrorWriter{ResponseWriter: w}
+		defer jw.close()
+		w = jw
+	}
+
+	if !allowMethods(w, r, "POST") {
 		return
 	}
 
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	if !h.acceptPublish() {
+		sendServiceUnavailable(w)
 		return
 	}
+	defer h.publishes.Done()
 
-	topics := r.PostForm["topic"]
-	if len(topics) == 0 {
-		http.Error(w, "Missing \"topic\" parameter", http.StatusBadRequest)
+	defer func(start time.Time) {
+		h.metrics.publishDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	ctx, span := h.startRequestSpan(r, "mercure.publish")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	claims, err := authorize(r, h.getAuthorizationConfig(true))
+	if err == nil && claims != nil && claims.Mercure.Publish == nil {
+		err = &authorizationError{"insufficient_scope", errors.New("The JWT must contain a \"mercure.publish\" claim")}
+	}
+	if err != nil || claims == nil {
+		h.unauthorized(w, r, err)
+		return
+	}
+	if len(claims.Mercure.Publish) == 0 && h.options.RejectEmptyTargets {
+		h.forbidden(w, r, errors.New("The \"mercure.publish\" claim of the JWT doesn't contain any target"))
 		return
 	}
 
-	data := r.PostForm.Get("data")
-	if data == "" {
-		http.Error(w, "Missing \"data\" parameter", http.StatusBadRequest)
+	if ok, delay := h.rateLimiter.allow(rateLimiterKey(r, claims), time.Now()); !ok {
+		sendTooManyRequests(w, delay)
 		return
 	}
 
-	authorizedAlltargets, authorizedTargets := authorizedTargets(claims, true)
-	targets := make(map[string]struct{}, len(r.PostForm["target"]))
-	for _, t := range r.PostForm["target"] {
-		if !authorizedAlltargets {
-			_, ok := authorizedTargets[t]
-			if !ok {
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-				return
-			}
-		}
+	authorizedAlltargets, authorizedTargets, templateTargets := authorizedTargets(claims, true)
+	r = withAuthorizedTargets(r, authorizedAlltargets, authorizedTargets, true)
+	canPublishTo := func(target string) bool {
+		return authorizedAlltargets || matchTarget(target, authorizedTargets, templateTargets)
+	}
+	isDenied := publishDenied(claims)
 
-		targets[t] = struct{}{}
+	dryRun, err := isDryRun(r)
+	if err != nil {
+		http.Error(w, "Invalid \"dry-run\" parameter", http.StatusBadRequest)
+		return
 	}
 
-	var retry uint64
-	retryString := r.PostForm.Get("retry")
-	if retryString == "" {
-		retry = 0
-	} else {
-		var err error
-		retry, err = strconv.ParseUint(retryString, 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid \"retry\" parameter", http.StatusBadRequest)
+	if h.options.MaxPublishBodySize > 0 {
+		// The body is never read entirely in memory if it exceeds the limit
+		r.Body = http.MaxBytesReader(w, r.Body, h.options.MaxPublishBodySize)
+	}
+
+	mediaType, err := requestMediaType(r)
+	if err != nil {
+		http.Error(w, "Invalid \"Content-Type\" header", http.StatusBadRequest)
+		return
+	}
+
+	var ur updateRequest
+	switch mediaType {
+	case "application/json":
+		batch, single, ok := decodeJSONUpdates(w, r)
+		if !ok {
+			return
+		}
+		if batch != nil {
+			h.publishBatch(w, r, claims, batch, canPublishTo, isDenied, dryRun)
+			return
+		}
+		ur = *single
+
+	case "application/x-ndjson":
+		h.publishStream(w, r, claims, canPublishTo, isDenied, dryRun)
+		return
+
+	case "application/x-www-form-urlencoded", "":
+		var ok bool
+		if ur, ok = parseFormUpdate(w, r); !ok {
 			return
 		}
+
+	default:
+		http.Error(w, "Unsupported \"Content-Type\", the body must be encoded as \"application/x-www-form-urlencoded\", \"application/json\" or \"application/x-ndjson\"", http.StatusUnsupportedMediaType)
+		return
 	}
 
-	u := &Update{
-		Targets: targets,
-		Topics:  topics,
-		Event:   Event{data, r.PostForm.Get("id"), r.PostForm.Get("type"), retry},
+	u, denial, ok := h.newUpdate(w, r, claims, ur, canPublishTo, isDenied, dryRun, "")
+	if !ok {
+		return
+	}
+	u.spanContext = span.SpanContext()
+
+	if dryRun {
+		result := newDryRunResult(u, denial)
+		h.logger.Info("Update dry run", "remote_addr", r.RemoteAddr, "event_id", result.ID, "topics", u.Topics, "granted", result.Granted, "subject", claims.Subject)
+		sendDryRun(w, result)
+		return
 	}
 
 	// Broadcast the update
 	err = h.publisher.Publish(h, u)
 	if err != nil {
-		panic(err)
+		span.RecordError(err)
+		if err != errHubStopped {
+			h.logger.Error("Failed to publish the update", "event_id", u.ID, "topics", u.Topics, "error", err)
+		}
+		sendServiceUnavailable(w)
+		return
 	}
+	span.SetAttributes(updateAttributes(u)...)
 
+	h.metrics.updatesPublished.Inc()
+	w.Header().Set(eventIDHeader, u.ID)
+	if u.recipients != nil {
+		w.Header().Set(recipientsHeader, strconv.Itoa(<-u.recipients))
+	}
 	io.WriteString(w, u.ID)
-	log.WithFields(log.Fields{"remote_addr": r.RemoteAddr, "event_id": u.ID}).Info("Update published")
+	h.logger.Info("Update published", "remote_addr", r.RemoteAddr, "event_id", u.ID, "topics", u.Topics, "subject", claims.Subject)
+}
+
+// updateRequest is an update as sent by a publisher, either form-encoded or JSON-encoded
+// A nil Retry means that the default retry must be used
+type updateRequest struct {
+	Topic       stringList `json:"topic"`
+	Data        string     `json:"data"`
+	Targets     stringList `json:"targets"`
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	ContentType string     `json:"content-type"`
+	Retry       *uint64    `json:"retry"`
+	TTL         string     `json:"ttl"`
+	Priority    string     `json:"priority"`
+}
+
+// requestMediaType returns the media type of the body of the request, without its parameters
+// It is empty if the request has no Content-Type header, such requests are handled as form-encoded ones for backward compatibility
+func requestMediaType(r *http.Request) (string, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return "", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return mediaType, err
+}
+
+// parseFormUpdate reads a form-encoded update, the topics and the targets can be repeated
+// The error response is sent if the form can't be parsed
+func parseFormUpdate(w http.ResponseWriter, r *http.Request) (updateRequest, bool) {
+	parseFormErr := r.ParseForm()
+	if isBodyTooLarge(parseFormErr) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return updateRequest{}, false
+	}
+	if parseFormErr != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return updateRequest{}, false
+	}
+
+	ur := updateRequest{
+		Topic:       r.PostForm["topic"],
+		Data:        r.PostForm.Get("data"),
+		Targets:     r.PostForm["target"],
+		ID:          r.PostForm.Get("id"),
+		Type:        r.PostForm.Get("type"),
+		ContentType: r.PostForm.Get("content-type"),
+		TTL:         r.PostForm.Get("ttl"),
+		Priority:    r.PostForm.Get("priority"),
+	}
+
+	if retryString := r.PostForm.Get("retry"); retryString != "" {
+		retry, err := strconv.ParseUint(retryString, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid \"retry\" parameter", http.StatusBadRequest)
+			return updateRequest{}, false
+		}
+		ur.Retry = &retry
+	}
+
+	// The targets can also be sent as a JSON array, for the clients unable to repeat a field
+	for _, targets := range r.PostForm["targets"] {
+		var t []string
+		if err := json.Unmarshal([]byte(targets), &t); err != nil {
+			http.Error(w, "Invalid \"targets\" parameter, it must be a JSON array of strings", http.StatusBadRequest)
+			return updateRequest{}, false
+		}
+		ur.Targets = append(ur.Targets, t...)
+	}
+	if ur.Targets != nil {
+		ur.Targets = distinctValues(ur.Targets)
+	}
+
+	return ur, true
+}
+
+// newUpdate validates an update sent by a publisher, and checks that the publisher is allowed to publish it
+// The error response is sent if the update is invalid, or if it is denied and dryRun is false
+// The suffix is appended to the error messages to identify the update of a batch
+func (h *Hub) newUpdate(w http.ResponseWriter, r *http.Request, claims *claims, ur updateRequest, canPublishTo, isDenied func(string) bool, dryRun bool, suffix string) (*Update, *publishDenial, bool) {
+	if len(ur.Topic) == 0 {
+		http.Error(w, "Missing \"topic\" parameter"+suffix, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	if err := h.validateTopics(ur.Topic); err != nil {
+		http.Error(w, err.Error()+suffix, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	if ur.Data == "" {
+		http.Error(w, "Missing \"data\" parameter"+suffix, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	if !isValidField(ur.ID) {
+		http.Error(w, "Invalid \"id\" parameter"+suffix, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	if !isValidField(ur.Type) {
+		http.Error(w, "Invalid \"type\" parameter"+suffix, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	if ur.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(ur.ContentType); err != nil {
+			http.Error(w, "Invalid \"content-type\" parameter"+suffix, http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+
+	targets, denial, err := h.authorizeUpdate(r, claims, ur.Topic, ur.Targets, canPublishTo, isDenied, suffix)
+	if err != nil {
+		h.authorizationHookFailed(w, r, err)
+		return nil, nil, false
+	}
+	if denial != nil && !dryRun {
+		h.denyPublish(w, r, denial)
+		return nil, nil, false
+	}
+
+	retry := h.options.DefaultRetry
+	if ur.Retry != nil {
+		retry = *ur.Retry
+	}
+
+	ttl, err := parseTTL(ur.TTL)
+	if err != nil {
+		http.Error(w, "Invalid \"ttl\" parameter"+suffix, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	priority, ok := parsePriority(ur.Priority)
+	if !ok {
+		http.Error(w, "Invalid \"priority\" parameter"+suffix, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	return &Update{
+		Targets:     targets,
+		Topics:      ur.Topic,
+		Event:       Event{ur.Data, ur.ID, ur.Type, retry},
+		ContentType: ur.ContentType,
+		TTL:         ttl,
+		Priority:    priority,
+	}, denial, true
+}
+
+// parsePriority parses the priority of an update, the normal priority is the default one and is represented by an empty string
+func parsePriority(value string) (string, bool) {
+	switch value {
+	case "", PriorityNormal:
+		return "", true
+	case PriorityHigh:
+		return PriorityHigh, true
+	}
+
+	return "", false
+}
+
+// distinctValues returns the values without the duplicates, in order
+func distinctValues(values []string) []string {
+	distinct := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			distinct = append(distinct, value)
+		}
+	}
+
+	return distinct
+}
+
+// parseTTL parses the duration during which an update can be retrieved from the history, it is 0 if not provided
+func parseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("the TTL must be positive")
+	}
+
+	return ttl, nil
+}
+
+// eventIDHeader contains the ID of the published update, it allows clients to retrieve it without parsing the body
+// It isn't sent when several updates are published at once, because IDs can contain commas
+const eventIDHeader = "X-Mercure-Event-ID"
+
+// recipientsHeader contains the number of subscribers connected to this hub the update has been sent to, after filtering by topics and targets
+// It isn't sent when the update is dispatched asynchronously, as with the Redis transport, and contains the comma-separated numbers of a batch
+const recipientsHeader = "X-Mercure-Recipients"
+
+// acceptPublish registers a publish request in progress, which Shutdown waits for, it returns false if the hub is shutting down or stopped
+func (h *Hub) acceptPublish() bool {
+	h.state.RLock()
+	defer h.state.RUnlock()
+
+	if h.state.shutdown || h.state.stopped {
+		return false
+	}
+	h.publishes.Add(1)
+
+	return true
+}
+
+// sendServiceUnavailable tells the client that the hub is shutting down
+func sendServiceUnavailable(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// isBodyTooLarge checks if the error has been returned by http.MaxBytesReader because the limit has been reached
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// validateTopics checks that the topics are absolute IRIs, unless relative topics are allowed, and that they aren't reserved to the hub
+func (h *Hub) validateTopics(topics []string) error {
+	for _, topic := range topics {
+		if topic == subscriptionEventsTopic {
+			return fmt.Errorf("Invalid \"topic\" parameter %q: it is reserved to the hub", topic)
+		}
+
+		if h.options.AllowRelativeTopics {
+			continue
+		}
+
+		if u, err := url.Parse(topic); err != nil || !u.IsAbs() {
+			return fmt.Errorf("Invalid \"topic\" parameter %q: it must be an absolute IRI", topic)
+		}
+	}
+
+	return nil
+}
+
+// isValidField checks that a value provided by the publisher, if any, can be used verbatim as a SSE field, such as "id" or "event"
+// Line breaks aren't allowed because they would terminate the field, and allow to forge other fields or events
+func isValidField(value string) bool {
+	return !strings.ContainsAny(value, "\r\n")
+}
+
+// checkDenied returns an error if one of the topics or of the targets of an update has been explicitly denied to the publisher
+func checkDenied(topics, targets []string, isDenied func(string) bool) error {
+	for _, topic := range topics {
+		if isDenied(topic) {
+			return fmt.Errorf("Not allowed to publish to the topic \"%s\"", topic)
+		}
+	}
+
+	for _, target := range targets {
+		if isDenied(target) {
+			return fmt.Errorf("Not allowed to publish to the target \"%s\"", target)
+		}
+	}
+
+	return nil
+}
+
+// publishDenial is the reason why a publisher isn't allowed to publish an update
+// The status is the one of the error response: 401 if a target isn't granted by the JWT, 403 if a topic or a target is denied
+type publishDenial struct {
+	status int
+	err    error
+}
+
+// authorizeUpdate resolves the targets of an update, and checks that the publisher is allowed to publish it
+// The error is only returned if the publish hook failed, the suffix is appended to the denial messages to identify the update of a batch
+func (h *Hub) authorizeUpdate(r *http.Request, claims *claims, topics, requestedTargets []string, canPublishTo, isDenied func(string) bool, suffix string) (map[string]struct{}, *publishDenial, error) {
+	targets, err := allowedTargets(requestedTargets, canPublishTo)
+	if err != nil {
+		return nil, &publishDenial{http.StatusUnauthorized, err}, nil
+	}
+	if err := checkDenied(topics, requestedTargets, isDenied); err != nil {
+		return nil, &publishDenial{http.StatusForbidden, fmt.Errorf("%s%s", err, suffix)}, nil
+	}
+
+	denied, err := authorizeTopics(r.Context(), h.options.AuthorizePublish, claims, topics)
+	if err != nil {
+		return nil, nil, err
+	}
+	if denied != "" {
+		return nil, &publishDenial{http.StatusForbidden, fmt.Errorf("Not allowed to publish to the topic \"%s\"%s", denied, suffix)}, nil
+	}
+
+	if len(requestedTargets) == 0 {
+		if defaultTargets := h.topicDefaultTargets.forTopics(topics); defaultTargets != nil {
+			targets = defaultTargets
+		}
+	}
+
+	return targets, nil, nil
+}
+
+// denyPublish replies to a publisher that isn't allowed to publish an update
+func (h *Hub) denyPublish(w http.ResponseWriter, r *http.Request, denial *publishDenial) {
+	if denial.status == http.StatusUnauthorized {
+		h.unauthorized(w, r, denial.err)
+		return
+	}
+
+	h.forbidden(w, r, denial.err)
+}
+
+// allowedTargets builds the set of targets of an update, and checks that the publisher is allowed to dispatch to all of them
+func allowedTargets(requestedTargets []string, canPublishTo func(string) bool) (map[string]struct{}, error) {
+	targets := make(map[string]struct{}, len(requestedTargets))
+	for _, t := range requestedTargets {
+		if !canPublishTo(t) {
+			return nil, &authorizationError{"insufficient_scope", fmt.Errorf("Not allowed to publish to the target \"%s\"", t)}
+		}
+
+		targets[t] = struct{}{}
+	}
+
+	return targets, nil
 }
@@ -8,7 +8,9 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gofrs/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -26,6 +28,46 @@ func TestNoAuthorizationHeader(t *testing.T) {
 	assert.Equal(t, http.StatusText(http.StatusUnauthorized)+"\n", w.Body.String())
 }
 
+func TestPublishAnonymousDebug(t *testing.T) {
+	publish := func(hub *Hub) *http.Response {
+		form := url.Values{}
+		form.Add("id", "id")
+		form.Add("topic", "http://example.com/books/1")
+		form.Add("data", "Hello!")
+		form.Add("target", "foo")
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		return w.Result()
+	}
+
+	// The debug mode is required too
+	hub := createDummy()
+	hub.options.DebugAllowAnonymousPublish = true
+	assert.Equal(t, http.StatusUnauthorized, publish(hub).StatusCode)
+
+	hub.options.Debug = true
+	hub.Start()
+	defer hub.Stop()
+
+	updates, _ := hub.registerSubscriber(nil)
+
+	assert.Equal(t, http.StatusOK, publish(hub).StatusCode)
+	u := <-updates
+	assert.Equal(t, "id", u.ID)
+	assert.Equal(t, struct{}{}, u.Targets["foo"])
+
+	// An invalid JWT is still rejected
+	req := httptest.NewRequest("POST", "http://example.com/hub", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyUnauthorizedJWT())
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
 func TestPublishUnauthorizedJWT(t *testing.T) {
 	hub := createDummy()
 
@@ -37,9 +79,50 @@ func TestPublishUnauthorizedJWT(t *testing.T) {
 	resp := w.Result()
 
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Bearer error="invalid_signature", error_description="signature is invalid"`, resp.Header.Get("WWW-Authenticate"))
 	assert.Equal(t, http.StatusText(http.StatusUnauthorized)+"\n", w.Body.String())
 }
 
+func TestPublishNotYetValidJWT(t *testing.T) {
+	hub := createDummy()
+
+	nbf := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{mercureClaim{Publish: []string{}}, jwt.StandardClaims{NotBefore: nbf.Unix()}})
+	tokenString, _ := token.SignedString(hub.options.PublisherJWTKey)
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", nil)
+	req.Header.Add("Authorization", "Bearer "+tokenString)
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Bearer error="token_not_yet_valid", error_description="Token is not valid yet, it will be valid from 2100-01-01T00:00:00Z"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestPublishEmptyTargets(t *testing.T) {
+	hub := createDummy()
+
+	// By default, the publisher is allowed to publish public updates
+	req := httptest.NewRequest("POST", "http://example.com/hub", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Equal(t, "Missing \"topic\" parameter\n", w.Body.String())
+
+	hub.options.RejectEmptyTargets = true
+	req = httptest.NewRequest("POST", "http://example.com/hub", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+	w = httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="The 'mercure.publish' claim of the JWT doesn't contain any target"`, resp.Header.Get("WWW-Authenticate"))
+}
+
 func TestPublishInvalidAlgJWT(t *testing.T) {
 	hub := createDummy()
 
@@ -122,6 +205,310 @@ func TestPublishInvalidRetry(t *testing.T) {
 	assert.Equal(t, "Invalid \"retry\" parameter\n", w.Body.String())
 }
 
+func TestPublishDefaultRetry(t *testing.T) {
+	hub := createDummy()
+	hub.options.DefaultRetry = 3000
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		u := <-hub.updates
+		assert.Equal(t, uint64(3000), u.Retry)
+		assert.Contains(t, u.event, "retry: 3000\n")
+
+		u = <-hub.updates
+		assert.Equal(t, uint64(10), u.Retry)
+	}()
+
+	for _, retry := range []string{"", "10"} {
+		form := url.Values{}
+		form.Add("topic", "http://example.com/books/1")
+		form.Add("data", "foo")
+		if retry != "" {
+			form.Add("retry", retry)
+		}
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	wg.Wait()
+}
+
+func TestPublishInvalidID(t *testing.T) {
+	hub := createDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("id", "first\ndata: injected")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Invalid \"id\" parameter\n", w.Body.String())
+}
+
+func TestPublishInvalidType(t *testing.T) {
+	hub := createDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("type", "message\r\rdata: injected")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"type\" parameter\n", w.Body.String())
+}
+
+func TestPublishInvalidContentType(t *testing.T) {
+	hub := createDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("content-type", "application/ld+json; profile")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"content-type\" parameter\n", w.Body.String())
+}
+
+func TestPublishContentType(t *testing.T) {
+	hub := createDummy()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u := <-hub.updates
+		assert.Equal(t, "application/ld+json", u.ContentType)
+		u = <-hub.updates
+		assert.Equal(t, `application/json; charset="utf-8"`, u.ContentType)
+	}()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", `{"@id": "/books/1"}`)
+	form.Add("content-type", "application/ld+json")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(`{"topic": "http://example.com/books/1", "data": "{}", "content-type": "application/json; charset=\"utf-8\""}`))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+	w = httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	<-done
+}
+
+func TestPublishInvalidTTL(t *testing.T) {
+	hub := createDummy()
+
+	for _, ttl := range []string{"foo", "-1s", "0s"} {
+		form := url.Values{}
+		form.Add("topic", "http://example.com/books/1")
+		form.Add("data", "foo")
+		form.Add("ttl", ttl)
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "Invalid \"ttl\" parameter\n", w.Body.String())
+	}
+}
+
+func TestPublishTTL(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	updates, _ := hub.registerSubscriber(nil)
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("ttl", "1m30s")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 90*time.Second, (<-updates).TTL)
+}
+
+func TestPublishInvalidPriority(t *testing.T) {
+	hub := createDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("priority", "urgent")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"priority\" parameter\n", w.Body.String())
+}
+
+func TestPublishPriority(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	updates, _ := hub.registerSubscriber(nil)
+
+	for priority, expected := range map[string]string{"": "", PriorityNormal: "", PriorityHigh: PriorityHigh} {
+		form := url.Values{}
+		form.Add("topic", "http://example.com/books/1")
+		form.Add("data", "foo")
+		if priority != "" {
+			form.Add("priority", priority)
+		}
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, expected, (<-updates).Priority)
+	}
+}
+
+func TestPublishRecipients(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	hub.registerSubscriber(NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, ""))
+	hub.registerSubscriber(NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, ""))
+	hub.registerSubscriber(NewSubscriber(true, nil, nil, []string{"http://example.com/books/2"}, nil, ""))
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-Mercure-Recipients"))
+
+	body := `[{"topic": "http://example.com/books/1", "data": "foo"}, {"topic": "http://example.com/books/3", "data": "bar"}]`
+	req = httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w = httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2,0", w.Header().Get("X-Mercure-Recipients"))
+}
+
+func TestPublishRelativeTopic(t *testing.T) {
+	hub := createDummy()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("topic", "/books/1")
+	form.Add("data", "foo")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"topic\" parameter \"/books/1\": it must be an absolute IRI\n", w.Body.String())
+}
+
+func TestValidateTopics(t *testing.T) {
+	hub := createDummy()
+	assert.Nil(t, hub.validateTopics([]string{"http://example.com/books/1", "urn:isbn:0451450523"}))
+	assert.Error(t, hub.validateTopics([]string{"books/1"}))
+	assert.Error(t, hub.validateTopics([]string{"http://example.com/%zz"}))
+
+	hub.options.AllowRelativeTopics = true
+	assert.Nil(t, hub.validateTopics([]string{"books/1"}))
+}
+
+func TestPublishBodyTooLarge(t *testing.T) {
+	hub := createDummy()
+	hub.options.MaxPublishBodySize = 10
+
+	bodies := map[string]string{
+		"application/x-www-form-urlencoded": url.Values{"topic": {"http://example.com/books/1"}, "data": {"foo"}}.Encode(),
+		"application/json":                  `[{"topic": "http://example.com/books/1", "data": "foo"}]`,
+	}
+
+	for contentType, body := range bodies {
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+		req.Header.Add("Content-Type", contentType)
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
 func TestPublishNotAuthorizedTarget(t *testing.T) {
 	hub := createDummy()
 
@@ -132,7 +519,7 @@ func TestPublishNotAuthorizedTarget(t *testing.T) {
 
 	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
 
 	w := httptest.NewRecorder()
 	hub.PublishHandler(w, req)
@@ -140,6 +527,182 @@ func TestPublishNotAuthorizedTarget(t *testing.T) {
 	resp := w.Result()
 
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="Not allowed to publish to the target 'not-allowed'"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestPublishFormTargetsJSON(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	updates, _ := hub.registerSubscriber(nil)
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("target", "foo")
+	form.Add("targets", `["bar", "foo"]`)
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo", "bar"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]struct{}{"foo": {}, "bar": {}}, (<-updates).Targets)
+
+	// The targets of the JSON array are authorized too
+	form.Set("targets", `["baz"]`)
+	req = httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo", "bar"}))
+
+	w = httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPublishFormInvalidTargetsJSON(t *testing.T) {
+	hub := createDummy()
+
+	for _, targets := range []string{"foo", `"foo"`, `["foo", 1]`} {
+		form := url.Values{}
+		form.Add("topic", "http://example.com/books/1")
+		form.Add("data", "foo")
+		form.Add("targets", targets)
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "Invalid \"targets\" parameter, it must be a JSON array of strings\n", w.Body.String())
+	}
+}
+
+func TestPublishDeniedTopicOrTarget(t *testing.T) {
+	testCases := []struct {
+		topic, target, description string
+	}{
+		{"http://example.com/admin/1", "", "Not allowed to publish to the topic 'http://example.com/admin/1'"},
+		{"http://example.com/books/1", "internal", "Not allowed to publish to the target 'internal'"},
+	}
+
+	for _, tc := range testCases {
+		// Nothing consumes the updates channel: the test would block if an update was published
+		hub := createDummy()
+
+		form := url.Values{}
+		form.Add("topic", tc.topic)
+		form.Add("data", "foo")
+		if tc.target != "" {
+			form.Add("target", tc.target)
+		}
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyDeniedJWT(hub, []string{"http://example.com/admin/{id}", "internal"}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, `Bearer error="insufficient_scope", error_description="`+tc.description+`"`, resp.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestPublishNotDenied(t *testing.T) {
+	hub := createDummy()
+
+	go func() {
+		u := <-hub.updates
+		assert.Equal(t, struct{}{}, u.Targets["foo"])
+	}()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("target", "foo")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyDeniedJWT(hub, []string{"http://example.com/admin/{id}", "internal"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestPublishTemplateTarget(t *testing.T) {
+	hub := createDummy()
+
+	go func() {
+		u := <-hub.updates
+		assert.Equal(t, struct{}{}, u.Targets["http://example.com/users/dunglas"])
+	}()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+	form.Add("target", "http://example.com/users/dunglas")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"http://example.com/users/{name}"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPublishTopicDefaultTargets(t *testing.T) {
+	hub := NewHub(&localPublisher{}, &noHistory{}, &Options{
+		PublisherJWTKey:     []byte("publisher"),
+		TopicDefaultTargets: map[string][]string{"http://example.com/users/{id}": {"admin"}},
+	})
+
+	targets := make(chan map[string]struct{})
+	go func() {
+		for u := range hub.updates {
+			targets <- u.Targets
+		}
+	}()
+
+	publish := func(target string) int {
+		form := url.Values{}
+		form.Add("topic", "http://example.com/users/1")
+		form.Add("data", "foo")
+		if target != "" {
+			form.Add("target", target)
+		}
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		return w.Result().StatusCode
+	}
+
+	go func() { assert.Equal(t, http.StatusOK, publish("")) }()
+	assert.Equal(t, map[string]struct{}{"admin": {}}, <-targets)
+
+	// Explicit targets override the default ones
+	go func() { assert.Equal(t, http.StatusOK, publish("foo")) }()
+	assert.Equal(t, map[string]struct{}{"foo": {}}, <-targets)
 }
 
 func TestPublishOK(t *testing.T) {
@@ -181,10 +744,86 @@ func TestPublishOK(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Equal(t, "id", string(body))
+	assert.Equal(t, "id", resp.Header.Get("X-Mercure-Event-ID"))
+
+	wg.Wait()
+}
+
+func TestPublishJSON(t *testing.T) {
+	hub := createDummy()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func(w *sync.WaitGroup) {
+		defer w.Done()
+		u := <-hub.updates
+		assert.Equal(t, "id", u.ID)
+		assert.Equal(t, []string{"http://example.com/books/1"}, u.Topics)
+		assert.Equal(t, "Hello!", u.Data)
+		assert.Equal(t, uint64(1000), u.Retry)
+		assert.Equal(t, struct{}{}, u.Targets["foo"])
+		assert.Equal(t, struct{}{}, u.Targets["bar"])
+	}(&wg)
+
+	body := `{"topic": "http://example.com/books/1", "data": "Hello!", "targets": ["foo", "bar"], "id": "id", "retry": 1000}`
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo", "bar"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	resp := w.Result()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "id", string(respBody))
+	assert.Equal(t, "id", resp.Header.Get("X-Mercure-Event-ID"))
 
 	wg.Wait()
 }
 
+func TestPublishJSONInvalid(t *testing.T) {
+	testCases := []struct {
+		body       string
+		statusCode int
+		message    string
+	}{
+		{`{"data": "foo"}`, http.StatusBadRequest, "Missing \"topic\" parameter\n"},
+		{`{"topic": "http://example.com/books/1"}`, http.StatusBadRequest, "Missing \"data\" parameter\n"},
+		{`{"topic": "http://example.com/books/1", "data": "foo", "retry": -1}`, http.StatusBadRequest, "Invalid JSON body\n"},
+		{`{"topic": "http://example.com/books/1", "data": "foo", "targets": "not-allowed"}`, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized) + "\n"},
+	}
+
+	for _, tc := range testCases {
+		// Nothing consumes the updates channel: the test would block if an update was published
+		hub := createDummy()
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(tc.body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		assert.Equal(t, tc.statusCode, w.Code)
+		assert.Equal(t, tc.message, w.Body.String())
+	}
+}
+
+func TestPublishUnsupportedContentType(t *testing.T) {
+	hub := createDummy()
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader("topic=http://example.com/books/1&data=foo"))
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+	req.Header.Add("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, "Unsupported \"Content-Type\", the body must be encoded as \"application/x-www-form-urlencoded\", \"application/json\" or \"application/x-ndjson\"\n", w.Body.String())
+}
+
 func TestPublishGenerateUUID(t *testing.T) {
 	hub := createDummy()
 
@@ -223,3 +862,8 @@ func TestPublishGenerateUUID(t *testing.T) {
 	_, err := uuid.FromString(body)
 	assert.Nil(t, err)
 }
+
+func TestDistinctValues(t *testing.T) {
+	assert.Equal(t, []string{"b", "a"}, distinctValues([]string{"b", "a", "b"}))
+	assert.Empty(t, distinctValues(nil))
+}
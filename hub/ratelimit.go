@@ -0,0 +1,107 @@
+package hub
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimiterBuckets bounds the memory used by the rate limiter when many different publishers are seen
+const maxRateLimiterBuckets = 10000
+
+// rateLimiter limits the number of publish requests per publisher using the token bucket algorithm
+type rateLimiter struct {
+	sync.Mutex
+	// rate is the number of tokens added to each bucket per second, the limiter is disabled if it is 0
+	rate float64
+	// burst is the capacity of each bucket
+	burst float64
+	m     map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{rate: rate, burst: float64(burst), m: make(map[string]*tokenBucket)}
+}
+
+// allow consumes a token from the bucket associated with the key
+// If the bucket is empty, it returns false and the delay before a token is available
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.m[key]
+	if !ok {
+		l.evict(now)
+		b = &tokenBucket{l.burst, now}
+		l.m[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+
+	b.tokens--
+
+	return true, 0
+}
+
+// evict removes the buckets that are full again (they are equivalent to new ones) when the limit is reached
+// If none can be removed, an arbitrary bucket is dropped
+func (l *rateLimiter) evict(now time.Time) {
+	if len(l.m) < maxRateLimiterBuckets {
+		return
+	}
+
+	for k, b := range l.m {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.m, k)
+		}
+	}
+
+	for k := range l.m {
+		if len(l.m) < maxRateLimiterBuckets {
+			return
+		}
+
+		delete(l.m, k)
+	}
+}
+
+// rateLimiterKey identifies the publisher using the "sub" claim of its JWT, or its IP address
+func rateLimiterKey(r *http.Request, claims *claims) string {
+	if claims.Subject != "" {
+		return "sub:" + claims.Subject
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// sendTooManyRequests replies with a 429 status code and a Retry-After header (in seconds)
+func sendTooManyRequests(w http.ResponseWriter, delay time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(delay.Seconds())), 10))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	now := time.Now()
+
+	ok, _ := l.allow("foo", now)
+	assert.True(t, ok)
+	ok, _ = l.allow("foo", now)
+	assert.True(t, ok)
+
+	ok, delay := l.allow("foo", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, delay)
+
+	// Other keys have their own bucket
+	ok, _ = l.allow("bar", now)
+	assert.True(t, ok)
+
+	ok, _ = l.allow("foo", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(0, 0)
+	for i := 0; i < 10; i++ {
+		ok, _ := l.allow("foo", time.Now())
+		assert.True(t, ok)
+	}
+	assert.Empty(t, l.m)
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := time.Now()
+
+	for i := 0; i < maxRateLimiterBuckets+10; i++ {
+		l.allow(strconv.Itoa(i), now)
+	}
+	assert.Len(t, l.m, maxRateLimiterBuckets)
+
+	// Full buckets are evicted first
+	l.allow("foo", now.Add(time.Second))
+	assert.Len(t, l.m, 1)
+}
+
+func TestRateLimiterKey(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://example.com/hub", nil)
+	assert.Equal(t, "ip:192.0.2.1", rateLimiterKey(r, &claims{}))
+	assert.Equal(t, "sub:partner", rateLimiterKey(r, &claims{StandardClaims: jwt.StandardClaims{Subject: "partner"}}))
+}
+
+func TestPublishRateLimited(t *testing.T) {
+	hub := createDummy()
+	hub.rateLimiter = newRateLimiter(0.5, 1)
+
+	for i, status := range []int{http.StatusBadRequest, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "http://example.com/hub", nil)
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{}))
+		w := httptest.NewRecorder()
+		hub.PublishHandler(w, req)
+
+		assert.Equal(t, status, w.Code)
+		if i == 1 {
+			assert.Equal(t, "2", w.Header().Get("Retry-After"))
+		}
+	}
+}
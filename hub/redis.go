@@ -0,0 +1,390 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// redisBlockTimeout is the maximum duration of a read of the stream, the listener checks if the hub has been stopped in between
+	redisBlockTimeout = time.Second
+	// redisRetryDelay is the time to wait before reading the stream again after an error
+	redisRetryDelay = time.Second
+	// redisPageSize is the number of entries retrieved at once when looking for the missed updates
+	redisPageSize = 100
+)
+
+// errInvalidRedisReply is returned when Redis doesn't reply with the expected structure
+var errInvalidRedisReply = errors.New("invalid Redis reply")
+
+// redisTransport publishes the updates in a Redis stream, and dispatches the updates added to this stream to the local subscribers
+// All the hubs sharing the stream receive all the updates, the stream is also used as the history to retrieve the missed updates
+type redisTransport struct {
+	pool   *redis.Pool
+	stream string
+	// maxLen is the approximate number of updates kept in the stream, they are kept forever if it is 0
+	maxLen int
+	// lastID is the ID of the last entry of the stream when the transport has been created, the listener dispatches the next ones
+	lastID string
+}
+
+// redisEntry is an entry of the stream, the update is decoded only if it must be sent
+type redisEntry struct {
+	id      string
+	eventID string
+	update  string
+	// sequences contains the comma-separated sequence numbers of the distinct topics of the update, in order, when TopicSequence is enabled
+	sequences string
+}
+
+// redisPublishScript increments the counters of the topics and adds the update to the stream atomically,
+// the sequence numbers of the entries of every topic are then increasing in the order of the stream, whichever hub published them
+// KEYS are the stream and the hash of the counters, ARGV the maximum length of the stream (0 if unlimited), the event ID, the update and its distinct topics
+var redisPublishScript = redis.NewScript(2, `
+local sequences = {}
+for i = 4, #ARGV do
+	sequences[#sequences + 1] = redis.call('HINCRBY', KEYS[2], ARGV[i], 1)
+end
+
+local args = {'XADD', KEYS[1]}
+if tonumber(ARGV[1]) > 0 then
+	table.insert(args, 'MAXLEN')
+	table.insert(args, '~')
+	table.insert(args, ARGV[1])
+end
+for _, v in ipairs({'*', 'id', ARGV[2], 'update', ARGV[3], 'sequences', table.concat(sequences, ',')}) do
+	table.insert(args, v)
+end
+
+return redis.call(unpack(args))
+`)
+
+// newRedisTransport connects to Redis, an error is returned if the server cannot be reached
+func newRedisTransport(rawURL, stream string, maxLen int) (*redisTransport, error) {
+	pool := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(rawURL)
+		},
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	entries, err := parseRedisEntries(conn.Do("XREVRANGE", stream, "+", "-", "COUNT", 1))
+	if err != nil {
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+
+	lastID := "0"
+	if len(entries) == 1 {
+		lastID = entries[0].id
+	}
+
+	return &redisTransport{pool, stream, maxLen, lastID}, nil
+}
+
+// Publish adds the update to the stream, it is then dispatched by the listener of every hub, including this one
+func (t *redisTransport) Publish(h *Hub, u *Update) error {
+	if h.isStopped() {
+		return errHubStopped
+	}
+
+	if u.ID == "" {
+		u.ID = uuid.Must(uuid.NewV4()).String()
+	}
+
+	buf, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	conn := t.pool.Get()
+	defer conn.Close()
+
+	if h.options.TopicSequence {
+		_, err = redisPublishScript.Do(conn, redis.Args{t.stream, t.sequencesKey(), t.maxLen, u.ID, buf}.AddFlat(distinctValues(u.Topics))...)
+
+		return err
+	}
+
+	args := redis.Args{t.stream}
+	if t.maxLen > 0 {
+		args = args.Add("MAXLEN", "~", t.maxLen)
+	}
+
+	_, err = conn.Do("XADD", args.Add("*", "id", u.ID, "update", buf)...)
+
+	return err
+}
+
+// sequencesKey returns the key of the hash containing the last sequence number of every topic
+func (t *redisTransport) sequencesKey() string {
+	return t.stream + ":sequences"
+}
+
+// assignsSequences marks the transport as assigning the sequence numbers, they must be shared by all the hubs
+func (*redisTransport) assignsSequences() {}
+
+// Add does nothing, the update has already been added to the stream by Publish
+func (*redisTransport) Add(*Update) error {
+	return nil
+}
+
+// FindFor retrieves the updates added to the stream after the Last-Event-ID (or since the date requested by the subscriber), in order
+// If the Last-Event-ID isn't in the stream anymore, all the available updates are retrieved, starting from the oldest one
+func (t *redisTransport) FindFor(subscriber *Subscriber, onItem func(*Update) bool) error {
+	conn := t.pool.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	send := func(e *redisEntry) (bool, error) {
+		u, err := e.decode()
+		if err != nil {
+			return false, err
+		}
+
+		if u.expired(e.addedAt(), now) {
+			return true, nil
+		}
+
+		return !subscriber.CanReceive(u) || onItem(u), nil
+	}
+
+	if subscriber.LastEventID == "" && subscriber.resumePosition != "" {
+		start, err := nextRedisStreamID(subscriber.resumePosition)
+		if err != nil {
+			return err
+		}
+
+		return t.rangeEntries(conn, start, send)
+	}
+
+	// Without Last-Event-ID nor resume token, the updates are selected using the date requested by the subscriber, stream IDs start with the number of milliseconds since the epoch
+	if subscriber.LastEventID == "" {
+		start := "-"
+		if subscriber.From.After(time.Unix(0, 0)) {
+			start = strconv.FormatInt(subscriber.From.UnixNano()/int64(time.Millisecond), 10)
+		}
+
+		return t.rangeEntries(conn, start, send)
+	}
+
+	afterLastEventID := false
+	err := t.rangeEntries(conn, "-", func(e *redisEntry) (bool, error) {
+		if afterLastEventID {
+			return send(e)
+		}
+
+		afterLastEventID = e.eventID == subscriber.LastEventID
+		return true, nil
+	})
+	if err != nil || afterLastEventID {
+		return err
+	}
+
+	if err := t.rangeEntries(conn, "-", send); err != nil {
+		return err
+	}
+
+	return errLastEventIDNotFound
+}
+
+// head returns the ID of the latest entry of the stream, or the smallest possible ID if the stream is empty
+func (t *redisTransport) head() (string, error) {
+	conn := t.pool.Get()
+	defer conn.Close()
+
+	entries, err := parseRedisEntries(conn.Do("XREVRANGE", t.stream, "+", "-", "COUNT", 1))
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "0-0", nil
+	}
+
+	return entries[0].id, nil
+}
+
+// validPosition checks that the position is a stream ID
+func (*redisTransport) validPosition(position string) bool {
+	parts := strings.SplitN(position, "-", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rangeEntries calls fn for every entry of the stream starting from this ID, in order, until it returns false or an error
+func (t *redisTransport) rangeEntries(conn redis.Conn, start string, fn func(*redisEntry) (bool, error)) error {
+	for {
+		entries, err := parseRedisEntries(conn.Do("XRANGE", t.stream, start, "+", "COUNT", redisPageSize))
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if next, err := fn(e); err != nil || !next {
+				return err
+			}
+		}
+
+		if len(entries) < redisPageSize {
+			return nil
+		}
+
+		if start, err = nextRedisStreamID(entries[len(entries)-1].id); err != nil {
+			return err
+		}
+	}
+}
+
+// listen dispatches the updates added to the stream to the local subscribers, until the hub is stopped
+func (t *redisTransport) listen(h *Hub) {
+	lastID := t.lastID
+	for !h.isStopped() {
+		entries, err := t.read(lastID)
+		if err != nil {
+			h.logger.Error("Failed to read the Redis stream", "stream", t.stream, "error", err)
+			time.Sleep(redisRetryDelay)
+			continue
+		}
+
+		for _, e := range entries {
+			lastID = e.id
+
+			u, err := e.decode()
+			if err != nil {
+				h.logger.Error("Invalid update in the Redis stream", "stream", t.stream, "entry_id", e.id, "error", err)
+				continue
+			}
+
+			if err := h.DispatchUpdate(u); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// read waits for the entries added to the stream after lastID, it returns no entries if none has been added before the timeout
+func (t *redisTransport) read(lastID string) ([]*redisEntry, error) {
+	conn := t.pool.Get()
+	defer conn.Close()
+
+	streams, err := redis.Values(conn.Do("XREAD", "BLOCK", int64(redisBlockTimeout/time.Millisecond), "STREAMS", t.stream, lastID))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only one stream is read, the reply contains its name and its entries
+	if len(streams) != 1 {
+		return nil, errInvalidRedisReply
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, errInvalidRedisReply
+	}
+
+	return parseRedisEntries(stream[1], nil)
+}
+
+// parseRedisEntries converts a list of stream entries, it is designed to wrap a call to Do like the helpers provided by redigo
+func parseRedisEntries(reply interface{}, err error) ([]*redisEntry, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*redisEntry, 0, len(values))
+	for _, v := range values {
+		entry, err := redis.Values(v, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, errInvalidRedisReply
+		}
+
+		id, err := redis.String(entry[0], nil)
+		if err != nil {
+			return nil, errInvalidRedisReply
+		}
+
+		fields, err := redis.StringMap(entry[1], nil)
+		if err != nil {
+			return nil, errInvalidRedisReply
+		}
+
+		entries = append(entries, &redisEntry{id, fields["id"], fields["update"], fields["sequences"]})
+	}
+
+	return entries, nil
+}
+
+// nextRedisStreamID returns the smallest ID greater than the given one, to retrieve the next page of a range
+func nextRedisStreamID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", errInvalidRedisReply
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", errInvalidRedisReply
+	}
+
+	return parts[0] + "-" + strconv.FormatUint(seq+1, 10), nil
+}
+
+// decode unmarshals the update stored in the entry
+func (e *redisEntry) decode() (*Update, error) {
+	var u Update
+	if err := json.Unmarshal([]byte(e.update), &u); err != nil {
+		return nil, err
+	}
+
+	if e.sequences != "" {
+		topics := distinctValues(u.Topics)
+		sequences := strings.Split(e.sequences, ",")
+		if len(sequences) != len(topics) {
+			return nil, errInvalidRedisReply
+		}
+
+		u.Sequences = make(map[string]uint64, len(topics))
+		for i, topic := range topics {
+			seq, err := strconv.ParseUint(sequences[i], 10, 64)
+			if err != nil {
+				return nil, errInvalidRedisReply
+			}
+			u.Sequences[topic] = seq
+		}
+	}
+
+	return &u, nil
+}
+
+// addedAt returns the date the entry has been added to the stream, according to the clock of the Redis server
+// It is extracted from the ID of the entry, which starts with the number of milliseconds since the epoch
+func (e *redisEntry) addedAt() time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(e.id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,265 @@
+package hub
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/yosida95/uritemplate"
+)
+
+func createRedisTransport(t *testing.T, s *miniredis.Miniredis, maxLen int) *redisTransport {
+	transport, err := newRedisTransport("redis://"+s.Addr(), "mercure", maxLen)
+	assert.Nil(t, err)
+
+	return transport
+}
+
+func TestNewRedisTransportUnreachable(t *testing.T) {
+	s := miniredis.RunT(t)
+	addr := s.Addr()
+	s.Close()
+
+	_, err := newRedisTransport("redis://"+addr, "mercure", 0)
+	assert.Error(t, err)
+}
+
+func TestRedisTransportDispatchToAllHubs(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	var subscribers []chan *serializedUpdate
+	var publisher *Hub
+	for i := 0; i < 2; i++ {
+		transport := createRedisTransport(t, s, 0)
+		h := NewHub(transport, transport, &Options{})
+		h.Start()
+		defer h.Stop()
+
+		updates, ok := h.registerSubscriber(nil)
+		assert.True(t, ok)
+		subscribers = append(subscribers, updates)
+		publisher = h
+	}
+
+	u := &Update{Topics: []string{"http://example.com/books/1"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{Data: "Hello"}}
+	assert.Nil(t, publisher.publisher.Publish(publisher, u))
+	assert.NotEmpty(t, u.ID)
+
+	for _, updates := range subscribers {
+		received := <-updates
+		assert.Equal(t, u.ID, received.ID)
+		assert.Equal(t, u.Topics, received.Topics)
+		assert.Equal(t, u.Targets, received.Targets)
+		assert.Equal(t, "Hello", received.Data)
+	}
+}
+
+func TestRedisTransportTopicSequence(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	var hubs []*Hub
+	var subscribers []chan *serializedUpdate
+	for i := 0; i < 2; i++ {
+		transport := createRedisTransport(t, s, 10)
+		h := NewHub(transport, transport, &Options{TopicSequence: true})
+		assert.Nil(t, h.sequences)
+		h.Start()
+		defer h.Stop()
+
+		updates, ok := h.registerSubscriber(nil)
+		assert.True(t, ok)
+		hubs = append(hubs, h)
+		subscribers = append(subscribers, updates)
+	}
+
+	// The counters are shared by the hubs
+	for i, h := range hubs {
+		assert.Nil(t, h.publisher.Publish(h, &Update{Topics: []string{"http://example.com/books/1", "http://example.com/books/2"}, Event: Event{ID: fmt.Sprintf("update-%d", i), Data: "Hello"}}))
+	}
+	for _, updates := range subscribers {
+		assert.Equal(t, map[string]uint64{"http://example.com/books/1": 1, "http://example.com/books/2": 1}, (<-updates).Sequences)
+		assert.Equal(t, map[string]uint64{"http://example.com/books/1": 2, "http://example.com/books/2": 2}, (<-updates).Sequences)
+	}
+
+	// The replayed updates contain them too
+	var sequences []uint64
+	assert.Nil(t, hubs[0].history.FindFor(NewSubscriber(true, nil, nil, []string{"http://example.com/books/2"}, nil, "update-0"), func(u *Update) bool {
+		sequences = append(sequences, u.Sequences["http://example.com/books/2"])
+		return true
+	}))
+	assert.Equal(t, []uint64{2}, sequences)
+}
+
+func TestRedisTransportPublishStopped(t *testing.T) {
+	s := miniredis.RunT(t)
+	transport := createRedisTransport(t, s, 0)
+	h := NewHub(transport, transport, &Options{})
+	h.Stop()
+
+	assert.Equal(t, errHubStopped, transport.Publish(h, &Update{Topics: []string{"http://example.com/books/1"}}))
+	assert.False(t, s.Exists("mercure"))
+}
+
+func TestRedisTransportMaxLen(t *testing.T) {
+	s := miniredis.RunT(t)
+	transport := createRedisTransport(t, s, 2)
+	h := NewHub(transport, transport, &Options{})
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, transport.Publish(h, &Update{Topics: []string{"http://example.com/books/1"}}))
+	}
+
+	entries, err := s.Stream("mercure")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestRedisTransportFindFor(t *testing.T) {
+	s := miniredis.RunT(t)
+	transport := createRedisTransport(t, s, 0)
+	h := NewHub(transport, transport, &Options{})
+
+	// More updates than a page of the stream
+	for i := 0; i < redisPageSize+10; i++ {
+		topic := "http://example.com/books/1"
+		if i%2 == 1 {
+			topic = "http://example.com/reviews/1"
+		}
+
+		assert.Nil(t, transport.Publish(h, &Update{Topics: []string{topic}, Event: Event{ID: fmt.Sprint(i)}}))
+	}
+
+	find := func(lastEventID string) ([]string, error) {
+		var ids []string
+		err := transport.FindFor(NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/books/1"}, []*uritemplate.Template{}, lastEventID), func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return len(ids) < 3
+		})
+
+		return ids, err
+	}
+
+	ids, err := find("100")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"102", "104", "106"}, ids)
+
+	ids, err = find("unknown")
+	assert.Equal(t, errLastEventIDNotFound, err)
+	assert.Equal(t, []string{"0", "2", "4"}, ids)
+}
+
+func TestRedisTransportFindForFrom(t *testing.T) {
+	s := miniredis.RunT(t)
+	for i, id := range []string{"first", "second", "third"} {
+		s.XAdd("mercure", fmt.Sprintf("%d-0", (i+1)*60000), []string{"id", id, "update", `{"Topics": ["http://example.com/books/1"], "ID": "` + id + `"}`})
+	}
+	transport := createRedisTransport(t, s, 0)
+
+	find := func(lastEventID string, from time.Time) []string {
+		s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/books/1"}, []*uritemplate.Template{}, lastEventID)
+		s.From = from
+
+		var ids []string
+		assert.Nil(t, transport.FindFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+
+		return ids
+	}
+
+	assert.Equal(t, []string{"second", "third"}, find("", time.Unix(120, 0)))
+	assert.Equal(t, []string{"second", "third"}, find("", time.Unix(90, 0)))
+	assert.Equal(t, []string{"first", "second", "third"}, find("", time.Unix(0, 0)))
+	assert.Empty(t, find("", time.Unix(3600, 0)))
+	// The Last-Event-ID takes precedence
+	assert.Equal(t, []string{"third"}, find("second", time.Unix(0, 0)))
+}
+
+func TestRedisTransportFindForResume(t *testing.T) {
+	s := miniredis.RunT(t)
+	transport := createRedisTransport(t, s, 0)
+
+	empty, err := transport.head()
+	assert.Nil(t, err)
+	assert.Equal(t, "0-0", empty)
+
+	s.XAdd("mercure", "60000-0", []string{"id", "first", "update", `{"Topics": ["http://example.com/books/1"], "ID": "first"}`})
+	position, err := transport.head()
+	assert.Nil(t, err)
+	assert.Equal(t, "60000-0", position)
+	assert.True(t, transport.validPosition(position))
+	assert.False(t, transport.validPosition("foo-0"))
+	s.XAdd("mercure", "120000-0", []string{"id", "second", "update", `{"Topics": ["http://example.com/books/1"], "ID": "second"}`})
+
+	find := func(position string) []string {
+		s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/books/1"}, []*uritemplate.Template{}, "")
+		s.resumePosition = position
+
+		var ids []string
+		assert.Nil(t, transport.FindFor(s, func(u *Update) bool {
+			ids = append(ids, u.ID)
+			return true
+		}))
+
+		return ids
+	}
+
+	assert.Equal(t, []string{"first", "second"}, find(empty))
+	assert.Equal(t, []string{"second"}, find(position))
+	assert.Empty(t, find("120000-0"))
+}
+
+func TestRedisTransportFindForTTL(t *testing.T) {
+	s := miniredis.RunT(t)
+	// Added a long time ago
+	s.XAdd("mercure", "60000-0", []string{"id", "expired", "update", `{"Topics": ["http://example.com/books/1"], "ID": "expired", "TTL": 3600000000000}`})
+	s.XAdd("mercure", "120000-0", []string{"id", "kept", "update", `{"Topics": ["http://example.com/books/1"], "ID": "kept"}`})
+	s.XAdd("mercure", "*", []string{"id", "recent", "update", `{"Topics": ["http://example.com/books/1"], "ID": "recent", "TTL": 3600000000000}`})
+	transport := createRedisTransport(t, s, 0)
+
+	var ids []string
+	assert.Nil(t, transport.FindFor(NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/books/1"}, []*uritemplate.Template{}, ""), func(u *Update) bool {
+		ids = append(ids, u.ID)
+		return true
+	}))
+	assert.Equal(t, []string{"kept", "recent"}, ids)
+}
+
+func TestRedisTransportListenFromCreation(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.XAdd("mercure", "*", []string{"id", "before", "update", `{"Topics": ["http://example.com/books/1"], "ID": "before"}`})
+
+	transport := createRedisTransport(t, s, 0)
+	h := NewHub(transport, transport, &Options{})
+
+	// Published before the listener is started, but after the transport has been created
+	assert.Nil(t, transport.Publish(h, &Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "after"}}))
+
+	go transport.listen(h)
+	defer h.Stop()
+
+	u := <-h.updates
+	assert.Equal(t, "after", u.ID)
+}
+
+func TestNewHubFromEnvRedis(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	os.Setenv("PUBLISHER_JWT_KEY", "foo")
+	os.Setenv("TRANSPORT", "redis")
+	os.Setenv("REDIS_URL", "redis://"+s.Addr())
+	defer os.Unsetenv("PUBLISHER_JWT_KEY")
+	defer os.Unsetenv("TRANSPORT")
+	defer os.Unsetenv("REDIS_URL")
+
+	h, db, err := NewHubFromEnv()
+	assert.NotNil(t, h)
+	assert.Nil(t, db)
+	assert.Nil(t, err)
+	assert.IsType(t, &redisTransport{}, h.publisher)
+	assert.IsType(t, &redisTransport{}, h.history)
+}
@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// defaultMaxReplayUpdates is the maximum number of updates returned by the replay endpoint when it isn't configured
+const defaultMaxReplayUpdates = 1000
+
+// positionNotFoundHeader is set when the Last-Event-ID or the resume token of a replay request hasn't been found in the history
+// The oldest available updates are then returned, as for the missed events of the subscribers
+const positionNotFoundHeader = "X-Mercure-Position-Not-Found"
+
+// ReplayHandler returns the updates of the history matching the topics of the request as a JSON array, without streaming the live ones
+// The request is authorized and parsed as a subscription: the updates are selected using the Last-Event-ID, the resume token or the date,
+// the ones the subscriber isn't allowed to receive are skipped, and at most Options.MaxReplayUpdates updates are returned, the oldest first
+func (h *Hub) ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.history.(*noHistory); ok || h.history == nil {
+		http.Error(w, "No history is configured.", http.StatusNotFound)
+		return
+	}
+
+	subscriber, _, ok := h.parseSubscription(w, r)
+	if !ok {
+		return
+	}
+	defer h.cleanup(subscriber)
+
+	max := h.options.MaxReplayUpdates
+	if max <= 0 {
+		max = defaultMaxReplayUpdates
+	}
+
+	messages := make([]webSocketMessage, 0)
+	err := h.history.FindFor(subscriber, func(u *Update) bool {
+		messages = append(messages, toWebSocketMessage(subscriber.redact(subscriber.updateFor(u))))
+
+		return len(messages) < max
+	})
+
+	switch err {
+	case nil:
+	case errLastEventIDNotFound, errResumePositionNotFound:
+		w.Header().Set(positionNotFoundHeader, "1")
+	default:
+		h.logger.Error("Failed to replay the history", "remote_addr", r.RemoteAddr, "last_event_id", subscriber.LastEventID, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("History replayed", "remote_addr", r.RemoteAddr, "topics", r.URL.Query()["topic"], "last_event_id", subscriber.LastEventID, "updates", len(messages))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(messages)
+}
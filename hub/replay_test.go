@@ -0,0 +1,107 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createReplayHistory() History {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "d1"}})
+	history.Add(&Update{Topics: []string{"http://example.com/books/2"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{ID: "b", Data: "d2"}})
+	history.Add(&Update{Topics: []string{"http://example.com/reviews/1"}, Event: Event{ID: "c", Data: "d3"}})
+	history.Add(&Update{Topics: []string{"http://example.com/books/3"}, Event: Event{ID: "d", Data: "d4", Type: "t"}})
+
+	return history
+}
+
+func replay(h *Hub, url, jwt string) ([]webSocketMessage, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest("GET", url, nil)
+	if jwt != "" {
+		req.Header.Add("Authorization", "Bearer "+jwt)
+	}
+
+	w := httptest.NewRecorder()
+	h.ReplayHandler(w, req)
+
+	var messages []webSocketMessage
+	json.Unmarshal(w.Body.Bytes(), &messages)
+
+	return messages, w
+}
+
+func TestReplay(t *testing.T) {
+	hub := createAnonymousDummyWithHistory(createReplayHistory())
+
+	messages, w := replay(hub, "http://example.com/hub/replay?topic=http://example.com/books/{id}", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	// The private update isn't returned to anonymous subscribers
+	assert.Equal(t, []webSocketMessage{
+		{ID: "a", Topic: "http://example.com/books/1", Data: "d1"},
+		{ID: "d", Topic: "http://example.com/books/3", Type: "t", Data: "d4"},
+	}, messages)
+
+	messages, _ = replay(hub, "http://example.com/hub/replay?topic=http://example.com/books/{id}&topic=http://example.com/reviews/1&Last-Event-ID=a", createDummyAuthorizedJWT(hub, false, []string{"foo"}))
+	assert.Equal(t, []string{"b", "c", "d"}, replayedIDs(messages))
+
+	hub.options.MaxReplayUpdates = 2
+	messages, _ = replay(hub, "http://example.com/hub/replay?topic=http://example.com/{collection}/{id}", "")
+	assert.Equal(t, []string{"a", "c"}, replayedIDs(messages))
+
+	// The whole history of the topic has been replayed
+	_, w = replay(hub, "http://example.com/hub/replay?topic=http://example.com/books/3&Last-Event-ID=d", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+	assert.Empty(t, w.Header().Get(positionNotFoundHeader))
+}
+
+func TestReplayLastEventIDNotFound(t *testing.T) {
+	hub := createAnonymousDummyWithHistory(createReplayHistory())
+
+	messages, w := replay(hub, "http://example.com/hub/replay?topic=http://example.com/books/1&Last-Event-ID=unknown", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get(positionNotFoundHeader))
+	assert.Equal(t, []string{"a"}, replayedIDs(messages))
+}
+
+func TestReplayInvalidRequest(t *testing.T) {
+	hub := createDummy()
+	hub.history = createReplayHistory()
+
+	_, w := replay(hub, "http://example.com/hub/replay?topic=http://example.com/books/1", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	_, w = replay(hub, "http://example.com/hub/replay", createDummyAuthorizedJWT(hub, false, []string{}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Missing \"topic\" parameter.\n", w.Body.String())
+}
+
+func TestReplayNoHistory(t *testing.T) {
+	hub := createAnonymousDummy()
+
+	_, w := replay(hub, "http://example.com/hub/replay?topic=http://example.com/books/1", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestReplayRoute(t *testing.T) {
+	hub := createAnonymousDummyWithHistory(createReplayHistory())
+
+	w := httptest.NewRecorder()
+	hub.chainHandlers().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/hub/replay?topic=http://example.com/books/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"a"`)
+}
+
+func replayedIDs(messages []webSocketMessage) []string {
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+
+	return ids
+}
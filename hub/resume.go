@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// resumeTokenVersion identifies the format of the resume tokens, the tokens of other versions are rejected
+// It must be changed every time the encoding of the tokens or of the positions of a history changes
+const resumeTokenVersion = "1"
+
+// resumableHistory is implemented by the histories able to retrieve the updates added after a given position, to resume a subscription
+// The positions are opaque strings, only meaningful for the history returning them, FindFor starts after Subscriber.resumePosition when it is set
+type resumableHistory interface {
+	// head returns the position of the latest update added to the history
+	head() (string, error)
+	// validPosition checks that a position, decoded from a token provided by a subscriber, has the format of the ones returned by head
+	validPosition(position string) bool
+}
+
+// errResumePositionNotFound is returned by FindFor when the position of the resume token can't be found in the history anymore
+// All the available updates have then been retrieved, starting from the oldest one
+var errResumePositionNotFound = errors.New("resume position not found in history")
+
+// errInvalidResumeToken is returned when the resume token can't be decoded, or has been issued by another version of the hub
+var errInvalidResumeToken = errors.New("invalid or unsupported resume token")
+
+// newResumeToken encodes the position of a history, with the version of the format of the token
+func newResumeToken(position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(resumeTokenVersion + ":" + position))
+}
+
+// parseResumeToken decodes the position contained in a token created by newResumeToken
+func parseResumeToken(token string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", errInvalidResumeToken
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 || parts[0] != resumeTokenVersion {
+		return "", errInvalidResumeToken
+	}
+
+	return parts[1], nil
+}
+
+// retrieveResumePosition extracts the position of the history encoded in the token passed in the "resume" query parameter
+// It is empty if the parameter isn't set
+func (h *Hub) retrieveResumePosition(r *http.Request) (string, error) {
+	token := r.URL.Query().Get("resume")
+	if token == "" {
+		return "", nil
+	}
+
+	history, ok := h.history.(resumableHistory)
+	if !ok {
+		return "", errors.New("the history of the hub doesn't allow to resume subscriptions")
+	}
+
+	position, err := parseResumeToken(token)
+	if err != nil {
+		return "", err
+	}
+	if !history.validPosition(position) {
+		return "", errInvalidResumeToken
+	}
+
+	return position, nil
+}
+
+// sendResumeToken sends a comment containing the token to pass in the "resume" query parameter to resume the subscription from the current head of the history
+// It must be called before retrieving the missed events and registering the subscriber, so that no update added in the meantime can be skipped when resuming
+func (h *Hub) sendResumeToken(w http.ResponseWriter, r *http.Request, s *Subscriber) {
+	history, ok := h.history.(resumableHistory)
+	if !ok {
+		return
+	}
+
+	position, err := history.head()
+	if err != nil {
+		h.logger.Error("Failed to retrieve the head of the history, no resume token sent", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+
+	fmt.Fprintf(w, ": resume-token %s\n", newResumeToken(position))
+	w.(http.Flusher).Flush()
+}
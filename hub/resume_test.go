@@ -0,0 +1,83 @@
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeToken(t *testing.T) {
+	position, err := parseResumeToken(newResumeToken("a:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a:1", position)
+
+	for _, token := range []string{"not base64!", "MTIz", "MDph"} {
+		_, err := parseResumeToken(token)
+		assert.Equal(t, errInvalidResumeToken, err, token)
+	}
+}
+
+func TestSubscribeResumeToken(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "d1"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.options.SendResumeToken = true
+	hub.Start()
+	defer hub.Stop()
+
+	subscribe := func(query string) string {
+		w := newCloseNotifyingRecorder()
+		done := make(chan struct{})
+		go func() {
+			hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1"+query, nil))
+			close(done)
+		}()
+
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if !empty {
+				break
+			}
+		}
+
+		w.close()
+		<-done
+
+		return w.Body.String()
+	}
+
+	// Nothing is received during the first connection
+	body := subscribe("")
+	matches := regexp.MustCompile(`^:\n: resume-token ([\w-]+)\n$`).FindStringSubmatch(body)
+	if !assert.Len(t, matches, 2, body) {
+		return
+	}
+
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "b", Data: "d2"}})
+
+	// Only the updates added after the token has been issued are sent
+	body = subscribe("&resume=" + matches[1])
+	assert.Regexp(t, `^:\n: resume-token [\w-]+\ntopic: http://example.com/books/1\nid: b\ndata: d2\n\n$`, body)
+}
+
+func TestSubscribeInvalidResumeToken(t *testing.T) {
+	hub := createAnonymousDummyWithHistory(newMemoryHistory(10, nil))
+
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&resume="+newResumeToken("foo"), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"resume\" parameter: invalid or unsupported resume token.\n", w.Body.String())
+
+	// The history doesn't allow to resume subscriptions
+	hub = createAnonymousDummyWithHistory(&noHistory{})
+	w = httptest.NewRecorder()
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&resume="+newResumeToken("1"), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
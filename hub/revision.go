@@ -0,0 +1,17 @@
+//go:build go1.18
+// +build go1.18
+
+package hub
+
+import "runtime/debug"
+
+// vcsRevision returns the commit from which the binary has been built, it is empty if the toolchain didn't record it
+func vcsRevision(info *debug.BuildInfo) string {
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,11 @@
+//go:build !go1.18
+// +build !go1.18
+
+package hub
+
+import "runtime/debug"
+
+// vcsRevision returns an empty string, the toolchain records the commit since Go 1.18
+func vcsRevision(*debug.BuildInfo) string {
+	return ""
+}
@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"net/http"
+	"sync"
+)
+
+// revokedTokens stores the IDs ("jti" claim) of the tokens that must be rejected even if they are still valid
+type revokedTokens struct {
+	sync.RWMutex
+	m map[string]struct{}
+}
+
+// contains checks if the token identified by this ID has been revoked
+func (rt *revokedTokens) contains(jti string) bool {
+	rt.RLock()
+	_, ok := rt.m[jti]
+	rt.RUnlock()
+
+	return ok
+}
+
+// RevokeToken rejects all tokens having this ID ("jti" claim) from now on
+func (h *Hub) RevokeToken(jti string) {
+	h.revokedTokens.Lock()
+	h.revokedTokens.m[jti] = struct{}{}
+	h.revokedTokens.Unlock()
+}
+
+// UnrevokeToken accepts again the tokens having this ID ("jti" claim)
+func (h *Hub) UnrevokeToken(jti string) {
+	h.revokedTokens.Lock()
+	delete(h.revokedTokens.m, jti)
+	h.revokedTokens.Unlock()
+}
+
+// RevokedTokensHandler allows to revoke (POST) or to restore (DELETE) the token identified by the "jti" parameter
+// Only publishers allowed to dispatch updates to all targets can use this endpoint
+func (h *Hub) RevokedTokensHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := authorize(r, h.getAuthorizationConfig(true))
+	if err != nil || claims == nil {
+		h.unauthorized(w, r, err)
+		return
+	}
+
+	if all, _, _ := authorizedTargets(claims, true); !all {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	jti := r.FormValue("jti")
+	if jti == "" {
+		http.Error(w, "Missing \"jti\" parameter", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		h.UnrevokeToken(jti)
+		h.logger.Info("Token unrevoked", "remote_addr", r.RemoteAddr, "jti", jti, "subject", claims.Subject)
+	} else {
+		h.RevokeToken(jti)
+		h.logger.Info("Token revoked", "remote_addr", r.RemoteAddr, "jti", jti, "subject", claims.Subject)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
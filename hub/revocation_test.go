@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevokeToken(t *testing.T) {
+	h := createDummy()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{mercureClaim{Subscribe: []string{"foo"}}, jwt.StandardClaims{Id: "leaked"}})
+	tokenString, _ := token.SignedString(h.options.SubscriberJWTKey)
+
+	claims, err := validateJWT(tokenString, h.getJWTConfig(false))
+	assert.NotNil(t, claims)
+	assert.Nil(t, err)
+
+	h.RevokeToken("leaked")
+	claims, err = validateJWT(tokenString, h.getJWTConfig(false))
+	assert.EqualError(t, err, "Token has been revoked")
+	assert.Nil(t, claims)
+
+	// Tokens without an ID are never revoked
+	claims, err = validateJWT(createDummyAuthorizedJWT(h, false, []string{}), h.getJWTConfig(false))
+	assert.NotNil(t, claims)
+	assert.Nil(t, err)
+
+	h.UnrevokeToken("leaked")
+	claims, err = validateJWT(tokenString, h.getJWTConfig(false))
+	assert.NotNil(t, claims)
+	assert.Nil(t, err)
+}
+
+func TestRevokedTokensHandler(t *testing.T) {
+	h := createDummy()
+
+	req := httptest.NewRequest("POST", "http://example.com/hub/revoked-tokens?jti=leaked", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{"*"}))
+	w := httptest.NewRecorder()
+	h.RevokedTokensHandler(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	assert.True(t, h.revokedTokens.contains("leaked"))
+
+	req = httptest.NewRequest("DELETE", "http://example.com/hub/revoked-tokens?jti=leaked", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{"*"}))
+	w = httptest.NewRecorder()
+	h.RevokedTokensHandler(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	assert.False(t, h.revokedTokens.contains("leaked"))
+}
+
+func TestRevokedTokensHandlerNotAllowed(t *testing.T) {
+	h := createDummy()
+
+	req := httptest.NewRequest("POST", "http://example.com/hub/revoked-tokens?jti=leaked", nil)
+	w := httptest.NewRecorder()
+	h.RevokedTokensHandler(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "http://example.com/hub/revoked-tokens?jti=leaked", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{"foo"}))
+	w = httptest.NewRecorder()
+	h.RevokedTokensHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	assert.False(t, h.revokedTokens.contains("leaked"))
+}
+
+func TestRevokedTokensHandlerNoJTI(t *testing.T) {
+	h := createDummy()
+
+	req := httptest.NewRequest("POST", "http://example.com/hub/revoked-tokens", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{"*"}))
+	w := httptest.NewRecorder()
+	h.RevokedTokensHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Equal(t, "Missing \"jti\" parameter\n", w.Body.String())
+}
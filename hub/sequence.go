@@ -0,0 +1,52 @@
+package hub
+
+// topicSequences assigns the sequence numbers of the updates in each of their topics, when TopicSequence is enabled
+// It is only used by the goroutine dispatching the updates: the numbers are assigned in the order the updates are dispatched, without locking
+type topicSequences struct {
+	// m contains the last number assigned in every topic, it grows with the number of distinct topics
+	m map[string]uint64
+	// store retrieves the last number of the topics the first time they are seen, it is nil if the history doesn't persist them
+	store sequenceStore
+}
+
+// sequenceStore is implemented by the persistent histories, which store the last sequence number of every topic along with the updates
+// The numbering then continues after a restart
+type sequenceStore interface {
+	lastSequence(topic string) (uint64, error)
+}
+
+// sequenceAssigner is implemented by the transports assigning the sequence numbers themselves when the updates are published, to share them between several hubs
+type sequenceAssigner interface {
+	assignsSequences()
+}
+
+func newTopicSequences(history History) *topicSequences {
+	store, _ := history.(sequenceStore)
+
+	return &topicSequences{make(map[string]uint64), store}
+}
+
+// assign sets the sequence numbers of the update, the next number of every one of its topics
+// Nothing is assigned if the last number of a topic can't be retrieved, to never reuse a number
+func (s *topicSequences) assign(u *Update) error {
+	topics := distinctValues(u.Topics)
+	sequences := make(map[string]uint64, len(topics))
+	for _, topic := range topics {
+		last, ok := s.m[topic]
+		if !ok && s.store != nil {
+			var err error
+			if last, err = s.store.lastSequence(topic); err != nil {
+				return err
+			}
+		}
+
+		sequences[topic] = last + 1
+	}
+
+	for topic, seq := range sequences {
+		s.m[topic] = seq
+	}
+	u.Sequences = sequences
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sequenceStoreStub map[string]uint64
+
+func (s sequenceStoreStub) lastSequence(topic string) (uint64, error) {
+	if topic == "http://example.com/broken" {
+		return 0, errors.New("broken")
+	}
+
+	return s[topic], nil
+}
+
+func TestTopicSequencesAssign(t *testing.T) {
+	s := &topicSequences{make(map[string]uint64), sequenceStoreStub{"http://example.com/2": 41}}
+
+	u := &Update{Topics: []string{"http://example.com/1", "http://example.com/2", "http://example.com/1"}}
+	assert.Nil(t, s.assign(u))
+	assert.Equal(t, map[string]uint64{"http://example.com/1": 1, "http://example.com/2": 42}, u.Sequences)
+
+	u = &Update{Topics: []string{"http://example.com/1"}}
+	assert.Nil(t, s.assign(u))
+	assert.Equal(t, map[string]uint64{"http://example.com/1": 2}, u.Sequences)
+
+	// No number is consumed when one of them can't be assigned
+	u = &Update{Topics: []string{"http://example.com/1", "http://example.com/broken"}}
+	assert.Error(t, s.assign(u))
+	assert.Nil(t, u.Sequences)
+	assert.Equal(t, uint64(2), s.m["http://example.com/1"])
+}
+
+func TestNewTopicSequences(t *testing.T) {
+	assert.Nil(t, newTopicSequences(&noHistory{}).store)
+	assert.NotNil(t, newTopicSequences(&boltHistory{}).store)
+}
@@ -3,39 +3,106 @@ package hub
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/unrolled/secure"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// shutdownTimeout is the time given to the connections to be closed when a signal is received
+const shutdownTimeout = 10 * time.Second
+
+// defaultShutdownRetry is the reconnection time (in milliseconds) sent to subscribers on shutdown when no default retry is configured
+const defaultShutdownRetry = 5000
+
+// Shutdown gracefully stops the hub: publishers and new subscribers get a 503 response,
+// connected subscribers are sent a reconnection time before being disconnected
+// The publish requests already accepted are given Options.PublishDrainTimeout to complete before the hub is stopped, the updates they publish are still dispatched
+// If the hub is served by Serve, it also waits for the connections to be closed until the context is done
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.state.Lock()
+	h.state.shutdown = true
+	h.state.Unlock()
+	h.drainPublishes(ctx)
+	h.Stop()
+
+	// Serve may be setting the server concurrently
+	h.state.RLock()
+	server := h.server
+	h.state.RUnlock()
+
+	if server == nil {
+		return nil
+	}
+
+	return server.Shutdown(ctx)
+}
+
+// drainPublishes waits for the publish requests in progress to complete, until the drain timeout expires or the context is done
+// No publish request is accepted anymore once the hub is shutting down, the wait group can't be incremented while waiting
+func (h *Hub) drainPublishes(ctx context.Context) {
+	if h.options.PublishDrainTimeout == time.Duration(0) {
+		return
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		h.publishes.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(h.options.PublishDrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+	case <-timer.C:
+		h.logger.Warn("Publish requests still in progress after the drain timeout", "publish_drain_timeout", h.options.PublishDrainTimeout)
+	case <-ctx.Done():
+	}
+}
+
 // Serve starts the HTTP server
 func (h *Hub) Serve() {
-	h.server = &http.Server{
-		Addr:         h.options.Addr,
-		Handler:      h.chainHandlers(),
-		ReadTimeout:  h.options.ReadTimeout,
+	server := &http.Server{
+		Addr:              h.options.Addr,
+		Handler:           h.chainHandlers(),
+		ReadTimeout:       h.options.ReadTimeout,
+		ReadHeaderTimeout: h.options.ReadHeaderTimeout,
+		// The streams reset the write deadline before each write, the write timeout doesn't limit their duration (see resetStreamWriteDeadline)
 		WriteTimeout: h.options.WriteTimeout,
+		IdleTimeout:  h.options.IdleTimeout,
 	}
-	h.server.RegisterOnShutdown(func() {
+	server.RegisterOnShutdown(func() {
 		h.Stop()
 	})
 
+	h.state.Lock()
+	h.server = server
+	h.state.Unlock()
+
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
 
-		if err := h.server.Shutdown(context.Background()); err != nil {
-			log.Error(err)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := h.Shutdown(ctx); err != nil {
+			h.logger.Error("Failed to shut down the server", "error", err)
 		}
-		log.Infoln("My Baby Shot Me Down")
+		h.logger.Info("My Baby Shot Me Down")
 		close(idleConnsClosed)
 	}()
 
@@ -43,8 +110,8 @@ func (h *Hub) Serve() {
 	var err error
 
 	if !acme && h.options.CertFile == "" && h.options.KeyFile == "" {
-		log.WithFields(log.Fields{"protocol": "http"}).Info("Mercure started")
-		err = h.server.ListenAndServe()
+		h.logger.Info("Mercure started", "protocol", "http", "addr", h.options.Addr)
+		err = h.listenAndServe(":http", func(ln net.Listener) error { return h.server.Serve(ln) })
 	} else {
 		// TLS
 		if acme {
@@ -57,27 +124,112 @@ func (h *Hub) Serve() {
 			}
 			h.server.TLSConfig = certManager.TLSConfig()
 
-			// Mandatory for Let's Encrypt http-01 challenge
-			go http.ListenAndServe(":http", certManager.HTTPHandler(nil))
+			// Mandatory for Let's Encrypt http-01 challenge, other requests are redirected to HTTPS
+			challengeServer := &http.Server{Addr: h.options.AcmeHTTP01Addr, Handler: certManager.HTTPHandler(nil)}
+			h.server.RegisterOnShutdown(func() {
+				challengeServer.Shutdown(context.Background())
+			})
+			go func() {
+				if err := challengeServer.ListenAndServe(); err != http.ErrServerClosed {
+					h.logger.Error("The ACME challenge server stopped unexpectedly", "addr", h.options.AcmeHTTP01Addr, "error", err)
+				}
+			}()
 		}
 
-		log.WithFields(log.Fields{"protocol": "https"}).Info("Mercure started")
-		err = h.server.ListenAndServeTLS(h.options.CertFile, h.options.KeyFile)
+		h.logger.Info("Mercure started", "protocol", "https", "addr", h.options.Addr)
+		err = h.listenAndServe(":https", func(ln net.Listener) error { return h.server.ServeTLS(ln, h.options.CertFile, h.options.KeyFile) })
 	}
 
 	if err != http.ErrServerClosed {
-		log.Error(err)
+		h.logger.Error("The server stopped unexpectedly", "error", err)
 	}
 
 	<-idleConnsClosed
 }
 
+// listenAndServe listens on the configured address, or on the default one of the protocol, and serves the connections using serve
+// The TCP keep-alive probes detect the half-open connections of the subscribers gone without closing them: once the probes fail,
+// the server cancels the context of the request, and the subscriber is removed (see Options.TCPKeepAlive)
+func (h *Hub) listenAndServe(defaultAddr string, serve func(net.Listener) error) error {
+	addr := h.server.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	ln, err := (&net.ListenConfig{KeepAlive: h.options.TCPKeepAlive}).Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return serve(ln)
+}
+
+// resetStreamWriteDeadline gives the next writes of a long-lived response, such as an event stream, the time allowed by the write timeout, counted from now
+// The server sets the write deadline once, when the request is read: without resetting it, every stream would be closed when the write timeout expires
+// The deadline can only be reset with Go 1.20 or later
+func (h *Hub) resetStreamWriteDeadline(w http.ResponseWriter, r *http.Request) {
+	if h.options.WriteTimeout != time.Duration(0) {
+		setWriteDeadline(w, r, time.Now().Add(h.options.WriteTimeout))
+	}
+}
+
+// defaultHubPath is the base path of the endpoints when it isn't configured
+const defaultHubPath = "/hub"
+
+// basePath returns the configured base path of the endpoints, or defaultHubPath
+func (h *Hub) basePath() string {
+	if h.options.BasePath == "" {
+		return defaultHubPath
+	}
+
+	return h.options.BasePath
+}
+
+// endpointPath returns the path of an endpoint under the base path
+func (h *Hub) endpointPath(path string) string {
+	return strings.TrimSuffix(h.basePath(), "/") + path
+}
+
+// hubPath returns the configured path of the subscribe or the publish endpoint, or the base path
+func (h *Hub) hubPath(path string) string {
+	if path == "" {
+		return h.basePath()
+	}
+
+	return path
+}
+
+// Handler returns the handler serving all the endpoints of the hub, to mount it in another server
+// The paths are matched against the path of the request: when the hub is mounted under a prefix, strip it using http.StripPrefix
+func (h *Hub) Handler() http.Handler {
+	return h.chainHandlers()
+}
+
 // chainHandlers configures and chains handlers
 func (h *Hub) chainHandlers() http.Handler {
 	r := mux.NewRouter()
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
 
-	r.HandleFunc("/hub", h.SubscribeHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/hub", h.PublishHandler).Methods("POST")
+	r.HandleFunc(h.hubPath(h.options.SubscribePath), h.SubscribeHandler).Methods("GET", "HEAD")
+	r.HandleFunc(h.hubPath(h.options.PublishPath), h.PublishHandler).Methods("POST")
+	r.HandleFunc(h.endpointPath("/replay"), h.ReplayHandler).Methods("GET")
+	r.HandleFunc(h.endpointPath("/revoked-tokens"), h.RevokedTokensHandler).Methods("POST", "DELETE")
+	r.HandleFunc(h.endpointPath("/subscriptions"), h.SubscriptionsHandler).Methods("GET")
+	r.HandleFunc(h.endpointPath("/subscriptions/events"), h.SubscriptionEventsHandler).Methods("GET")
+	if h.options.HealthCheckPath != "" {
+		r.HandleFunc(h.options.HealthCheckPath, h.HealthCheckHandler).Methods("GET", "HEAD")
+	}
+	if h.webhooks != nil {
+		r.HandleFunc(h.endpointPath("/webhooks"), h.WebhooksHandler).Methods("POST", "DELETE")
+	}
+	if h.options.WebSocket {
+		r.HandleFunc(h.endpointPath("/ws"), h.WebSocketHandler).Methods("GET")
+	}
+	if h.options.Metrics {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(h.metrics, prometheus.NewGoCollector())
+		r.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{})).Methods("GET")
+	}
 	if h.options.Demo {
 		r.PathPrefix("/demo").HandlerFunc(demo).Methods("GET", "HEAD")
 		r.PathPrefix("/").Handler(http.FileServer(http.Dir("public")))
@@ -101,25 +253,34 @@ func (h *Hub) chainHandlers() http.Handler {
 	var corsHandler http.Handler
 	if len(h.options.CorsAllowedOrigins) > 0 {
 		allowedOrigins := handlers.AllowedOrigins(h.options.CorsAllowedOrigins)
-		allowedHeaders := handlers.AllowedHeaders([]string{"authorization"})
+		// Last-Event-ID is sent by EventSource polyfills when reconnecting, Content-Type by the publishers sending JSON-encoded updates
+		headers := []string{"authorization", "last-event-id", "content-type"}
+		if h.options.TokenHeader != "" && !strings.EqualFold(h.options.TokenHeader, defaultTokenHeader) {
+			headers = append(headers, strings.ToLower(h.options.TokenHeader))
+		}
+		headers = append(headers, h.options.CorsAllowedHeaders...)
+		allowedHeaders := handlers.AllowedHeaders(headers)
+		exposedHeaders := handlers.ExposedHeaders([]string{eventIDHeader, recipientsHeader})
+		// Lets the browsers cache the answers to the preflight requests, capped to 10 minutes by the CORS handler
+		maxAge := handlers.MaxAge(int(h.options.CorsMaxAge / time.Second))
 
-		corsHandler = handlers.CORS(handlers.AllowCredentials(), allowedOrigins, allowedHeaders)(r)
+		corsHandler = handlers.CORS(handlers.AllowCredentials(), allowedOrigins, allowedHeaders, exposedHeaders, maxAge)(r)
 	} else {
 		corsHandler = r
 	}
 
 	var compressHandler http.Handler
 	if h.options.Compress {
-		compressHandler = handlers.CompressHandler(corsHandler)
+		compressHandler = withCompressionStats(corsHandler)
 	} else {
 		compressHandler = corsHandler
 	}
 	secureHandler := secureMiddleware.Handler(compressHandler)
 	loggingHandler := handlers.CombinedLoggingHandler(os.Stderr, secureHandler)
 	recoveryHandler := handlers.RecoveryHandler(
-		handlers.RecoveryLogger(log.New()),
+		handlers.RecoveryLogger(recoveryLogger{h.logger}),
 		handlers.PrintRecoveryStack(h.options.Debug),
 	)(loggingHandler)
 
-	return recoveryHandler
+	return withResponseController(recoveryHandler)
 }
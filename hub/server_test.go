@@ -1,10 +1,14 @@
 package hub
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"sync"
@@ -96,7 +100,7 @@ func TestServe(t *testing.T) {
 		defer resp.Body.Close()
 		body, _ := ioutil.ReadAll(resp.Body)
 
-		assert.Equal(t, []byte(":\nid: first\ndata: hello\n\n"), body)
+		assert.Equal(t, []byte(":\ntopic: http://example.com/foo/1\nid: first\ndata: hello\n\n"), body)
 	}()
 
 	go func() {
@@ -110,7 +114,8 @@ func TestServe(t *testing.T) {
 		defer resp.Body.Close()
 		body, _ := ioutil.ReadAll(resp.Body)
 
-		assert.Equal(t, []byte(":\nid: first\ndata: hello\n\n"), body)
+		// The event carries the alternate topic the subscriber matched
+		assert.Equal(t, []byte(":\ntopic: http://example.com/alt/1\nid: first\ndata: hello\n\n"), body)
 	}()
 
 	wgConnected.Wait()
@@ -128,3 +133,498 @@ func TestServe(t *testing.T) {
 	h.server.Shutdown(context.Background())
 	wgTested.Wait()
 }
+
+func TestServeCompressedSubscription(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.HeartbeatInterval = 10 * time.Millisecond
+
+	h.Start()
+	go func() {
+		h.Serve()
+	}()
+	defer h.Shutdown(context.Background())
+
+	// The response is decompressed by the test, not by the client
+	client := http.Client{Transport: &http.Transport{DisableCompression: true}}
+	req, _ := http.NewRequest("GET", testURL+"?topic=http%3A%2F%2Fexample.com%2Ffoo%2F1", nil)
+	req.Header.Add("Accept-Encoding", "gzip")
+
+	// loop until the web server is ready
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Do(req)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	// The headers of the stream are kept by the middleware
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache, no-store, must-revalidate", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "no", resp.Header.Get("X-Accel-Buffering"))
+	assert.Contains(t, resp.Header["Vary"], "Last-Event-ID")
+
+	r, err := gzip.NewReader(resp.Body)
+	assert.Nil(t, err)
+	lines := bufio.NewReader(r)
+	readLine := func() string {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			panic(err)
+		}
+
+		return line
+	}
+
+	// The comment flushing the headers, then the heartbeats, are received through the compressed stream while it is still open
+	assert.Equal(t, ":\n", readLine())
+	assert.Equal(t, ":\n", readLine())
+
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/foo/1"}, Event: Event{ID: "first", Data: "hello"}})
+
+	line := readLine()
+	for line == ":\n" {
+		line = readLine()
+	}
+	assert.Equal(t, "topic: http://example.com/foo/1\n", line)
+	assert.Equal(t, "id: first\n", readLine())
+	assert.Equal(t, "data: hello\n", readLine())
+	assert.Equal(t, "\n", readLine())
+}
+
+func TestServeWriteTimeoutStream(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.WriteTimeout = 100 * time.Millisecond
+	h.options.HeartbeatInterval = 20 * time.Millisecond
+
+	h.Start()
+	go func() {
+		h.Serve()
+	}()
+	defer h.Shutdown(context.Background())
+
+	// loop until the web server is ready
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = http.Get(testURL + "?topic=http%3A%2F%2Fexample.com%2Ffoo%2F1")
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			panic(err)
+		}
+
+		return line
+	}
+
+	// The stream is still open long after the write timeout, every write has been given its own deadline
+	for start := time.Now(); time.Since(start) < 300*time.Millisecond; {
+		assert.Equal(t, ":\n", readLine())
+	}
+
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/foo/1"}, Event: Event{ID: "first", Data: "hello"}})
+
+	line := readLine()
+	for line == ":\n" {
+		line = readLine()
+	}
+	assert.Equal(t, "topic: http://example.com/foo/1\n", line)
+}
+
+func TestServeReadHeaderTimeout(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.ReadHeaderTimeout = 50 * time.Millisecond
+
+	h.Start()
+	go func() {
+		h.Serve()
+	}()
+
+	// loop until the web server is ready
+	var conn net.Conn
+	for conn == nil {
+		conn, _ = net.Dial("tcp", testAddr)
+	}
+	defer conn.Close()
+	defer h.Shutdown(context.Background())
+
+	// The client never ends the headers, the connection is closed once the timeout expires
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	assert.Nil(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(response), "Mercure Hub")
+}
+
+func TestListenAndServe(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.TCPKeepAlive = 5 * time.Second
+	h.server = &http.Server{Addr: "127.0.0.1:0"}
+
+	var addr net.Addr
+	assert.Nil(t, h.listenAndServe(":http", func(ln net.Listener) error {
+		addr = ln.Addr()
+		return ln.Close()
+	}))
+	assert.Equal(t, "tcp", addr.Network())
+	assert.True(t, strings.HasPrefix(addr.String(), "127.0.0.1:"))
+
+	h.server.Addr = "invalid"
+	assert.NotNil(t, h.listenAndServe(":http", func(ln net.Listener) error {
+		t.Fail()
+		return nil
+	}))
+}
+
+func TestShutdown(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.DefaultRetry = 1000
+	h.Start()
+
+	w := newCloseNotifyingRecorder()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+		h.SubscribeHandler(w, req)
+	}()
+
+	for {
+		h.subscribers.RLock()
+		empty := len(h.subscribers.m) == 0
+		h.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	assert.Nil(t, h.Shutdown(context.Background()))
+	wg.Wait()
+	assert.Equal(t, ":\nretry: 1000\n\n", w.Body.String())
+
+	// Calling it twice is safe
+	assert.Nil(t, h.Shutdown(context.Background()))
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	w2 := httptest.NewRecorder()
+	h.SubscribeHandler(w2, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w2.Code)
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "foo")
+
+	req = httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{}))
+	w3 := httptest.NewRecorder()
+	h.PublishHandler(w3, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w3.Code)
+
+	assert.Equal(t, errHubStopped, h.DispatchUpdate(&Update{}))
+}
+
+// blockingPublisher waits for the release channel to be closed before publishing the updates locally
+type blockingPublisher struct {
+	localPublisher
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPublisher) Publish(h *Hub, u *Update) error {
+	close(p.entered)
+	<-p.release
+
+	return p.localPublisher.Publish(h, u)
+}
+
+func TestShutdownPublishDrainTimeout(t *testing.T) {
+	publisher := &blockingPublisher{entered: make(chan struct{}), release: make(chan struct{})}
+	h := NewHub(publisher, &noHistory{}, &Options{PublisherJWTKey: []byte("publisher"), AllowAnonymous: true, PublishDrainTimeout: 5 * time.Second})
+	h.Start()
+
+	updates, _ := h.registerSubscriber(NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, ""))
+
+	publish := func() *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("topic", "http://example.com/books/1")
+		form.Add("data", "in flight")
+
+		req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{}))
+		w := httptest.NewRecorder()
+		h.PublishHandler(w, req)
+
+		return w
+	}
+
+	published := make(chan *httptest.ResponseRecorder)
+	go func() {
+		published <- publish()
+	}()
+	<-publisher.entered
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- h.Shutdown(context.Background())
+	}()
+
+	// New publish requests are rejected while the ones in progress are completing
+	for {
+		h.state.RLock()
+		draining := h.state.shutdown
+		h.state.RUnlock()
+
+		if draining {
+			break
+		}
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, publish().Code)
+	assert.False(t, h.isStopped())
+
+	// The hub isn't ready anymore, and new subscribers are rejected
+	w := httptest.NewRecorder()
+	h.HealthCheckHandler(w, httptest.NewRequest("GET", "http://example.com/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"shutting_down"`)
+
+	w = httptest.NewRecorder()
+	h.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	_, ok := h.registerSubscriber(nil)
+	assert.False(t, ok)
+
+	close(publisher.release)
+	assert.Equal(t, http.StatusOK, (<-published).Code)
+	assert.Nil(t, <-shutdown)
+
+	u := <-updates
+	assert.Equal(t, "in flight", u.Data)
+}
+
+func TestShutdownPublishDrainTimeoutExpired(t *testing.T) {
+	publisher := &blockingPublisher{entered: make(chan struct{}), release: make(chan struct{})}
+	h := NewHub(publisher, &noHistory{}, &Options{PublisherJWTKey: []byte("publisher"), PublishDrainTimeout: 10 * time.Millisecond})
+	h.Start()
+
+	form := url.Values{}
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "too late")
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{}))
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.PublishHandler(w, req)
+	}()
+	<-publisher.entered
+
+	// The hub is stopped once the timeout expired, the update can't be dispatched anymore
+	assert.Nil(t, h.Shutdown(context.Background()))
+	assert.True(t, h.isStopped())
+
+	close(publisher.release)
+	<-done
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestSubscribeCORS(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.CorsAllowedOrigins = []string{"https://app.example.com", "https://admin.example.com"}
+	handler := h.chainHandlers()
+
+	// Preflight request sent by EventSource polyfills
+	req := httptest.NewRequest("OPTIONS", "http://example.com/hub?topic=foo", nil)
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "GET")
+	req.Header.Add("Access-Control-Request-Headers", "authorization, last-event-id")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Authorization,Last-Event-Id", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Empty(t, w.Header().Get("Access-Control-Max-Age"))
+
+	// Not allowed origin
+	req = httptest.NewRequest("GET", "http://example.com/hub", nil)
+	req.Header.Add("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Actual request
+	req = httptest.NewRequest("GET", "http://example.com/hub", nil)
+	req.Header.Add("Origin", "https://admin.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, "https://admin.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	assert.Equal(t, "X-Mercure-Event-Id,X-Mercure-Recipients", w.Header().Get("Access-Control-Expose-Headers"))
+}
+
+func TestCORSPreflightCustomHeaders(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.CorsAllowedOrigins = []string{"https://app.example.com"}
+	h.options.CorsAllowedHeaders = []string{"x-request-id"}
+	h.options.CorsMaxAge = 5 * time.Minute
+	handler := h.chainHandlers()
+
+	// Credentialed cross-origin subscription sending a custom header
+	req := httptest.NewRequest("OPTIONS", "http://example.com/hub?topic=foo", nil)
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "GET")
+	req.Header.Add("Access-Control-Request-Headers", "authorization, last-event-id, x-request-id")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Authorization,Last-Event-Id,X-Request-Id", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "300", w.Header().Get("Access-Control-Max-Age"))
+
+	// Preflight of a publication
+	req = httptest.NewRequest("OPTIONS", "http://example.com/hub", nil)
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	req.Header.Add("Access-Control-Request-Headers", "authorization, content-type")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Authorization,Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+
+	// Header not allowed
+	req = httptest.NewRequest("OPTIONS", "http://example.com/hub?topic=foo", nil)
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "GET")
+	req.Header.Add("Access-Control-Request-Headers", "x-tenant")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSCustomTokenHeader(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.CorsAllowedOrigins = []string{"https://app.example.com"}
+	h.options.TokenHeader = "X-Mercure-Authorization"
+	handler := h.chainHandlers()
+
+	req := httptest.NewRequest("OPTIONS", "http://example.com/hub?topic=foo", nil)
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "GET")
+	req.Header.Add("Access-Control-Request-Headers", "x-mercure-authorization")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "X-Mercure-Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func TestCustomPaths(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.SubscribePath = "/subscribe"
+	h.options.PublishPath = "/publish"
+	h.Start()
+	defer h.Stop()
+
+	// The hub is mounted under a prefix of another server
+	mux := http.NewServeMux()
+	mux.Handle("/mercure/", http.StripPrefix("/mercure", h.Handler()))
+
+	form := url.Values{"topic": {"http://example.com/books/1"}, "data": {"foo"}, "id": {"first"}}
+	req := httptest.NewRequest("POST", "http://example.com/mercure/publish", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{}))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first", w.Body.String())
+
+	// The subscribe path doesn't accept updates anymore
+	req = httptest.NewRequest("POST", "http://example.com/mercure/subscribe", strings.NewReader(form.Encode()))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", w.Header().Get("Allow"))
+
+	req = httptest.NewRequest("GET", "http://example.com/mercure/hub?topic=foo", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCustomBasePath(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.BasePath = "/mercure"
+	h.options.WebSocket = true
+	h.Start()
+	defer h.Stop()
+
+	handler := h.Handler()
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+
+		return w
+	}
+
+	// All the endpoints are under the base path, the subscribe and the publish endpoints use the base path itself
+	assert.Equal(t, http.StatusUnauthorized, serve("POST", "http://example.com/mercure").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "http://example.com/mercure/subscriptions").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("GET", "http://example.com/mercure/ws?topic=foo").Code)
+	assert.NotEqual(t, "404 page not found\n", serve("GET", "http://example.com/mercure/replay").Body.String())
+
+	for _, path := range []string{"/hub", "/hub/replay", "/hub/subscriptions", "/hub/subscriptions/events", "/hub/ws"} {
+		assert.Equal(t, "404 page not found\n", serve("GET", "http://example.com"+path).Body.String(), path)
+	}
+}
+
+func TestServeAcme(t *testing.T) {
+	h := createAnonymousDummy()
+	h.options.AcmeHosts = []string{"example.com"}
+	h.options.AcmeHTTP01Addr = "127.0.0.1:4243"
+
+	h.Start()
+	go func() {
+		h.Serve()
+	}()
+
+	client := http.Client{
+		Timeout: time.Duration(100 * time.Millisecond),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// loop until the challenge server is ready
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get("http://127.0.0.1:4243/hub")
+	}
+	resp.Body.Close()
+
+	// Requests not related to the challenge are redirected to HTTPS
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://127.0.0.1:443/hub", resp.Header.Get("Location"))
+
+	h.server.Shutdown(context.Background())
+}
@@ -0,0 +1,238 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxStreamLineSize is the maximum size of a line of a NDJSON stream of updates, longer lines are reported as invalid and skipped
+const maxStreamLineSize = 1 << 20
+
+// errLineTooLong is returned when a line of a stream exceeds maxStreamLineSize
+var errLineTooLong = errors.New("line too long")
+
+// streamResult is the JSON representation of the outcome of a line of a NDJSON stream of updates
+// ID is set if the update has been published, Status and Error if the line has been rejected, DryRun if the publisher asked for a dry run
+type streamResult struct {
+	Line   int           `json:"line"`
+	ID     string        `json:"id,omitempty"`
+	Status int           `json:"status,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	DryRun *dryRunResult `json:"dry_run,omitempty"`
+}
+
+// errorResponse captures the error response sent by newUpdate, to report it in the result of a line instead
+type errorResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (e *errorResponse) Header() http.Header {
+	return e.header
+}
+
+func (e *errorResponse) Write(b []byte) (int, error) {
+	return e.body.Write(b)
+}
+
+func (e *errorResponse) WriteHeader(status int) {
+	e.status = status
+}
+
+// isStopOnError checks if the publisher asked to stop processing a stream at the first rejected line, using the "stop-on-error" query parameter
+func isStopOnError(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("stop-on-error")
+	if value == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// publishStream publishes the updates of a NDJSON body as the lines are received, without waiting for the end of the body
+// Every line contains a JSON-encoded update, its result is sent and flushed as soon as it has been processed, blank lines are ignored
+// The rejected lines are reported and skipped, unless stopOnError is true, the publish rate limit throttles the stream instead of rejecting its lines
+func (h *Hub) publishStream(w http.ResponseWriter, r *http.Request, claims *claims, canPublishTo, isDenied func(string) bool, dryRun bool) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	stopOnError, err := isStopOnError(r)
+	if err != nil {
+		http.Error(w, "Invalid \"stop-on-error\" parameter", http.StatusBadRequest)
+		return
+	}
+
+	// With HTTP/1, the server doesn't allow to read the body anymore once the response has been written otherwise
+	if err := enableFullDuplex(w, r); err != nil {
+		h.logger.Debug("Full duplex unsupported, reading the stream after the first result may fail with HTTP/1", "remote_addr", r.RemoteAddr, "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	span := trace.SpanFromContext(r.Context())
+	encoder := json.NewEncoder(w)
+	send := func(result streamResult) bool {
+		h.resetStreamWriteDeadline(w, r)
+		encoder.Encode(result)
+		f.Flush()
+
+		return result.Status == 0 || !stopOnError
+	}
+
+	reader := bufio.NewReader(r.Body)
+	// The first update has already been allowed by the rate limiter when the stream has been accepted
+	throttle := false
+	for n := 1; ; n++ {
+		line, err := readStreamLine(reader)
+		switch {
+		case err == io.ErrUnexpectedEOF:
+			// The connection has been closed in the middle of a line, the truncated update is discarded
+			send(streamResult{Line: n, Status: http.StatusBadRequest, Error: "Incomplete line"})
+			return
+
+		case err == errLineTooLong:
+			if !send(streamResult{Line: n, Status: http.StatusRequestEntityTooLarge, Error: "Line too long"}) {
+				return
+			}
+			continue
+
+		case isBodyTooLarge(err):
+			send(streamResult{Line: n, Status: http.StatusRequestEntityTooLarge, Error: http.StatusText(http.StatusRequestEntityTooLarge)})
+			return
+
+		case err != nil && err != io.EOF:
+			h.logger.Info("Failed to read the stream of updates", "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
+
+		if len(bytes.TrimSpace(line)) != 0 {
+			if throttle && !h.waitRateLimit(r, claims) {
+				return
+			}
+			throttle = true
+
+			if !h.publishStreamLine(r, claims, line, n, canPublishTo, isDenied, dryRun, span, send) {
+				return
+			}
+		}
+
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+// publishStreamLine decodes, validates and publishes the update contained in a line, and sends its result
+// It returns false if the stream must be stopped
+func (h *Hub) publishStreamLine(r *http.Request, claims *claims, line []byte, n int, canPublishTo, isDenied func(string) bool, dryRun bool, span trace.Span, send func(streamResult) bool) bool {
+	var ur updateRequest
+	if err := json.Unmarshal(line, &ur); err != nil {
+		return send(streamResult{Line: n, Status: http.StatusBadRequest, Error: "Invalid JSON"})
+	}
+
+	// The denials are returned as for a dry run, to report their reason instead of the generic message of the error response
+	rejection := &errorResponse{header: make(http.Header)}
+	u, denial, ok := h.newUpdate(rejection, r, claims, ur, canPublishTo, isDenied, true, "")
+	if !ok {
+		return send(streamResult{Line: n, Status: rejection.status, Error: string(bytes.TrimSpace(rejection.body.Bytes()))})
+	}
+	if denial != nil && !dryRun {
+		// The denial is still logged and counted
+		h.denyPublish(rejection, r, denial)
+
+		return send(streamResult{Line: n, Status: denial.status, Error: denial.err.Error()})
+	}
+
+	if dryRun {
+		result := newDryRunResult(u, denial)
+		h.logger.Info("Update dry run", "remote_addr", r.RemoteAddr, "event_id", result.ID, "topics", u.Topics, "granted", result.Granted, "subject", claims.Subject)
+
+		return send(streamResult{Line: n, DryRun: &result})
+	}
+
+	u.spanContext = span.SpanContext()
+	if err := h.publisher.Publish(h, u); err != nil {
+		span.RecordError(err)
+		if err != errHubStopped {
+			h.logger.Error("Failed to publish the update", "event_id", u.ID, "topics", u.Topics, "error", err)
+		}
+		send(streamResult{Line: n, Status: http.StatusServiceUnavailable, Error: http.StatusText(http.StatusServiceUnavailable)})
+
+		return false
+	}
+	span.AddEvent("Update published", trace.WithAttributes(updateAttributes(u)...))
+
+	h.metrics.updatesPublished.Inc()
+	h.logger.Info("Update published", "remote_addr", r.RemoteAddr, "event_id", u.ID, "topics", u.Topics, "subject", claims.Subject)
+
+	return send(streamResult{Line: n, ID: u.ID})
+}
+
+// waitRateLimit blocks until the publisher is allowed to publish another update, it returns false if the request has been canceled meanwhile
+func (h *Hub) waitRateLimit(r *http.Request, claims *claims) bool {
+	key := rateLimiterKey(r, claims)
+	for {
+		ok, delay := h.rateLimiter.allow(key, time.Now())
+		if ok {
+			return true
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// readStreamLine reads a line, without the trailing newline
+// The last line of the stream doesn't need to be terminated, io.EOF is then returned along with it
+// The error is io.ErrUnexpectedEOF if the body couldn't be read entirely, and errLineTooLong if the line exceeds maxStreamLineSize, the rest of the line is then skipped
+func readStreamLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxStreamLineSize {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err == nil || err == io.EOF {
+				err = errLineTooLong
+			}
+
+			return nil, err
+		}
+		line = append(line, chunk...)
+
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case nil:
+			return bytes.TrimRight(line, "\r\n"), nil
+		case io.EOF:
+			return bytes.TrimRight(line, "\r"), io.EOF
+		default:
+			if len(line) != 0 && !isBodyTooLarge(err) {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeStreamResults(t *testing.T, body io.Reader) []streamResult {
+	var results []streamResult
+	decoder := json.NewDecoder(body)
+	for decoder.More() {
+		var result streamResult
+		assert.Nil(t, decoder.Decode(&result))
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func TestPublishStream(t *testing.T) {
+	hub := createDummy()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		u := <-hub.updates
+		assert.Equal(t, "first", u.ID)
+		assert.Equal(t, []string{"http://example.com/books/1"}, u.Topics)
+		assert.Equal(t, "Hello", u.Data)
+		assert.Equal(t, struct{}{}, u.Targets["foo"])
+
+		u = <-hub.updates
+		assert.NotEmpty(t, u.ID)
+		assert.Equal(t, []string{"http://example.com/books/2"}, u.Topics)
+		assert.Equal(t, "World", u.Data)
+	}()
+
+	body := `{"id": "first", "topic": "http://example.com/books/1", "data": "Hello", "targets": ["foo"]}
+
+{"topic": "http://example.com/books/1"
+{"topic": "http://example.com/books/1"}
+{"topic": "http://example.com/books/1", "data": "Hello", "targets": ["bar"]}
+{"topic": "http://example.com/books/2", "data": "World"}`
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	wg.Wait()
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	results := decodeStreamResults(t, resp.Body)
+	assert.Len(t, results, 5)
+	assert.Equal(t, streamResult{Line: 1, ID: "first"}, results[0])
+	assert.Equal(t, streamResult{Line: 3, Status: http.StatusBadRequest, Error: "Invalid JSON"}, results[1])
+	assert.Equal(t, streamResult{Line: 4, Status: http.StatusBadRequest, Error: "Missing \"data\" parameter"}, results[2])
+	assert.Equal(t, streamResult{Line: 5, Status: http.StatusUnauthorized, Error: "Not allowed to publish to the target \"bar\""}, results[3])
+	assert.Equal(t, 6, results[4].Line)
+	assert.NotEmpty(t, results[4].ID)
+}
+
+func TestPublishStreamStopOnError(t *testing.T) {
+	hub := createDummy()
+
+	body := "{\"topic\": \"http://example.com/books/1\"}\n{\"topic\": \"http://example.com/books/1\", \"data\": \"Hello\"}\n"
+	req := httptest.NewRequest("POST", "http://example.com/hub?stop-on-error=1", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, []streamResult{{Line: 1, Status: http.StatusBadRequest, Error: "Missing \"data\" parameter"}}, decodeStreamResults(t, w.Body))
+
+	req = httptest.NewRequest("POST", "http://example.com/hub?stop-on-error=foo", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+	w = httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"stop-on-error\" parameter\n", w.Body.String())
+}
+
+func TestPublishStreamDryRun(t *testing.T) {
+	hub := createDummy()
+
+	body := "{\"id\": \"first\", \"topic\": \"http://example.com/books/1\", \"data\": \"Hello\", \"targets\": \"foo\"}\n{\"topic\": \"http://example.com/books/1\", \"data\": \"Hello\", \"targets\": \"bar\"}\n"
+	req := httptest.NewRequest("POST", "http://example.com/hub?dry-run=1", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"foo"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, []streamResult{
+		{Line: 1, DryRun: &dryRunResult{Granted: true, Targets: []string{"foo"}, ID: "first"}},
+		{Line: 2, DryRun: &dryRunResult{Reason: "Not allowed to publish to the target \"bar\"", Targets: []string{}}},
+	}, decodeStreamResults(t, w.Body))
+}
+
+func TestPublishStreamLineTooLong(t *testing.T) {
+	hub := createDummy()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		u := <-hub.updates
+		assert.Equal(t, "Hello", u.Data)
+	}()
+
+	body := fmt.Sprintf("{\"topic\": \"http://example.com/books/1\", \"data\": %q}\n{\"topic\": \"http://example.com/books/1\", \"data\": \"Hello\"}\n", strings.Repeat("a", maxStreamLineSize))
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	wg.Wait()
+
+	results := decodeStreamResults(t, w.Body)
+	assert.Len(t, results, 2)
+	assert.Equal(t, streamResult{Line: 1, Status: http.StatusRequestEntityTooLarge, Error: "Line too long"}, results[0])
+	assert.Equal(t, 2, results[1].Line)
+	assert.NotEmpty(t, results[1].ID)
+}
+
+func TestPublishStreamFullDuplex(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	server := httptest.NewServer(hub.Handler())
+	defer server.Close()
+
+	reader, writer := io.Pipe()
+	req, _ := http.NewRequest("POST", server.URL+"/hub", reader)
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	// The writer converting the error responses to JSON must not prevent streaming
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+
+	responses := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		responses <- resp
+	}()
+
+	// The result of every line is received before sending the next one
+	writer.Write([]byte("{\"id\": \"first\", \"topic\": \"http://example.com/books/1\", \"data\": \"Hello\"}\n"))
+	resp := <-responses
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	results := bufio.NewReader(resp.Body)
+	line, err := results.ReadBytes('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"line\":1,\"id\":\"first\"}\n", string(line))
+
+	writer.Write([]byte("{\"id\": \"second\", \"topic\": \"http://example.com/books/1\", \"data\": \"World\"}\n"))
+	line, err = results.ReadBytes('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"line\":2,\"id\":\"second\"}\n", string(line))
+
+	// The last line doesn't need to be terminated
+	writer.Write([]byte("{\"id\": \"third\", \"topic\": \"http://example.com/books/1\", \"data\": \"!\"}"))
+	writer.Close()
+	rest, err := ioutil.ReadAll(results)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"line\":3,\"id\":\"third\"}\n", string(rest))
+}
+
+func TestReadStreamLine(t *testing.T) {
+	reader := bufio.NewReader(io.MultiReader(strings.NewReader("foo\r\nbar\n"), bytes.NewReader([]byte("baz")), &failingReader{}))
+
+	line, err := readStreamLine(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(line))
+
+	line, err = readStreamLine(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", string(line))
+
+	// The connection has been cut in the middle of the line
+	line, err = readStreamLine(reader)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Nil(t, line)
+}
+
+type failingReader struct{}
+
+func (*failingReader) Read([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -1,60 +1,331 @@
 package hub
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/gofrs/uuid"
 	"github.com/yosida95/uritemplate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Markers sent to the subscribers once the events retrieved from the history have been sent, before the live ones
+const (
+	// CatchUpMarkerComment sends a comment, which EventSource ignores, for clients parsing the stream themselves
+	CatchUpMarkerComment = "comment"
+	// CatchUpMarkerEvent sends an event of type "catch-up", containing the number of replayed events
+	CatchUpMarkerEvent = "event"
+)
+
+// Limits of the topics of a subscription when they aren't configured, every topic is matched against each dispatched update
+const (
+	defaultMaxSubscribeTopics = 1000
+	defaultMaxTopicLength     = 4096
 )
 
 // SubscribeHandler create a keep alive connection and send the events to the subscribers
 func (h *Hub) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET", "HEAD") {
+		return
+	}
+
 	f, ok := w.(http.Flusher)
 	if !ok {
-		panic("The Response Writer must be an instance of Flusher.")
+		// Without flushing, the events would stay in the buffer of the response and never reach the subscriber
+		h.logger.Error("The response writer doesn't support flushing, check the middleware wrapping the subscribe handler", "remote_addr", r.RemoteAddr)
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
 	}
 
-	subscriber, updateChan, ok := h.initSubscription(w, r)
+	subscriber, updateChan, unsubscribe, r, ok := h.initSubscription(w, r)
 	if !ok {
 		return
 	}
 	defer h.cleanup(subscriber)
+	// The handler can end the stream itself (quota, idle timeout, failed write...), the subscriber must then stop receiving the updates too
+	defer unsubscribe()
+	defer h.reportCompression(w, r, subscriber)
+
+	h.metrics.subscribers.Inc()
+	defer h.metrics.subscribers.Dec()
+
+	// The span covers the whole lifetime of the stream, an event is added for every update sent
+	_, span := h.startRequestSpan(r, "mercure.subscribe", attribute.String("mercure.subscriber_id", subscriber.ID))
+	defer span.End()
+
+	// The heartbeat timer is reset every time an event is sent, it is nil if no heartbeat is defined
+	var heartbeat <-chan time.Time
+	var timer *time.Timer
+	if h.options.HeartbeatInterval != time.Duration(0) {
+		timer = time.NewTimer(h.options.HeartbeatInterval)
+		defer timer.Stop()
+		heartbeat = timer.C
+	}
+
+	// When a flush interval is defined, the events sent during this interval are flushed together, flush is nil otherwise
+	var flush <-chan time.Time
+
+	quota := h.newSubscriberQuota()
+
+	// When an idle timeout is defined, the connection is closed if nothing has been successfully flushed during this period, idle is nil otherwise
+	// The heartbeats keep the connections of the subscribers still reading the stream alive
+	lastFlush := time.Now()
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if h.options.SubscriberIdleTimeout != time.Duration(0) {
+		idleTimer = time.NewTimer(h.options.SubscriberIdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	// Every write is given the configured time to complete, so a subscriber which doesn't read the stream anymore can't block the connection forever
+	// The deadline is reset before each write, the time elapsed while waiting for the updates doesn't count
+	// It can't exceed the end of the idle timeout, a write blocked by a dead peer is then interrupted too
+	// Without event write timeout, the write timeout of the server applies to every write instead of the whole stream (see resetStreamWriteDeadline)
+	writeTimeout := h.options.EventWriteTimeout
+	if writeTimeout == time.Duration(0) {
+		writeTimeout = h.options.WriteTimeout
+	}
+	resetWriteDeadline := func() {
+		var deadline time.Time
+		if writeTimeout != time.Duration(0) {
+			deadline = time.Now().Add(writeTimeout)
+		}
+		if h.options.SubscriberIdleTimeout != time.Duration(0) {
+			if idleDeadline := lastFlush.Add(h.options.SubscriberIdleTimeout); deadline.IsZero() || idleDeadline.Before(deadline) {
+				deadline = idleDeadline
+			}
+		}
+
+		if !deadline.IsZero() {
+			setWriteDeadline(w, r, deadline)
+		}
+	}
+
+	// flushed records that the events written so far reached the connection, a write failing after the idle timeout means that the subscriber is gone
+	flushed := func(err error) bool {
+		if err == nil {
+			lastFlush = time.Now()
+			return true
+		}
+
+		if h.options.SubscriberIdleTimeout != time.Duration(0) && time.Since(lastFlush) >= h.options.SubscriberIdleTimeout {
+			h.idleTimedOut(subscriber, r)
+			return false
+		}
+
+		h.writeFailed(subscriber, r, err)
+		return false
+	}
+
+	// send writes an update to the response, it returns false if the connection must be closed
+	send := func(serializedUpdate *serializedUpdate) bool {
+		if serializedUpdate == slowSubscriberMarker {
+			h.logger.Warn("Slow subscriber disconnected", "subscriber_id", subscriber.ID, "remote_addr", r.RemoteAddr)
+			fmt.Fprint(w, ": disconnected, too slow to consume the updates\n\n")
+			f.Flush()
+			return false
+		}
+		event := serializedUpdate.event
+		if u := subscriber.redact(serializedUpdate.Update); u != serializedUpdate.Update {
+			event = h.serialize(u)
+		}
+		if exceeded := quota.consume(len(event)); exceeded != "" {
+			h.quotaExceeded(subscriber, r, exceeded)
+			fmt.Fprintf(w, ": disconnected, %s quota exceeded\n\n", exceeded)
+			f.Flush()
+			return false
+		}
+		resetWriteDeadline()
+		fmt.Fprint(w, event)
+
+		if h.options.FlushInterval == time.Duration(0) {
+			if !flushed(flushResponse(w, r)) {
+				return false
+			}
+		} else if flush == nil {
+			flush = time.After(h.options.FlushInterval)
+		}
+
+		h.metrics.updatesDispatched.Inc()
+		span.AddEvent("Event sent", trace.WithAttributes(updateAttributes(serializedUpdate.Update)...))
+		h.logger.Info("Event sent", "subscriber_id", subscriber.ID, "event_id", serializedUpdate.ID, "topics", serializedUpdate.Topics, "remote_addr", r.RemoteAddr)
+		if timer != nil {
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(h.options.HeartbeatInterval)
+		}
+
+		return true
+	}
 
 	for {
-		if h.options.HeartbeatInterval == time.Duration(0) {
-			// No heartbeat defined, just block
-			serializedUpdate, open := <-updateChan
-			if !open {
+		// The high priority updates jump ahead of the normal ones already queued
+		select {
+		case serializedUpdate := <-subscriber.priorityUpdates:
+			if !send(serializedUpdate) {
 				return
 			}
-			publish(serializedUpdate, subscriber, w, r)
-
 			continue
+		default:
 		}
 
 		select {
+		case <-r.Context().Done():
+			// Drain the channel until the hub closes it, to not block the dispatch of the other updates
+			unsubscribe()
+			for range updateChan {
+			}
+			return
+
+		case serializedUpdate := <-subscriber.priorityUpdates:
+			if !send(serializedUpdate) {
+				return
+			}
+
 		case serializedUpdate, open := <-updateChan:
 			if !open {
+				h.sendShutdownRetry(w)
+				return
+			}
+			if !send(serializedUpdate) {
 				return
 			}
-			publish(serializedUpdate, subscriber, w, r)
 
-		case <-time.After(h.options.HeartbeatInterval):
+		case <-flush:
+			resetWriteDeadline()
+			if !flushed(flushResponse(w, r)) {
+				return
+			}
+			flush = nil
+
+		case <-heartbeat:
 			// Send a SSE comment as a heartbeat, to prevent issues with some proxies and old browsers
+			resetWriteDeadline()
 			fmt.Fprint(w, ":\n")
-			f.Flush()
+			if !flushed(flushResponse(w, r)) {
+				return
+			}
+			timer.Reset(h.options.HeartbeatInterval)
+
+		case <-idle:
+			if remaining := h.options.SubscriberIdleTimeout - time.Since(lastFlush); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+
+			h.idleTimedOut(subscriber, r)
+			return
 		}
 	}
 }
 
 // initSubscription initializes the connection
-func (h *Hub) initSubscription(w http.ResponseWriter, r *http.Request) (*Subscriber, chan *serializedUpdate, bool) {
-	claims, err := authorize(r, h.options.SubscriberJWTKey, nil)
+// The returned request's context contains the targets granted to the subscriber
+// The returned function unregisters the subscriber, it must be called once the stream ends, it is called when the connection is closed too
+func (h *Hub) initSubscription(w http.ResponseWriter, r *http.Request) (*Subscriber, chan *serializedUpdate, func(), *http.Request, bool) {
+	subscriber, r, ok := h.createSubscriber(w, r)
+	if !ok {
+		return nil, nil, nil, r, false
+	}
+
+	sendHeaders(w)
+
+	if h.options.SendConnectionEvent {
+		sendConnectionEvent(w, subscriber)
+	}
+
+	if h.options.SendResumeToken {
+		h.sendResumeToken(w, r, subscriber)
+	}
+
+	if subscriber.requestsMissedEvents() {
+		h.sendCatchUpMarker(w, h.sendMissedEvents(w, r, subscriber))
+	} else if h.options.SendInitialState {
+		h.sendCatchUpMarker(w, h.sendInitialState(w, r, subscriber))
+	}
+
+	updateChan, ok := h.registerSubscriber(subscriber)
+	if !ok {
+		h.cleanup(subscriber)
+		h.sendShutdownRetry(w)
+		return nil, nil, nil, r, false
+	}
+
+	unsubscribe, done := h.unsubscriber(updateChan)
+
+	// Listen to the closing of the http connection via the CloseNotifier
+	// It may never happen once the handler has returned, with a keep-alive connection for instance, the goroutine then stops when the subscriber is unregistered
+	notify := w.(http.CloseNotifier).CloseNotify()
+	go func() {
+		select {
+		case <-notify:
+			h.logger.Info("Subscriber disconnected", "subscriber_id", subscriber.ID, "remote_addr", r.RemoteAddr)
+			unsubscribe()
+		case <-done:
+		}
+	}()
+
+	return subscriber, updateChan, unsubscribe, r, true
+}
+
+// createSubscriber authorizes the request and creates and registers the corresponding subscriber
+// An error response is sent if the subscription isn't allowed or isn't valid
+func (h *Hub) createSubscriber(w http.ResponseWriter, r *http.Request) (*Subscriber, *http.Request, bool) {
+	subscriber, claims, ok := h.parseSubscription(w, r)
+	if !ok {
+		return nil, r, false
+	}
+
+	// The subscriber is registered before replying, it is removed by the deferred cleanup of the handler however the connection ends
+	if !h.addSubscription(w, r, subscriber, claims) {
+		return nil, r, false
+	}
+	r = withAuthorizedTargets(r, subscriber.AllTargets, subscriber.Targets, false)
+
+	return subscriber, r, true
+}
+
+// addSubscription gives an ID to the subscriber and adds it to the registry of the subscriptions
+// If the maximum number of subscribers has been reached, the subscriber is released and an error response is sent
+func (h *Hub) addSubscription(w http.ResponseWriter, r *http.Request, subscriber *Subscriber, claims *claims) bool {
+	subscriber.ID = uuid.Must(uuid.NewV4()).String()
+	if !h.subscriptions.add(subscriber, r.RemoteAddr, subject(claims), time.Now(), h.options.MaxSubscribers) {
+		h.cleanup(subscriber)
+		h.logger.Warn("Subscriber rejected, the maximum number of subscribers has been reached", "remote_addr", r.RemoteAddr, "max_subscribers", h.options.MaxSubscribers)
+		h.sendOverloaded(w, r)
+		return false
+	}
+	h.logger.Info("New subscriber", "subscriber_id", subscriber.ID, "remote_addr", r.RemoteAddr, "topics", r.URL.Query()["topic"], "subject", subject(claims))
+	if sub, ok := h.subscriptions.get(subscriber.ID); ok {
+		h.dispatchSubscriptionEvent("connected", sub)
+	}
+
+	return true
+}
+
+// parseSubscription authorizes the request and creates the subscriber corresponding to its parameters, without registering it
+// An error response is sent if the subscription isn't allowed or isn't valid, otherwise the subscriber must be released using cleanup
+func (h *Hub) parseSubscription(w http.ResponseWriter, r *http.Request) (*Subscriber, *claims, bool) {
+	claims, err := authorize(r, h.getAuthorizationConfig(false))
 	if err != nil || (claims == nil && !h.options.AllowAnonymous) {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		h.unauthorized(w, r, err)
+		return nil, nil, false
+	}
+	if claims != nil && len(claims.Mercure.Subscribe) == 0 && h.options.RejectEmptyTargets {
+		// Such subscribers would only receive public updates, which is very likely to be a mistake
+		h.forbidden(w, r, errors.New("The \"mercure.subscribe\" claim of the JWT doesn't contain any target"))
 		return nil, nil, false
 	}
 
@@ -63,65 +334,219 @@ func (h *Hub) initSubscription(w http.ResponseWriter, r *http.Request) (*Subscri
 		http.Error(w, "Missing \"topic\" parameter.", http.StatusBadRequest)
 		return nil, nil, false
 	}
+	if err := h.validateSubscribeTopics(topics); err != nil {
+		http.Error(w, fmt.Sprintf("%s.", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	from, err := retrieveFrom(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid \"from\" parameter: %s.", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	resumePosition, err := h.retrieveResumePosition(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid \"resume\" parameter: %s.", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	filter, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid \"filter\" parameter: %s.", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	denied, err := authorizeTopics(r.Context(), h.options.AuthorizeSubscribe, claims, topics)
+	if err != nil {
+		h.authorizationHookFailed(w, r, err)
+		return nil, nil, false
+	}
+	if denied != "" {
+		h.forbidden(w, r, fmt.Errorf("Not allowed to subscribe to the topic \"%s\"", denied))
+		return nil, nil, false
+	}
+	if h.options.RestrictedTopicsStatus != 0 && h.canNeverReceive(claims, topics) {
+		h.rejectRestrictedTopics(w, r, topics)
+		return nil, nil, false
+	}
 
 	var rawTopics = make([]string, 0, len(topics))
 	var templateTopics = make([]*uritemplate.Template, 0, len(topics))
 	for _, topic := range topics {
-		if tpl := h.getURITemplate(topic); tpl == nil {
+		tpl, err := h.getURITemplate(topic)
+		if err != nil {
+			// Release the templates already retrieved
+			h.cleanup(&Subscriber{RawTopics: rawTopics, TemplateTopics: templateTopics})
+			http.Error(w, fmt.Sprintf("Invalid \"topic\" parameter %q: %s.", topic, err), http.StatusBadRequest)
+			return nil, nil, false
+		}
+
+		if tpl == nil {
 			rawTopics = append(rawTopics, topic)
 		} else {
 			templateTopics = append(templateTopics, tpl)
 		}
 	}
 
-	log.WithFields(log.Fields{"remote_addr": r.RemoteAddr}).Info("New subscriber")
-	sendHeaders(w)
+	if h.isShuttingDown() {
+		h.cleanup(&Subscriber{RawTopics: rawTopics, TemplateTopics: templateTopics})
+		sendServiceUnavailable(w)
+		return nil, nil, false
+	}
+
+	authorizedAlltargets, authorizedTargets, templateTargets := authorizedTargets(claims, false)
+	subscriber := NewSubscriber(authorizedAlltargets, authorizedTargets, templateTargets, rawTopics, templateTopics, retrieveLastEventID(r))
+	// The Last-Event-ID is more recent than the resume token if events have been received since, the token is more precise than the date
+	if subscriber.LastEventID == "" {
+		if resumePosition != "" {
+			subscriber.resumePosition = resumePosition
+		} else {
+			subscriber.From = from
+		}
+	}
+	subscriber.filter = filter
+	subscriber.sendSelectors = h.options.SendSelectors
+	if h.options.RedactForSubscriber != nil {
+		subscriber.redactor, subscriber.claims = h.options.RedactForSubscriber, newAuthorizationClaims(claims)
+	}
 
-	authorizedAlltargets, authorizedTargets := authorizedTargets(claims, false)
-	subscriber := NewSubscriber(authorizedAlltargets, authorizedTargets, rawTopics, templateTopics, retrieveLastEventID(r))
+	return subscriber, claims, true
+}
 
-	if subscriber.LastEventID != "" {
-		h.sendMissedEvents(w, r, subscriber)
+// canNeverReceive checks if a subscriber having no targets only subscribes to topics whose updates always have targets (see Options.TopicDefaultTargets)
+// A subscriber having targets could receive the updates published to these topics with explicit targets, it is never rejected
+func (h *Hub) canNeverReceive(claims *claims, topics []string) bool {
+	if claims != nil && len(claims.Mercure.Subscribe) != 0 {
+		return false
 	}
 
-	// Create a new channel, over which the hub can send can send updates to this subscriber.
-	updateChan := make(chan *serializedUpdate)
+	for _, topic := range topics {
+		if !h.topicDefaultTargets.restricts(topic) {
+			return false
+		}
+	}
 
-	// Add this client to the map of those that should
-	// receive updates
-	h.newSubscribers <- updateChan
+	return true
+}
 
-	// Listen to the closing of the http connection via the CloseNotifier
-	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		h.removedSubscribers <- updateChan
-		log.WithFields(log.Fields{"remote_addr": r.RemoteAddr}).Info("Subscriber disconnected")
-	}()
+// rejectRestrictedTopics replies to a subscriber which can never receive any update with the status code and the body set in the options, instead of keeping an idle connection open
+func (h *Hub) rejectRestrictedTopics(w http.ResponseWriter, r *http.Request, topics []string) {
+	body := h.options.RestrictedTopicsBody
+	if body == "" {
+		body = http.StatusText(h.options.RestrictedTopicsStatus)
+	}
+
+	h.logger.Info("Subscriber rejected, it can't receive any update from these topics", "remote_addr", r.RemoteAddr, "topics", topics)
+	http.Error(w, body, h.options.RestrictedTopicsStatus)
+}
+
+// validateSubscribeTopics checks that the number of topics of a subscription, and their length, don't exceed the limits set in the options, and that they aren't reserved to the hub
+func (h *Hub) validateSubscribeTopics(topics []string) error {
+	maxTopics := h.options.MaxSubscribeTopics
+	if maxTopics <= 0 {
+		maxTopics = defaultMaxSubscribeTopics
+	}
+	if len(topics) > maxTopics {
+		return fmt.Errorf("Too many \"topic\" parameters, the maximum is %d", maxTopics)
+	}
+
+	maxLength := h.options.MaxTopicLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxTopicLength
+	}
+	for _, topic := range topics {
+		// The subscription events are only streamed by SubscriptionEventsHandler, to the publishers allowed to dispatch updates to the "admin" target
+		if topic == subscriptionEventsTopic {
+			return fmt.Errorf("Invalid \"topic\" parameter %q: it is reserved to the hub", topic)
+		}
+
+		// The topic isn't included in the message, it can be very long
+		if len(topic) > maxLength {
+			return fmt.Errorf("Invalid \"topic\" parameter, the maximum length is %d bytes", maxLength)
+		}
+	}
+
+	return nil
+}
+
+// registerSubscriber creates a new channel, over which the hub can send updates to this subscriber
+// Only the updates the subscriber can receive are sent, all of them if the subscriber is nil
+// It returns false if the hub is shutting down or has been stopped
+func (h *Hub) registerSubscriber(subscriber *Subscriber) (chan *serializedUpdate, bool) {
+	bufferSize := h.options.SubscriberBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultSubscriberBufferSize
+	}
+	updateChan := make(chan *serializedUpdate, bufferSize)
+	if subscriber != nil {
+		subscriber.priorityUpdates = make(chan *serializedUpdate, bufferSize)
+	}
+
+	h.state.RLock()
+	defer h.state.RUnlock()
+	if h.state.shutdown || h.state.stopped {
+		return nil, false
+	}
+
+	// Add this client to the map of those that should receive updates
+	h.newSubscribers <- subscriberRegistration{updateChan, subscriber}
 
-	return subscriber, updateChan, true
+	return updateChan, true
+}
+
+// unregisterSubscriber stops dispatching the updates to the channel, the hub then closes it
+// Nothing is sent once the hub has been stopped, all the channels are closed then
+func (h *Hub) unregisterSubscriber(updateChan chan *serializedUpdate) {
+	h.state.RLock()
+	defer h.state.RUnlock()
+	if h.state.stopped {
+		return
+	}
+
+	h.removedSubscribers <- updateChan
+}
+
+// unsubscriber returns a function unregistering the channel of a subscriber, only its first call has an effect
+// The returned channel is closed by this first call, the goroutines watching the connection stop then
+func (h *Hub) unsubscriber(updateChan chan *serializedUpdate) (func(), <-chan struct{}) {
+	var once sync.Once
+	done := make(chan struct{})
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			h.unregisterSubscriber(updateChan)
+		})
+	}, done
 }
 
 // getURITemplate retrieves or creates the uritemplate.Template associated with this topic, or nil if it's not a template
-func (h *Hub) getURITemplate(topic string) *uritemplate.Template {
-	var tpl *uritemplate.Template
+// An error is returned if the topic looks like a template but cannot be parsed
+func (h *Hub) getURITemplate(topic string) (*uritemplate.Template, error) {
 	h.uriTemplates.Lock()
+	defer h.uriTemplates.Unlock()
+
 	if tplCache, ok := h.uriTemplates.m[topic]; ok {
-		tpl = tplCache.template
 		tplCache.counter = tplCache.counter + 1
-	} else {
-		if strings.Contains(topic, "{") { // If it's definitely not an URI template, skip to save some resources
-			tpl, _ = uritemplate.New(topic) // Returns nil in case of error, will be considered as a raw string
-		}
+		return tplCache.template, nil
+	}
 
-		h.uriTemplates.m[topic] = &templateCache{1, tpl}
+	var tpl *uritemplate.Template
+	if strings.Contains(topic, "{") { // If it's definitely not an URI template, skip to save some resources
+		var err error
+		if tpl, err = uritemplate.New(topic); err != nil {
+			return nil, err
+		}
 	}
-	h.uriTemplates.Unlock()
 
-	return tpl
+	h.uriTemplates.m[topic] = &templateCache{1, tpl}
+
+	return tpl, nil
 }
 
 // sendHeaders sends correct HTTP headers to create a keep-alive connection
+// They are sent before any event, the Last-Event-ID must have been extracted from the request before
 func sendHeaders(w http.ResponseWriter) {
 	// Keep alive, useful only for HTTP 1 clients https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Keep-Alive
 	w.Header().Set("Connection", "keep-alive")
@@ -132,7 +557,9 @@ func sendHeaders(w http.ResponseWriter) {
 	// Disable cache, even for old browsers and proxies
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expire", "0")
+	w.Header().Set("Expires", "0")
+	// The stream depends on the Last-Event-ID sent when reconnecting, a cache ignoring the directives above must not serve it to another request
+	w.Header().Add("Vary", "Last-Event-ID")
 
 	// NGINX support https://www.nginx.com/resources/wiki/start/topics/examples/x-accel/#x-accel-buffering
 	w.Header().Set("X-Accel-Buffering", "no")
@@ -153,42 +580,238 @@ func retrieveLastEventID(r *http.Request) string {
 	return r.URL.Query().Get("Last-Event-ID")
 }
 
-// sendMissedEvents sends the events received since the one provided in Last-Event-ID
-func (h *Hub) sendMissedEvents(w http.ResponseWriter, r *http.Request, s *Subscriber) {
-	f := w.(http.Flusher)
-	if err := h.history.FindFor(s, func(u *Update) bool {
-		fmt.Fprint(w, u.String())
-		f.Flush()
-		log.WithFields(log.Fields{
-			"event_id":      u.ID,
-			"last_event_id": s.LastEventID,
-			"remote_addr":   r.RemoteAddr,
-		}).Info("Event sent")
+// retrieveFrom extracts the date from which the missed updates must be sent from the "from" query parameter (RFC3339)
+// It is zero if the parameter isn't set, the Last-Event-ID takes precedence over this date
+func retrieveFrom(r *http.Request) (time.Time, error) {
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, from)
+}
+
+// connectionEvent is the payload of the event sent when a subscriber connects
+type connectionEvent struct {
+	ID      string   `json:"id"`
+	Targets []string `json:"targets"`
+}
+
+// sendConnectionEvent sends an event of type "connection" containing the ID of the connection and the targets the subscriber is authorized to receive
+// It has no "id" field, to not change the Last-Event-ID of the client
+// The ID isn't added to the metrics' labels because a label per connection would make their cardinality unbounded
+func sendConnectionEvent(w http.ResponseWriter, s *Subscriber) {
+	e := connectionEvent{ID: s.ID, Targets: []string{"*"}}
+	if !s.AllTargets {
+		e.Targets = make([]string, 0, len(s.Targets))
+		for t := range s.Targets {
+			e.Targets = append(e.Targets, t)
+		}
+		sort.Strings(e.Targets)
+	}
+
+	// Marshaling strings cannot fail
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "event: connection\ndata: %s\n\n", data)
+	w.(http.Flusher).Flush()
+}
+
+// sendMissedEvents sends the events received since the one provided in Last-Event-ID, since the position of the resume token, or since the date provided in the "from" query parameter
+// If this event or this position isn't in the history anymore, a comment is sent before the oldest available events
+// It returns the number of events sent
+func (h *Hub) sendMissedEvents(w http.ResponseWriter, r *http.Request, s *Subscriber) int {
+	var updates []*Update
+	err := h.history.FindFor(s, func(u *Update) bool {
+		updates = append(updates, u)
+		return true
+	})
+
+	switch err {
+	case nil:
+	case errLastEventIDNotFound:
+		fmt.Fprint(w, ": Last-Event-ID not found, sending the oldest available events\n")
+		h.logger.Info("Last-Event-ID not found in history", "subscriber_id", s.ID, "last_event_id", s.LastEventID, "remote_addr", r.RemoteAddr)
+	case errResumePositionNotFound:
+		fmt.Fprint(w, ": resume position not found, sending the oldest available events\n")
+		h.logger.Info("Resume position not found in history", "subscriber_id", s.ID, "resume_position", s.resumePosition, "remote_addr", r.RemoteAddr)
+	default:
+		h.logger.Error("Failed to retrieve the missed events", "subscriber_id", s.ID, "last_event_id", s.LastEventID, "remote_addr", r.RemoteAddr, "error", err)
+	}
+
+	return h.sendHistoryEvents(w, r, s, updates)
+}
+
+// sendInitialState sends the latest update of each topic the subscriber is subscribed to, so it doesn't have to fetch the current state of the resources separately
+// Nothing is sent if the history can't retrieve the latest updates, it returns the number of events sent
+func (h *Hub) sendInitialState(w http.ResponseWriter, r *http.Request, s *Subscriber) int {
+	history, ok := h.history.(latestHistory)
+	if !ok {
+		return 0
+	}
+
+	var updates []*Update
+	if err := history.findLatestFor(s, func(u *Update) bool {
+		updates = append(updates, u)
 		return true
 	}); err != nil {
-		panic(err)
+		h.logger.Error("Failed to retrieve the initial state", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "error", err)
+	}
+
+	return h.sendHistoryEvents(w, r, s, updates)
+}
+
+// sendHistoryEvents sends the updates retrieved from the history, before the subscriber is registered to receive the live ones, it returns their number
+func (h *Hub) sendHistoryEvents(w http.ResponseWriter, r *http.Request, s *Subscriber, updates []*Update) int {
+	f := w.(http.Flusher)
+	for _, u := range updates {
+		fmt.Fprint(w, h.serialize(s.redact(s.updateFor(u))))
+		f.Flush()
+		h.metrics.updatesDispatched.Inc()
+		h.logger.Info("Event sent", "subscriber_id", s.ID, "event_id", u.ID, "last_event_id", s.LastEventID, "remote_addr", r.RemoteAddr)
+	}
+	f.Flush()
+
+	return len(updates)
+}
+
+// catchUpEvent is the data of the event sent once the events retrieved from the history have been sent
+type catchUpEvent struct {
+	Replayed int `json:"replayed"`
+}
+
+// sendCatchUpMarker tells the subscriber that the events retrieved from the history have all been sent, using the marker set in the options
+// The next events are the live ones, the marker is only sent if events have been replayed: nothing separates the live events from an empty replay
+// The event has no "id" field, to not change the Last-Event-ID of the client
+func (h *Hub) sendCatchUpMarker(w http.ResponseWriter, replayed int) {
+	if replayed == 0 {
+		return
+	}
+
+	switch h.options.CatchUpMarker {
+	case CatchUpMarkerComment:
+		fmt.Fprintf(w, ": catch-up complete, %d events replayed\n", replayed)
+	case CatchUpMarkerEvent:
+		// Marshaling an int cannot fail
+		data, _ := json.Marshal(catchUpEvent{replayed})
+		fmt.Fprintf(w, "event: catch-up\ndata: %s\n\n", data)
+	default:
+		return
+	}
+
+	w.(http.Flusher).Flush()
+}
+
+// writeFailed logs the failure of a write of the stream, and counts it if it timed out (see Options.EventWriteTimeout)
+// The connection can't be used anymore, the subscriber is removed when the handler returns
+func (h *Hub) writeFailed(s *Subscriber, r *http.Request, err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		h.metrics.subscribersWriteTimeout.Inc()
+		h.logger.Warn("Subscriber disconnected, writing the event timed out", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+
+	h.logger.Info("Subscriber disconnected, writing the event failed", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "error", err)
+}
+
+// idleTimedOut records the disconnection of a subscriber to which nothing could be written during the idle timeout, it is considered gone
+func (h *Hub) idleTimedOut(s *Subscriber, r *http.Request) {
+	h.metrics.subscribersIdleTimeout.Inc()
+	h.logger.Warn("Subscriber disconnected, idle timeout reached", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "idle_timeout", h.options.SubscriberIdleTimeout)
+}
+
+// quotaExceeded records the disconnection of a subscriber which exceeded a quota
+func (h *Hub) quotaExceeded(s *Subscriber, r *http.Request, quota string) {
+	h.metrics.subscribersQuotaExceeded.WithLabelValues(quota).Inc()
+	h.logger.Warn("Subscriber disconnected, quota exceeded", "subscriber_id", s.ID, "remote_addr", r.RemoteAddr, "quota", quota)
+}
+
+// reconnectionDelay returns the time (in milliseconds) subscribers are asked to wait before reconnecting when the hub can't serve them
+func (h *Hub) reconnectionDelay() uint64 {
+	if h.options.DefaultRetry == 0 {
+		return defaultShutdownRetry
+	}
+
+	return h.options.DefaultRetry
+}
+
+// overloadRetry returns the delay after which the subscribers rejected because the hub is overloaded should reconnect
+// A random delay, up to the base one, is added so that the rejected subscribers don't all reconnect at the same time
+func (h *Hub) overloadRetry() time.Duration {
+	base := h.options.OverloadRetry
+	if base <= 0 {
+		base = time.Duration(h.reconnectionDelay()) * time.Millisecond
 	}
+
+	return base + time.Duration(h.jitter.int63n(int64(base)+1))
 }
 
-// publish sends the update to the client, if authorized
-func publish(serializedUpdate *serializedUpdate, subscriber *Subscriber, w http.ResponseWriter, r *http.Request) {
-	// Check authorization
-	if !subscriber.CanReceive(serializedUpdate.Update) {
+// sendOverloaded rejects a subscriber because the maximum number of subscribers has been reached, with the delay after which it should reconnect
+// An EventSource doesn't reconnect after a 503 response, so the subscribers accepting an event stream are sent the reconnection time in a stream closed immediately instead
+func (h *Hub) sendOverloaded(w http.ResponseWriter, r *http.Request) {
+	retry := h.overloadRetry()
+	if f, ok := w.(http.Flusher); ok && acceptsEventStream(r) {
+		sendHeaders(w)
+		fmt.Fprintf(w, "retry: %d\n\n", retry/time.Millisecond)
+		f.Flush()
 		return
 	}
 
-	fmt.Fprint(w, serializedUpdate.event)
-	log.WithFields(log.Fields{
-		"event_id":    serializedUpdate.ID,
-		"remote_addr": r.RemoteAddr,
-	}).Info("Event sent")
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((retry+time.Second-1)/time.Second), 10))
+	sendServiceUnavailable(w)
+}
+
+// acceptsEventStream checks if the "Accept" HTTP header, always sent by the EventSource of the browsers, contains "text/event-stream"
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		if strings.Contains(accept, "text/event-stream") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jitter draws the random delays added to the reconnection times, a rand.Rand isn't safe for concurrent use
+type jitter struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+func newJitter() *jitter {
+	return &jitter{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// int63n returns a random number in [0,n)
+func (j *jitter) int63n(n int64) int64 {
+	j.Lock()
+	defer j.Unlock()
+
+	return j.r.Int63n(n)
+}
+
+// sendShutdownRetry sends the reconnection time to the subscriber when the hub is shut down gracefully
+func (h *Hub) sendShutdownRetry(w http.ResponseWriter) {
+	h.state.RLock()
+	shutdown := h.state.shutdown
+	h.state.RUnlock()
+	if !shutdown {
+		return
+	}
+
+	fmt.Fprintf(w, "retry: %d\n\n", h.reconnectionDelay())
 	w.(http.Flusher).Flush()
 }
 
-// cleanup removes unused uritemplate.Template instances from memory
+// cleanup removes unused uritemplate.Template instances from memory and unregisters the subscriber
 func (h *Hub) cleanup(s *Subscriber) {
+	if s.ID != "" {
+		if sub, ok := h.subscriptions.remove(s.ID); ok {
+			h.dispatchSubscriptionEvent("disconnected", sub)
+		}
+	}
+
 	keys := make([]string, 0, len(s.RawTopics)+len(s.TemplateTopics))
-	copy(s.RawTopics, keys)
+	keys = append(keys, s.RawTopics...)
 	for _, uriTemplate := range s.TemplateTopics {
 		keys = append(keys, uriTemplate.Raw())
 	}
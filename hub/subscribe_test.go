@@ -1,18 +1,30 @@
 package hub
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/yosida95/uritemplate"
 	bolt "go.etcd.io/bbolt"
 )
 
 type responseWriterMock struct {
+	statusCode int
 }
 
 func (m *responseWriterMock) Header() http.Header {
@@ -24,6 +36,7 @@ func (m *responseWriterMock) Write([]byte) (int, error) {
 }
 
 func (m *responseWriterMock) WriteHeader(statusCode int) {
+	m.statusCode = statusCode
 }
 
 func TestSubscribeNotAFlusher(t *testing.T) {
@@ -31,9 +44,10 @@ func TestSubscribeNotAFlusher(t *testing.T) {
 
 	req := httptest.NewRequest("GET", "http://example.com/hub", nil)
 
-	assert.PanicsWithValue(t, "The Response Writer must be an instance of Flusher.", func() {
-		hub.SubscribeHandler(&responseWriterMock{}, req)
-	})
+	w := &responseWriterMock{}
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.statusCode)
 }
 
 func TestSubscribeNoCookie(t *testing.T) {
@@ -47,9 +61,46 @@ func TestSubscribeNoCookie(t *testing.T) {
 	resp := w.Result()
 
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
 	assert.Equal(t, http.StatusText(http.StatusUnauthorized)+"\n", w.Body.String())
 }
 
+func TestSubscribeAllowAnonymous(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	// Even the public topics require a JWT by default
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	hub.options.AllowAnonymous = true
+	w2 := newCloseNotifyingRecorder()
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if !empty {
+				w2.close()
+				return
+			}
+		}
+	}()
+	hub.SubscribeHandler(w2, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil))
+	assert.Equal(t, http.StatusOK, w2.Code)
+
+	// An invalid JWT is never considered as anonymous
+	req = httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyUnauthorizedJWT())
+	w = httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
 func TestSubscribeInvalidJWT(t *testing.T) {
 	hub := createDummy()
 
@@ -81,6 +132,21 @@ func TestSubscribeUnauthorizedJWT(t *testing.T) {
 	assert.Equal(t, http.StatusText(http.StatusUnauthorized)+"\n", w.Body.String())
 }
 
+func TestSubscribeEmptyTargets(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.RejectEmptyTargets = true
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, false, []string{}))
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, `Bearer error="insufficient_scope", error_description="The 'mercure.subscribe' claim of the JWT doesn't contain any target"`, resp.Header.Get("WWW-Authenticate"))
+	assert.Empty(t, hub.subscriptions.snapshot(false).Subscriptions)
+}
+
 func TestSubscribeInvalidAlgJWT(t *testing.T) {
 	hub := createDummy()
 
@@ -96,6 +162,104 @@ func TestSubscribeInvalidAlgJWT(t *testing.T) {
 	assert.Equal(t, http.StatusText(http.StatusUnauthorized)+"\n", w.Body.String())
 }
 
+func TestSubscribeTooManyTopics(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.MaxSubscribeTopics = 2
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/books/2&topic=http://example.com/books/{id}", nil)
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Too many \"topic\" parameters, the maximum is 2.\n", w.Body.String())
+	assert.Empty(t, hub.subscriptions.m)
+
+	req = httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/books/{id}", nil)
+	s, _, ok := hub.parseSubscription(httptest.NewRecorder(), req)
+	assert.True(t, ok)
+	hub.cleanup(s)
+}
+
+func TestSubscribeRestrictedTopics(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.topicDefaultTargets = newTopicDefaultTargets(map[string][]string{"http://example.com/users/{id}": {"admin"}, "http://example.com/payroll": {"admin"}})
+	hub.options.RestrictedTopicsStatus = http.StatusForbidden
+	hub.options.RestrictedTopicsBody = "Authentication required."
+
+	// These subscribers can never receive anything
+	for _, query := range []string{"topic=http://example.com/users/1&topic=http://example.com/payroll", "topic=http://example.com/users/{id}"} {
+		req := httptest.NewRequest("GET", "http://example.com/hub?"+query, nil)
+		w := httptest.NewRecorder()
+		hub.SubscribeHandler(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, "Authentication required.\n", w.Body.String())
+	}
+	assert.Empty(t, hub.subscriptions.m)
+
+	// These subscribers are idle until an update they are allowed to receive is published
+	for _, query := range []string{"topic=http://example.com/users/1&topic=http://example.com/books/1", "topic=http://example.com/{collection}/{id}"} {
+		req := httptest.NewRequest("GET", "http://example.com/hub?"+query, nil)
+		s, _, ok := hub.parseSubscription(httptest.NewRecorder(), req)
+		assert.True(t, ok, query)
+		hub.cleanup(s)
+	}
+
+	// Updates published with explicit targets can be received
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/payroll", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, false, []string{"foo"}))
+	s, _, ok := hub.parseSubscription(httptest.NewRecorder(), req)
+	assert.True(t, ok)
+	hub.cleanup(s)
+
+	// A JWT without targets doesn't grant anything more than anonymity
+	req = httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/payroll", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, false, []string{}))
+	w := httptest.NewRecorder()
+	hub.options.RestrictedTopicsBody = ""
+	hub.SubscribeHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "Forbidden\n", w.Body.String())
+
+	hub.options.RestrictedTopicsStatus = 0
+	req = httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/payroll", nil)
+	s, _, ok = hub.parseSubscription(httptest.NewRecorder(), req)
+	assert.True(t, ok)
+	hub.cleanup(s)
+}
+
+func TestSubscribeTopicTooLong(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.MaxTopicLength = 26
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/books/10", nil)
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"topic\" parameter, the maximum length is 26 bytes.\n", w.Body.String())
+
+	req = httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	s, _, ok := hub.parseSubscription(httptest.NewRecorder(), req)
+	assert.True(t, ok)
+	hub.cleanup(s)
+}
+
+func TestValidateSubscribeTopicsDefaults(t *testing.T) {
+	hub := createDummy()
+
+	topics := make([]string, defaultMaxSubscribeTopics)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("http://example.com/books/%d", i)
+	}
+	assert.Nil(t, hub.validateSubscribeTopics(topics))
+	assert.Error(t, hub.validateSubscribeTopics(append(topics, "http://example.com/books/new")))
+
+	topic := "http://example.com/" + strings.Repeat("a", defaultMaxTopicLength-19)
+	assert.Nil(t, hub.validateSubscribeTopics([]string{topic}))
+	assert.Error(t, hub.validateSubscribeTopics([]string{topic + "a"}))
+}
+
 func TestSubscribeNoTopic(t *testing.T) {
 	hub := createAnonymousDummy()
 
@@ -109,6 +273,131 @@ func TestSubscribeNoTopic(t *testing.T) {
 	assert.Equal(t, "Missing \"topic\" parameter.\n", w.Body.String())
 }
 
+func TestSubscribeInvalidFrom(t *testing.T) {
+	hub := createAnonymousDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&from=yesterday", nil)
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"from\" parameter: parsing time \"yesterday\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"yesterday\" as \"2006\".\n", w.Body.String())
+}
+
+func TestSubscribeInvalidTemplate(t *testing.T) {
+	hub := createAnonymousDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/{id}&topic=http://example.com/hub?topic=faulty{iri", nil)
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+
+	resp := w.Result()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, w.Body.String(), "Invalid \"topic\" parameter \"http://example.com/hub?topic=faulty{iri\"")
+	assert.Equal(t, uint32(0), hub.uriTemplates.m["http://example.com/books/{id}"].counter)
+	assert.NotContains(t, hub.uriTemplates.m, "http://example.com/hub?topic=faulty{iri")
+}
+
+func TestSubscribeInvalidFilter(t *testing.T) {
+	hub := createAnonymousDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&filter="+url.QueryEscape("status = 1"), nil)
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"filter\" parameter: at position 7: missing comparison operator after \"status\".\n", w.Body.String())
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.Start()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			ready := len(hub.subscribers.m) == 2
+			hub.subscribers.RUnlock()
+
+			if !ready {
+				continue
+			}
+
+			hub.updates <- newSerializedUpdate(&Update{
+				Topics: []string{"http://example.com/books/1"},
+				Event:  Event{Data: `{"status": "draft"}`, ID: "a"},
+			})
+			hub.updates <- newSerializedUpdate(&Update{
+				Topics: []string{"http://example.com/books/1"},
+				Event:  Event{Data: `{"status": "active"}`, ID: "b"},
+			})
+
+			hub.Stop()
+			return
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&filter="+url.QueryEscape(`status == "active"`), nil)
+		w := newCloseNotifyingRecorder()
+		hub.SubscribeHandler(w, req)
+
+		assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: b\ndata: {\"status\": \"active\"}\n\n", w.Body.String())
+	}()
+	go func() {
+		defer wg.Done()
+
+		// The filter of the other subscriber doesn't apply to this one
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+		w := newCloseNotifyingRecorder()
+		hub.SubscribeHandler(w, req)
+
+		assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: a\ndata: {\"status\": \"draft\"}\n\ntopic: http://example.com/books/1\nid: b\ndata: {\"status\": \"active\"}\n\n", w.Body.String())
+	}()
+
+	wg.Wait()
+}
+
+func TestSubscribeExactTopic(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.Start()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			hub.updates <- newSerializedUpdate(&Update{
+				Topics: []string{"http://example.com/books/1/reviews"},
+				Event:  Event{Data: "Longer", ID: "a"},
+			})
+			hub.updates <- newSerializedUpdate(&Update{
+				Topics: []string{"http://example.com/books/1"},
+				Event:  Event{Data: "Exact", ID: "b"},
+			})
+
+			hub.Stop()
+			return
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	w := newCloseNotifyingRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: b\ndata: Exact\n\n", w.Body.String())
+}
+
 func testSubscribe(numberOfSubscribers int, t *testing.T) {
 	hub := createAnonymousDummy()
 	hub.Start()
@@ -136,10 +425,6 @@ func testSubscribe(numberOfSubscribers int, t *testing.T) {
 				Topics: []string{"http://example.com/reviews/22"},
 				Event:  Event{Data: "Great", ID: "c"},
 			})
-			hub.updates <- newSerializedUpdate(&Update{
-				Topics: []string{"http://example.com/hub?topic=faulty{iri"},
-				Event:  Event{Data: "Faulty IRI", ID: "d"},
-			})
 
 			hub.Stop()
 			return
@@ -151,14 +436,14 @@ func testSubscribe(numberOfSubscribers int, t *testing.T) {
 	for i := 0; i < numberOfSubscribers; i++ {
 		go func(w2 *sync.WaitGroup) {
 			defer w2.Done()
-			req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/reviews/{id}&topic=http://example.com/hub?topic=faulty{iri", nil)
+			req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/reviews/{id}", nil)
 			w := newCloseNotifyingRecorder()
 			hub.SubscribeHandler(w, req)
 
 			if t != nil {
 				resp := w.Result()
 				assert.Equal(t, http.StatusOK, resp.StatusCode)
-				assert.Equal(t, ":\nid: b\ndata: Hello World\n\nid: c\ndata: Great\n\nid: d\ndata: Faulty IRI\n\n", w.Body.String())
+				assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: b\ndata: Hello World\n\ntopic: http://example.com/reviews/22\nid: c\ndata: Great\n\n", w.Body.String())
 			}
 		}(&wg)
 	}
@@ -241,7 +526,7 @@ func TestSubscribeTarget(t *testing.T) {
 
 	resp := w.Result()
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, ":\nevent: test\nid: b\ndata: Hello World\n\nretry: 1\nid: c\ndata: Great\n\n", w.Body.String())
+	assert.Equal(t, ":\ntopic: http://example.com/reviews/22\nevent: test\nid: b\ndata: Hello World\n\ntopic: http://example.com/reviews/23\nretry: 1\nid: c\ndata: Great\n\n", w.Body.String())
 }
 
 func TestSubscribeAllTargets(t *testing.T) {
@@ -281,7 +566,81 @@ func TestSubscribeAllTargets(t *testing.T) {
 
 	resp := w.Result()
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, ":\nid: a\ndata: Foo\n\nevent: test\nid: b\ndata: Hello World\n\n", w.Body.String())
+	assert.Equal(t, ":\ntopic: http://example.com/reviews/21\nid: a\ndata: Foo\n\ntopic: http://example.com/reviews/22\nevent: test\nid: b\ndata: Hello World\n\n", w.Body.String())
+}
+
+func TestSubscribeAnonymousTargets(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.Start()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			hub.updates <- newSerializedUpdate(&Update{
+				Targets: map[string]struct{}{"foo": {}},
+				Topics:  []string{"http://example.com/reviews/21"},
+				Event:   Event{Data: "Private", ID: "a"},
+			})
+			hub.updates <- newSerializedUpdate(&Update{
+				Targets: map[string]struct{}{},
+				Topics:  []string{"http://example.com/reviews/22"},
+				Event:   Event{Data: "Public", ID: "b"},
+			})
+
+			hub.Stop()
+			return
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/reviews/{id}", nil)
+	w := newCloseNotifyingRecorder()
+	hub.SubscribeHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ":\ntopic: http://example.com/reviews/22\nid: b\ndata: Public\n\n", w.Body.String())
+}
+
+func TestSubscribeConnectionEvent(t *testing.T) {
+	hub := createDummy()
+	hub.options.SendConnectionEvent = true
+	hub.Start()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if !empty {
+				hub.Stop()
+				return
+			}
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, false, []string{"foo", "bar"}))
+	w := newCloseNotifyingRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Regexp(t, `^:\nevent: connection\ndata: {"id":"[0-9a-f-]{36}","targets":\["bar","foo"\]}\n\n$`, w.Body.String())
+}
+
+func TestSendConnectionEventAllTargets(t *testing.T) {
+	w := httptest.NewRecorder()
+	s := NewSubscriber(true, nil, nil, []string{}, nil, "")
+	s.ID = "foo"
+	sendConnectionEvent(w, s)
+
+	assert.Equal(t, "event: connection\ndata: {\"id\":\"foo\",\"targets\":[\"*\"]}\n\n", w.Body.String())
 }
 
 func TestSendMissedEvents(t *testing.T) {
@@ -289,7 +648,7 @@ func TestSendMissedEvents(t *testing.T) {
 	defer db.Close()
 	defer os.Remove("test.db")
 
-	history := &boltHistory{db}
+	history := &boltHistory{DB: db}
 	history.Add(&Update{
 		Topics: []string{"http://example.com/foos/a"},
 		Event: Event{
@@ -316,7 +675,7 @@ func TestSendMissedEvents(t *testing.T) {
 		defer w.Done()
 		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/foos/{id}&Last-Event-ID=a", nil)
 		hub.SubscribeHandler(wr1, req)
-		assert.Equal(t, ":\nid: b\ndata: d2\n\n", wr1.Body.String())
+		assert.Equal(t, ":\ntopic: http://example.com/foos/b\nid: b\ndata: d2\n\n", wr1.Body.String())
 	}(&wg)
 
 	wr2 := newCloseNotifyingRecorder()
@@ -325,7 +684,7 @@ func TestSendMissedEvents(t *testing.T) {
 		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/foos/{id}", nil)
 		req.Header.Add("Last-Event-ID", "a")
 		hub.SubscribeHandler(wr2, req)
-		assert.Equal(t, ":\nid: b\ndata: d2\n\n", wr2.Body.String())
+		assert.Equal(t, ":\ntopic: http://example.com/foos/b\nid: b\ndata: d2\n\n", wr2.Body.String())
 	}(&wg)
 
 	for {
@@ -343,39 +702,460 @@ func TestSendMissedEvents(t *testing.T) {
 	wg.Wait()
 }
 
-func TestSubscribeHeartbeat(t *testing.T) {
-	hub := createAnonymousDummy()
-	hub.options.HeartbeatInterval = 5 * time.Millisecond
+func TestSendInitialState(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/foos/a"}, Event: Event{ID: "a1", Data: "d1"}})
+	history.Add(&Update{Topics: []string{"http://example.com/foos/b"}, Event: Event{ID: "b1", Data: "d2"}})
+	history.Add(&Update{Topics: []string{"http://example.com/foos/a"}, Event: Event{ID: "a2", Data: "d3"}})
+	history.Add(&Update{Topics: []string{"http://example.com/foos/b"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{ID: "b2", Data: "d4"}})
+	history.Add(&Update{Topics: []string{"http://example.com/bars/a"}, Event: Event{ID: "c1", Data: "d5"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.options.SendInitialState = true
 	hub.Start()
 
-	go func() {
-		for {
-			hub.subscribers.RLock()
-			empty := len(hub.subscribers.m) == 0
-			hub.subscribers.RUnlock()
+	var wg sync.WaitGroup
+	wg.Add(2)
 
-			if empty {
-				continue
-			}
+	// The latest update of each topic the subscriber can receive is sent
+	wr1 := newCloseNotifyingRecorder()
+	go func(w *sync.WaitGroup) {
+		defer w.Done()
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/foos/{id}", nil)
+		hub.SubscribeHandler(wr1, req)
+		assert.Equal(t, ":\ntopic: http://example.com/foos/b\nid: b1\ndata: d2\n\ntopic: http://example.com/foos/a\nid: a2\ndata: d3\n\n", wr1.Body.String())
+	}(&wg)
 
-			hub.updates <- newSerializedUpdate(&Update{
-				Topics: []string{"http://example.com/books/1"},
-				Event:  Event{Data: "Hello World", ID: "b"},
-			})
+	// The missed events are sent instead
+	wr2 := newCloseNotifyingRecorder()
+	go func(w *sync.WaitGroup) {
+		defer w.Done()
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/foos/{id}", nil)
+		req.Header.Add("Last-Event-ID", "b1")
+		hub.SubscribeHandler(wr2, req)
+		assert.Equal(t, ":\ntopic: http://example.com/foos/a\nid: a2\ndata: d3\n\n", wr2.Body.String())
+	}(&wg)
 
-			time.Sleep(8 * time.Millisecond)
-			hub.Stop()
-			return
+	for {
+		hub.subscribers.RLock()
+		two := len(hub.subscribers.m) == 2
+		hub.subscribers.RUnlock()
+
+		if two {
+			break
 		}
-	}()
+	}
+
+	wr1.close()
+	wr2.close()
+	wg.Wait()
+}
+
+func TestSubscribeCatchUpMarker(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "old"}})
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "b", Data: "missed"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.options.CatchUpMarker = CatchUpMarkerEvent
+	hub.Start()
+
+	var wg sync.WaitGroup
+	subscribe := func(lastEventID, expected string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+			if lastEventID != "" {
+				req.Header.Add("Last-Event-ID", lastEventID)
+			}
+			w := newCloseNotifyingRecorder()
+			hub.SubscribeHandler(w, req)
+
+			assert.Equal(t, expected, w.Body.String())
+		}()
+	}
+
+	// The marker separates the replayed events from the live ones
+	subscribe("a", ":\ntopic: http://example.com/books/1\nid: b\ndata: missed\n\nevent: catch-up\ndata: {\"replayed\":1}\n\ntopic: http://example.com/books/1\nid: c\ndata: live\n\n")
+	// The subscriber is already up to date, no event has been replayed
+	subscribe("b", ":\ntopic: http://example.com/books/1\nid: c\ndata: live\n\n")
+	// No replay has been requested
+	subscribe("", ":\ntopic: http://example.com/books/1\nid: c\ndata: live\n\n")
+
+	for {
+		hub.subscribers.RLock()
+		ready := len(hub.subscribers.m) == 3
+		hub.subscribers.RUnlock()
+
+		if ready {
+			break
+		}
+	}
+
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "c", Data: "live"}})
+	hub.Stop()
+	wg.Wait()
+}
+
+func TestSendCatchUpMarkerComment(t *testing.T) {
+	hub := createAnonymousDummy()
+
+	w := httptest.NewRecorder()
+	hub.sendCatchUpMarker(w, 3)
+	assert.Empty(t, w.Body.String())
+
+	hub.options.CatchUpMarker = CatchUpMarkerComment
+	hub.sendCatchUpMarker(w, 0)
+	assert.Empty(t, w.Body.String())
+
+	hub.sendCatchUpMarker(w, 3)
+	assert.Equal(t, ": catch-up complete, 3 events replayed\n", w.Body.String())
+}
+
+func TestSendMissedEventsFrom(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/foos/a"}, Event: Event{ID: "a", Data: "d1"}})
+	history.Add(&Update{Topics: []string{"http://example.com/foos/b"}, Event: Event{ID: "b", Data: "d2"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.Start()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	wr1 := newCloseNotifyingRecorder()
+	go func(w *sync.WaitGroup) {
+		defer w.Done()
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/foos/{id}&from=2019-04-01T12:00:00Z", nil)
+		hub.SubscribeHandler(wr1, req)
+		assert.Equal(t, ":\ntopic: http://example.com/foos/a\nid: a\ndata: d1\n\ntopic: http://example.com/foos/b\nid: b\ndata: d2\n\n", wr1.Body.String())
+	}(&wg)
+
+	// The Last-Event-ID takes precedence
+	wr2 := newCloseNotifyingRecorder()
+	go func(w *sync.WaitGroup) {
+		defer w.Done()
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/foos/{id}&from=2019-04-01T12:00:00Z", nil)
+		req.Header.Add("Last-Event-ID", "a")
+		hub.SubscribeHandler(wr2, req)
+		assert.Equal(t, ":\ntopic: http://example.com/foos/b\nid: b\ndata: d2\n\n", wr2.Body.String())
+	}(&wg)
+
+	for {
+		hub.subscribers.RLock()
+		two := len(hub.subscribers.m) == 2
+		hub.subscribers.RUnlock()
+
+		if two {
+			break
+		}
+	}
+
+	wr1.close()
+	wr2.close()
+	wg.Wait()
+}
+
+func TestSendMissedEventsTopicAlias(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1", "http://example.com/old/books/1"}, Event: Event{ID: "a", Data: "d1"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.Start()
 
-	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/reviews/{id}", nil)
+	w := newCloseNotifyingRecorder()
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if !empty {
+				w.close()
+				return
+			}
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/old/books/1&from=2019-04-01T12:00:00Z", nil)
+	hub.SubscribeHandler(w, req)
+	assert.Equal(t, ":\ntopic: http://example.com/old/books/1\nid: a\ndata: d1\n\n", w.Body.String())
+}
+
+func TestSendMissedEventsSelectors(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "d1"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.options.DataFormat = DataFormatEnvelope
+	hub.options.SendSelectors = true
+	hub.Start()
+
+	w := newCloseNotifyingRecorder()
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if !empty {
+				w.close()
+				return
+			}
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/{id}&from=2019-04-01T12:00:00Z", nil)
+	hub.SubscribeHandler(w, req)
+	assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: a\ndata: {\"topic\":\"http://example.com/books/1\",\"id\":\"a\",\"selectors\":[\"http://example.com/books/{id}\"],\"data\":\"d1\"}\n\n", w.Body.String())
+}
+
+func TestSendMissedEventsLastEventIDNotFound(t *testing.T) {
+	history := newMemoryHistory(1, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/foos/a"}, Event: Event{ID: "a", Data: "d1"}})
+	history.Add(&Update{Topics: []string{"http://example.com/foos/a"}, Event: Event{ID: "b", Data: "d2"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/foos/{id}&Last-Event-ID=a", nil)
+	w := httptest.NewRecorder()
+	hub.sendMissedEvents(w, req, NewSubscriber(true, nil, nil, []string{}, []*uritemplate.Template{uritemplate.MustNew("http://example.com/foos/{id}")}, "a"))
+
+	assert.Equal(t, ": Last-Event-ID not found, sending the oldest available events\ntopic: http://example.com/foos/a\nid: b\ndata: d2\n\n", w.Body.String())
+}
+
+func TestSubscribeHeartbeat(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.HeartbeatInterval = 5 * time.Millisecond
+	hub.Start()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			hub.updates <- newSerializedUpdate(&Update{
+				Topics: []string{"http://example.com/books/1"},
+				Event:  Event{Data: "Hello World", ID: "b"},
+			})
+
+			time.Sleep(8 * time.Millisecond)
+			hub.Stop()
+			return
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1&topic=http://example.com/reviews/{id}", nil)
 	w := newCloseNotifyingRecorder()
 	hub.SubscribeHandler(w, req)
 
 	resp := w.Result()
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, ":\nid: b\ndata: Hello World\n\n:\n", w.Body.String())
+	assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: b\ndata: Hello World\n\n:\n", w.Body.String())
+}
+
+func TestSubscribeQuotaExceeded(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.MaxSubscriberMessages = 2
+	hub.Start()
+	defer hub.Stop()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			for _, id := range []string{"a", "b", "c"} {
+				hub.updates <- newSerializedUpdate(&Update{
+					Topics: []string{"http://example.com/books/1"},
+					Event:  Event{Data: "Hello World", ID: id},
+				})
+			}
+			return
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	w := newCloseNotifyingRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: a\ndata: Hello World\n\ntopic: http://example.com/books/1\nid: b\ndata: Hello World\n\n: disconnected, messages quota exceeded\n\n", w.Body.String())
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.subscribersQuotaExceeded.WithLabelValues("messages")))
+
+	// The connection isn't closed by the recorder, the subscriber must be removed anyway
+	assert.True(t, waitForNoSubscribers(hub))
+}
+
+// waitForNoSubscribers waits until the hub doesn't dispatch the updates to any subscriber anymore, it returns false after 5 seconds
+func waitForNoSubscribers(hub *Hub) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if empty {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return false
+}
+
+// waitForNoGoroutine waits until no goroutine runs the given function, or one of its closures
+func waitForNoGoroutine(function string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	buf := make([]byte, 1<<20)
+	for time.Now().Before(deadline) {
+		if !strings.Contains(string(buf[:runtime.Stack(buf, true)]), function) {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return false
+}
+
+type flushCountingRecorder struct {
+	*closeNotifyingRecorder
+	flushes int32
+}
+
+func (f *flushCountingRecorder) Flush() {
+	atomic.AddInt32(&f.flushes, 1)
+	f.closeNotifyingRecorder.Flush()
+}
+
+func TestSubscribeFlushInterval(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.FlushInterval = 20 * time.Millisecond
+	hub.Start()
+
+	w := &flushCountingRecorder{closeNotifyingRecorder: newCloseNotifyingRecorder()}
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			// Only the headers have been flushed
+			assert.Equal(t, int32(1), atomic.LoadInt32(&w.flushes))
+			for _, id := range []string{"a", "b", "c"} {
+				hub.updates <- newSerializedUpdate(&Update{
+					Topics: []string{"http://example.com/books/1"},
+					Event:  Event{Data: "Hello World", ID: id},
+				})
+			}
+
+			time.Sleep(50 * time.Millisecond)
+			hub.Stop()
+			return
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: a\ndata: Hello World\n\ntopic: http://example.com/books/1\nid: b\ndata: Hello World\n\ntopic: http://example.com/books/1\nid: c\ndata: Hello World\n\n", w.Body.String())
+	// The headers, then the three events at once
+	assert.Equal(t, int32(2), atomic.LoadInt32(&w.flushes))
+}
+
+func TestSubscribeHeaders(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "old", ID: "a"}})
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "missed", ID: "b"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.Start()
+	defer hub.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil).WithContext(ctx)
+	req.Header.Add("Last-Event-ID", "a")
+	w := newCloseNotifyingRecorder()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			cancel()
+			w.close()
+			return
+		}
+	}()
+
+	hub.SubscribeHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	assert.Equal(t, "no-cache, no-store, must-revalidate", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Pragma"))
+	assert.Equal(t, "0", resp.Header.Get("Expires"))
+	assert.Equal(t, "no", resp.Header.Get("X-Accel-Buffering"))
+	assert.Equal(t, "Last-Event-ID", resp.Header.Get("Vary"))
+
+	// The Last-Event-ID has been taken into account before writing the body
+	assert.Equal(t, ":\ntopic: http://example.com/books/1\nid: b\ndata: missed\n\n", w.Body.String())
+}
+
+func TestSubscribeContextDone(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.HeartbeatInterval = time.Second
+	hub.Start()
+	defer hub.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil).WithContext(ctx)
+	w := newCloseNotifyingRecorder()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			cancel()
+			w.close()
+			return
+		}
+	}()
+
+	hub.SubscribeHandler(w, req)
+
+	hub.subscribers.RLock()
+	defer hub.subscribers.RUnlock()
+	assert.Empty(t, hub.subscribers.m)
+	assert.Equal(t, ":\n", w.Body.String())
 }
 
 // From https://github.com/go-martini/martini/blob/master/response_writer_test.go
@@ -404,3 +1184,215 @@ func BenchmarkSubscribe(b *testing.B) {
 		testSubscribe(1000, nil)
 	}
 }
+
+func TestSubscribeEventWriteTimeout(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.EventWriteTimeout = 50 * time.Millisecond
+	hub.Start()
+	defer hub.Stop()
+
+	// The handlers wrapping the response writer are used, to check that the deadline is set on the connection anyway
+	s := httptest.NewServer(hub.chainHandlers())
+	defer s.Close()
+
+	// This client never reads the stream, writes block once the TCP buffers are full
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /hub?topic=http://example.com/books/1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	data := strings.Repeat("a", 1<<20)
+	deadline := time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(hub.metrics.subscribersWriteTimeout) == 0 && time.Now().Before(deadline) {
+		hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: data}})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.subscribersWriteTimeout))
+
+	// The client is still connected, the dropped stream must not receive the updates anymore
+	assert.True(t, waitForNoSubscribers(hub))
+}
+
+// failingFlushRecorder reports an error when flushing, like a connection whose write failed
+type failingFlushRecorder struct {
+	*closeNotifyingRecorder
+}
+
+func (f *failingFlushRecorder) FlushError() error {
+	return errors.New("broken pipe")
+}
+
+func TestSubscribeWriteFailedUnregisters(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if !empty {
+				break
+			}
+		}
+
+		hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "Hello World"}})
+	}()
+
+	w := &failingFlushRecorder{newCloseNotifyingRecorder()}
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil))
+
+	assert.Contains(t, w.Body.String(), "id: a\n")
+	assert.True(t, waitForNoSubscribers(hub))
+}
+
+func TestSubscribeIdleTimeout(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.HeartbeatInterval = 10 * time.Millisecond
+	hub.options.SubscriberIdleTimeout = 200 * time.Millisecond
+	hub.Start()
+	defer hub.Stop()
+
+	s := httptest.NewServer(hub.chainHandlers())
+	defer s.Close()
+
+	// This client never reads the stream, like a peer gone without closing the connection
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /hub?topic=http://example.com/books/1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	data := strings.Repeat("a", 1<<20)
+	deadline := time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(hub.metrics.subscribersIdleTimeout) == 0 && time.Now().Before(deadline) {
+		hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: data}})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.subscribersIdleTimeout))
+	assert.Equal(t, 0.0, testutil.ToFloat64(hub.metrics.subscribersWriteTimeout))
+
+	// The connection is still open, the reaped subscriber must not receive the updates anymore
+	assert.True(t, waitForNoSubscribers(hub))
+}
+
+func TestSubscribeIdleTimeoutUnregisters(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.SubscriberIdleTimeout = 50 * time.Millisecond
+	hub.Start()
+	defer hub.Stop()
+
+	// Nothing is flushed, the subscriber is reaped by the idle timer while the recorder keeps the connection open
+	w := newCloseNotifyingRecorder()
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.subscribersIdleTimeout))
+	assert.True(t, waitForNoSubscribers(hub))
+}
+
+func TestSubscribeIdleTimeoutHeartbeat(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.HeartbeatInterval = 10 * time.Millisecond
+	hub.options.SubscriberIdleTimeout = 50 * time.Millisecond
+	hub.Start()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		hub.Stop()
+	}()
+
+	// The heartbeats are flushed successfully, the subscriber stays connected until the hub stops
+	w := newCloseNotifyingRecorder()
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil))
+
+	assert.Equal(t, 0.0, testutil.ToFloat64(hub.metrics.subscribersIdleTimeout))
+	assert.Contains(t, w.Body.String(), ":\n")
+}
+
+func TestSubscribeMaxSubscribers(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.MaxSubscribers = 1
+	hub.Start()
+	defer hub.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newCloseNotifyingRecorder()
+	done := make(chan struct{})
+	go func() {
+		hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil).WithContext(ctx))
+		close(done)
+	}()
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	rejected := httptest.NewRecorder()
+	hub.SubscribeHandler(rejected, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+	assert.Equal(t, 1, hub.subscriptions.snapshot(false).Total)
+
+	// The reconnection delay is between the default retry and twice its value
+	retryAfter, err := strconv.Atoi(rejected.Header().Get("Retry-After"))
+	assert.Nil(t, err)
+	assert.True(t, retryAfter >= 5 && retryAfter <= 10, retryAfter)
+
+	// EventSource doesn't reconnect after a 503, the reconnection time is sent in the stream instead
+	hub.options.OverloadRetry = 30 * time.Second
+	delays := make(map[int]struct{})
+	for i := 0; i < 20; i++ {
+		rejected := newCloseNotifyingRecorder()
+		req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+		req.Header.Add("Accept", "text/event-stream")
+		hub.SubscribeHandler(rejected, req)
+		assert.Equal(t, http.StatusOK, rejected.Code)
+		assert.Equal(t, "text/event-stream", rejected.Header().Get("Content-Type"))
+
+		var retry int
+		_, err := fmt.Sscanf(rejected.Body.String(), ":\nretry: %d\n\n", &retry)
+		assert.Nil(t, err)
+		assert.True(t, retry >= 30000 && retry <= 60000, retry)
+		delays[retry] = struct{}{}
+	}
+	assert.True(t, len(delays) > 1)
+	assert.Equal(t, 1, hub.subscriptions.snapshot(false).Total)
+
+	// The slot is released when the subscriber disconnects
+	cancel()
+	w.close()
+	<-done
+	assert.Equal(t, 0, hub.subscriptions.snapshot(false).Total)
+}
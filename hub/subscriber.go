@@ -2,43 +2,139 @@ package hub
 
 import (
 	"sync"
+	"time"
 
 	"github.com/yosida95/uritemplate"
 )
 
+// subscribers maps the channels receiving the updates to their subscribers, the updates are filtered before being sent
 type subscribers struct {
 	sync.RWMutex
-	m map[chan *serializedUpdate]struct{}
+	m map[chan *serializedUpdate]*Subscriber
+}
+
+// subscriberRegistration is sent to the goroutine dispatching the updates when a subscriber connects
+type subscriberRegistration struct {
+	updates    chan *serializedUpdate
+	subscriber *Subscriber
 }
 
 // Subscriber represents a client subscribed to a list of topics
 type Subscriber struct {
-	AllTargets     bool
-	Targets        map[string]struct{}
-	RawTopics      []string
-	TemplateTopics []*uritemplate.Template
-	LastEventID    string
-	matchCache     map[string]bool
+	AllTargets      bool
+	Targets         map[string]struct{}
+	TemplateTargets []*uritemplate.Template
+	RawTopics       []string
+	TemplateTopics  []*uritemplate.Template
+	LastEventID     string
+	// From is the date from which the missed updates are sent when no Last-Event-ID is provided
+	From time.Time
+	// resumePosition is the position of the history, decoded from a resume token, after which the missed updates are sent when no Last-Event-ID is provided
+	resumePosition string
+	// ID identifies the connection in the logs, and in the connection event
+	ID         string
+	matchCache map[string]bool
+	// filter selects the updates to send among the ones of the subscribed topics, using their JSON payload, all of them are sent if it is nil
+	filter filter
+	// redactor is the RedactForSubscriber hook, called with the claims of the subscriber (nil for anonymous subscribers)
+	redactor DataRedactor
+	claims   *AuthorizationClaims
+	// priorityUpdates is the lane of the high priority updates, created when the subscriber is registered, they are sent before the normal ones already queued
+	priorityUpdates chan *serializedUpdate
+	// sendSelectors is true if the topics and URI templates matching the updates are attached to them, see Options.SendSelectors
+	sendSelectors bool
+	// subscriptionEvents is true for the streams of SubscriptionEventsHandler, they only receive the updates generated by the hub, which no other subscriber receives
+	subscriptionEvents bool
+}
+
+// subscriberQuota counts the messages and bytes sent through a connection, to enforce the limits set in the options (0 means unlimited)
+// It is only used by the goroutine serving the connection, the counters don't need to be synchronized
+type subscriberQuota struct {
+	maxMessages int
+	maxBytes    int64
+	messages    int
+	bytes       int64
+}
+
+// newSubscriberQuota creates the quota of a new connection
+func (h *Hub) newSubscriberQuota() *subscriberQuota {
+	return &subscriberQuota{maxMessages: h.options.MaxSubscriberMessages, maxBytes: h.options.MaxSubscriberBytes}
+}
+
+// consume counts a message of this size, it returns the name of the quota that sending it would exceed, or an empty string
+func (q *subscriberQuota) consume(size int) string {
+	if q.maxMessages > 0 && q.messages >= q.maxMessages {
+		return "messages"
+	}
+	if q.maxBytes > 0 && q.bytes+int64(size) > q.maxBytes {
+		return "bytes"
+	}
+
+	q.messages++
+	q.bytes += int64(size)
+
+	return ""
 }
 
 // NewSubscriber creates a subscriber
-func NewSubscriber(allTargets bool, targets map[string]struct{}, rawTopics []string, templateTopics []*uritemplate.Template, lastEventID string) *Subscriber {
-	return &Subscriber{allTargets, targets, rawTopics, templateTopics, lastEventID, make(map[string]bool)}
+func NewSubscriber(allTargets bool, targets map[string]struct{}, templateTargets []*uritemplate.Template, rawTopics []string, templateTopics []*uritemplate.Template, lastEventID string) *Subscriber {
+	return &Subscriber{allTargets, targets, templateTargets, rawTopics, templateTopics, lastEventID, time.Time{}, "", "", make(map[string]bool), nil, nil, nil, nil, false, false}
+}
+
+// nextUpdate waits for the next update to send, the high priority updates are received before the normal ones already queued
+// It returns false once the hub has closed the channel of the normal updates
+func (s *Subscriber) nextUpdate(updates chan *serializedUpdate) (*serializedUpdate, bool) {
+	select {
+	case u := <-s.priorityUpdates:
+		return u, true
+	default:
+	}
+
+	select {
+	case u := <-s.priorityUpdates:
+		return u, true
+	case u, open := <-updates:
+		return u, open
+	}
+}
+
+// requestsMissedEvents checks if the subscriber asked for the updates it missed, using a Last-Event-ID, a resume token or a date
+func (s *Subscriber) requestsMissedEvents() bool {
+	return s.LastEventID != "" || s.resumePosition != "" || !s.From.IsZero()
 }
 
 // CanReceive checks if the update can be dispatched according to the given criteria
 func (s *Subscriber) CanReceive(u *Update) bool {
-	return s.isAuthorized(u) && s.isSubscribed(u)
+	return s.canReceive(u, nil)
+}
+
+// canReceive is CanReceive evaluating the filter against the document decoded from the data of the update, if any
+// The document is only reused when the redaction hook kept the data as is, otherwise the redacted data is decoded
+func (s *Subscriber) canReceive(u *Update, document *filterDocument) bool {
+	if !s.isAuthorized(u) || !s.isSubscribed(u) {
+		return false
+	}
+	if s.filter == nil {
+		return true
+	}
+
+	redacted := s.redact(u)
+	if redacted != u || document == nil {
+		return matchFilter(s.filter, redacted.Data)
+	}
+
+	return document.match(s.filter)
 }
 
 // isAuthorized checks if the subscriber can access to at least one of the update's intended targets
+// Updates without targets are public, private ones are never dispatched to anonymous subscribers
 func (s *Subscriber) isAuthorized(u *Update) bool {
 	if s.AllTargets || len(u.Targets) == 0 {
 		return true
 	}
 
-	for t := range s.Targets {
-		if _, ok := u.Targets[t]; ok {
+	for t := range u.Targets {
+		if matchTarget(t, s.Targets, s.TemplateTargets) {
 			return true
 		}
 	}
@@ -48,26 +144,101 @@ func (s *Subscriber) isAuthorized(u *Update) bool {
 
 // isSubscribedToUpdate checks if the subscriber has subscribed to this update
 func (s *Subscriber) isSubscribed(u *Update) bool {
+	_, ok := s.matchedTopic(u)
+
+	return ok
+}
+
+// matchedTopic returns the first topic of the update the subscriber has subscribed to, the canonical one comes first
+func (s *Subscriber) matchedTopic(u *Update) (string, bool) {
 	for _, ut := range u.Topics {
-		if match, ok := s.matchCache[ut]; ok {
-			return match
+		match, ok := s.matchCache[ut]
+		if !ok {
+			match = matchTopic(ut, s.RawTopics, s.TemplateTopics)
+			s.matchCache[ut] = match
 		}
 
-		for _, rt := range s.RawTopics {
-			if ut == rt {
-				s.matchCache[ut] = true
-				return true
+		if match {
+			return ut, true
+		}
+	}
+
+	return "", false
+}
+
+// redact returns the update as it must be sent to the subscriber, its data passed through the redaction hook
+// The update itself is returned if there is no hook or if it kept the data as is
+func (s *Subscriber) redact(u *Update) *Update {
+	if s.redactor == nil {
+		return u
+	}
+
+	data := s.redactor(s.claims, u.Data)
+	if data == u.Data {
+		return u
+	}
+
+	redacted := *u
+	redacted.Data = data
+
+	return &redacted
+}
+
+// selectors returns the topics and the URI templates the subscriber has subscribed to matching one of the topics of the update, in the order of the subscription
+// The raw topics come first, the URI templates are returned as written by the subscriber
+func (s *Subscriber) selectors(u *Update) []string {
+	var selectors []string
+	for _, rt := range s.RawTopics {
+		for _, t := range u.Topics {
+			if t == rt {
+				selectors = append(selectors, rt)
+				break
 			}
 		}
+	}
 
-		for _, tt := range s.TemplateTopics {
-			if tt.Match(ut) != nil {
-				s.matchCache[ut] = true
-				return true
+	for _, tt := range s.TemplateTopics {
+		for _, t := range u.Topics {
+			if tt.Match(t) != nil {
+				selectors = append(selectors, tt.Raw())
+				break
 			}
 		}
+	}
 
-		s.matchCache[ut] = false
+	return selectors
+}
+
+// updateFor returns the update as it must be sent to the subscriber: when only an alternate topic has been subscribed to, this topic is attached to the event
+// The matching selectors are attached too if they must be sent
+func (s *Subscriber) updateFor(u *Update) *Update {
+	topic, ok := s.matchedTopic(u)
+	if !ok {
+		return u
+	}
+
+	if topic != u.Topics[0] {
+		u = u.withTopic(topic)
+	}
+	if s.sendSelectors {
+		u = u.withSelectors(s.selectors(u))
+	}
+
+	return u
+}
+
+// matchTopic checks if the topic is equal to one of the raw topics, or matches one of the URI templates
+func matchTopic(topic string, rawTopics []string, templateTopics []*uritemplate.Template) bool {
+	for _, rt := range rawTopics {
+		if topic == rt {
+			return true
+		}
+	}
+
+	for _, tt := range templateTopics {
+		if tt.Match(topic) != nil {
+			return true
+		}
 	}
 
 	return false
@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosida95/uritemplate"
+)
+
+func TestCanReceivePublicUpdate(t *testing.T) {
+	s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/foo"}, nil, "")
+
+	assert.True(t, s.CanReceive(&Update{Topics: []string{"http://example.com/foo"}}))
+	assert.False(t, s.CanReceive(&Update{Topics: []string{"http://example.com/bar"}}))
+}
+
+func TestCanReceiveAnonymous(t *testing.T) {
+	all, targets, templateTargets := authorizedTargets(nil, false)
+	s := NewSubscriber(all, targets, templateTargets, []string{"http://example.com/foo"}, nil, "")
+
+	assert.False(t, s.CanReceive(&Update{Topics: []string{"http://example.com/foo"}, Targets: map[string]struct{}{"foo": {}}}))
+}
+
+func TestCanReceivePartialMatch(t *testing.T) {
+	tpl, _ := uritemplate.New("http://example.com/users/{id}")
+	s := NewSubscriber(false, map[string]struct{}{"foo": {}}, []*uritemplate.Template{tpl}, []string{"http://example.com/foo"}, nil, "")
+
+	assert.True(t, s.CanReceive(&Update{Topics: []string{"http://example.com/foo"}, Targets: map[string]struct{}{"foo": {}, "bar": {}}}))
+	assert.True(t, s.CanReceive(&Update{Topics: []string{"http://example.com/foo"}, Targets: map[string]struct{}{"bar": {}, "http://example.com/users/1": {}}}))
+	assert.False(t, s.CanReceive(&Update{Topics: []string{"http://example.com/foo"}, Targets: map[string]struct{}{"bar": {}, "baz": {}}}))
+}
+
+func TestCanReceiveAllTargets(t *testing.T) {
+	all, targets, templateTargets := authorizedTargets(&claims{Mercure: mercureClaim{Subscribe: []string{"foo", "*"}}}, false)
+	s := NewSubscriber(all, targets, templateTargets, []string{"http://example.com/foo"}, nil, "")
+
+	assert.True(t, s.CanReceive(&Update{Topics: []string{"http://example.com/foo"}, Targets: map[string]struct{}{"bar": {}}}))
+	assert.False(t, s.CanReceive(&Update{Topics: []string{"http://example.com/bar"}, Targets: map[string]struct{}{"bar": {}}}))
+}
+
+func TestCanReceiveCachedMatch(t *testing.T) {
+	s := NewSubscriber(false, map[string]struct{}{}, nil, []string{"http://example.com/alt"}, nil, "")
+	u := &Update{Topics: []string{"http://example.com/foo", "http://example.com/alt"}}
+
+	assert.True(t, s.CanReceive(u))
+	// The result for the first topic is now cached, the other topics must still be checked
+	assert.True(t, s.CanReceive(u))
+}
+
+func TestSubscriberSelectors(t *testing.T) {
+	s := NewSubscriber(true, nil, nil, []string{"http://example.com/old/books/1", "http://example.com/books/1"}, []*uritemplate.Template{uritemplate.MustNew("http://example.com/books/{id}"), uritemplate.MustNew("http://example.com/{collection}/{id}"), uritemplate.MustNew("http://example.com/users/{id}")}, "")
+
+	assert.Equal(t, []string{"http://example.com/old/books/1", "http://example.com/books/1", "http://example.com/books/{id}", "http://example.com/{collection}/{id}"}, s.selectors(&Update{Topics: []string{"http://example.com/books/1", "http://example.com/old/books/1"}}))
+	assert.Equal(t, []string{"http://example.com/books/{id}", "http://example.com/{collection}/{id}"}, s.selectors(&Update{Topics: []string{"http://example.com/books/2"}}))
+	assert.Nil(t, s.selectors(&Update{Topics: []string{"http://example.com/reviews/1/2"}}))
+}
+
+func TestSubscriberUpdateForSelectors(t *testing.T) {
+	s := NewSubscriber(true, nil, nil, []string{"http://example.com/old/books/1"}, nil, "")
+	u := &Update{Topics: []string{"http://example.com/books/1", "http://example.com/old/books/1"}}
+
+	assert.Nil(t, s.updateFor(u).selectors)
+
+	s.sendSelectors = true
+	selected := s.updateFor(u)
+	assert.Equal(t, []string{"http://example.com/old/books/1"}, selected.selectors)
+	assert.Equal(t, []string{"http://example.com/old/books/1", "http://example.com/books/1"}, selected.Topics)
+	assert.Nil(t, u.selectors)
+}
+
+func TestSubscriberRedact(t *testing.T) {
+	s := NewSubscriber(true, nil, nil, []string{"http://example.com/books/1"}, nil, "")
+	u := &Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: `{"author":"Kévin","email":"kevin@example.com"}`}}
+
+	assert.Same(t, u, s.redact(u))
+
+	s.redactor = redactEmails
+	redacted := s.redact(u)
+	assert.Equal(t, `{"author":"Kévin"}`, redacted.Data)
+	assert.Equal(t, "a", redacted.ID)
+	assert.Equal(t, `{"author":"Kévin","email":"kevin@example.com"}`, u.Data)
+
+	// The update is reused when the data is unchanged
+	s.claims = &AuthorizationClaims{Subscribe: []string{"private"}}
+	assert.Same(t, u, s.redact(u))
+}
+
+func TestSubscriberQuota(t *testing.T) {
+	q := &subscriberQuota{}
+	for i := 0; i < 100; i++ {
+		assert.Empty(t, q.consume(1024))
+	}
+
+	q = &subscriberQuota{maxMessages: 2}
+	assert.Empty(t, q.consume(10))
+	assert.Empty(t, q.consume(10))
+	assert.Equal(t, "messages", q.consume(10))
+
+	q = &subscriberQuota{maxBytes: 25}
+	assert.Empty(t, q.consume(10))
+	assert.Empty(t, q.consume(10))
+	assert.Equal(t, "bytes", q.consume(10))
+	// Nothing is counted for the message which hasn't been sent
+	assert.Empty(t, q.consume(5))
+}
@@ -0,0 +1,254 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// adminTarget is the target a publisher must be allowed to dispatch updates to in order to use the introspection API
+const adminTarget = "admin"
+
+// subscriptionEventsTopic is the topic of the updates describing the lifecycle of the subscriptions, they are only sent to the "admin" target
+// It is reserved to the hub, publishers can't publish updates to it
+const subscriptionEventsTopic = "/.well-known/mercure/subscriptions"
+
+// subscriptions is the registry of the subscribers currently connected to the hub
+// watchers counts the streams of subscription events, the lifecycle events are only dispatched when at least one of them is connected
+type subscriptions struct {
+	sync.RWMutex
+	m        map[string]*subscription
+	watchers int
+}
+
+// subscription stores the metadata of a live subscriber
+type subscription struct {
+	ID          string    `json:"id"`
+	Topics      []string  `json:"topics"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Subject     string    `json:"subject,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// subscriptionsSnapshot is a consistent view of the registry at a given time
+type subscriptionsSnapshot struct {
+	Total         int            `json:"total"`
+	Topics        map[string]int `json:"topics"`
+	Subscriptions []subscription `json:"subscriptions,omitempty"`
+}
+
+// add registers a subscriber, it must have been given an ID
+// It returns false if the registry already contains max subscribers, there is no limit if max is 0
+func (s *subscriptions) add(subscriber *Subscriber, remoteAddr, subject string, connectedAt time.Time, max int) bool {
+	topics := make([]string, 0, len(subscriber.RawTopics)+len(subscriber.TemplateTopics))
+	topics = append(topics, subscriber.RawTopics...)
+	for _, uriTemplate := range subscriber.TemplateTopics {
+		topics = append(topics, uriTemplate.Raw())
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if max > 0 && len(s.m) >= max {
+		return false
+	}
+	s.m[subscriber.ID] = &subscription{subscriber.ID, topics, remoteAddr, subject, connectedAt}
+
+	return true
+}
+
+// get returns the subscription of the subscriber identified by this ID
+func (s *subscriptions) get(id string) (*subscription, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	sub, ok := s.m[id]
+
+	return sub, ok
+}
+
+// remove unregisters the subscriber identified by this ID, and returns its subscription if it was registered
+func (s *subscriptions) remove(id string) (*subscription, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	sub, ok := s.m[id]
+	delete(s.m, id)
+
+	return sub, ok
+}
+
+// watched checks if at least one stream of subscription events is connected
+func (s *subscriptions) watched() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.watchers > 0
+}
+
+// watch counts a stream of subscription events, delta is 1 when it connects and -1 when it disconnects
+func (s *subscriptions) watch(delta int) {
+	s.Lock()
+	s.watchers += delta
+	s.Unlock()
+}
+
+// snapshot counts the subscribers by topic, and lists them if details is true
+func (s *subscriptions) snapshot(details bool) subscriptionsSnapshot {
+	s.RLock()
+	defer s.RUnlock()
+
+	snapshot := subscriptionsSnapshot{Total: len(s.m), Topics: make(map[string]int)}
+	for _, sub := range s.m {
+		for _, topic := range sub.Topics {
+			snapshot.Topics[topic]++
+		}
+
+		if details {
+			snapshot.Subscriptions = append(snapshot.Subscriptions, *sub)
+		}
+	}
+
+	// Oldest subscribers first, to get a stable output
+	sort.Slice(snapshot.Subscriptions, func(i, j int) bool {
+		a, b := snapshot.Subscriptions[i], snapshot.Subscriptions[j]
+		if a.ConnectedAt.Equal(b.ConnectedAt) {
+			return a.ID < b.ID
+		}
+
+		return a.ConnectedAt.Before(b.ConnectedAt)
+	})
+
+	return snapshot
+}
+
+// SubscriptionsHandler returns the number of subscribers connected to the hub, by topic
+// The details of every subscription are also listed if the "details" query parameter is set
+// Only publishers allowed to dispatch updates to the "admin" target can use this endpoint
+func (h *Hub) SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	snapshot := h.subscriptions.snapshot(r.URL.Query().Get("details") != "")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// authorizeAdmin checks that the request has been sent by a publisher allowed to dispatch updates to the "admin" target
+// An error response is sent otherwise
+func (h *Hub) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	claims, err := authorize(r, h.getAuthorizationConfig(true))
+	if err != nil || claims == nil {
+		h.unauthorized(w, r, err)
+		return false
+	}
+
+	if all, targets, _ := authorizedTargets(claims, true); !all {
+		if _, ok := targets[adminTarget]; !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
+// dispatchSubscriptionEvent sends an event of the given type ("connected" or "disconnected") describing the subscription to the streams of subscription events
+// The event isn't stored in the history, nothing is dispatched if no stream is connected
+func (h *Hub) dispatchSubscriptionEvent(eventType string, sub *subscription) {
+	if !h.subscriptions.watched() {
+		return
+	}
+
+	// Marshaling a struct of strings and dates cannot fail
+	data, _ := json.Marshal(sub)
+	h.DispatchUpdate(&Update{
+		Targets:  map[string]struct{}{adminTarget: {}},
+		Topics:   []string{subscriptionEventsTopic},
+		Event:    Event{Data: string(data), ID: uuid.Must(uuid.NewV4()).String(), Type: eventType},
+		internal: true,
+	})
+}
+
+// SubscriptionEventsHandler streams the lifecycle events of the subscriptions: an event of type "connected" or "disconnected" is sent every time a subscriber connects or disconnects
+// The data of the events contains the subscription, as listed by SubscriptionsHandler
+// Only publishers allowed to dispatch updates to the "admin" target can use this endpoint, the streams aren't included in the subscriptions they report
+func (h *Hub) SubscriptionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	h.subscriptions.watch(1)
+	defer h.subscriptions.watch(-1)
+
+	// The subscriber is only used to filter the updates, it isn't added to the registry
+	subscriber := NewSubscriber(false, map[string]struct{}{adminTarget: {}}, nil, []string{subscriptionEventsTopic}, nil, "")
+	subscriber.subscriptionEvents = true
+	updateChan, ok := h.registerSubscriber(subscriber)
+	if !ok {
+		sendServiceUnavailable(w)
+		return
+	}
+
+	sendHeaders(w)
+
+	// However the stream ends, the events aren't dispatched to it anymore
+	unsubscribe, done := h.unsubscriber(updateChan)
+	defer unsubscribe()
+
+	if cn, ok := w.(http.CloseNotifier); ok {
+		notify := cn.CloseNotify()
+		go func() {
+			select {
+			case <-notify:
+				unsubscribe()
+			case <-done:
+			}
+		}()
+	}
+
+	var heartbeat <-chan time.Time
+	if h.options.HeartbeatInterval != time.Duration(0) {
+		ticker := time.NewTicker(h.options.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			// Drain the channel until the hub closes it, to not block the dispatch of the other updates
+			unsubscribe()
+			for range updateChan {
+			}
+			return
+
+		case u, open := <-updateChan:
+			if !open || u == slowSubscriberMarker {
+				return
+			}
+
+			h.resetStreamWriteDeadline(w, r)
+			fmt.Fprint(w, u.event)
+			f.Flush()
+
+		case <-heartbeat:
+			h.resetStreamWriteDeadline(w, r)
+			fmt.Fprint(w, ":\n")
+			f.Flush()
+		}
+	}
+}
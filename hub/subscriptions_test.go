@@ -0,0 +1,276 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yosida95/uritemplate"
+)
+
+func TestSubscriptionsSnapshot(t *testing.T) {
+	s := subscriptions{m: make(map[string]*subscription)}
+	now := time.Now()
+
+	s.add(&Subscriber{ID: "b", RawTopics: []string{"http://example.com/books/1"}}, "192.0.2.2:1234", "", now.Add(time.Second), 0)
+	s.add(&Subscriber{ID: "a", RawTopics: []string{"http://example.com/books/1"}, TemplateTopics: []*uritemplate.Template{uritemplate.MustNew("http://example.com/reviews/{id}")}}, "192.0.2.1:1234", "kevin", now, 0)
+
+	snapshot := s.snapshot(false)
+	assert.Equal(t, 2, snapshot.Total)
+	assert.Equal(t, map[string]int{"http://example.com/books/1": 2, "http://example.com/reviews/{id}": 1}, snapshot.Topics)
+	assert.Nil(t, snapshot.Subscriptions)
+
+	snapshot = s.snapshot(true)
+	assert.Len(t, snapshot.Subscriptions, 2)
+	assert.Equal(t, "a", snapshot.Subscriptions[0].ID)
+	assert.Equal(t, "kevin", snapshot.Subscriptions[0].Subject)
+	assert.Equal(t, "192.0.2.1:1234", snapshot.Subscriptions[0].RemoteAddr)
+	assert.Equal(t, "b", snapshot.Subscriptions[1].ID)
+
+	s.remove("a")
+	snapshot = s.snapshot(false)
+	assert.Equal(t, 1, snapshot.Total)
+	assert.Equal(t, map[string]int{"http://example.com/books/1": 1}, snapshot.Topics)
+}
+
+func TestSubscriptionsMax(t *testing.T) {
+	s := subscriptions{m: make(map[string]*subscription)}
+
+	assert.True(t, s.add(&Subscriber{ID: "a"}, "192.0.2.1:1234", "", time.Now(), 2))
+	assert.True(t, s.add(&Subscriber{ID: "b"}, "192.0.2.2:1234", "", time.Now(), 2))
+	assert.False(t, s.add(&Subscriber{ID: "c"}, "192.0.2.3:1234", "", time.Now(), 2))
+	assert.Equal(t, 2, s.snapshot(false).Total)
+
+	s.remove("a")
+	assert.True(t, s.add(&Subscriber{ID: "c"}, "192.0.2.3:1234", "", time.Now(), 2))
+	assert.True(t, s.add(&Subscriber{ID: "d"}, "192.0.2.4:1234", "", time.Now(), 0))
+}
+
+func TestSubscriptionsHandler(t *testing.T) {
+	h := createDummy()
+	h.subscriptions.add(&Subscriber{ID: "a", RawTopics: []string{"http://example.com/books/1"}}, "192.0.2.1:1234", "", time.Now(), 0)
+
+	req := httptest.NewRequest("GET", "http://example.com/hub/subscriptions?details=1", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{"admin"}))
+	w := httptest.NewRecorder()
+	h.SubscriptionsHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var snapshot subscriptionsSnapshot
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&snapshot))
+	assert.Equal(t, 1, snapshot.Total)
+	assert.Equal(t, map[string]int{"http://example.com/books/1": 1}, snapshot.Topics)
+	assert.Len(t, snapshot.Subscriptions, 1)
+	assert.Equal(t, "192.0.2.1:1234", snapshot.Subscriptions[0].RemoteAddr)
+}
+
+func TestSubscriptionsHandlerNotAllowed(t *testing.T) {
+	h := createDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub/subscriptions", nil)
+	w := httptest.NewRecorder()
+	h.SubscriptionsHandler(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "http://example.com/hub/subscriptions", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{"http://example.com/books/1"}))
+	w = httptest.NewRecorder()
+	h.SubscriptionsHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
+
+func TestSubscriptionsRegistry(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil).WithContext(ctx)
+	w := newCloseNotifyingRecorder()
+
+	go func() {
+		for {
+			if hub.subscriptions.snapshot(false).Total == 0 {
+				continue
+			}
+
+			assert.Equal(t, map[string]int{"http://example.com/books/1": 1}, hub.subscriptions.snapshot(false).Topics)
+			cancel()
+			w.close()
+			return
+		}
+	}()
+
+	hub.SubscribeHandler(w, req)
+	assert.Equal(t, 0, hub.subscriptions.snapshot(false).Total)
+}
+
+func TestSubscriptionEventsHandler(t *testing.T) {
+	hub := createDummy()
+	hub.options.AllowAnonymous = true
+	hub.Start()
+	defer hub.Stop()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub/subscriptions/events", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"admin"}))
+	adminW := newCloseNotifyingRecorder()
+	done := make(chan struct{})
+	go func() {
+		hub.SubscriptionEventsHandler(adminW, req)
+		close(done)
+	}()
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+	// The stream of events isn't a subscription
+	assert.Equal(t, 0, hub.subscriptions.snapshot(false).Total)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newCloseNotifyingRecorder()
+	go func() {
+		for hub.subscriptions.snapshot(false).Total == 0 {
+		}
+
+		cancel()
+		w.close()
+	}()
+	hub.SubscribeHandler(w, httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil).WithContext(ctx))
+
+	adminW.close()
+	<-done
+
+	assert.Equal(t, "text/event-stream", adminW.Header().Get("Content-Type"))
+	body := adminW.Body.String()
+	assert.Regexp(t, `topic: /.well-known/mercure/subscriptions\nevent: connected\nid: [^\n]+\ndata: {"id":"[^"]+","topics":\["http://example.com/books/1"\],"remote_addr":"192.0.2.1:1234","connected_at":"[^"]+"}\n\n`, body)
+	assert.Regexp(t, `event: disconnected\nid: [^\n]+\ndata: {"id":"[^"]+","topics":\["http://example.com/books/1"\]`, body)
+	assert.True(t, strings.Index(body, "event: connected") < strings.Index(body, "event: disconnected"))
+}
+
+func TestSubscriptionEventsHandlerEnd(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+
+	// The stream ends when the request is canceled, the writer doesn't have to notify the closing of the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "http://example.com/hub/subscriptions/events", nil).WithContext(ctx)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"admin"}))
+	done := make(chan struct{})
+	go func() {
+		hub.SubscriptionEventsHandler(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	cancel()
+	<-done
+	assert.True(t, waitForNoSubscribers(hub))
+
+	// The stream ends when the hub is stopped, while the connection is still open
+	req = httptest.NewRequest("GET", "http://example.com/hub/subscriptions/events", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"admin"}))
+	done = make(chan struct{})
+	go func() {
+		hub.SubscriptionEventsHandler(newCloseNotifyingRecorder(), req)
+		close(done)
+	}()
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	hub.Stop()
+	<-done
+	assert.True(t, waitForNoGoroutine("(*Hub).SubscriptionEventsHandler"))
+}
+
+func TestSubscriptionEventsHandlerNotAllowed(t *testing.T) {
+	h := createDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub/subscriptions/events", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(h, true, []string{"http://example.com/books/1"}))
+	w := httptest.NewRecorder()
+	h.SubscriptionEventsHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
+
+func TestPublishSubscriptionEventsTopic(t *testing.T) {
+	hub := createDummy()
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(`{"topic": "/.well-known/mercure/subscriptions", "data": "{}", "targets": "admin"}`))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"topic\" parameter \"/.well-known/mercure/subscriptions\": it is reserved to the hub\n", w.Body.String())
+}
+
+func TestSubscriptionEventsOnlySentToEventStreams(t *testing.T) {
+	hub := createDummy()
+	hub.Start()
+	defer hub.Stop()
+
+	hub.subscriptions.watch(1)
+	defer hub.subscriptions.watch(-1)
+
+	catchAll, _ := uritemplate.New("{+url}")
+	subscriber := NewSubscriber(true, nil, nil, nil, []*uritemplate.Template{catchAll}, "")
+	updates, _ := hub.registerSubscriber(subscriber)
+
+	events := NewSubscriber(false, map[string]struct{}{adminTarget: {}}, nil, []string{subscriptionEventsTopic}, nil, "")
+	events.subscriptionEvents = true
+	eventUpdates, _ := hub.registerSubscriber(events)
+
+	hub.dispatchSubscriptionEvent("connected", &subscription{ID: "a", Topics: []string{"http://example.com/books/1"}, RemoteAddr: "192.0.2.1:1234"})
+	hub.DispatchUpdate(&Update{Topics: []string{subscriptionEventsTopic + "/other"}, Targets: map[string]struct{}{adminTarget: {}}, Event: Event{ID: "b"}})
+
+	// The subscriber allowed to receive all the targets, and subscribed to all the topics, only receives the regular update
+	u := <-updates
+	assert.Equal(t, "b", u.ID)
+	assert.Equal(t, "connected", (<-eventUpdates).Type)
+	assert.Empty(t, eventUpdates)
+	assert.Empty(t, updates)
+}
+
+func TestSubscribeSubscriptionEventsTopic(t *testing.T) {
+	hub := createDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=/.well-known/mercure/subscriptions", nil)
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, false, []string{"*"}))
+	w := httptest.NewRecorder()
+	hub.SubscribeHandler(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"topic\" parameter \"/.well-known/mercure/subscriptions\": it is reserved to the hub.\n", w.Body.String())
+}
@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"strings"
+
+	"github.com/yosida95/uritemplate"
+)
+
+// topicDefaultTargets contains the targets applied to the updates published without targets, by topic
+// It prevents sensitive topics from being accidentally broadcasted to everyone
+type topicDefaultTargets []topicDefaultTargetsRule
+
+type topicDefaultTargetsRule struct {
+	rawTopics      []string
+	templateTopics []*uritemplate.Template
+	targets        []string
+}
+
+// newTopicDefaultTargets compiles the rules, the keys of the map are topics or URI templates
+// Invalid URI templates are matched as raw strings
+func newTopicDefaultTargets(m map[string][]string) topicDefaultTargets {
+	rules := make(topicDefaultTargets, 0, len(m))
+	for topic, targets := range m {
+		rule := topicDefaultTargetsRule{targets: targets}
+		rule.rawTopics, rule.templateTopics = compileTopicSelector(topic)
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// compileTopicSelector parses the topic as an URI template if it contains a brace, invalid URI templates are matched as raw strings
+// The returned slices can be passed to matchTopic
+func compileTopicSelector(topic string) ([]string, []*uritemplate.Template) {
+	if strings.Contains(topic, "{") {
+		if tpl, err := uritemplate.New(topic); err == nil {
+			return nil, []*uritemplate.Template{tpl}
+		}
+	}
+
+	return []string{topic}, nil
+}
+
+// forTopics returns the default targets of an update dispatched to these topics, or nil if no rule matches
+// When several rules match, all their targets are applied
+func (d topicDefaultTargets) forTopics(topics []string) map[string]struct{} {
+	var targets map[string]struct{}
+	for _, rule := range d {
+		for _, topic := range topics {
+			if !matchTopic(topic, rule.rawTopics, rule.templateTopics) {
+				continue
+			}
+
+			if targets == nil {
+				targets = make(map[string]struct{}, len(rule.targets))
+			}
+			for _, t := range rule.targets {
+				targets[t] = struct{}{}
+			}
+
+			break
+		}
+	}
+
+	return targets
+}
+
+// restricts checks if the updates dispatched to the topic, or to every topic matching this URI template, always have targets
+// A URI template is only considered restricted if a rule uses the exact same template, the topics it matches may not all match another one
+func (d topicDefaultTargets) restricts(topic string) bool {
+	_, templateTopics := compileTopicSelector(topic)
+	for _, rule := range d {
+		if len(templateTopics) == 0 {
+			if matchTopic(topic, rule.rawTopics, rule.templateTopics) {
+				return true
+			}
+
+			continue
+		}
+
+		for _, tpl := range rule.templateTopics {
+			if tpl.Raw() == topic {
+				return true
+			}
+		}
+	}
+
+	return false
+}
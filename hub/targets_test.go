@@ -0,0 +1,35 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicDefaultTargets(t *testing.T) {
+	d := newTopicDefaultTargets(map[string][]string{
+		"https://example.com/users/{id}": {"admin"},
+		"https://example.com/payroll":    {"hr", "admin"},
+		"https://example.com/faulty{iri": {"faulty"},
+	})
+
+	assert.Nil(t, d.forTopics([]string{"https://example.com/books/1"}))
+	assert.Equal(t, map[string]struct{}{"admin": {}}, d.forTopics([]string{"https://example.com/users/1"}))
+	assert.Equal(t, map[string]struct{}{"hr": {}, "admin": {}}, d.forTopics([]string{"https://example.com/books/1", "https://example.com/payroll"}))
+	assert.Equal(t, map[string]struct{}{"faulty": {}}, d.forTopics([]string{"https://example.com/faulty{iri"}))
+}
+
+func TestTopicDefaultTargetsRestricts(t *testing.T) {
+	d := newTopicDefaultTargets(map[string][]string{
+		"https://example.com/users/{id}": {"admin"},
+		"https://example.com/payroll":    {"hr", "admin"},
+	})
+
+	assert.True(t, d.restricts("https://example.com/users/1"))
+	assert.True(t, d.restricts("https://example.com/users/{id}"))
+	assert.True(t, d.restricts("https://example.com/payroll"))
+	assert.False(t, d.restricts("https://example.com/books/1"))
+	// This template also matches topics without default targets
+	assert.False(t, d.restricts("https://example.com/{collection}/{id}"))
+	assert.False(t, newTopicDefaultTargets(nil).restricts("https://example.com/payroll"))
+}
@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer used to create the spans of the hub
+const tracerName = "github.com/dunglas/mercure"
+
+// newTracer creates the tracer of the hub, spans are discarded if no provider is given
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = trace.NewNoopTracerProvider()
+	}
+
+	return provider.Tracer(tracerName)
+}
+
+// startRequestSpan starts a span covering the request, as a child of the span propagated by the client
+// using the W3C Trace Context headers, if any
+func (h *Hub) startRequestSpan(r *http.Request, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return h.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attributes...))
+}
+
+// startUpdateSpan starts a span as a child of the span in which the update has been published, if any
+func (h *Hub) startUpdateSpan(u *serializedUpdate, name string, attributes ...attribute.KeyValue) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), u.spanContext)
+	_, span := h.tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+
+	return span
+}
+
+// updateAttributes describes the update in spans and span events
+func updateAttributes(u *Update) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("mercure.event_id", u.ID),
+		attribute.StringSlice("mercure.topics", u.Topics),
+	}
+}
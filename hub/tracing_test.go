@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPublishTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	hub := NewHub(&localPublisher{}, &noHistory{}, &Options{
+		PublisherJWTKey: []byte("publisher"),
+		TracerProvider:  sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	hub.Start()
+	defer hub.Stop()
+
+	form := url.Values{}
+	form.Add("id", "id")
+	form.Add("topic", "http://example.com/books/1")
+	form.Add("data", "Hello!")
+
+	req := httptest.NewRequest("POST", "http://example.com/hub", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+createDummyAuthorizedJWT(hub, true, []string{"*"}))
+	req.Header.Add("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+	hub.PublishHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// The history and dispatch spans are ended asynchronously
+	var spans []sdktrace.ReadOnlySpan
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if spans = recorder.Ended(); len(spans) == 3 {
+			break
+		}
+	}
+
+	names := make(map[string]sdktrace.ReadOnlySpan, len(spans))
+	for _, span := range spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+		names[span.Name()] = span
+	}
+
+	publishSpan := names["mercure.publish"]
+	assert.NotNil(t, publishSpan)
+	assert.Equal(t, "00f067aa0ba902b7", publishSpan.Parent().SpanID().String())
+	assert.Equal(t, publishSpan.SpanContext().SpanID(), names["mercure.history.add"].Parent().SpanID())
+	assert.Equal(t, publishSpan.SpanContext().SpanID(), names["mercure.dispatch"].Parent().SpanID())
+}
+
+func TestSubscribeTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	hub := NewHub(&localPublisher{}, &noHistory{}, &Options{
+		AllowAnonymous: true,
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	hub.Start()
+
+	go func() {
+		for {
+			hub.subscribers.RLock()
+			empty := len(hub.subscribers.m) == 0
+			hub.subscribers.RUnlock()
+
+			if empty {
+				continue
+			}
+
+			hub.DispatchUpdate(&Update{
+				Topics: []string{"http://example.com/books/1"},
+				Event:  Event{Data: "Hello World", ID: "a"},
+			})
+			hub.Stop()
+			return
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub?topic=http://example.com/books/1", nil)
+	hub.SubscribeHandler(newCloseNotifyingRecorder(), req)
+
+	var subscribeSpan sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "mercure.subscribe" {
+			subscribeSpan = span
+		}
+	}
+
+	assert.NotNil(t, subscribeSpan)
+	assert.Len(t, subscribeSpan.Events(), 1)
+	assert.Equal(t, "Event sent", subscribeSpan.Events()[0].Name)
+}
@@ -1,5 +1,28 @@
 package hub
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Formats of the data of the events sent to the subscribers
+const (
+	// DataFormatRaw sends the data as published
+	DataFormatRaw = "raw"
+	// DataFormatEnvelope sends a JSON object containing the topic, the ID and the data of the update
+	DataFormatEnvelope = "envelope"
+)
+
+// Priorities of the updates, the high priority updates jump ahead of the normal ones queued for a subscriber
+const (
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
 // Update represents an update to send to subscribers
 type Update struct {
 	// The target audience
@@ -11,13 +34,115 @@ type Update struct {
 
 	// The Server-Sent Event to send
 	Event
+
+	// ContentType is the media type of the data, such as "application/ld+json", it is empty if the publisher didn't provide it
+	// It can't be attached to the events of the "text/event-stream" format, only the envelopes and the WebSocket messages contain it
+	ContentType string
+
+	// TTL is the duration during which the update is retrieved from the history, the retention of the history applies if it is 0
+	TTL time.Duration
+
+	// Priority is PriorityHigh for the updates sent ahead of the normal ones waiting in the buffers of the subscribers, it is empty for the normal ones
+	Priority string
+
+	// Sequences contains the sequence number of the update in each of its topics, when TopicSequence is enabled
+	// They are assigned when the update is dispatched, and stored in the history along with it
+	Sequences map[string]uint64
+
+	// selectors are the topics and the URI templates of the subscriber the update is sent to matching it, when SendSelectors is enabled
+	selectors []string
+
+	// spanContext identifies the span in which the update has been published, to trace its dispatch
+	spanContext trace.SpanContext
+
+	// recipients receives the number of subscribers the update has been sent to, once dispatched by this hub
+	recipients <-chan int
+
+	// internal is true for the updates generated by the hub itself, such as the subscription events, they aren't stored in the history
+	internal bool
+}
+
+// String serializes the update in a "text/event-stream" representation
+// The first IRI is attached to the "topic" field, to allow subscribers of several topics to route the event
+// It is the canonical one, unless the update is sent to a subscriber of an alternate IRI (see withTopic)
+func (u *Update) String() string {
+	if len(u.Topics) == 0 || strings.ContainsAny(u.Topics[0], "\r\n") {
+		return u.Event.String()
+	}
+
+	return fmt.Sprintf("topic: %s\n%s", u.Topics[0], u.Event.String())
+}
+
+// envelope is the JSON object sent as data when the envelope format is used
+type envelope struct {
+	Topic       string          `json:"topic"`
+	ID          string          `json:"id"`
+	ContentType string          `json:"contentType,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	Selectors   []string        `json:"selectors,omitempty"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// envelope returns a copy of the update whose data is wrapped in a JSON object along with the canonical topic, the ID and the content type
+// Data containing a valid JSON document is embedded as is, other data is encoded as a JSON string
+func (u *Update) envelope() *Update {
+	e := envelope{ID: u.ID, ContentType: u.ContentType, Selectors: u.selectors}
+	if len(u.Topics) > 0 {
+		e.Topic = u.Topics[0]
+		e.Seq = u.Sequences[e.Topic]
+	}
+
+	if json.Valid([]byte(u.Data)) {
+		e.Data = json.RawMessage(u.Data)
+	} else {
+		// Marshaling a string cannot fail
+		e.Data, _ = json.Marshal(u.Data)
+	}
+
+	// The embedded document is compacted, the data never contains line breaks
+	b, _ := json.Marshal(e)
+
+	wrapped := *u
+	wrapped.Data = string(b)
+
+	return &wrapped
+}
+
+// withTopic returns a copy of the update whose first topic is the given alternate topic, followed by the other ones
+func (u *Update) withTopic(topic string) *Update {
+	topics := make([]string, 1, len(u.Topics))
+	topics[0] = topic
+	for _, t := range u.Topics {
+		if t != topic {
+			topics = append(topics, t)
+		}
+	}
+
+	aliased := *u
+	aliased.Topics = topics
+
+	return &aliased
+}
+
+// withSelectors returns a copy of the update to which the given selectors are attached
+func (u *Update) withSelectors(selectors []string) *Update {
+	selected := *u
+	selected.selectors = selectors
+
+	return &selected
+}
+
+// expired checks if the TTL of the update, added to the history at the given time, has elapsed
+func (u *Update) expired(addedAt, now time.Time) bool {
+	return u.TTL != 0 && now.Sub(addedAt) >= u.TTL
 }
 
 type serializedUpdate struct {
 	*Update
-	event string
+	event      string
+	recipients chan<- int
 }
 
 func newSerializedUpdate(u *Update) *serializedUpdate {
-	return &serializedUpdate{u, u.String()}
+	return &serializedUpdate{u, u.String(), nil}
 }
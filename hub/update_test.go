@@ -0,0 +1,58 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateString(t *testing.T) {
+	u := &Update{
+		Topics: []string{"http://example.com/books/1", "http://example.com/alt/books/1"},
+		Event:  Event{Data: "data", ID: "custom-id"},
+	}
+	assert.Equal(t, "topic: http://example.com/books/1\nid: custom-id\ndata: data\n\n", u.String())
+
+	u.Topics = []string{"http://example.com/books/1\nid: injected"}
+	assert.Equal(t, "id: custom-id\ndata: data\n\n", u.String())
+
+	u.Topics = nil
+	assert.Equal(t, "id: custom-id\ndata: data\n\n", u.String())
+}
+
+func TestUpdateWithTopic(t *testing.T) {
+	u := &Update{
+		Topics: []string{"http://example.com/books/1", "http://example.com/alt/books/1", "http://example.com/old/books/1"},
+		Event:  Event{Data: "data", ID: "custom-id"},
+	}
+
+	aliased := u.withTopic("http://example.com/old/books/1")
+	assert.Equal(t, []string{"http://example.com/old/books/1", "http://example.com/books/1", "http://example.com/alt/books/1"}, aliased.Topics)
+	assert.Equal(t, "topic: http://example.com/old/books/1\nid: custom-id\ndata: data\n\n", aliased.String())
+	// The original update isn't modified
+	assert.Equal(t, "http://example.com/books/1", u.Topics[0])
+}
+
+func TestUpdateEnvelope(t *testing.T) {
+	u := &Update{
+		Topics: []string{"http://example.com/books/1", "http://example.com/alt/books/1"},
+		Event:  Event{Data: "{\n  \"title\": \"Mercure\"\n}", ID: "custom-id", Type: "test"},
+	}
+	assert.Equal(t, "topic: http://example.com/books/1\nevent: test\nid: custom-id\ndata: {\"topic\":\"http://example.com/books/1\",\"id\":\"custom-id\",\"data\":{\"title\":\"Mercure\"}}\n\n", u.envelope().String())
+	// The original update isn't modified
+	assert.Equal(t, "{\n  \"title\": \"Mercure\"\n}", u.Data)
+
+	u.Data = "not JSON\n\"quoted\""
+	assert.Equal(t, `{"topic":"http://example.com/books/1","id":"custom-id","data":"not JSON\n\"quoted\""}`, u.envelope().Data)
+
+	u.Data = "42"
+	assert.Equal(t, `{"topic":"http://example.com/books/1","id":"custom-id","data":42}`, u.envelope().Data)
+
+	u.ContentType = "application/ld+json"
+	assert.Equal(t, `{"topic":"http://example.com/books/1","id":"custom-id","contentType":"application/ld+json","data":42}`, u.envelope().Data)
+
+	u.Topics = nil
+	u.Data = ""
+	u.ContentType = ""
+	assert.Equal(t, `{"topic":"","id":"custom-id","data":""}`, u.envelope().Data)
+}
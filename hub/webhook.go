@@ -0,0 +1,326 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookIDHeader contains the ID of the webhook an update is delivered to
+	webhookIDHeader = "X-Mercure-Webhook-ID"
+	// webhookSignatureHeader contains the HMAC-SHA256 of the body of a delivery computed with the secret of the webhook, hex-encoded and prefixed by "sha256="
+	webhookSignatureHeader = "X-Mercure-Signature"
+)
+
+const (
+	defaultWebhookMaxRetries = 5
+	defaultWebhookRetryDelay = time.Second
+	// maxWebhookRetryDelay caps the exponential backoff between two attempts
+	maxWebhookRetryDelay = time.Minute
+	// webhookTimeout is the maximum duration of a delivery attempt, including reading the response
+	webhookTimeout = 10 * time.Second
+)
+
+// webhook delivers the updates of a subscription by POSTing them to a callback URL
+// The subscription is registered like the one of a connected subscriber, the targets and the filter of the registration apply
+type webhook struct {
+	ID       string   `json:"id"`
+	Callback string   `json:"callback"`
+	Topics   []string `json:"topics"`
+	// Secret signs the deliveries, it is only sent in the response to the registration
+	Secret string `json:"secret"`
+	// subject is the "sub" claim of the JWT used to register the webhook, only the same subject can deregister it
+	subject string
+	// jti and expiresAt come from the JWT used to register the webhook, it is disabled once this JWT is revoked or expired
+	jti        string
+	expiresAt  time.Time
+	subscriber *Subscriber
+	updates    chan *serializedUpdate
+}
+
+// expired checks if the JWT used to register the webhook doesn't grant access to the updates anymore
+func (wh *webhook) expired(h *Hub, now time.Time) bool {
+	return (!wh.expiresAt.IsZero() && !now.Before(wh.expiresAt)) || (wh.jti != "" && h.revokedTokens.contains(wh.jti))
+}
+
+// webhooks is the registry of the webhooks, the callbacks must belong to the allowed origins
+type webhooks struct {
+	sync.Mutex
+	m              map[string]*webhook
+	allowedOrigins *originPatterns
+	client         *http.Client
+}
+
+// newWebhooks returns nil if no origin is allowed, the webhooks are then disabled
+func newWebhooks(allowedOrigins []string) *webhooks {
+	if len(allowedOrigins) == 0 {
+		return nil
+	}
+
+	client := &http.Client{
+		Timeout: webhookTimeout,
+		// Following a redirection would allow to reach an origin which isn't allowed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &webhooks{m: make(map[string]*webhook), allowedOrigins: newOriginPatterns(allowedOrigins), client: client}
+}
+
+func (ws *webhooks) add(wh *webhook) {
+	ws.Lock()
+	ws.m[wh.ID] = wh
+	ws.Unlock()
+}
+
+func (ws *webhooks) get(id string) (*webhook, bool) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	wh, ok := ws.m[id]
+
+	return wh, ok
+}
+
+// remove returns false if the webhook had already been removed
+func (ws *webhooks) remove(id string) bool {
+	ws.Lock()
+	defer ws.Unlock()
+
+	_, ok := ws.m[id]
+	delete(ws.m, id)
+
+	return ok
+}
+
+// validateCallback checks that the callback is an absolute HTTP URL whose origin is allowed
+func (ws *webhooks) validateCallback(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("it must be an absolute HTTP URL")
+	}
+
+	if !ws.allowedOrigins.match(u.Scheme + "://" + u.Host) {
+		return errors.New("its origin isn't allowed")
+	}
+
+	return nil
+}
+
+// post sends the body to the callback of the webhook, the callback must respond with a 2xx status code
+func (ws *webhooks) post(wh *webhook, body []byte, signature string) error {
+	req, err := http.NewRequest("POST", wh.Callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, wh.ID)
+	req.Header.Set(webhookSignatureHeader, signature)
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// The body is read to reuse the connection, it is ignored
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the callback responded with the status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// WebhooksHandler registers (POST) or deregisters (DELETE) a webhook, the updates of its subscription are then POSTed to its callback URL
+// The registration is authorized and parsed as a subscription, the form containing the "topic" (and "filter") parameters along with the "callback" URL
+// The response contains the ID of the webhook, needed to deregister it using the "id" parameter, and the secret used to sign the deliveries
+func (h *Hub) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if h.webhooks == nil {
+		http.Error(w, "Webhooks aren't enabled.", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		h.deregisterWebhook(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %s.", err), http.StatusBadRequest)
+		return
+	}
+
+	// The parameters of the subscription are read from the form instead of the query
+	u := *r.URL
+	u.RawQuery = r.PostForm.Encode()
+	sr := r.WithContext(r.Context())
+	sr.URL = &u
+
+	subscriber, claims, ok := h.parseSubscription(w, sr)
+	if !ok {
+		return
+	}
+
+	callback := r.PostForm.Get("callback")
+	if err := h.webhooks.validateCallback(callback); err != nil {
+		h.cleanup(subscriber)
+		http.Error(w, fmt.Sprintf("Invalid \"callback\" parameter: %s.", err), http.StatusBadRequest)
+		return
+	}
+
+	if !h.addSubscription(w, sr, subscriber, claims) {
+		return
+	}
+
+	updates, ok := h.registerSubscriber(subscriber)
+	if !ok {
+		h.cleanup(subscriber)
+		sendServiceUnavailable(w)
+		return
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	wh := &webhook{ID: subscriber.ID, Callback: callback, Topics: u.Query()["topic"], Secret: hex.EncodeToString(secret), subject: subject(claims), subscriber: subscriber, updates: updates}
+	if claims != nil {
+		wh.jti = claims.Id
+		if claims.ExpiresAt != 0 {
+			wh.expiresAt = time.Unix(claims.ExpiresAt, 0)
+		}
+	}
+	h.webhooks.add(wh)
+	go h.runWebhook(wh)
+
+	h.logger.Info("Webhook registered", "webhook_id", wh.ID, "callback", callback, "topics", wh.Topics, "subject", wh.subject)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", webhookLocation(r, wh.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wh)
+}
+
+// webhookLocation returns the URL of a webhook, on the path the registration request has been sent to
+// The path requested by the client is used, it still contains the prefix stripped by the handlers mounting the hub, if any
+func webhookLocation(r *http.Request, id string) string {
+	path := r.URL.Path
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil && u.Path != "" {
+		path = u.Path
+	}
+
+	return path + "?id=" + url.QueryEscape(id)
+}
+
+// deregisterWebhook removes the webhook identified by the "id" parameter, if it has been registered by the same subject
+// A 404 response is sent otherwise, to not reveal the webhooks of other subjects
+func (h *Hub) deregisterWebhook(w http.ResponseWriter, r *http.Request) {
+	claims, err := authorize(r, h.getAuthorizationConfig(false))
+	if err != nil || (claims == nil && !h.options.AllowAnonymous) {
+		h.unauthorized(w, r, err)
+		return
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing \"id\" parameter.", http.StatusBadRequest)
+		return
+	}
+
+	wh, ok := h.webhooks.get(id)
+	if !ok || wh.subject != subject(claims) || !h.webhooks.remove(id) {
+		http.Error(w, "Webhook not found.", http.StatusNotFound)
+		return
+	}
+
+	h.unregisterWebhook(wh)
+	h.logger.Info("Webhook deregistered", "webhook_id", wh.ID, "callback", wh.Callback, "subject", wh.subject)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runWebhook delivers the updates of the webhook one at a time, in order, until it is deregistered or disabled, or the hub is stopped
+func (h *Hub) runWebhook(wh *webhook) {
+	defer h.cleanup(wh.subscriber)
+
+	for {
+		u, ok := wh.subscriber.nextUpdate(wh.updates)
+		if !ok {
+			h.webhooks.remove(wh.ID)
+			return
+		}
+		if _, ok := h.webhooks.get(wh.ID); !ok {
+			// The webhook has been deregistered, the updates still queued are discarded
+			return
+		}
+
+		var err error
+		switch {
+		case u == slowSubscriberMarker:
+			err = errors.New("too slow to consume the updates")
+		case wh.expired(h, time.Now()):
+			err = errors.New("the JWT used to register it has expired or has been revoked")
+		default:
+			err = h.deliverWebhook(wh, u)
+		}
+
+		if err != nil {
+			if h.webhooks.remove(wh.ID) {
+				h.logger.Warn("Webhook disabled", "webhook_id", wh.ID, "callback", wh.Callback, "error", err)
+				h.unregisterWebhook(wh)
+			}
+
+			return
+		}
+	}
+}
+
+// deliverWebhook POSTs the update to the callback of the webhook, the failed attempts are retried with an exponential backoff
+// It returns the error of the last attempt once Options.WebhookMaxRetries retries have failed
+func (h *Hub) deliverWebhook(wh *webhook, u *serializedUpdate) error {
+	body := newWebSocketMessage(wh.subscriber.redact(u.Update))
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	maxRetries, delay := h.options.WebhookMaxRetries, h.options.WebhookRetryDelay
+	if maxRetries <= 0 {
+		maxRetries = defaultWebhookMaxRetries
+	}
+	if delay <= 0 {
+		delay = defaultWebhookRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := h.webhooks.post(wh, body, signature)
+		if err == nil {
+			h.metrics.updatesDispatched.Inc()
+			return nil
+		}
+
+		if _, ok := h.webhooks.get(wh.ID); attempt >= maxRetries || !ok || h.isStopped() {
+			return err
+		}
+
+		h.logger.Info("Webhook delivery failed, retrying", "webhook_id", wh.ID, "event_id", u.ID, "attempt", attempt+1, "error", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxWebhookRetryDelay {
+			delay = maxWebhookRetryDelay
+		}
+	}
+}
+
+// unregisterWebhook stops dispatching the updates to the webhook, the hub then closes its channel
+func (h *Hub) unregisterWebhook(wh *webhook) {
+	h.unregisterSubscriber(wh.updates)
+}
@@ -0,0 +1,266 @@
+package hub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// createWebhookServer starts a callback server responding with the given status codes in turn, then with 200
+func createWebhookServer(statuses ...int) (*httptest.Server, chan webhookDelivery, *int32) {
+	deliveries := make(chan webhookDelivery, 10)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if i := int(atomic.AddInt32(&attempts, 1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+			return
+		}
+
+		deliveries <- webhookDelivery{r.Header, body}
+	}))
+
+	return server, deliveries, &attempts
+}
+
+func createWebhookHub(allowedOrigin string) *Hub {
+	h := NewHub(&localPublisher{}, &noHistory{}, &Options{
+		PublisherJWTKey:       []byte("publisher"),
+		SubscriberJWTKey:      []byte("subscriber"),
+		AllowAnonymous:        true,
+		WebhookAllowedOrigins: []string{allowedOrigin},
+		WebhookMaxRetries:     2,
+		WebhookRetryDelay:     time.Millisecond,
+	})
+	h.Start()
+
+	return h
+}
+
+func registerWebhook(h *Hub, form url.Values, jwt string) (*httptest.ResponseRecorder, webhook) {
+	req := httptest.NewRequest("POST", "http://example.com/hub/webhooks", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if jwt != "" {
+		req.Header.Add("Authorization", "Bearer "+jwt)
+	}
+
+	w := httptest.NewRecorder()
+	h.WebhooksHandler(w, req)
+
+	var wh webhook
+	json.Unmarshal(w.Body.Bytes(), &wh)
+
+	return w, wh
+}
+
+func deregisterWebhook(h *Hub, id, jwt string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("DELETE", "http://example.com/hub/webhooks?id="+url.QueryEscape(id), nil)
+	if jwt != "" {
+		req.Header.Add("Authorization", "Bearer "+jwt)
+	}
+
+	w := httptest.NewRecorder()
+	h.WebhooksHandler(w, req)
+
+	return w
+}
+
+func waitForWebhookRemoval(h *Hub, id string) {
+	for {
+		if _, ok := h.webhooks.get(id); !ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	server, deliveries, _ := createWebhookServer()
+	defer server.Close()
+	h := createWebhookHub(server.URL)
+	defer h.Stop()
+
+	w, wh := registerWebhook(h, url.Values{"topic": {"http://example.com/books/{id}"}, "callback": {server.URL + "/callback"}}, "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "/hub/webhooks?id="+wh.ID, w.Header().Get("Location"))
+	assert.Equal(t, server.URL+"/callback", wh.Callback)
+	assert.Equal(t, []string{"http://example.com/books/{id}"}, wh.Topics)
+	assert.Len(t, wh.Secret, 64)
+	assert.Contains(t, h.subscriptions.m, wh.ID)
+
+	// The targets of the registration apply, anonymous webhooks only receive the public updates
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{ID: "private", Data: "d1"}})
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/2"}, Event: Event{ID: "a", Type: "t", Data: "d2"}})
+
+	d := <-deliveries
+	assert.Equal(t, `{"id":"a","topic":"http://example.com/books/2","type":"t","data":"d2"}`, string(d.body))
+	assert.Equal(t, "application/json", d.header.Get("Content-Type"))
+	assert.Equal(t, wh.ID, d.header.Get(webhookIDHeader))
+
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write(d.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), d.header.Get(webhookSignatureHeader))
+}
+
+func TestWebhookLocation(t *testing.T) {
+	h := createWebhookHub("https://example.com")
+	defer h.Stop()
+
+	form := url.Values{"topic": {"http://example.com/books/1"}, "callback": {"https://example.com/callback"}}
+	req := httptest.NewRequest("POST", "http://example.com/mercure/webhooks", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	// The prefix stripped by the handler mounting the hub is kept
+	w := httptest.NewRecorder()
+	http.StripPrefix("/mercure", http.HandlerFunc(h.WebhooksHandler)).ServeHTTP(w, req)
+
+	var wh webhook
+	json.Unmarshal(w.Body.Bytes(), &wh)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/mercure/webhooks?id="+wh.ID, w.Header().Get("Location"))
+}
+
+func TestWebhookRetry(t *testing.T) {
+	server, deliveries, attempts := createWebhookServer(http.StatusInternalServerError, http.StatusServiceUnavailable)
+	defer server.Close()
+	h := createWebhookHub(server.URL)
+	defer h.Stop()
+
+	_, wh := registerWebhook(h, url.Values{"topic": {"http://example.com/books/1"}, "callback": {server.URL}}, "")
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "d1"}})
+
+	assert.Contains(t, string((<-deliveries).body), `"id":"a"`)
+	assert.Equal(t, int32(3), atomic.LoadInt32(attempts))
+	_, ok := h.webhooks.get(wh.ID)
+	assert.True(t, ok)
+}
+
+func TestWebhookDisabledAfterRetries(t *testing.T) {
+	server, _, attempts := createWebhookServer(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusFound, http.StatusOK)
+	defer server.Close()
+	h := createWebhookHub(server.URL)
+	defer h.Stop()
+
+	_, wh := registerWebhook(h, url.Values{"topic": {"http://example.com/books/1"}, "callback": {server.URL}}, "")
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{ID: "a", Data: "d1"}})
+
+	// The redirection isn't followed, it is a failure too
+	waitForWebhookRemoval(h, wh.ID)
+	assert.Equal(t, int32(3), atomic.LoadInt32(attempts))
+
+	for {
+		h.subscriptions.RLock()
+		_, ok := h.subscriptions.m[wh.ID]
+		h.subscriptions.RUnlock()
+
+		if !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookExpiredJWT(t *testing.T) {
+	server, _, attempts := createWebhookServer()
+	defer server.Close()
+	h := createWebhookHub(server.URL)
+	defer h.Stop()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{mercureClaim{Subscribe: []string{"foo"}}, jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	signed, _ := token.SignedString(h.options.SubscriberJWTKey)
+
+	_, wh := registerWebhook(h, url.Values{"topic": {"http://example.com/books/1"}, "callback": {server.URL}}, signed)
+	registered, _ := h.webhooks.get(wh.ID)
+	assert.Equal(t, time.Now().Add(time.Hour).Unix(), registered.expiresAt.Unix())
+
+	registered.expiresAt = time.Now().Add(-time.Second)
+	h.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{ID: "a", Data: "d1"}})
+
+	waitForWebhookRemoval(h, wh.ID)
+	assert.Equal(t, int32(0), atomic.LoadInt32(attempts))
+}
+
+func TestWebhookInvalidRegistration(t *testing.T) {
+	h := createWebhookHub("https://example.com")
+	defer h.Stop()
+
+	w, _ := registerWebhook(h, url.Values{"topic": {"http://example.com/books/1"}, "callback": {"https://evil.com/callback"}}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"callback\" parameter: its origin isn't allowed.\n", w.Body.String())
+
+	w, _ = registerWebhook(h, url.Values{"topic": {"http://example.com/books/1"}, "callback": {"/callback"}}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Invalid \"callback\" parameter: it must be an absolute HTTP URL.\n", w.Body.String())
+
+	w, _ = registerWebhook(h, url.Values{"callback": {"https://example.com/callback"}}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Missing \"topic\" parameter.\n", w.Body.String())
+
+	w, _ = registerWebhook(h, url.Values{"topic": {"http://example.com/books/1"}, "callback": {"https://example.com/callback"}}, createDummyUnauthorizedJWT())
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Empty(t, h.webhooks.m)
+	assert.Empty(t, h.subscriptions.m)
+}
+
+func TestWebhookDeregistration(t *testing.T) {
+	server, _, _ := createWebhookServer()
+	defer server.Close()
+	h := createWebhookHub(server.URL)
+	defer h.Stop()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{mercureClaim{Subscribe: []string{"foo"}}, jwt.StandardClaims{Subject: "alice"}})
+	alice, _ := token.SignedString(h.options.SubscriberJWTKey)
+
+	_, wh := registerWebhook(h, url.Values{"topic": {"http://example.com/books/1"}, "callback": {server.URL}}, alice)
+
+	// Other subjects can't deregister the webhook
+	w := deregisterWebhook(h, wh.ID, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, http.StatusBadRequest, deregisterWebhook(h, "", alice).Code)
+
+	assert.Equal(t, http.StatusNoContent, deregisterWebhook(h, wh.ID, alice).Code)
+	assert.Equal(t, http.StatusNotFound, deregisterWebhook(h, wh.ID, alice).Code)
+
+	for {
+		h.subscribers.RLock()
+		empty := len(h.subscribers.m) == 0
+		h.subscribers.RUnlock()
+
+		if empty {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhooksDisabled(t *testing.T) {
+	h := createDummy()
+	assert.Nil(t, h.webhooks)
+
+	w := httptest.NewRecorder()
+	h.WebhooksHandler(w, httptest.NewRequest("POST", "http://example.com/hub/webhooks", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	h.chainHandlers().ServeHTTP(w, httptest.NewRequest("POST", "http://example.com/hub/webhooks", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
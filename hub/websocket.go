@@ -0,0 +1,202 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Types of the WebSocket messages containing the updates
+const (
+	// WebSocketMessageText sends the updates as text messages
+	WebSocketMessageText = "text"
+	// WebSocketMessageBinary sends the updates as binary messages
+	WebSocketMessageBinary = "binary"
+	// WebSocketMessageAuto sends the updates as binary messages to the clients which negotiated the compression, as text messages to the other ones
+	WebSocketMessageAuto = "auto"
+)
+
+// webSocketMessage is the JSON representation of an update sent in a WebSocket text message, and returned by the replay endpoint
+type webSocketMessage struct {
+	ID          string   `json:"id"`
+	Topic       string   `json:"topic,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+	Seq         uint64   `json:"seq,omitempty"`
+	Selectors   []string `json:"selectors,omitempty"`
+	Data        string   `json:"data"`
+}
+
+func toWebSocketMessage(u *Update) webSocketMessage {
+	m := webSocketMessage{ID: u.ID, Type: u.Type, ContentType: u.ContentType, Selectors: u.selectors, Data: u.Data}
+	if len(u.Topics) > 0 {
+		m.Topic = u.Topics[0]
+		m.Seq = u.Sequences[m.Topic]
+	}
+
+	return m
+}
+
+func newWebSocketMessage(u *Update) []byte {
+	// Marshaling this struct cannot fail
+	b, _ := json.Marshal(toWebSocketMessage(u))
+
+	return b
+}
+
+// WebSocketHandler is an alternative to SubscribeHandler, it sends the updates as WebSocket messages
+// The topic and target semantics are the same, the Last-Event-ID must be passed as a query parameter
+// The messages are compressed for the clients offering the permessage-deflate extension, their type depends on Options.WebSocketMessageType
+func (h *Hub) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	subscriber, r, ok := h.createSubscriber(w, r)
+	if !ok {
+		return
+	}
+	defer h.cleanup(subscriber)
+
+	// Only the compression without context takeover is supported, every message is compressed independently
+	upgrader := websocket.Upgrader{CheckOrigin: h.checkWebSocketOrigin, EnableCompression: true}
+	messageType := h.webSocketMessageType(r)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	if subscriber.requestsMissedEvents() {
+		if err := h.history.FindFor(subscriber, func(u *Update) bool {
+			return conn.WriteMessage(messageType, newWebSocketMessage(subscriber.redact(subscriber.updateFor(u)))) == nil
+		}); err != nil && err != errLastEventIDNotFound && err != errResumePositionNotFound {
+			h.logger.Error("Failed to retrieve the missed events", "subscriber_id", subscriber.ID, "last_event_id", subscriber.LastEventID, "remote_addr", r.RemoteAddr, "error", err)
+		}
+	}
+
+	updateChan, ok := h.registerSubscriber(subscriber)
+	if !ok {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		return
+	}
+
+	h.metrics.subscribers.Inc()
+	defer h.metrics.subscribers.Dec()
+
+	_, span := h.startRequestSpan(r, "mercure.subscribe", attribute.String("mercure.subscriber_id", subscriber.ID))
+	defer span.End()
+
+	// However the stream ends, the subscriber is unregistered, and closing the connection stops the reader
+	unsubscribe, done := h.unsubscriber(updateChan)
+	defer unsubscribe()
+
+	// Messages sent by the client are discarded, reading is only used to detect the disconnection
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				select {
+				case <-done:
+				default:
+					h.logger.Info("Subscriber disconnected", "subscriber_id", subscriber.ID, "remote_addr", r.RemoteAddr)
+				}
+				unsubscribe()
+				return
+			}
+		}
+	}()
+
+	quota := h.newSubscriberQuota()
+	// failed is true once a write failed, the connection is then closed and the remaining updates are discarded
+	var failed bool
+	for {
+		// The high priority updates jump ahead of the normal ones already queued
+		serializedUpdate, open := subscriber.nextUpdate(updateChan)
+		if !open {
+			break
+		}
+		if serializedUpdate == slowSubscriberMarker {
+			h.logger.Warn("Slow subscriber disconnected", "subscriber_id", subscriber.ID, "remote_addr", r.RemoteAddr)
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+			return
+		}
+
+		if failed {
+			continue
+		}
+
+		message := newWebSocketMessage(subscriber.redact(serializedUpdate.Update))
+		if exceeded := quota.consume(len(message)); exceeded != "" {
+			h.quotaExceeded(subscriber, r, exceeded)
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, exceeded+" quota exceeded"))
+			return
+		}
+
+		if h.options.EventWriteTimeout != time.Duration(0) {
+			conn.SetWriteDeadline(time.Now().Add(h.options.EventWriteTimeout))
+		}
+
+		// If the write fails, the connection is closed and the channel drained until the reader removes the subscriber
+		if err := conn.WriteMessage(messageType, message); err != nil {
+			h.writeFailed(subscriber, r, err)
+			conn.Close()
+			failed = true
+			continue
+		}
+
+		h.metrics.updatesDispatched.Inc()
+		span.AddEvent("Event sent", trace.WithAttributes(updateAttributes(serializedUpdate.Update)...))
+		h.logger.Info("Event sent", "subscriber_id", subscriber.ID, "event_id", serializedUpdate.ID, "topics", serializedUpdate.Topics, "remote_addr", r.RemoteAddr)
+	}
+
+	// The hub has been stopped
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+}
+
+// webSocketMessageType returns the type of the messages to send to the client, according to the options and to the extensions it offered
+func (h *Hub) webSocketMessageType(r *http.Request) int {
+	switch h.options.WebSocketMessageType {
+	case WebSocketMessageBinary:
+		return websocket.BinaryMessage
+	case WebSocketMessageAuto:
+		if offersWebSocketCompression(r) {
+			return websocket.BinaryMessage
+		}
+	}
+
+	return websocket.TextMessage
+}
+
+// offersWebSocketCompression checks if the client offered the permessage-deflate extension, which the upgrader then always negotiates
+func offersWebSocketCompression(r *http.Request) bool {
+	for _, header := range r.Header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(header, ",") {
+			if name := strings.SplitN(extension, ";", 2)[0]; strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkWebSocketOrigin allows same origin requests, and requests from the origins allowed by the CORS configuration
+func (h *Hub) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range h.options.CorsAllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+
+	return err == nil && u.Host == r.Host
+}
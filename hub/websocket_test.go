@@ -0,0 +1,229 @@
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocket(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "old", ID: "a"}})
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "missed", ID: "b"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.Start()
+	defer hub.Stop()
+
+	s := httptest.NewServer(http.HandlerFunc(hub.WebSocketHandler))
+	defer s.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"?topic=http://example.com/books/{id}&Last-Event-ID=a", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	_, msg, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":"b","topic":"http://example.com/books/1","data":"missed"}`, string(msg))
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/2"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{Data: "private", ID: "c"}})
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/reviews/1"}, Event: Event{Data: "not subscribed", ID: "d"}})
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/3"}, Event: Event{Data: "public", ID: "e", Type: "test"}, ContentType: "text/plain"})
+
+	_, msg, err = conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":"e","topic":"http://example.com/books/3","type":"test","contentType":"text/plain","data":"public"}`, string(msg))
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	history := newMemoryHistory(10, nil)
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "old", ID: "a"}})
+	history.Add(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "missed", ID: "b"}})
+
+	hub := createAnonymousDummyWithHistory(history)
+	hub.options.WebSocketMessageType = WebSocketMessageAuto
+	hub.Start()
+	defer hub.Stop()
+
+	s := httptest.NewServer(http.HandlerFunc(hub.WebSocketHandler))
+	defer s.Close()
+
+	compressing := &websocket.Dialer{EnableCompression: true}
+	dial := func(dialer *websocket.Dialer) (*websocket.Conn, *http.Response) {
+		conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"?topic=http://example.com/books/{id}&Last-Event-ID=a", nil)
+		if err != nil {
+			panic(err)
+		}
+
+		return conn, resp
+	}
+
+	compressed, resp := dial(compressing)
+	defer compressed.Close()
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+
+	uncompressed, resp := dial(websocket.DefaultDialer)
+	defer uncompressed.Close()
+	assert.Empty(t, resp.Header.Get("Sec-Websocket-Extensions"))
+
+	for {
+		hub.subscribers.RLock()
+		ready := len(hub.subscribers.m) == 2
+		hub.subscribers.RUnlock()
+
+		if ready {
+			break
+		}
+	}
+
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/2"}, Targets: map[string]struct{}{"foo": {}}, Event: Event{Data: "private", ID: "c"}})
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/3"}, Event: Event{Data: strings.Repeat("public ", 100), ID: "d"}})
+
+	// Both clients receive the same missed and live updates, only the type of the messages differs
+	for _, expected := range []string{
+		`{"id":"b","topic":"http://example.com/books/1","data":"missed"}`,
+		`{"id":"d","topic":"http://example.com/books/3","data":"` + strings.Repeat("public ", 100) + `"}`,
+	} {
+		messageType, msg, err := compressed.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		assert.Equal(t, expected, string(msg))
+
+		messageType, msg, err = uncompressed.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, websocket.TextMessage, messageType)
+		assert.Equal(t, expected, string(msg))
+	}
+}
+
+func TestWebSocketMessageType(t *testing.T) {
+	hub := createAnonymousDummy()
+	compressing := httptest.NewRequest("GET", "http://example.com/hub/ws", nil)
+	compressing.Header.Set("Sec-WebSocket-Extensions", "x-foo, permessage-deflate; client_max_window_bits")
+	plain := httptest.NewRequest("GET", "http://example.com/hub/ws", nil)
+
+	assert.Equal(t, websocket.TextMessage, hub.webSocketMessageType(compressing))
+	assert.Equal(t, websocket.TextMessage, hub.webSocketMessageType(plain))
+
+	hub.options.WebSocketMessageType = WebSocketMessageBinary
+	assert.Equal(t, websocket.BinaryMessage, hub.webSocketMessageType(compressing))
+	assert.Equal(t, websocket.BinaryMessage, hub.webSocketMessageType(plain))
+
+	hub.options.WebSocketMessageType = WebSocketMessageAuto
+	assert.Equal(t, websocket.BinaryMessage, hub.webSocketMessageType(compressing))
+	assert.Equal(t, websocket.TextMessage, hub.webSocketMessageType(plain))
+}
+
+func TestWebSocketQuotaExceeded(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.options.MaxSubscriberMessages = 1
+	hub.Start()
+	defer hub.Stop()
+
+	s := httptest.NewServer(http.HandlerFunc(hub.WebSocketHandler))
+	defer s.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"?topic=http://example.com/books/1", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "first", ID: "a"}})
+	hub.DispatchUpdate(&Update{Topics: []string{"http://example.com/books/1"}, Event: Event{Data: "second", ID: "b"}})
+
+	_, msg, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":"a","topic":"http://example.com/books/1","data":"first"}`, string(msg))
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	assert.Contains(t, err.Error(), "messages quota exceeded")
+	assert.True(t, waitForNoSubscribers(hub))
+}
+
+func TestWebSocketHubStopped(t *testing.T) {
+	hub := createAnonymousDummy()
+	hub.Start()
+
+	s := httptest.NewServer(http.HandlerFunc(hub.WebSocketHandler))
+	defer s.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"?topic=http://example.com/books/1", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		hub.subscribers.RLock()
+		empty := len(hub.subscribers.m) == 0
+		hub.subscribers.RUnlock()
+
+		if !empty {
+			break
+		}
+	}
+
+	hub.Stop()
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+
+	// The reader doesn't block once the hub doesn't dispatch the updates anymore
+	assert.True(t, waitForNoGoroutine("(*Hub).WebSocketHandler"))
+}
+
+func TestWebSocketUnauthorized(t *testing.T) {
+	hub := createDummy()
+
+	s := httptest.NewServer(http.HandlerFunc(hub.WebSocketHandler))
+	defer s.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"?topic=http://example.com/books/1", nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	hub := createDummy()
+
+	req := httptest.NewRequest("GET", "http://example.com/hub/ws", nil)
+	assert.True(t, hub.checkWebSocketOrigin(req))
+
+	req.Header.Set("Origin", "http://example.com")
+	assert.True(t, hub.checkWebSocketOrigin(req))
+
+	req.Header.Set("Origin", "http://evil.com")
+	assert.False(t, hub.checkWebSocketOrigin(req))
+
+	hub.options.CorsAllowedOrigins = []string{"http://evil.com"}
+	assert.True(t, hub.checkWebSocketOrigin(req))
+}
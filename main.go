@@ -28,7 +28,9 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	defer db.Close()
+	if db != nil {
+		defer db.Close()
+	}
 
 	hub.Start()
 	hub.Serve()